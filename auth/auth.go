@@ -0,0 +1,154 @@
+// Package auth はサービスが直接公開するAPI向けの認証を提供します。
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// ErrUnauthenticated は認証情報がない、または無効であることを表します。
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// TokenValidator はBearerトークンを検証し、呼び出し元の識別子を返します。
+type TokenValidator interface {
+	Validate(ctx context.Context, token string) (string, error)
+}
+
+// Authenticator はAPIキーまたはBearerトークンでリクエストを認証します。
+type Authenticator struct {
+	apiKeys   [][sha256.Size]byte
+	validator TokenValidator
+}
+
+// NewAuthenticator は新しい Authenticator を作成します。
+// validator が nil の場合、Bearerトークンも APIキーとしてのみ照合します。
+func NewAuthenticator(apiKeys []string, validator TokenValidator) *Authenticator {
+	a := &Authenticator{validator: validator}
+	for _, key := range apiKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			a.apiKeys = append(a.apiKeys, sha256.Sum256([]byte(key)))
+		}
+	}
+
+	return a
+}
+
+// Enabled は認証手段が1つ以上設定されているかを返します。
+func (a *Authenticator) Enabled() bool {
+	return len(a.apiKeys) > 0 || a.validator != nil
+}
+
+// Authenticate はリクエストの X-API-Key ヘッダーまたは Authorization: Bearer ヘッダーを検証し、
+// 呼び出し元の識別子を返します。
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if a.matchAPIKey(key) {
+			return "api-key", nil
+		}
+		return "", ErrUnauthenticated
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", ErrUnauthenticated
+	}
+
+	if a.matchAPIKey(token) {
+		return "api-key", nil
+	}
+
+	if a.validator == nil {
+		return "", ErrUnauthenticated
+	}
+
+	principal, err := a.validator.Validate(r.Context(), token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	return principal, nil
+}
+
+// Middleware は認証に失敗したリクエストを 401 で拒否するハンドラを返します。
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.Authenticate(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "rejecting unauthenticated request", "component", "auth", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fcm-backend"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func (a *Authenticator) matchAPIKey(key string) bool {
+	sum := sha256.Sum256([]byte(key))
+
+	matched := 0
+	for _, k := range a.apiKeys {
+		matched |= subtle.ConstantTimeCompare(sum[:], k[:])
+	}
+
+	return matched == 1
+}
+
+type principalKey struct{}
+
+// WithPrincipal は呼び出し元の識別子を ctx に格納します。
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal は ctx に格納された呼び出し元の識別子を返します。
+func Principal(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// GoogleIDTokenValidator はGoogleが発行したIDトークン (サービスアカウントのOIDCトークンなど) を検証します。
+type GoogleIDTokenValidator struct {
+	audience      string
+	allowedEmails map[string]bool
+}
+
+// NewGoogleIDTokenValidator は新しい GoogleIDTokenValidator を作成します。
+// allowedEmails が空の場合、audience が一致する有効なトークンはすべて受け付けます。
+func NewGoogleIDTokenValidator(audience string, allowedEmails []string) *GoogleIDTokenValidator {
+	v := &GoogleIDTokenValidator{audience: audience, allowedEmails: make(map[string]bool)}
+	for _, email := range allowedEmails {
+		if email = strings.TrimSpace(email); email != "" {
+			v.allowedEmails[email] = true
+		}
+	}
+
+	return v
+}
+
+func (v *GoogleIDTokenValidator) Validate(ctx context.Context, token string) (string, error) {
+	payload, err := idtoken.Validate(ctx, token, v.audience)
+	if err != nil {
+		return "", fmt.Errorf("validating ID token: %w", err)
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	if len(v.allowedEmails) > 0 && !v.allowedEmails[email] {
+		return "", fmt.Errorf("ID token email %q is not allowed", email)
+	}
+
+	if email == "" {
+		return payload.Subject, nil
+	}
+
+	return email, nil
+}
@@ -0,0 +1,77 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/teamzidi/example-go-fcm/auth"
+)
+
+type fakeValidator struct{}
+
+func (fakeValidator) Validate(ctx context.Context, token string) (string, error) {
+	if token == "valid-id-token" {
+		return "caller@example.iam.gserviceaccount.com", nil
+	}
+	return "", errors.New("invalid token")
+}
+
+func TestAuthenticator_Middleware(t *testing.T) {
+	tests := []struct {
+		name              string
+		validator         auth.TokenValidator
+		header            string
+		value             string
+		expectedStatus    int
+		expectedPrincipal string
+	}{
+		{name: "API key header", header: "X-API-Key", value: "key-1", expectedStatus: http.StatusOK, expectedPrincipal: "api-key"},
+		{name: "API key as bearer token", header: "Authorization", value: "Bearer key-2", expectedStatus: http.StatusOK, expectedPrincipal: "api-key"},
+		{name: "wrong API key", header: "X-API-Key", value: "wrong", expectedStatus: http.StatusUnauthorized},
+		{name: "no credentials", expectedStatus: http.StatusUnauthorized},
+		{name: "non-bearer authorization", header: "Authorization", value: "Basic a2V5LTE=", expectedStatus: http.StatusUnauthorized},
+		{name: "bearer token without validator", header: "Authorization", value: "Bearer valid-id-token", expectedStatus: http.StatusUnauthorized},
+		{name: "valid bearer token", validator: fakeValidator{}, header: "Authorization", value: "Bearer valid-id-token", expectedStatus: http.StatusOK, expectedPrincipal: "caller@example.iam.gserviceaccount.com"},
+		{name: "invalid bearer token", validator: fakeValidator{}, header: "Authorization", value: "Bearer forged", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := auth.NewAuthenticator([]string{"key-1", " key-2 "}, tt.validator)
+
+			var principal string
+			h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal = auth.Principal(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/notifications", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("status: got %v want %v", rr.Code, tt.expectedStatus)
+			}
+
+			if principal != tt.expectedPrincipal {
+				t.Errorf("principal: got %q want %q", principal, tt.expectedPrincipal)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Enabled(t *testing.T) {
+	if auth.NewAuthenticator([]string{"", " "}, nil).Enabled() {
+		t.Error("authenticator with only blank keys should be disabled")
+	}
+
+	if !auth.NewAuthenticator(nil, fakeValidator{}).Enabled() {
+		t.Error("authenticator with validator should be enabled")
+	}
+}
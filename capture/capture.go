@@ -0,0 +1,406 @@
+// Package capture はPushエンドポイントとpullで受信したリクエストと応答を秘匿化してJSONLファイルに記録します。
+// 記録したファイルは cmd/replay で偽のFCMまたはドライランのFCMに対して再実行し、元の結果と比較できます。
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+// maxResponseSize は記録する応答ボディの最大バイト数です。
+const maxResponseSize = 4096
+
+// Record は記録した1件のPushリクエストと、そのときの応答です。
+type Record struct {
+	RequestID string            `json:"request_id"` // Pub/SubのメッセージID。分からない場合は記録時に採番する
+	Time      time.Time         `json:"time"`
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers,omitempty"` // 再実行に必要なヘッダーだけを記録する
+	Body      string            `json:"body"`              // 秘匿化したリクエストボディ
+	Status    int               `json:"status"`
+	Response  string            `json:"response,omitempty"`
+	Outcome   string            `json:"outcome"` // Outcome で要約した処理結果
+}
+
+// Recorder はPushリクエストをJSONLファイルに追記します。
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder は path のファイルを追記用に開きます。ファイルや親ディレクトリがなければ作成します。
+func NewRecorder(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating capture file directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening capture file: %w", err)
+	}
+
+	return &Recorder{f: f}, nil
+}
+
+// Write は記録を1行追記します。
+func (r *Recorder) Write(rec Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding capture record: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing capture file: %w", err)
+	}
+
+	return nil
+}
+
+// Close はファイルを閉じます。
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+// Middleware は h が処理したリクエストと応答を記録します。記録に失敗しても h の処理には影響しません。
+func (r *Recorder) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, req)
+
+		rec := Record{
+			RequestID: requestID(req, body),
+			Time:      time.Now().UTC(),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Headers:   replayHeaders(req.Header),
+			Body:      string(RedactBody(body)),
+			Status:    rw.status,
+			Response:  rw.body.String(),
+			Outcome:   Outcome(rw.status, rw.body.Bytes()),
+		}
+		if err := r.Write(rec); err != nil {
+			slog.WarnContext(req.Context(), "capturing push request", "component", "capture", "error", err)
+		}
+	})
+}
+
+// CaptureMessage はpullで受信したメッセージを、同じ内容のPub/Sub Pushリクエストとして記録します。
+// cmd/replay ではPushで受信したリクエストと同じように path に再実行できます。記録に失敗してもログに残すだけです。
+func (r *Recorder) CaptureMessage(ctx context.Context, path string, m handlers.ReceivedMessage, status int, response []byte) {
+	push := handlers.PubSubPushRequest{
+		Message: handlers.PubSubInternalMessage{
+			Data:       base64.StdEncoding.EncodeToString(m.Data),
+			MessageID:  m.ID,
+			Attributes: m.Attributes,
+		},
+		Subscription: m.Subscription,
+	}
+	if !m.PublishTime.IsZero() {
+		push.Message.PublishTime = m.PublishTime.UTC().Format(time.RFC3339Nano)
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		slog.WarnContext(ctx, "capturing pulled message", "component", "capture", "error", err)
+		return
+	}
+
+	requestID := m.ID
+	if requestID == "" {
+		requestID = fmt.Sprintf("capture-%d", time.Now().UnixNano())
+	}
+	rec := Record{
+		RequestID: requestID,
+		Time:      time.Now().UTC(),
+		Method:    http.MethodPost,
+		Path:      path,
+		Headers:   map[string]string{"Content-Type": "application/json"},
+		Body:      string(RedactBody(body)),
+		Status:    status,
+		Response:  string(response[:min(len(response), maxResponseSize)]),
+		Outcome:   Outcome(status, response),
+	}
+	if err := r.Write(rec); err != nil {
+		slog.WarnContext(ctx, "capturing pulled message", "component", "capture", "error", err)
+	}
+}
+
+// requestID はリクエストのPub/SubメッセージIDを返します。分からなければ時刻から採番します。
+func requestID(req *http.Request, body []byte) string {
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	if msg, _ := handlers.DecodePushRequest(clone); msg.ID != "" {
+		return msg.ID
+	}
+	return fmt.Sprintf("capture-%d", time.Now().UnixNano())
+}
+
+// replayHeaders はリクエストの解釈に使うヘッダーだけを返します。Authorization などの認証情報は記録しません。
+func replayHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		keep := lower == "content-type" || lower == "traceparent" || lower == "tracestate" ||
+			strings.HasPrefix(lower, "ce-") || strings.HasPrefix(lower, "x-goog-pubsub-")
+		if keep && len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// responseWriter は応答のステータスコードとボディの先頭を記録する http.ResponseWriter です。
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if remaining := maxResponseSize - w.body.Len(); remaining > 0 {
+		w.body.Write(b[:min(len(b), remaining)])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// redactedFields はペイロードのうち秘匿化するフィールドです。
+var redactedFields = map[string]bool{"token": true, "user_id": true}
+
+// redactedValueFields はペイロードのうち、キーは残して文字列の値をすべて秘匿化するオブジェクトです。
+var redactedValueFields = map[string]bool{"custom_data": true}
+
+// RedactBody はリクエストボディに含まれるデバイストークン、ユーザーIDと custom_data の値を秘匿化します。
+// Pub/SubのPushリクエストやCloudEventsの中のBase64エンコードされたペイロードも秘匿化します。
+// 秘匿化した値は元の値のハッシュなので、同じトークンは同じ値になり、トークンの形式の検証も通ります。
+// JSONでないボディはそのまま返します。
+func RedactBody(body []byte) []byte {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+
+	b, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			s, isString := val.(string)
+			switch {
+			case redactedFields[k] && isString && s != "":
+				v[k] = redactString(s)
+			case (k == "data" || k == "data_base64") && isString:
+				v[k] = redactBase64(s)
+			case redactedValueFields[k]:
+				v[k] = redactValues(val)
+			default:
+				v[k] = redactValue(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redactValue(val)
+		}
+	}
+	return v
+}
+
+// redactValues は v がオブジェクトであれば、空でない文字列の値をすべて秘匿化します。
+// キーは予約キーの検証などに使うため残します。
+func redactValues(v any) any {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	for k, val := range m {
+		if s, isString := val.(string); isString && s != "" {
+			m[k] = redactString(s)
+		}
+	}
+	return m
+}
+
+// redactBase64 は s がBase64エンコードされたJSONであれば、その中身を秘匿化してエンコードし直します。
+func redactBase64(s string) string {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || !json.Valid(decoded) {
+		return s
+	}
+	return base64.StdEncoding.EncodeToString(RedactBody(decoded))
+}
+
+// HasRedactedToken は body に秘匿化したデバイストークンが含まれるかどうかを返します。
+// RedactBody と同じく、Base64エンコードされたペイロードの中も調べます。
+func HasRedactedToken(body []byte) bool {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+	return hasRedactedToken(v)
+}
+
+func hasRedactedToken(v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			s, isString := val.(string)
+			switch {
+			case k == "token" && isString:
+				if strings.HasPrefix(s, redactedPrefix) {
+					return true
+				}
+			case (k == "data" || k == "data_base64") && isString:
+				if decoded, err := base64.StdEncoding.DecodeString(s); err == nil && HasRedactedToken(decoded) {
+					return true
+				}
+			default:
+				if hasRedactedToken(val) {
+					return true
+				}
+			}
+		}
+	case []any:
+		for _, val := range v {
+			if hasRedactedToken(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactedPrefix は秘匿化した値の接頭辞です。
+const redactedPrefix = "redacted:"
+
+func redactString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return redactedPrefix + hex.EncodeToString(sum[:])[:16]
+}
+
+// Outcome はPushエンドポイントの応答を、再実行の結果と比較できるように要約します。
+// メッセージIDや予約IDなど実行ごとに変わる値は含めません。
+//
+//	sent                      FCMに送信した
+//	suppressed:<理由>          配信制御により送信しなかった
+//	scheduled                 予約した
+//	batch sent=N invalid=N failed=N republished=N
+//	acked                     不正なメッセージまたは恒久的な失敗としてackした (204)
+//	nacked                    再送すべき失敗としてnackした (5xx)
+func Outcome(status int, response []byte) string {
+	switch {
+	case status == http.StatusNoContent:
+		return "acked"
+	case status >= http.StatusInternalServerError:
+		return "nacked"
+	case status != http.StatusOK:
+		return fmt.Sprintf("status %d", status)
+	}
+
+	var r struct {
+		Status      string `json:"status"`
+		Reason      string `json:"reason"`
+		Sent        *int   `json:"sent"`
+		Invalid     int    `json:"invalid"`
+		Failed      int    `json:"failed"`
+		Republished int    `json:"republished"`
+	}
+	if err := json.Unmarshal(response, &r); err != nil {
+		return "ok"
+	}
+
+	switch {
+	case r.Sent != nil:
+		return fmt.Sprintf("batch sent=%d invalid=%d failed=%d republished=%d", *r.Sent, r.Invalid, r.Failed, r.Republished)
+	case r.Status == "suppressed":
+		return "suppressed:" + r.Reason
+	case r.Status == "scheduled":
+		return "scheduled"
+	default:
+		return "sent"
+	}
+}
+
+// ReadFile は記録したJSONLファイルを読み込みます。空行は無視します。
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Read は記録したJSONLを読み込みます。
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20) // Pub/Subのメッセージは最大10MB
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,236 @@
+package capture_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/teamzidi/example-go-fcm/capture"
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func envelope(payload string) string {
+	return `{"message":{"data":"` + base64.StdEncoding.EncodeToString([]byte(payload)) + `","messageId":"m-1"},"subscription":"projects/p/subscriptions/s"}`
+}
+
+// decodeData はPushリクエストの中のペイロードを返します。
+func decodeData(t *testing.T, body string) string {
+	t.Helper()
+	var req handlers.PubSubPushRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Message.Data)
+	if err != nil {
+		t.Fatalf("decoding data: %v", err)
+	}
+	return string(data)
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wrapped bool
+	}{
+		{name: "wrapped", body: envelope(`{"title":"T","body":"B","token":"secret-token","user_id":"user-1","data":{"k":"v"}}`), wrapped: true},
+		{name: "custom data", body: envelope(`{"title":"T","body":"B","topic":"news","custom_data":{"order_id":"secret-order"}}`), wrapped: true},
+		{name: "wrapped batch", body: envelope(`{"notifications":[{"title":"T","body":"B","token":"secret-token"},{"title":"T","body":"B","user_id":"user-1","topic":"news"}]}`), wrapped: true},
+		{name: "unwrapped", body: `{"title":"T","body":"B","token":"secret-token","user_id":"user-1"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redacted := string(RedactBody([]byte(tt.body)))
+			payload := redacted
+			if tt.wrapped {
+				payload = decodeData(t, redacted)
+			}
+
+			if strings.Contains(payload, "secret-token") || strings.Contains(payload, "user-1") || strings.Contains(payload, "secret-order") {
+				t.Errorf("token, user ID or custom data was not redacted: %s", payload)
+			}
+			if !strings.Contains(payload, `"redacted:`) {
+				t.Errorf("expected redacted values: %s", payload)
+			}
+			if _, err := handlers.ValidatePayload([]byte(payload)); err != nil {
+				t.Errorf("redacted payload should stay valid: %v", err)
+			}
+			if again := string(RedactBody([]byte(tt.body))); again != redacted {
+				t.Errorf("redaction should be deterministic:\n%s\n%s", redacted, again)
+			}
+		})
+	}
+
+	if got := string(RedactBody([]byte("not json"))); got != "not json" {
+		t.Errorf("non-JSON body: got %q", got)
+	}
+}
+
+func TestHasRedactedToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected bool
+	}{
+		{name: "wrapped token", body: envelope(`{"title":"T","body":"B","token":"secret-token"}`), expected: true},
+		{name: "wrapped batch", body: envelope(`{"notifications":[{"title":"T","body":"B","topic":"news"},{"title":"T","body":"B","token":"secret-token"}]}`), expected: true},
+		{name: "unwrapped token", body: `{"title":"T","body":"B","token":"secret-token"}`, expected: true},
+		{name: "topic with user ID", body: envelope(`{"title":"T","body":"B","topic":"news","user_id":"user-1"}`)},
+		{name: "not json", body: "not json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasRedactedToken(RedactBody([]byte(tt.body))); got != tt.expected {
+				t.Errorf("HasRedactedToken: got %v want %v", got, tt.expected)
+			}
+		})
+	}
+
+	if HasRedactedToken([]byte(`{"token":"secret-token"}`)) {
+		t.Error("a token that was not redacted should not be reported")
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		status   int
+		response string
+		expected string
+	}{
+		{http.StatusOK, `{"status":"processed","message_id":"projects/p/messages/1"}`, "sent"},
+		{http.StatusOK, `{"status":"suppressed","reason":"quiet_hours"}`, "suppressed:quiet_hours"},
+		{http.StatusOK, `{"status":"scheduled","schedule_id":"s-1"}`, "scheduled"},
+		{http.StatusOK, `{"sent":2,"invalid":1,"failed":0,"republished":1}`, "batch sent=2 invalid=1 failed=0 republished=1"},
+		{http.StatusOK, ``, "ok"},
+		{http.StatusNoContent, ``, "acked"},
+		{http.StatusInternalServerError, "Failed to send notification\n", "nacked"},
+		{http.StatusMethodNotAllowed, "", "status 405"},
+	}
+
+	for _, tt := range tests {
+		if got := Outcome(tt.status, []byte(tt.response)); got != tt.expected {
+			t.Errorf("Outcome(%d, %q) = %q, want %q", tt.status, tt.response, got, tt.expected)
+		}
+	}
+}
+
+func TestRecorder_Middleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture", "requests.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	h := recorder.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := handlers.DecodePushRequest(r)
+		received = string(msg.Data)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"processed","message_id":"projects/p/messages/1"}`))
+	}))
+
+	payload := `{"title":"T","body":"B","token":"secret-token"}`
+	req := httptest.NewRequest(http.MethodPost, "/publish/token", strings.NewReader(envelope(payload)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if received != payload {
+		t.Errorf("handler should receive the original body, got %q", received)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.RequestID != "m-1" || rec.Method != http.MethodPost || rec.Path != "/publish/token" || rec.Status != http.StatusOK || rec.Outcome != "sent" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+	if rec.Headers["Content-Type"] != "application/json" || rec.Headers["Authorization"] != "" {
+		t.Errorf("headers: got %v", rec.Headers)
+	}
+	if data := decodeData(t, rec.Body); strings.Contains(data, "secret-token") {
+		t.Errorf("recorded body was not redacted: %s", data)
+	}
+}
+
+func TestRecorder_CaptureMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := `{"title":"T","body":"B","token":"secret-token"}`
+	publishTime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	recorder.CaptureMessage(context.Background(), "/publish/token", handlers.ReceivedMessage{
+		ID:           "m-1",
+		Data:         []byte(payload),
+		Attributes:   map[string]string{"tenant": "app-a"},
+		PublishTime:  publishTime,
+		Subscription: "projects/p/subscriptions/s",
+	}, http.StatusOK, []byte(`{"status":"processed","message_id":"projects/p/messages/1"}`))
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.RequestID != "m-1" || rec.Method != http.MethodPost || rec.Path != "/publish/token" || rec.Status != http.StatusOK || rec.Outcome != "sent" {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+
+	// 記録はPushリクエストとしてデコードでき、ペイロードは秘匿化されている
+	req := httptest.NewRequest(rec.Method, rec.Path, strings.NewReader(rec.Body))
+	for name, value := range rec.Headers {
+		req.Header.Set(name, value)
+	}
+	msg, err := handlers.DecodePushRequest(req)
+	if err != nil {
+		t.Fatalf("DecodePushRequest: %v", err)
+	}
+	if msg.ID != "m-1" || msg.Attributes["tenant"] != "app-a" || !msg.PublishTime.Equal(publishTime) || msg.Subscription != "projects/p/subscriptions/s" {
+		t.Errorf("decoded message: %+v", msg)
+	}
+	if strings.Contains(string(msg.Data), "secret-token") || !HasRedactedToken([]byte(rec.Body)) {
+		t.Errorf("recorded payload was not redacted: %s", msg.Data)
+	}
+}
+
+func TestRead(t *testing.T) {
+	records, err := Read(strings.NewReader(`{"request_id":"a","path":"/publish/token","status":200,"outcome":"sent"}
+
+{"request_id":"b","path":"/publish/topic","status":204,"outcome":"acked"}
+`))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(records) != 2 || records[0].RequestID != "a" || records[1].Outcome != "acked" {
+		t.Errorf("unexpected records: %+v", records)
+	}
+
+	if _, err := Read(strings.NewReader("{\"request_id\":\"a\"}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+// Package chaos はFCMへの送信に障害 (FCMのエラー、遅延、タイムアウト) を注入する fcm.Middleware を提供します。
+// プロデューサーやPub/Subの再送ポリシーがFCMの障害時に正しく振る舞うかを、障害を待たずに検証するために使います。
+//
+// 注入したエラーは本物のFCMのエラーと同じ型なので、fcm.ErrorCode や fcm.IsRetryableError は本物と同じように判定します。
+// エラーは *InjectedError でラップされ、メッセージは "chaos: injected" で始まります。
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// FaultTimeout は送信が応答せず、送信のタイムアウトまで待たせる障害です。
+const FaultTimeout = "TIMEOUT"
+
+// FaultLatency は遅延を加えたことを表すメトリクスのラベルです。
+const FaultLatency = "LATENCY"
+
+// defaultTimeout は ctx に期限がない場合に FaultTimeout で待たせる時間です。
+const defaultTimeout = 30 * time.Second
+
+// Faults は注入できる障害です。TIMEOUT 以外はFCMのエラーコードです。
+var Faults = []string{
+	"UNREGISTERED",
+	"INVALID_ARGUMENT",
+	"SENDER_ID_MISMATCH",
+	"QUOTA_EXCEEDED",
+	"UNAVAILABLE",
+	"INTERNAL",
+	"THIRD_PARTY_AUTH_ERROR",
+	FaultTimeout,
+}
+
+// Rules は注入する障害の設定です。
+type Rules struct {
+	// Faults は障害ごとの、送信するメッセージのうちその障害にする割合 (0 から 1) です。合計は 1 以下です。
+	Faults map[string]float64
+	// Latency は対象のメッセージの送信に加える遅延です。
+	Latency time.Duration
+	// Topics と Tokens は障害を注入する送信先です。どちらも空ならすべてのメッセージが対象です。
+	Topics []string
+	Tokens []string
+}
+
+// ParseFaults は障害ごとの割合を "0.05" のような文字列から解釈して検証します。
+func ParseFaults(m map[string]string) (map[string]float64, error) {
+	faults := make(map[string]float64, len(m))
+	for name, value := range m {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("fault %s: invalid rate %q", name, value)
+		}
+		faults[strings.ToUpper(strings.TrimSpace(name))] = rate
+	}
+
+	rules := Rules{Faults: faults}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return faults, nil
+}
+
+// Validate は障害の種類と割合を検証します。
+func (r Rules) Validate() error {
+	var errs []error
+	total := 0.0
+	for name, rate := range r.Faults {
+		if !slices.Contains(Faults, name) {
+			errs = append(errs, fmt.Errorf("unknown fault %q (one of %s)", name, strings.Join(Faults, ", ")))
+		}
+		if rate < 0 || rate > 1 {
+			errs = append(errs, fmt.Errorf("fault %s: rate must be between 0 and 1, got %g", name, rate))
+		}
+		total += rate
+	}
+	if total > 1 {
+		errs = append(errs, fmt.Errorf("fault rates must add up to at most 1, got %g", total))
+	}
+	if r.Latency < 0 {
+		errs = append(errs, errors.New("latency must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// rulesJSON は管理用エンドポイントが受け付ける Rules のJSONの形式です。
+// トークンは秘匿情報なので、Rules をJSONで出力する場合は Summary を使います。
+type rulesJSON struct {
+	Faults  map[string]float64 `json:"faults,omitempty"`
+	Latency string             `json:"latency,omitempty"` // 例: "500ms"
+	Topics  []string           `json:"topics,omitempty"`
+	Tokens  []string           `json:"tokens,omitempty"`
+}
+
+// RulesSummary はトークンを数だけにした Rules です。管理用エンドポイントの応答に使います。
+type RulesSummary struct {
+	Faults  map[string]float64 `json:"faults,omitempty"`
+	Latency string             `json:"latency,omitempty"`
+	Topics  []string           `json:"topics,omitempty"`
+	Tokens  int                `json:"tokens"` // 対象のトークンの数
+}
+
+// Summary はトークンを含まない r の要約を返します。
+func (r Rules) Summary() RulesSummary {
+	summary := RulesSummary{Faults: r.Faults, Topics: r.Topics, Tokens: len(r.Tokens)}
+	if r.Latency > 0 {
+		summary.Latency = r.Latency.String()
+	}
+	return summary
+}
+
+func (r *Rules) UnmarshalJSON(b []byte) error {
+	var j rulesJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&j); err != nil {
+		return err
+	}
+
+	var latency time.Duration
+	if j.Latency != "" {
+		d, err := time.ParseDuration(j.Latency)
+		if err != nil {
+			return fmt.Errorf("invalid latency %q (e.g. 500ms, 2s)", j.Latency)
+		}
+		latency = d
+	}
+
+	*r = Rules{Faults: j.Faults, Latency: latency, Topics: j.Topics, Tokens: j.Tokens}
+	return nil
+}
+
+// matches は message が障害を注入する対象かどうかを返します。
+func (r Rules) matches(message *messaging.Message) bool {
+	if len(r.Topics) == 0 && len(r.Tokens) == 0 {
+		return true
+	}
+	if message.Token != "" && slices.Contains(r.Tokens, message.Token) {
+		return true
+	}
+	return message.Topic != "" && slices.Contains(r.Topics, strings.TrimPrefix(message.Topic, "/topics/"))
+}
+
+// pick は割合に応じてランダムに障害を選びます。障害にしない場合は空文字列を返します。
+func (r Rules) pick() string {
+	x := rand.Float64()
+	for _, name := range Faults { // 乱数が同じなら同じ障害を選ぶように順序を固定する
+		if x < r.Faults[name] {
+			return name
+		}
+		x -= r.Faults[name]
+	}
+	return ""
+}
+
+// InjectedError は注入した障害のエラーです。Err は本物のFCMのエラー、または TIMEOUT の場合は ctx のエラーです。
+type InjectedError struct {
+	Fault string
+	Err   error
+}
+
+func (e *InjectedError) Error() string {
+	return fmt.Sprintf("chaos: injected %s: %v", e.Fault, e.Err)
+}
+
+func (e *InjectedError) Unwrap() error {
+	return e.Err
+}
+
+// IsInjected は err が注入した障害によるものかどうかを返します。
+func IsInjected(err error) bool {
+	var ie *InjectedError
+	return errors.As(err, &ie)
+}
+
+// MetricsRecorder は注入した障害を記録します。metrics.Metrics が実装しています。
+type MetricsRecorder interface {
+	ObserveInjectedFault(tenant, targetType, fault string)
+}
+
+// Injector は障害を注入するかどうかと、そのルールを保持します。管理用エンドポイントから実行中に切り替えられます。
+type Injector struct {
+	mu      sync.RWMutex
+	enabled bool
+	rules   Rules
+
+	metrics MetricsRecorder
+}
+
+// NewInjector は無効な状態の Injector を作成します。
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+// WithMetrics は注入した障害を m に記録するよう設定します。
+func (in *Injector) WithMetrics(m MetricsRecorder) *Injector {
+	in.metrics = m
+
+	return in
+}
+
+// Enable は rules の障害の注入を始めます。すでに有効ならルールを置き換えます。
+func (in *Injector) Enable(rules Rules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.enabled = true
+	in.rules = rules
+	return nil
+}
+
+// Disable は障害の注入をやめます。
+func (in *Injector) Disable() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.enabled = false
+	in.rules = Rules{}
+}
+
+// State は注入が有効かどうかと、そのルールを返します。
+func (in *Injector) State() (bool, Rules) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	return in.enabled, in.rules
+}
+
+// Middleware は送信に障害を注入する fcm.Middleware を返します。tenant はログとメトリクスに使うテナント名です。
+// 注入した遅延とエラーが外側のメトリクスとトレースにも本物と同じように記録されるよう、最も内側に置きます。
+func (in *Injector) Middleware(tenant string) fcm.Middleware {
+	return func(next fcm.Sender) fcm.Sender {
+		return &sender{next: next, injector: in, tenant: tenant}
+	}
+}
+
+type sender struct {
+	next     fcm.Sender
+	injector *Injector
+	tenant   string
+}
+
+// plan は1件のメッセージに注入する障害を決めます。
+func (s *sender) plan(message *messaging.Message) (fault string, latency time.Duration) {
+	enabled, rules := s.injector.State()
+	if !enabled || !rules.matches(message) {
+		return "", 0
+	}
+	return rules.pick(), rules.Latency
+}
+
+func (s *sender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	fault, latency := s.plan(message)
+	if err := s.delay(ctx, latency, fcm.TargetType(message)); err != nil {
+		return "", err
+	}
+	if fault == "" {
+		return s.next.Send(ctx, message)
+	}
+
+	return "", s.inject(ctx, fault, fcm.TargetType(message))
+}
+
+// SendEach は障害にしないメッセージだけを送信し、障害にしたメッセージの結果と合わせて返します。
+// TIMEOUT を選んだメッセージがあれば、呼び出し全体をタイムアウトさせます。
+func (s *sender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	faults := make([]string, len(messages))
+	var (
+		latency time.Duration
+		send    []*messaging.Message
+		timeout bool
+	)
+	for i, message := range messages {
+		var l time.Duration
+		faults[i], l = s.plan(message)
+		latency = max(latency, l)
+		switch faults[i] {
+		case "":
+			send = append(send, message)
+		case FaultTimeout:
+			timeout = true
+		}
+	}
+
+	if err := s.delay(ctx, latency, "batch"); err != nil {
+		return nil, err
+	}
+	if timeout {
+		return nil, s.inject(ctx, FaultTimeout, "batch")
+	}
+	if len(send) == len(messages) {
+		return s.next.SendEach(ctx, messages)
+	}
+
+	var sent *messaging.BatchResponse
+	if len(send) > 0 {
+		var err error
+		if sent, err = s.next.SendEach(ctx, send); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &messaging.BatchResponse{Responses: make([]*messaging.SendResponse, len(messages))}
+	j := 0
+	for i, message := range messages {
+		if faults[i] == "" {
+			resp.Responses[i] = sent.Responses[j]
+			j++
+		} else {
+			resp.Responses[i] = &messaging.SendResponse{Error: s.inject(ctx, faults[i], fcm.TargetType(message))}
+		}
+
+		if resp.Responses[i].Success {
+			resp.SuccessCount++
+		} else {
+			resp.FailureCount++
+		}
+	}
+	return resp, nil
+}
+
+// delay は注入した遅延だけ待ちます。待っている間に ctx が終了した場合はそのエラーを返します。
+func (s *sender) delay(ctx context.Context, latency time.Duration, targetType string) error {
+	if latency <= 0 {
+		return nil
+	}
+
+	s.observe(ctx, FaultLatency, targetType)
+	select {
+	case <-time.After(latency):
+		return nil
+	case <-ctx.Done():
+		return &InjectedError{Fault: FaultLatency, Err: ctx.Err()}
+	}
+}
+
+// inject は fault のエラーを返します。TIMEOUT の場合は ctx が終了するまで待ちます。
+func (s *sender) inject(ctx context.Context, fault, targetType string) error {
+	s.observe(ctx, fault, targetType)
+
+	if fault == FaultTimeout {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+			defer cancel()
+		}
+		<-ctx.Done()
+		return &InjectedError{Fault: fault, Err: ctx.Err()}
+	}
+
+	err, ok := fcmErrors()[fault]
+	if !ok {
+		err = fmt.Errorf("no FCM error for %s", fault)
+	}
+	return &InjectedError{Fault: fault, Err: err}
+}
+
+// observe は注入した障害をログとメトリクスに記録します。
+func (s *sender) observe(ctx context.Context, fault, targetType string) {
+	slog.WarnContext(ctx, "injected FCM fault", "component", "chaos", "tenant", s.tenant, "fault", fault, "targetType", targetType)
+	if m := s.injector.metrics; m != nil {
+		m.ObserveInjectedFault(s.tenant, targetType, fault)
+	}
+}
@@ -0,0 +1,243 @@
+package chaos_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/teamzidi/example-go-fcm/chaos"
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/metrics"
+)
+
+// recordingSender は受け取ったメッセージを記録し、すべて成功させます。
+type recordingSender struct {
+	sent []*messaging.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	s.sent = append(s.sent, message)
+	return "projects/p/messages/1", nil
+}
+
+func (s *recordingSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	resp := &messaging.BatchResponse{}
+	for _, message := range messages {
+		s.sent = append(s.sent, message)
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: true, MessageID: "projects/p/messages/1"})
+		resp.SuccessCount++
+	}
+	return resp, nil
+}
+
+func TestParseFaults(t *testing.T) {
+	tests := []struct {
+		input         map[string]string
+		expected      map[string]float64
+		expectedError bool
+	}{
+		{input: map[string]string{"UNAVAILABLE": "0.1", "timeout": " 0.01"}, expected: map[string]float64{"UNAVAILABLE": 0.1, "TIMEOUT": 0.01}},
+		{input: map[string]string{}, expected: map[string]float64{}},
+		{input: map[string]string{"UNAVAILABLE": "ten"}, expectedError: true},
+		{input: map[string]string{"UNAVAILABLE": "1.5"}, expectedError: true},
+		{input: map[string]string{"UNAVAILABLE": "-0.1"}, expectedError: true},
+		{input: map[string]string{"UNAVAILABLE": "0.6", "INTERNAL": "0.6"}, expectedError: true},
+		{input: map[string]string{"NOT_FOUND": "0.1"}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		faults, err := chaos.ParseFaults(tt.input)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("ParseFaults(%v) error = %v, want error %v", tt.input, err, tt.expectedError)
+			continue
+		}
+		if len(faults) != len(tt.expected) {
+			t.Errorf("ParseFaults(%v) = %v, want %v", tt.input, faults, tt.expected)
+		}
+		for name, rate := range tt.expected {
+			if faults[name] != rate {
+				t.Errorf("ParseFaults(%v)[%s] = %g, want %g", tt.input, name, faults[name], rate)
+			}
+		}
+	}
+}
+
+func TestRules_JSON(t *testing.T) {
+	var rules chaos.Rules
+	if err := json.Unmarshal([]byte(`{"faults":{"INTERNAL":0.5},"latency":"250ms","topics":["news"]}`), &rules); err != nil {
+		t.Fatal(err)
+	}
+	if rules.Faults["INTERNAL"] != 0.5 || rules.Latency != 250*time.Millisecond || len(rules.Topics) != 1 {
+		t.Errorf("decoded rules: %+v", rules)
+	}
+
+	rules.Tokens = []string{"token-1", "token-2"}
+	b, _ := json.Marshal(rules.Summary())
+	if string(b) != `{"faults":{"INTERNAL":0.5},"latency":"250ms","topics":["news"],"tokens":2}` {
+		t.Errorf("encoded summary: %s", b)
+	}
+
+	for _, input := range []string{`{"latency":"soon"}`, `{"rate":0.5}`} {
+		if err := json.Unmarshal([]byte(input), &rules); err == nil {
+			t.Errorf("decoding %s should fail", input)
+		}
+	}
+}
+
+// TestInjector_Errors は注入したエラーが本物のFCMのエラーと同じように分類されることを確認します。
+func TestInjector_Errors(t *testing.T) {
+	tests := []struct {
+		fault     string
+		retryable bool
+	}{
+		{fault: "UNREGISTERED"},
+		{fault: "INVALID_ARGUMENT"},
+		{fault: "SENDER_ID_MISMATCH"},
+		{fault: "QUOTA_EXCEEDED", retryable: true},
+		{fault: "UNAVAILABLE", retryable: true},
+		{fault: "INTERNAL", retryable: true},
+		{fault: "THIRD_PARTY_AUTH_ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fault, func(t *testing.T) {
+			injector := chaos.NewInjector()
+			if err := injector.Enable(chaos.Rules{Faults: map[string]float64{tt.fault: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			next := &recordingSender{}
+			client := fcm.NewClientWithSender(next, injector.Middleware(fcm.DefaultTenant))
+
+			start := time.Now()
+			_, err := client.SendToToken(context.Background(), "token", "t", "b", nil)
+			if !chaos.IsInjected(err) || !strings.Contains(err.Error(), "chaos: injected "+tt.fault) {
+				t.Fatalf("error: %v", err)
+			}
+			if code := fcm.ErrorCode(err); code != tt.fault {
+				t.Errorf("ErrorCode: got %s want %s", code, tt.fault)
+			}
+			if fcm.IsRetryableError(err) != tt.retryable {
+				t.Errorf("IsRetryableError: got %v want %v", !tt.retryable, tt.retryable)
+			}
+			if len(next.sent) != 0 {
+				t.Errorf("a failed message was sent to FCM")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("injecting %s took %s", tt.fault, elapsed)
+			}
+		})
+	}
+}
+
+func TestInjector_Scope(t *testing.T) {
+	injector := chaos.NewInjector()
+	next := &recordingSender{}
+	client := fcm.NewClientWithSender(next, injector.Middleware(fcm.DefaultTenant))
+	ctx := context.Background()
+
+	if _, err := client.SendToToken(ctx, "token", "t", "b", nil); err != nil {
+		t.Errorf("disabled injector failed a message: %v", err)
+	}
+
+	injector.Enable(chaos.Rules{Faults: map[string]float64{"INTERNAL": 1}, Topics: []string{"news"}, Tokens: []string{"bad"}})
+	if _, err := client.SendToToken(ctx, "bad", "t", "b", nil); !chaos.IsInjected(err) {
+		t.Errorf("token in scope: %v", err)
+	}
+	if _, err := client.SendToTopic(ctx, "news", "t", "b", nil); !chaos.IsInjected(err) {
+		t.Errorf("topic in scope: %v", err)
+	}
+	if _, err := client.SendToToken(ctx, "good", "t", "b", nil); err != nil {
+		t.Errorf("token out of scope: %v", err)
+	}
+	if _, err := client.SendToTopic(ctx, "sports", "t", "b", nil); err != nil {
+		t.Errorf("topic out of scope: %v", err)
+	}
+
+	injector.Disable()
+	if _, err := client.SendToToken(ctx, "bad", "t", "b", nil); err != nil {
+		t.Errorf("after Disable: %v", err)
+	}
+	if enabled, _ := injector.State(); enabled {
+		t.Error("injector is still enabled")
+	}
+	if len(next.sent) != 4 {
+		t.Errorf("sent %d messages to FCM, want 4", len(next.sent))
+	}
+}
+
+func TestInjector_SendEach(t *testing.T) {
+	m := metrics.New()
+	injector := chaos.NewInjector().WithMetrics(m)
+	injector.Enable(chaos.Rules{Faults: map[string]float64{"UNREGISTERED": 1}, Tokens: []string{"bad-1", "bad-2"}})
+	next := &recordingSender{}
+	client := fcm.NewClientWithSender(next, m.FCMMiddleware("app-a"), injector.Middleware("app-a"))
+
+	notifications := []fcm.Notification{
+		{Token: "good-1", Title: "t", Body: "b"},
+		{Token: "bad-1", Title: "t", Body: "b"},
+		{Token: "good-2", Title: "t", Body: "b"},
+		{Token: "bad-2", Title: "t", Body: "b"},
+	}
+	results := client.SendEach(context.Background(), notifications)
+	for i, r := range results {
+		injected := strings.HasPrefix(notifications[i].Token, "bad")
+		if chaos.IsInjected(r.Err) != injected || (r.MessageID == "") != injected {
+			t.Errorf("result %d for %s: %+v", i, notifications[i].Token, r)
+		}
+		if injected && fcm.ErrorCode(r.Err) != "UNREGISTERED" {
+			t.Errorf("result %d: error code %s", i, fcm.ErrorCode(r.Err))
+		}
+	}
+	if len(next.sent) != 2 || next.sent[0].Token != "good-1" || next.sent[1].Token != "good-2" {
+		t.Errorf("sent to FCM: %v", next.sent)
+	}
+
+	expected := `
+# HELP fcm_backend_fcm_injected_faults_total Faults injected into FCM sends by the chaos mode, by tenant, target type and fault.
+# TYPE fcm_backend_fcm_injected_faults_total counter
+fcm_backend_fcm_injected_faults_total{fault="UNREGISTERED",target_type="token",tenant="app-a"} 2
+# HELP fcm_backend_fcm_sends_total FCM send calls, by tenant, target type and FCM error code (empty on success).
+# TYPE fcm_backend_fcm_sends_total counter
+fcm_backend_fcm_sends_total{fcm_error_code="",target_type="token",tenant="app-a"} 2
+fcm_backend_fcm_sends_total{fcm_error_code="UNREGISTERED",target_type="token",tenant="app-a"} 2
+`
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "fcm_backend_fcm_injected_faults_total", "fcm_backend_fcm_sends_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInjector_TimeoutAndLatency(t *testing.T) {
+	injector := chaos.NewInjector()
+	next := &recordingSender{}
+	client := fcm.NewClientWithSender(next, injector.Middleware(fcm.DefaultTenant))
+
+	injector.Enable(chaos.Rules{Faults: map[string]float64{chaos.FaultTimeout: 1}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client.SendEach(ctx, []fcm.Notification{{Token: "token", Title: "t", Body: "b"}})[0].Err
+	if !errors.Is(err, context.DeadlineExceeded) || !chaos.IsInjected(err) || !fcm.IsRetryableError(err) {
+		t.Errorf("timeout: %v", err)
+	}
+
+	injector.Enable(chaos.Rules{Latency: 30 * time.Millisecond})
+	start := time.Now()
+	if _, err := client.SendToToken(context.Background(), "token", "t", "b", nil); err != nil {
+		t.Errorf("latency: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("send took %s with 30ms latency", elapsed)
+	}
+	if len(next.sent) != 1 {
+		t.Errorf("sent %d messages to FCM, want 1", len(next.sent))
+	}
+
+	if err := injector.Enable(chaos.Rules{Latency: -time.Second}); err == nil {
+		t.Error("negative latency should be rejected")
+	}
+}
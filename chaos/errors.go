@@ -0,0 +1,89 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/option"
+)
+
+// fcmFailure はFCMのエラーコードごとにFCMが返すエラーレスポンスです。
+type fcmFailure struct {
+	status int    // HTTPステータスコード
+	code   string // google.rpc.Code の名前
+}
+
+// fcmFailures は注入するFCMのエラーです。
+// UNAVAILABLE の本来のステータスは 503 ですが、Firebase Admin SDKが 503 を自動で再試行しないよう 500 で返します。
+var fcmFailures = map[string]fcmFailure{
+	"UNREGISTERED":           {http.StatusNotFound, "NOT_FOUND"},
+	"INVALID_ARGUMENT":       {http.StatusBadRequest, "INVALID_ARGUMENT"},
+	"SENDER_ID_MISMATCH":     {http.StatusForbidden, "PERMISSION_DENIED"},
+	"QUOTA_EXCEEDED":         {http.StatusTooManyRequests, "RESOURCE_EXHAUSTED"},
+	"UNAVAILABLE":            {http.StatusInternalServerError, "UNAVAILABLE"},
+	"INTERNAL":               {http.StatusInternalServerError, "INTERNAL"},
+	"THIRD_PARTY_AUTH_ERROR": {http.StatusUnauthorized, "UNAUTHENTICATED"},
+}
+
+// fcmErrors は障害ごとの本物のFCMのエラーです。
+// messaging.IsUnregistered などはSDKの内部の型のエラーしか判定しないため、
+// FCMのエラーレスポンスを返すHTTPクライアントでSDKに送信させて作ります。
+var fcmErrors = sync.OnceValue(func() map[string]error {
+	errs := make(map[string]error, len(fcmFailures))
+	for errorCode, f := range fcmFailures {
+		errs[errorCode] = sdkError(errorCode, f)
+	}
+	return errs
+})
+
+// sdkError は f のエラーレスポンスをSDKに解釈させたエラーを返します。
+func sdkError(errorCode string, f fcmFailure) error {
+	ctx := context.Background()
+	client := &http.Client{Transport: failureTransport{errorCode: errorCode, failure: f}}
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: "chaos"}, option.WithHTTPClient(client), option.WithoutAuthentication())
+	if err != nil {
+		return fmt.Errorf("creating firebase app: %w", err)
+	}
+	msgClient, err := app.Messaging(ctx)
+	if err != nil {
+		return fmt.Errorf("creating messaging client: %w", err)
+	}
+
+	_, err = msgClient.Send(ctx, &messaging.Message{Token: "chaos"})
+	return err
+}
+
+// failureTransport はすべてのリクエストにFCMと同じ形式のエラーレスポンスを返します。
+type failureTransport struct {
+	errorCode string
+	failure   fcmFailure
+}
+
+func (t failureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"code":    t.failure.status,
+			"message": "injected by chaos",
+			"status":  t.failure.code,
+			"details": []any{
+				map[string]string{
+					"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+					"errorCode": t.errorCode,
+				},
+			},
+		},
+	})
+	return &http.Response{
+		StatusCode: t.failure.status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,147 @@
+// devstack はGCPの認証情報なしでサービスをローカルで動かすための開発用コマンドです。
+// 偽のFCM (internal/fakefcm) を起動し、その宛先を設定したサービスを同じプロセスで実行します。
+// Pub/SubのPushサブスクリプションの代わりに、publish されたメッセージをPushエンドポイントに配信するシミュレーターも起動します。
+//
+//	go run ./cmd/devstack
+//	curl -X POST localhost:8085/v1/projects/devstack/topics/device:publish \
+//	  -d '{"messages":[{"payload":{"title":"T","body":"B","token":"token-1"}}]}'
+//
+// 配信の様子は http://localhost:8085/ で確認できます。
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/internal/app"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// defaultProjectID は GOOGLE_CLOUD_PROJECT が設定されていない場合に使うプロジェクトIDです。
+const defaultProjectID = "devstack"
+
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	addr := flag.String("addr", "127.0.0.1:8085", "address of the Pub/Sub publish API and the live view")
+	fcmAddr := flag.String("fcm-addr", "127.0.0.1:9099", "address of the fake FCM")
+	minBackoff := flag.Duration("min-backoff", 10*time.Second, "minimum redelivery delay of nacked messages")
+	maxBackoff := flag.Duration("max-backoff", 600*time.Second, "maximum redelivery delay of nacked messages")
+	maxAttempts := flag.Int("max-delivery-attempts", 5, "delivery attempts before a message is dead-lettered")
+	fcmLatency := flag.Duration("fcm-latency", 0, "latency of the fake FCM")
+	fcmErrorRate := flag.Float64("fcm-error-rate", 0, "fraction (0 to 1) of messages the fake FCM fails with INTERNAL")
+	flag.Parse()
+
+	// 設定はサービスと同じく読み込み、FCMの宛先だけ偽のFCMに向ける
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if cfg.FCM.ProjectID == "" {
+		cfg.FCM.ProjectID = defaultProjectID
+	}
+	if os.Getenv("LOG_FORMAT") == "" {
+		cfg.Logging.Format = "text" // 端末で読みやすいようにする
+	}
+
+	var logLevel slog.Level
+	_ = logLevel.UnmarshalText([]byte(cfg.Logging.Level)) // config.Load で検証済み
+	if _, err := logging.Setup(os.Stderr, logging.Options{
+		Level:        logLevel,
+		Format:       cfg.Logging.Format,
+		ProjectID:    cfg.FCM.ProjectID,
+		RevealTokens: true, // ローカルのダミーのトークンなので伏せない
+	}); err != nil {
+		fatal("Failed to initialize logging", err)
+	}
+
+	if *minBackoff <= 0 || *maxBackoff < *minBackoff || *maxAttempts <= 0 {
+		fatal("Invalid flags", errors.New("require 0 < -min-backoff <= -max-backoff and -max-delivery-attempts > 0"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// 偽のFCM
+	internalError, _ := fakefcm.FailureFor("INTERNAL")
+	fake := fakefcm.NewServer().WithLatency(*fcmLatency, 0).WithErrorRate(*fcmErrorRate, internalError)
+	fcmListener, err := net.Listen("tcp", *fcmAddr)
+	if err != nil {
+		fatal("Failed to listen for the fake FCM", err)
+	}
+	go serve(&http.Server{Handler: fake, ReadHeaderTimeout: 10 * time.Second}, fcmListener, "fake FCM")
+	cfg.FCM.Endpoint = fmt.Sprintf("http://%s/v1", fcmListener.Addr())
+	go logFCMMessages(fake)
+
+	// サービス。Push先のURLを決めるため、リスナーはここで作る
+	serviceListener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.Port))
+	if err != nil {
+		fatal("Failed to listen for the service", err)
+	}
+	serviceURL := fmt.Sprintf("http://localhost:%d", serviceListener.Addr().(*net.TCPAddr).Port)
+
+	// Pushサブスクリプションのシミュレーター
+	sim, err := NewSimulator(cfg.FCM.ProjectID, []Subscription{
+		{Name: "device-push", Topic: "device", Endpoint: serviceURL + "/publish/token"},
+		{Name: "topic-push", Topic: "topic", Endpoint: serviceURL + "/publish/topic"},
+		{Name: "batch-push", Topic: "batch", Endpoint: serviceURL + "/publish/batch"},
+	}, RetryPolicy{MinBackoff: *minBackoff, MaxBackoff: *maxBackoff, MaxDeliveryAttempts: *maxAttempts})
+	if err != nil {
+		fatal("Failed to initialize the push simulator", err)
+	}
+
+	devListener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal("Failed to listen for the publish API", err)
+	}
+	go serve(&http.Server{Handler: newDevMux(cfg.FCM.ProjectID, fake, sim), ReadHeaderTimeout: 10 * time.Second}, devListener, "publish API")
+
+	slog.Info("devstack started",
+		"service", serviceURL,
+		"fakeFCM", cfg.FCM.Endpoint,
+		"publish", fmt.Sprintf("http://%s/v1/projects/%s/topics/{device,topic,batch}:publish", devListener.Addr(), cfg.FCM.ProjectID),
+		"liveView", fmt.Sprintf("http://%s/", devListener.Addr()))
+
+	if err := app.Run(ctx, cfg, app.Options{Listener: serviceListener}); err != nil {
+		fatal("Server stopped", err)
+	}
+
+	slog.Info("devstack exiting")
+}
+
+// serve は srv でリクエストを受け付けます。失敗した場合はプロセスを終了します。
+func serve(srv *http.Server, l net.Listener, name string) {
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(fmt.Sprintf("Failed to serve the %s", name), err)
+	}
+}
+
+// logFCMMessages は偽のFCMが受信したメッセージをログに出力します。
+func logFCMMessages(fake *fakefcm.Server) {
+	messages, _ := fake.Subscribe()
+	for m := range messages {
+		level := slog.LevelInfo
+		if m.ErrorCode != "" {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "fake FCM received a message",
+			"token", m.Token, "topic", m.Topic, "condition", m.Condition, "title", m.Title, "body", m.Body,
+			"data", m.Data, "status", m.Status, "errorCode", m.ErrorCode, "name", m.Name)
+	}
+}
+
+// fatal はエラーをログに出力してプロセスを終了します。
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDeliveries は記録しておく配信結果の数の上限です。
+const maxDeliveries = 1000
+
+// Subscription はトピックに publish されたメッセージを Endpoint にPushするサブスクリプションです。
+type Subscription struct {
+	Name     string // サブスクリプションID
+	Topic    string // トピックID
+	Endpoint string // Push先のURL
+}
+
+// RetryPolicy はnackされたメッセージの再配信の設定です。Pub/Subのサブスクリプションの再試行ポリシーと同じく、
+// 再配信の間隔は MinBackoff から試行ごとに倍になり、MaxBackoff で頭打ちになります。
+type RetryPolicy struct {
+	MinBackoff          time.Duration
+	MaxBackoff          time.Duration
+	MaxDeliveryAttempts int // この回数配信してもackされなければデッドレターとして扱う
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxBackoff)
+}
+
+// PubsubMessage はPub/SubのREST APIの publish リクエストの1件のメッセージです。
+type PubsubMessage struct {
+	Data        string            `json:"data,omitempty"` // Base64エンコードされたデータ
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	// Payload は data の代わりに指定できる、Base64エンコードしていない業務ペイロードです (devstack独自の拡張)。
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Delivery は1回のPushの結果です。
+type Delivery struct {
+	Seq          int       `json:"seq"`
+	Time         time.Time `json:"time"`
+	Subscription string    `json:"subscription"`
+	MessageID    string    `json:"message_id"`
+	Attempt      int       `json:"attempt"`
+	Status       int       `json:"status,omitempty"` // Push先のHTTPステータスコード。接続できなかった場合は 0
+	Acked        bool      `json:"acked"`
+	Error        string    `json:"error,omitempty"`
+	NextAttempt  time.Time `json:"next_attempt,omitzero"` // nackされた場合の次の配信時刻
+	DeadLettered bool      `json:"dead_lettered,omitempty"`
+}
+
+// Simulator はPub/SubのPushサブスクリプションを模倣し、publish されたメッセージをPush先に配信します。
+type Simulator struct {
+	project       string
+	subscriptions []Subscription
+	retry         RetryPolicy
+	client        *http.Client
+	signer        *tokenSigner
+
+	mu          sync.Mutex
+	nextID      int
+	seq         int
+	deliveries  []Delivery
+	subscribers map[chan Delivery]struct{}
+	inflight    sync.WaitGroup
+}
+
+func NewSimulator(project string, subscriptions []Subscription, retry RetryPolicy) (*Simulator, error) {
+	signer, err := newTokenSigner(fmt.Sprintf("devstack-push@%s.iam.gserviceaccount.com", project))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Simulator{
+		project:       project,
+		subscriptions: subscriptions,
+		retry:         retry,
+		client:        &http.Client{Timeout: 60 * time.Second}, // Pushの確認応答期限に相当
+		signer:        signer,
+		subscribers:   make(map[chan Delivery]struct{}),
+	}, nil
+}
+
+// Publish は topic にメッセージを publish し、そのトピックのサブスクリプションへの配信をバックグラウンドで始めます。
+// 割り当てたメッセージIDを返します。
+func (s *Simulator) Publish(ctx context.Context, topic string, messages []PubsubMessage) ([]string, error) {
+	var subs []Subscription
+	for _, sub := range s.subscriptions {
+		if sub.Topic == topic {
+			subs = append(subs, sub)
+		}
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("topic %q has no subscriptions", topic)
+	}
+
+	var ids []string
+	for i, m := range messages {
+		data := m.Data
+		if data == "" && len(m.Payload) > 0 {
+			data = base64.StdEncoding.EncodeToString(m.Payload)
+		}
+		if data == "" && len(m.Attributes) == 0 {
+			return nil, fmt.Errorf("message %d: data or attributes is required", i)
+		}
+
+		s.mu.Lock()
+		s.nextID++
+		id := fmt.Sprintf("%d", s.nextID)
+		s.mu.Unlock()
+		ids = append(ids, id)
+
+		msg := pushedMessage{
+			Data:        data,
+			Attributes:  m.Attributes,
+			MessageID:   id,
+			PublishTime: time.Now().UTC().Format(time.RFC3339Nano),
+			OrderingKey: m.OrderingKey,
+		}
+		msg.MessageIDSnake, msg.PublishTimeSnake = msg.MessageID, msg.PublishTime
+
+		for _, sub := range subs {
+			s.inflight.Add(1)
+			go func() {
+				defer s.inflight.Done()
+				s.deliver(context.WithoutCancel(ctx), sub, msg)
+			}()
+		}
+	}
+
+	return ids, nil
+}
+
+// Wait は配信中のメッセージがすべてackされるかデッドレターになるまで待ちます。
+func (s *Simulator) Wait() {
+	s.inflight.Wait()
+}
+
+// pushedMessage はPushリクエストの message です。Pub/Subと同じく camelCase と snake_case の両方のフィールドを持ちます。
+type pushedMessage struct {
+	Data             string            `json:"data,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+	MessageID        string            `json:"messageId"`
+	MessageIDSnake   string            `json:"message_id"`
+	PublishTime      string            `json:"publishTime"`
+	PublishTimeSnake string            `json:"publish_time"`
+	OrderingKey      string            `json:"orderingKey,omitempty"`
+}
+
+// deliver はackされるか再配信の上限に達するまで msg を sub のPush先に配信します。
+func (s *Simulator) deliver(ctx context.Context, sub Subscription, msg pushedMessage) {
+	for attempt := 1; ; attempt++ {
+		d := Delivery{Subscription: sub.Name, MessageID: msg.MessageID, Attempt: attempt}
+		d.Status, d.Error = s.push(ctx, sub, msg, attempt)
+		// Pub/Subは 102, 200, 201, 202, 204 をackとして扱う
+		switch d.Status {
+		case http.StatusProcessing, http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+			d.Acked = true
+		}
+
+		switch {
+		case d.Acked:
+		case attempt >= s.retry.MaxDeliveryAttempts:
+			d.DeadLettered = true
+		default:
+			d.NextAttempt = time.Now().Add(s.retry.backoff(attempt))
+		}
+		s.record(d)
+
+		if d.Acked || d.DeadLettered {
+			return
+		}
+
+		select {
+		case <-time.After(time.Until(d.NextAttempt)):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push は1回のPushリクエストを送り、HTTPステータスコードとエラーを返します。
+func (s *Simulator) push(ctx context.Context, sub Subscription, msg pushedMessage, attempt int) (int, string) {
+	body, err := json.Marshal(map[string]any{
+		"message":         msg,
+		"subscription":    fmt.Sprintf("projects/%s/subscriptions/%s", s.project, sub.Name),
+		"deliveryAttempt": attempt,
+	})
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	token, err := s.signer.token(sub.Endpoint)
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "APIs-Google; (+https://developers.google.com/webmasters/APIs-Google.html)")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp.StatusCode, strings.TrimSpace(string(respBody))
+	}
+	return resp.StatusCode, ""
+}
+
+func (s *Simulator) record(d Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	d.Seq = s.seq
+	d.Time = time.Now()
+
+	s.deliveries = append(s.deliveries, d)
+	if len(s.deliveries) > maxDeliveries {
+		s.deliveries = s.deliveries[len(s.deliveries)-maxDeliveries:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- d:
+		default:
+		}
+	}
+
+	level := slog.LevelInfo
+	if !d.Acked {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "push delivery", "subscription", d.Subscription, "messageId", d.MessageID,
+		"attempt", d.Attempt, "status", d.Status, "acked", d.Acked, "deadLettered", d.DeadLettered, "error", d.Error)
+}
+
+// Deliveries は記録している配信結果を古い順に返します。
+func (s *Simulator) Deliveries() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Delivery(nil), s.deliveries...)
+}
+
+// Subscribe は以降の配信結果を受け取るチャネルと、購読をやめる関数を返します。
+func (s *Simulator) Subscribe() (<-chan Delivery, func()) {
+	ch := make(chan Delivery, 64)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// ServeHTTP はPub/SubのREST APIと同じ形式の publish リクエストを受け付けます。
+//
+//	POST /v1/projects/{project}/topics/{topic}:publish  {"messages": [{"data": "...", "attributes": {...}}]}
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// ServeMux のワイルドカードはセグメント全体にしか使えないため、":publish" はここで取り除く
+	topic, ok := strings.CutSuffix(r.PathValue("topic"), ":publish")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req struct {
+		Messages []PubsubMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid publish request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, "messages is required", http.StatusBadRequest)
+		return
+	}
+
+	ids, err := s.Publish(r.Context(), topic, req.Messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"messageIds": ids})
+}
+
+// tokenSigner はPushリクエストに付けるGoogle発行のものと同じ形式のOIDCトークンを、起動ごとに生成した鍵で署名します。
+// サービス自身はトークンを検証しないため (Cloud RunのIAMが検証する)、ヘッダーの形式を本番に合わせるためのものです。
+type tokenSigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+func newTokenSigner(email string) (*tokenSigner, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating signing key: %w", err)
+	}
+	return &tokenSigner{email: email, key: key}, nil
+}
+
+func (t *tokenSigner) token(audience string) (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "devstack"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"azp":            t.email,
+		"sub":            t.email,
+		"email":          t.email,
+		"email_verified": true,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing token: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSimulator(t *testing.T) {
+	tests := []struct {
+		name             string
+		nacks            int // Push先がnackする回数
+		expectedAttempts int
+		expectedAcked    bool
+	}{
+		{name: "acked on the first delivery", nacks: 0, expectedAttempts: 1, expectedAcked: true},
+		{name: "redelivered until acked", nacks: 2, expectedAttempts: 3, expectedAcked: true},
+		{name: "dead-lettered after max attempts", nacks: 10, expectedAttempts: 3, expectedAcked: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				attempts []int
+			)
+			push := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), "."); len(parts) != 3 {
+					t.Errorf("Authorization is not a bearer JWT: %q", r.Header.Get("Authorization"))
+				}
+
+				var envelope struct {
+					Message struct {
+						Data       string            `json:"data"`
+						Attributes map[string]string `json:"attributes"`
+						MessageID  string            `json:"messageId"`
+					} `json:"message"`
+					Subscription    string `json:"subscription"`
+					DeliveryAttempt int    `json:"deliveryAttempt"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+					t.Errorf("decoding push request: %v", err)
+				}
+				data, _ := base64.StdEncoding.DecodeString(envelope.Message.Data)
+				if string(data) != `{"title":"T"}` {
+					t.Errorf("data: got %q", data)
+				}
+				if envelope.Message.Attributes["k"] != "v" {
+					t.Errorf("attributes: got %v", envelope.Message.Attributes)
+				}
+				if envelope.Subscription != "projects/devstack/subscriptions/device-push" {
+					t.Errorf("subscription: got %q", envelope.Subscription)
+				}
+
+				mu.Lock()
+				attempts = append(attempts, envelope.DeliveryAttempt)
+				n := len(attempts)
+				mu.Unlock()
+
+				if n <= tt.nacks {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer push.Close()
+
+			sim, err := NewSimulator("devstack", []Subscription{{Name: "device-push", Topic: "device", Endpoint: push.URL}},
+				RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, MaxDeliveryAttempts: 3})
+			if err != nil {
+				t.Fatalf("NewSimulator: %v", err)
+			}
+
+			// Pub/SubのREST APIと同じ形式で publish する
+			rr := httptest.NewRecorder()
+			mux := http.NewServeMux()
+			mux.Handle("POST /v1/projects/devstack/topics/{topic}", sim)
+			body := `{"messages":[{"payload":{"title":"T"},"attributes":{"k":"v"}}]}`
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/projects/devstack/topics/device:publish", bytes.NewBufferString(body)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("publish: got %d (%s)", rr.Code, rr.Body.String())
+			}
+
+			sim.Wait()
+
+			deliveries := sim.Deliveries()
+			if len(deliveries) != tt.expectedAttempts {
+				t.Fatalf("deliveries: got %d want %d", len(deliveries), tt.expectedAttempts)
+			}
+			for i, d := range deliveries {
+				if d.Attempt != i+1 || attempts[i] != i+1 {
+					t.Errorf("delivery %d: attempt %d, deliveryAttempt %d", i, d.Attempt, attempts[i])
+				}
+			}
+			last := deliveries[len(deliveries)-1]
+			if last.Acked != tt.expectedAcked || last.DeadLettered == tt.expectedAcked {
+				t.Errorf("last delivery: acked %v, dead-lettered %v", last.Acked, last.DeadLettered)
+			}
+		})
+	}
+}
+
+func TestSimulator_UnknownTopic(t *testing.T) {
+	sim, err := NewSimulator("devstack", nil, RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxDeliveryAttempts: 1})
+	if err != nil {
+		t.Fatalf("NewSimulator: %v", err)
+	}
+	if _, err := sim.Publish(context.Background(), "missing", []PubsubMessage{{Data: "e30="}}); err == nil {
+		t.Error("expected an error for a topic without subscriptions")
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 10 * time.Second, MaxBackoff: 60 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: 60 * time.Second, 10: 60 * time.Second} {
+		if got := p.backoff(attempt); got != want {
+			t.Errorf("backoff(%d): got %v want %v", attempt, got, want)
+		}
+	}
+}
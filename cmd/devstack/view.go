@@ -0,0 +1,93 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+)
+
+//go:embed view.html
+var viewHTML []byte
+
+// newDevMux はPub/SubのpublishのAPIと、偽のFCMの受信と配信の結果を表示するライブビューのハンドラを返します。
+//
+//	POST /v1/projects/{project}/topics/{topic}:publish  メッセージを publish する
+//	GET  /                                              ライブビュー
+//	GET  /api/messages                                  偽のFCMが受信したメッセージ
+//	GET  /api/deliveries                                Pushの結果
+//	GET  /api/events                                    上の2つを Server-Sent Events で配信する
+func newDevMux(project string, fake *fakefcm.Server, sim *Simulator) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(fmt.Sprintf("POST /v1/projects/%s/topics/{topic}", project), sim)
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(viewHTML)
+	})
+	mux.HandleFunc("GET /api/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, fake.Messages())
+	})
+	mux.HandleFunc("GET /api/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, sim.Deliveries())
+	})
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		streamEvents(w, r, fake, sim)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "encoding response", "error", err)
+	}
+}
+
+// streamEvents は偽のFCMの受信 (event: message) とPushの結果 (event: delivery) をクライアントが切断するまで送ります。
+func streamEvents(w http.ResponseWriter, r *http.Request, fake *fakefcm.Server, sim *Simulator) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	messages, stopMessages := fake.Subscribe()
+	defer stopMessages()
+	deliveries, stopDeliveries := sim.Subscribe()
+	defer stopDeliveries()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event string, v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for {
+		var err error
+		select {
+		case m := <-messages:
+			err = send("message", m)
+		case d := <-deliveries:
+			err = send("delivery", d)
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+const decodeUsage = `[flags] [FILE]
+
+Decodes a captured push request the same way the service does and validates its payload.
+FILE (or stdin) is either the request body, or a full HTTP request dump starting with the
+request line (e.g. "POST /publish/token HTTP/1.1"), which keeps the headers of unwrapped
+Pub/Sub deliveries and CloudEvents binary mode. Headers can also be given with -header.`
+
+func runDecode(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	var headers listFlag
+	fs := newFlagSet("decode", decodeUsage)
+	fs.Var(&headers, "header", `request header "Name: value" (repeatable)`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in := stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	raw, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("reading request: %w", err)
+	}
+
+	req, err := capturedRequest(raw, headers)
+	if err != nil {
+		return err
+	}
+
+	msg, err := handlers.DecodePushRequest(req)
+
+	type decoded struct {
+		MessageID    string            `json:"message_id,omitempty"`
+		PublishTime  string            `json:"publish_time,omitempty"`
+		Subscription string            `json:"subscription,omitempty"`
+		Attributes   map[string]string `json:"attributes,omitempty"`
+		Payload      any               `json:"payload,omitempty"` // JSONならそのまま、そうでなければ文字列
+		PayloadType  string            `json:"payload_type,omitempty"`
+		Valid        bool              `json:"valid"`
+		Error        string            `json:"error,omitempty"`
+	}
+	out := decoded{
+		MessageID:    msg.ID,
+		Subscription: msg.Subscription,
+		Attributes:   msg.Attributes,
+	}
+	if !msg.PublishTime.IsZero() {
+		out.PublishTime = msg.PublishTime.Format(time.RFC3339Nano)
+	}
+	if json.Valid(msg.Data) {
+		out.Payload = json.RawMessage(msg.Data)
+	} else if len(msg.Data) > 0 {
+		out.Payload = string(msg.Data)
+	}
+
+	if err == nil {
+		out.PayloadType, err = handlers.ValidatePayload(msg.Data)
+	}
+	out.Valid = err == nil
+	out.Error = errorString(err)
+
+	if err := printJSON(stdout, out); err != nil {
+		return err
+	}
+	if !out.Valid {
+		return fmt.Errorf("the service would discard this message")
+	}
+	return nil
+}
+
+// capturedRequest は raw からハンドラに渡すリクエストを作成します。
+// raw がHTTPのリクエスト行で始まっていればヘッダーを含むリクエストとして解釈し、そうでなければボディとして扱います。
+func capturedRequest(raw []byte, headers []string) (*http.Request, error) {
+	var req *http.Request
+	if line, _, _ := bytes.Cut(raw, []byte("\n")); bytes.Contains(line, []byte(" HTTP/")) {
+		// キャプチャには Content-Length がないことがあるため、ボディは空行より後ろすべてとする
+		raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+		head, body, _ := bytes.Cut(raw, []byte("\n\n"))
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(append(head, "\n\n"...))))
+		if err != nil {
+			return nil, fmt.Errorf("parsing HTTP request: %w", err)
+		}
+		req = httptest.NewRequest(r.Method, r.URL.String(), bytes.NewReader(body))
+		req.Header = r.Header
+	} else {
+		req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw))
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf(`-header must be "Name: value", got %q`, h)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return req, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+)
+
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := run(context.Background(), args, strings.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := filepath.Join(dir, "message.json")
+	if err := os.WriteFile(tmpl, []byte(`{"notification":{"title":{{json .title}}},"apns":{"payload":{"aps":{"category":"news"}}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCommand(t, "", "render", "-message", tmpl, "-var", `title=He said "hi"`,
+		"-condition", "'news' in topics", "-body", "B", "-data", "k=v", "-priority", "high", "-ttl", "1h", "-badge", "3")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+
+	var rendered []struct {
+		Message struct {
+			Notification map[string]string `json:"notification"`
+			Data         map[string]string `json:"data"`
+			Condition    string            `json:"condition"`
+			Android      struct {
+				Priority string `json:"priority"`
+				TTL      string `json:"ttl"`
+			} `json:"android"`
+			APNS struct {
+				Headers map[string]string `json:"headers"`
+				Payload struct {
+					Aps map[string]any `json:"aps"`
+				} `json:"payload"`
+			} `json:"apns"`
+		} `json:"message"`
+		Valid bool `json:"valid"`
+	}
+	if err := json.Unmarshal([]byte(out), &rendered); err != nil || len(rendered) != 1 {
+		t.Fatalf("decoding output %q: %v", out, err)
+	}
+	m := rendered[0].Message
+	if !rendered[0].Valid || m.Notification["title"] != `He said "hi"` || m.Notification["body"] != "B" || m.Data["k"] != "v" || m.Condition != "'news' in topics" {
+		t.Errorf("unexpected message: %s", out)
+	}
+	if m.Android.Priority != "high" || m.Android.TTL != "3600s" || m.APNS.Headers["apns-priority"] != "10" {
+		t.Errorf("platform options: %s", out)
+	}
+	if m.APNS.Payload.Aps["category"] != "news" || m.APNS.Payload.Aps["badge"] != float64(3) {
+		t.Errorf("aps from the file and flags should be merged: %s", out)
+	}
+
+	if _, err := runCommand(t, "", "render", "-topic", "news", "-tenant", "a"); err == nil {
+		t.Error("render -tenant without -service: expected an error")
+	}
+}
+
+func TestSend_Direct(t *testing.T) {
+	fake := fakefcm.NewServer()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	// 複数のトークンはトークンごとのメッセージとして送信し、失敗したものだけエラーになる
+	out, err := runCommand(t, "", "send", "-endpoint", srv.URL+"/v1", "-project", "p",
+		"-token", "token-1", "-token", "unregistered-1", "-title", "T", "-body", "B")
+	if err == nil {
+		t.Error("send: expected an error for the unregistered token")
+	}
+	if !strings.Contains(out, `"error_code": "UNREGISTERED"`) || !strings.Contains(out, `"message_id": "projects/p/messages/`) {
+		t.Errorf("unexpected output: %s", out)
+	}
+	if got := len(fake.Messages()); got != 2 {
+		t.Errorf("fake FCM received %d messages, want 2", got)
+	}
+
+	// 送信前に検証し、不正なメッセージは送信しない
+	if _, err := runCommand(t, "", "send", "-endpoint", srv.URL+"/v1", "-project", "p", "-topic", "/topics/news", "-title", "T"); err == nil {
+		t.Error("send: expected a validation error")
+	}
+	if got := len(fake.Messages()); got != 2 {
+		t.Errorf("fake FCM received %d messages after an invalid message, want 2", got)
+	}
+}
+
+func TestSend_ThroughService(t *testing.T) {
+	var (
+		path     string
+		envelope handlers.PubSubPushRequest
+	)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&envelope)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer service.Close()
+
+	_, err := runCommand(t, "", "send", "-service", service.URL, "-token", "a", "-token", "b",
+		"-title", "T", "-body", "B", "-attr", "correlation_id=c-1")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if path != "/publish/batch" {
+		t.Errorf("path: got %q want /publish/batch", path)
+	}
+	if envelope.Message.Attributes["correlation_id"] != "c-1" {
+		t.Errorf("attributes: got %v", envelope.Message.Attributes)
+	}
+	data, _ := base64.StdEncoding.DecodeString(envelope.Message.Data)
+	if kind, err := handlers.ValidatePayload(data); kind != "batch" || err != nil {
+		t.Errorf("payload %s: kind %q, error %v", data, kind, err)
+	}
+
+	if _, err := runCommand(t, "", "send", "-service", service.URL, "-condition", "'a' in topics", "-title", "T", "-body", "B"); err == nil {
+		t.Error("send -condition through the service: expected an error")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString([]byte(`{"title":"T","body":"B","token":"token-1"}`))
+
+	tests := []struct {
+		name          string
+		input         string
+		expectedType  string
+		expectedValid bool
+	}{
+		{
+			name:          "wrapped envelope",
+			input:         `{"message":{"data":"` + data + `","messageId":"m-1","attributes":{"k":"v"}},"subscription":"projects/p/subscriptions/s"}`,
+			expectedType:  "token",
+			expectedValid: true,
+		},
+		{
+			name: "HTTP dump of an unwrapped delivery",
+			input: "POST /publish/topic HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\n" +
+				"X-Goog-Pubsub-Message-Id: m-2\r\nX-Goog-Pubsub-Subscription-Name: projects/p/subscriptions/s\r\n\r\n" +
+				`{"title":"T","body":"B","topic":"news"}`,
+			expectedType:  "topic",
+			expectedValid: true,
+		},
+		{
+			name:          "invalid payload",
+			input:         `{"message":{"data":"` + base64.StdEncoding.EncodeToString([]byte(`{"title":"T","token":"t"}`)) + `"}}`,
+			expectedType:  "token",
+			expectedValid: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runCommand(t, tt.input, "decode")
+			if (err == nil) != tt.expectedValid {
+				t.Errorf("decode error = %v, want valid %v", err, tt.expectedValid)
+			}
+
+			var decoded struct {
+				MessageID   string          `json:"message_id"`
+				PayloadType string          `json:"payload_type"`
+				Payload     json.RawMessage `json:"payload"`
+				Valid       bool            `json:"valid"`
+			}
+			if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+				t.Fatalf("decoding output %q: %v", out, err)
+			}
+			if decoded.PayloadType != tt.expectedType || decoded.Valid != tt.expectedValid || len(decoded.Payload) == 0 {
+				t.Errorf("unexpected output: %s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+// fcmctl は通知の送信と調査のためのコマンドラインツールです。
+//
+//	fcmctl send        通知を送信する (FCMに直接、または -service で起動中のサービス経由で)
+//	fcmctl render      send と同じ引数から送信するメッセージを組み立てて表示する (送信しない)
+//	fcmctl subscribe   デバイストークンをトピックに登録する
+//	fcmctl unsubscribe デバイストークンのトピックへの登録を解除する
+//	fcmctl decode      キャプチャしたPub/SubのPushリクエストをデコードして検証する
+//
+// 各コマンドの引数は fcmctl <command> -h で表示します。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// command はサブコマンドです。
+type command struct {
+	summary string
+	run     func(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"send":        {"send a notification directly to FCM or through a running service", runSend},
+	"render":      {"print the message send would deliver without sending it", runRender},
+	"subscribe":   {"subscribe device tokens to a topic", runSubscribe},
+	"unsubscribe": {"unsubscribe device tokens from a topic", runUnsubscribe},
+	"decode":      {"decode and validate a captured Pub/Sub push request", runDecode},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "fcmctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		usage(os.Stderr)
+		return flag.ErrHelp
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd.run(ctx, args[1:], stdin, stdout)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: fcmctl <command> [flags]")
+	fmt.Fprintln(w)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+}
+
+// fcmFlags はFCMに直接接続するコマンドの共通のフラグです。デフォルト値はサービスと同じ環境変数から取ります。
+type fcmFlags struct {
+	projectID       string
+	credentialsFile string
+	endpoint        string
+	dryRun          bool
+}
+
+func (f *fcmFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.projectID, "project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "Firebase project ID")
+	fs.StringVar(&f.credentialsFile, "credentials", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), "service account key file (default: Application Default Credentials)")
+	fs.StringVar(&f.endpoint, "endpoint", os.Getenv("FCM_ENDPOINT"), "FCM API base URL, e.g. a local fake FCM (http://localhost:9099/v1)")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "validate only; FCM checks the message without delivering it")
+}
+
+func (f *fcmFlags) client(ctx context.Context) (*fcm.Client, error) {
+	return fcm.NewClient(ctx, fcm.Config{
+		ProjectID:       f.projectID,
+		CredentialsFile: f.credentialsFile,
+		DryRun:          f.dryRun,
+		Endpoint:        f.endpoint,
+	})
+}
+
+// listFlag は繰り返し指定できる文字列のフラグです。
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// keyValueFlag は key=value の形式で繰り返し指定できるフラグです。
+type keyValueFlag map[string]string
+
+func (kv keyValueFlag) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValueFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	kv[key] = value
+	return nil
+}
+
+// readTokens は tokens に tokensFile (1行に1トークン、空行と # で始まる行は無視) のトークンを加えて返します。
+func readTokens(tokens []string, tokensFile string) ([]string, error) {
+	if tokensFile == "" {
+		return tokens, nil
+	}
+
+	b, err := os.ReadFile(tokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading tokens file: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, nil
+}
+
+// printJSON は v を整形したJSONとして w に出力します。
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// newFlagSet はエラーを返すフラグセットを作成します。使い方は stderr に出力します。
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: fcmctl %s %s\n\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+const sendUsage = `[flags]
+
+Sends directly to FCM by default. With -service, the notification is wrapped in a Pub/Sub
+push envelope and posted to the running service (/publish/token, /publish/topic or
+/publish/batch for several tokens), so it goes through the same path as production.
+
+-message and -payload files are Go templates rendered with the -var values, e.g.
+{"notification": {"title": {{json .title}}}}. Flags override the values in the file.`
+
+// sendFlags は send と render の引数です。
+type sendFlags struct {
+	fcm fcmFlags
+
+	tokens     listFlag
+	tokensFile string
+	topic      string
+	condition  string
+
+	title string
+	body  string
+	image string
+	data  keyValueFlag
+
+	messageFile string
+	payloadFile string
+	vars        keyValueFlag
+
+	// プラットフォームごとのオプション
+	priority       string
+	ttl            time.Duration
+	collapseKey    string
+	channelID      string
+	sound          string
+	badge          int
+	analyticsLabel string
+
+	// サービス経由で送信する場合の引数
+	service       string
+	attributes    keyValueFlag
+	tenant        string
+	category      string
+	userID        string
+	correlationID string
+	sendAt        string
+	delay         string
+}
+
+func parseSendFlags(name string, args []string) (*sendFlags, error) {
+	f := &sendFlags{data: keyValueFlag{}, vars: keyValueFlag{}, attributes: keyValueFlag{}}
+	fs := newFlagSet(name, sendUsage)
+	f.fcm.register(fs)
+
+	fs.Var(&f.tokens, "token", "device token (repeatable; several tokens are sent as a multicast)")
+	fs.StringVar(&f.tokensFile, "tokens-file", "", "file with one device token per line")
+	fs.StringVar(&f.topic, "topic", "", "topic name")
+	fs.StringVar(&f.condition, "condition", "", `topic condition, e.g. "'news' in topics && 'jp' in topics"`)
+
+	fs.StringVar(&f.title, "title", "", "notification title")
+	fs.StringVar(&f.body, "body", "", "notification body")
+	fs.StringVar(&f.image, "image", "", "notification image URL")
+	fs.Var(f.data, "data", "data key=value (repeatable)")
+
+	fs.StringVar(&f.messageFile, "message", "", "FCM v1 message JSON template file (all options)")
+	fs.StringVar(&f.payloadFile, "payload", "", "service payload JSON template file (with -service)")
+	fs.Var(f.vars, "var", "template variable key=value (repeatable)")
+
+	fs.StringVar(&f.priority, "priority", "", "delivery priority: high or normal (Android priority and apns-priority)")
+	fs.DurationVar(&f.ttl, "ttl", 0, "Android time to live, e.g. 1h")
+	fs.StringVar(&f.collapseKey, "collapse-key", "", "Android collapse key")
+	fs.StringVar(&f.channelID, "channel-id", "", "Android notification channel ID")
+	fs.StringVar(&f.sound, "sound", "", "notification sound (Android and APNs)")
+	fs.IntVar(&f.badge, "badge", -1, "APNs badge count")
+	fs.StringVar(&f.analyticsLabel, "analytics-label", "", "FCM analytics label")
+
+	fs.StringVar(&f.service, "service", "", "base URL of a running service to send through, e.g. http://localhost:8080")
+	fs.Var(f.attributes, "attr", "Pub/Sub message attribute key=value (repeatable, with -service)")
+	fs.StringVar(&f.tenant, "tenant", "", "tenant (with -service)")
+	fs.StringVar(&f.category, "category", "", "notification category (with -service)")
+	fs.StringVar(&f.userID, "user-id", "", "recipient user ID (with -service)")
+	fs.StringVar(&f.correlationID, "correlation-id", "", "correlation ID (with -service)")
+	fs.StringVar(&f.sendAt, "send-at", "", "scheduled send time in RFC 3339 (with -service)")
+	fs.StringVar(&f.delay, "delay", "", "send delay, e.g. 10m (with -service)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	var err error
+	f.tokens, err = readTokens(f.tokens, f.tokensFile)
+	return f, err
+}
+
+func runSend(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	f, err := parseSendFlags("send", args)
+	if err != nil {
+		return err
+	}
+
+	if f.service != "" {
+		return sendThroughService(ctx, f, stdout)
+	}
+	return sendDirect(ctx, f, stdout)
+}
+
+func runRender(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	f, err := parseSendFlags("render", args)
+	if err != nil {
+		return err
+	}
+
+	if f.service != "" {
+		payload, err := f.servicePayload()
+		if err != nil {
+			return err
+		}
+		kind, err := handlers.ValidatePayload(payload)
+		return printJSON(stdout, map[string]any{
+			"endpoint": f.service + serviceEndpoint(kind),
+			"payload":  json.RawMessage(payload),
+			"valid":    err == nil,
+			"error":    errorString(err),
+		})
+	}
+
+	messages, err := f.messages()
+	if err != nil {
+		return err
+	}
+	var rendered []map[string]any
+	for _, m := range messages {
+		err := fcm.ValidateMessage(m)
+		rendered = append(rendered, map[string]any{"message": m, "valid": err == nil, "error": errorString(err)})
+	}
+	return printJSON(stdout, rendered)
+}
+
+// sendDirect はFCMに直接送信し、メッセージごとの結果を出力します。
+func sendDirect(ctx context.Context, f *sendFlags, stdout io.Writer) error {
+	messages, err := f.messages()
+	if err != nil {
+		return err
+	}
+
+	client, err := f.fcm.client(ctx)
+	if err != nil {
+		return fmt.Errorf("initializing FCM client: %w", err)
+	}
+
+	var results []fcm.SendResult
+	if len(messages) == 1 {
+		id, err := client.Send(ctx, messages[0])
+		results = []fcm.SendResult{{MessageID: id, Err: err}}
+	} else {
+		results = client.SendMessages(ctx, messages)
+	}
+
+	type result struct {
+		Target    string `json:"target"`
+		MessageID string `json:"message_id,omitempty"`
+		Error     string `json:"error,omitempty"`
+		ErrorCode string `json:"error_code,omitempty"`
+	}
+	out := make([]result, len(results))
+	failed := 0
+	for i, r := range results {
+		out[i] = result{Target: fcm.TargetType(messages[i]) + " " + messages[i].Token + messages[i].Topic + messages[i].Condition, MessageID: r.MessageID}
+		if r.Err != nil {
+			failed++
+			out[i].Error = r.Err.Error()
+			var ve *fcm.ValidationError
+			if !errors.As(r.Err, &ve) {
+				out[i].ErrorCode = fcm.ErrorCode(r.Err)
+			}
+		}
+	}
+	if err := printJSON(stdout, map[string]any{"dry_run": f.fcm.dryRun, "results": out}); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages failed", failed, len(results))
+	}
+	return nil
+}
+
+// messages はフラグから送信するメッセージを組み立てます。トークンが複数ある場合はトークンごとのメッセージを返します。
+func (f *sendFlags) messages() ([]*messaging.Message, error) {
+	if err := f.serviceOnlyFlags(); err != nil {
+		return nil, err
+	}
+
+	base := &messaging.Message{}
+	if f.messageFile != "" {
+		b, err := renderTemplate(f.messageFile, f.vars)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, base); err != nil {
+			return nil, fmt.Errorf("decoding message file: %w", err)
+		}
+	}
+
+	if f.title != "" || f.body != "" || f.image != "" {
+		if base.Notification == nil {
+			base.Notification = &messaging.Notification{}
+		}
+		setIf(&base.Notification.Title, f.title)
+		setIf(&base.Notification.Body, f.body)
+		setIf(&base.Notification.ImageURL, f.image)
+	}
+
+	for k, v := range f.data {
+		if base.Data == nil {
+			base.Data = map[string]string{}
+		}
+		base.Data[k] = v
+	}
+
+	if err := f.applyPlatformOptions(base); err != nil {
+		return nil, err
+	}
+
+	setIf(&base.Topic, f.topic)
+	setIf(&base.Condition, f.condition)
+	if len(f.tokens) <= 1 {
+		if len(f.tokens) == 1 {
+			base.Token = f.tokens[0]
+		}
+		return []*messaging.Message{base}, nil
+	}
+
+	// マルチキャスト。送信先以外はすべてのトークンで共通
+	if base.Topic != "" || base.Condition != "" {
+		return nil, fmt.Errorf("several tokens cannot be combined with a topic or condition")
+	}
+	messages := make([]*messaging.Message, len(f.tokens))
+	for i, token := range f.tokens {
+		m := *base
+		m.Token = token
+		messages[i] = &m
+	}
+	return messages, nil
+}
+
+// applyPlatformOptions はAndroid、APNs、全プラットフォーム共通のオプションのフラグを m に設定します。
+func (f *sendFlags) applyPlatformOptions(m *messaging.Message) error {
+	android := func() *messaging.AndroidConfig {
+		if m.Android == nil {
+			m.Android = &messaging.AndroidConfig{}
+		}
+		return m.Android
+	}
+	androidNotification := func() *messaging.AndroidNotification {
+		if android().Notification == nil {
+			m.Android.Notification = &messaging.AndroidNotification{}
+		}
+		return m.Android.Notification
+	}
+	aps := func() *messaging.Aps {
+		if m.APNS == nil {
+			m.APNS = &messaging.APNSConfig{}
+		}
+		if m.APNS.Payload == nil {
+			m.APNS.Payload = &messaging.APNSPayload{}
+		}
+		if m.APNS.Payload.Aps == nil {
+			m.APNS.Payload.Aps = &messaging.Aps{}
+		}
+		return m.APNS.Payload.Aps
+	}
+
+	switch f.priority {
+	case "":
+	case "high", "normal":
+		android().Priority = f.priority
+		aps()
+		if m.APNS.Headers == nil {
+			m.APNS.Headers = map[string]string{}
+		}
+		// APNsの優先度は 10 (即時) または 5 (省電力を考慮)
+		m.APNS.Headers["apns-priority"] = map[string]string{"high": "10", "normal": "5"}[f.priority]
+	default:
+		return fmt.Errorf("-priority must be high or normal, got %q", f.priority)
+	}
+
+	if f.ttl > 0 {
+		android().TTL = &f.ttl
+	}
+	if f.collapseKey != "" {
+		android().CollapseKey = f.collapseKey
+	}
+	if f.channelID != "" {
+		androidNotification().ChannelID = f.channelID
+	}
+	if f.sound != "" {
+		androidNotification().Sound = f.sound
+		aps().Sound = f.sound
+	}
+	if f.badge >= 0 {
+		aps().Badge = &f.badge
+	}
+	if f.analyticsLabel != "" {
+		m.FCMOptions = &messaging.FCMOptions{AnalyticsLabel: f.analyticsLabel}
+	}
+
+	return nil
+}
+
+// serviceOnlyFlags はサービス経由でしか使えないフラグが指定されていればエラーを返します。
+func (f *sendFlags) serviceOnlyFlags() error {
+	for name, set := range map[string]bool{
+		"-payload":        f.payloadFile != "",
+		"-attr":           len(f.attributes) > 0,
+		"-tenant":         f.tenant != "",
+		"-category":       f.category != "",
+		"-user-id":        f.userID != "",
+		"-correlation-id": f.correlationID != "",
+		"-send-at":        f.sendAt != "",
+		"-delay":          f.delay != "",
+	} {
+		if set {
+			return fmt.Errorf("%s requires -service", name)
+		}
+	}
+	return nil
+}
+
+// servicePayload はフラグからサービスに送る業務ペイロードを組み立てます。トークンが複数ある場合はバッチにします。
+func (f *sendFlags) servicePayload() ([]byte, error) {
+	switch {
+	case f.messageFile != "":
+		return nil, fmt.Errorf("-message cannot be used with -service; use -payload")
+	case f.condition != "":
+		return nil, fmt.Errorf("conditions cannot be sent through the service")
+	case f.image != "" || f.priority != "" || f.ttl != 0 || f.collapseKey != "" || f.channelID != "" || f.sound != "" || f.badge >= 0 || f.analyticsLabel != "":
+		return nil, fmt.Errorf("platform options cannot be sent through the service; send directly instead")
+	}
+
+	payload := map[string]any{}
+	if f.payloadFile != "" {
+		b, err := renderTemplate(f.payloadFile, f.vars)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &payload); err != nil {
+			return nil, fmt.Errorf("decoding payload file: %w", err)
+		}
+	}
+	if _, ok := payload["schema_version"]; !ok {
+		payload["schema_version"] = handlers.LatestSchemaVersion
+	}
+
+	item := map[string]any{}
+	for k, v := range map[string]string{
+		"title": f.title, "body": f.body, "topic": f.topic, "category": f.category,
+		"user_id": f.userID, "correlation_id": f.correlationID, "send_at": f.sendAt, "delay": f.delay,
+	} {
+		if v != "" {
+			item[k] = v
+		}
+	}
+	if len(f.data) > 0 {
+		item["custom_data"] = map[string]string(f.data)
+	}
+
+	if len(f.tokens) > 1 {
+		notifications := make([]any, len(f.tokens))
+		for i, token := range f.tokens {
+			n := map[string]any{"schema_version": payload["schema_version"], "token": token}
+			for k, v := range item {
+				n[k] = v
+			}
+			notifications[i] = n
+		}
+		payload["notifications"] = notifications
+	} else {
+		if len(f.tokens) == 1 {
+			item["token"] = f.tokens[0]
+		}
+		for k, v := range item {
+			payload[k] = v
+		}
+	}
+	if f.tenant != "" {
+		payload["tenant"] = f.tenant
+	}
+
+	return json.Marshal(payload)
+}
+
+// serviceEndpoint はペイロードの種類に対応するサービスのPushエンドポイントです。
+func serviceEndpoint(kind string) string {
+	switch kind {
+	case "topic":
+		return "/publish/topic"
+	case "batch":
+		return "/publish/batch"
+	default:
+		return "/publish/token"
+	}
+}
+
+// sendThroughService は業務ペイロードをPub/SubのPushリクエストの形式で起動中のサービスに送信します。
+// -dry-run の場合はペイロードを検証するだけで送信しません。
+func sendThroughService(ctx context.Context, f *sendFlags, stdout io.Writer) error {
+	payload, err := f.servicePayload()
+	if err != nil {
+		return err
+	}
+	kind, err := handlers.ValidatePayload(payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	if f.fcm.dryRun {
+		return printJSON(stdout, map[string]any{"dry_run": true, "payload": json.RawMessage(payload), "valid": true})
+	}
+
+	messageID := fmt.Sprintf("fcmctl-%d", time.Now().UnixNano())
+	envelope, err := json.Marshal(handlers.PubSubPushRequest{
+		Message: handlers.PubSubInternalMessage{
+			Data:        base64.StdEncoding.EncodeToString(payload),
+			MessageID:   messageID,
+			PublishTime: time.Now().UTC().Format(time.RFC3339Nano),
+			Attributes:  f.attributes,
+		},
+		Subscription: "projects/" + cmp.Or(f.fcm.projectID, "local") + "/subscriptions/fcmctl",
+	})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(f.service, "/") + serviceEndpoint(kind)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	out := map[string]any{"endpoint": url, "message_id": messageID, "status": resp.StatusCode}
+	if json.Valid(body) {
+		out["response"] = json.RawMessage(body)
+	} else if len(bytes.TrimSpace(body)) > 0 {
+		out["response"] = strings.TrimSpace(string(body))
+	}
+	if err := printJSON(stdout, out); err != nil {
+		return err
+	}
+
+	// サービスは処理できなかった不正なメッセージをack (204) し、再送すべきものをnack (5xx) する
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return fmt.Errorf("the service discarded the message as invalid")
+	case resp.StatusCode >= http.StatusBadRequest:
+		return fmt.Errorf("the service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// renderTemplate は path のファイルを text/template として vars で展開します。
+// テンプレートでは {{json .key}} で値をJSONの文字列として埋め込めます。
+func renderTemplate(path string, vars map[string]string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	}
+
+	tmpl, err := template.New(path).Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("rendering template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func setIf(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// maxTopicManagementTokens はトピックの登録・解除の1回の呼び出しで指定できるトークン数の上限です。
+const maxTopicManagementTokens = 1000
+
+func runSubscribe(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	return manageTopic(ctx, "subscribe", args, stdout, (*fcm.Client).SubscribeToTopic)
+}
+
+func runUnsubscribe(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	return manageTopic(ctx, "unsubscribe", args, stdout, (*fcm.Client).UnsubscribeFromTopic)
+}
+
+type topicFunc func(c *fcm.Client, ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+
+// manageTopic はトークンを上限ごとに分けてトピックに登録 (または解除) し、トークンごとの失敗を出力します。
+func manageTopic(ctx context.Context, name string, args []string, stdout io.Writer, fn topicFunc) error {
+	var (
+		f          fcmFlags
+		tokens     listFlag
+		tokensFile string
+		topic      string
+	)
+	fs := newFlagSet(name, "-topic TOPIC -token TOKEN [-token TOKEN...] [flags]")
+	f.register(fs)
+	fs.Var(&tokens, "token", "device token (repeatable)")
+	fs.StringVar(&tokensFile, "tokens-file", "", "file with one device token per line")
+	fs.StringVar(&topic, "topic", "", "topic name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	all, err := readTokens(tokens, tokensFile)
+	if err != nil {
+		return err
+	}
+	if topic == "" || len(all) == 0 {
+		return fmt.Errorf("-topic and at least one token are required")
+	}
+	if err := fcm.Validate(fcm.Notification{Topic: topic}); err != nil {
+		return err
+	}
+
+	type failure struct {
+		Token  string `json:"token"`
+		Reason string `json:"reason"`
+	}
+	out := struct {
+		Topic     string    `json:"topic"`
+		DryRun    bool      `json:"dry_run"`
+		Succeeded int       `json:"succeeded"`
+		Failed    []failure `json:"failed,omitempty"`
+	}{Topic: topic, DryRun: f.dryRun}
+
+	// FCMにはトピックの登録・解除を検証だけ行うAPIがないため、ドライランではトークンの形式だけ確かめる
+	if f.dryRun {
+		for _, token := range all {
+			if err := fcm.Validate(fcm.Notification{Token: token}); err != nil {
+				out.Failed = append(out.Failed, failure{Token: token, Reason: err.Error()})
+				continue
+			}
+			out.Succeeded++
+		}
+		return finishTopic(stdout, out, len(out.Failed))
+	}
+
+	client, err := f.client(ctx)
+	if err != nil {
+		return fmt.Errorf("initializing FCM client: %w", err)
+	}
+
+	for start := 0; start < len(all); start += maxTopicManagementTokens {
+		chunk := all[start:min(start+maxTopicManagementTokens, len(all))]
+		resp, err := fn(client, ctx, chunk, topic)
+		if err != nil {
+			return fmt.Errorf("%s %d tokens: %w", name, len(chunk), err)
+		}
+		out.Succeeded += resp.SuccessCount
+		for _, e := range resp.Errors {
+			out.Failed = append(out.Failed, failure{Token: chunk[e.Index], Reason: e.Reason})
+		}
+	}
+
+	return finishTopic(stdout, out, len(out.Failed))
+}
+
+func finishTopic(stdout io.Writer, out any, failed int) error {
+	if err := printJSON(stdout, out); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tokens failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/capture"
+	"github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+)
+
+// kinds は生成するリクエストの種類と送信先のパスです。invalid は検証で拒否されるペイロードです。
+var kinds = map[string]string{
+	"token":   "/publish/token",
+	"topic":   "/publish/topic",
+	"batch":   "/publish/batch",
+	"invalid": "/publish/token",
+}
+
+// Mix はリクエストの種類ごとの重みです。
+type Mix map[string]int
+
+// parseMix は "token=8,topic=1,batch=1" の形式の重みを解釈します。
+func parseMix(s string) (Mix, error) {
+	mix := Mix{}
+	for _, part := range strings.Split(s, ",") {
+		kind, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: must be kind=weight", part)
+		}
+		if _, known := kinds[kind]; !known {
+			return nil, fmt.Errorf("%q: unknown kind %q (token, topic, batch or invalid)", part, kind)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q: weight must be a non-negative integer", part)
+		}
+		mix[kind] += n
+	}
+
+	total := 0
+	for _, n := range mix {
+		total += n
+	}
+	if total == 0 {
+		return nil, errors.New("at least one weight must be positive")
+	}
+	return mix, nil
+}
+
+// pick は重みに応じてランダムに種類を選びます。
+func (m Mix) pick() string {
+	names := make([]string, 0, len(m))
+	total := 0
+	for kind, n := range m {
+		names = append(names, kind)
+		total += n
+	}
+	slices.Sort(names) // 乱数が同じなら同じ種類を選ぶように順序を固定する
+
+	r := rand.IntN(total)
+	for _, kind := range names {
+		if r < m[kind] {
+			return kind
+		}
+		r -= m[kind]
+	}
+	return names[len(names)-1]
+}
+
+// Generator は一定のレートでPushリクエストを送り続けます。
+type Generator struct {
+	BaseURL     string
+	Client      *http.Client
+	RPS         float64
+	Duration    time.Duration
+	Concurrency int // 同時に処理中にできるリクエスト数の上限。超えた分は送らずに dropped として数える
+	Mix         Mix
+	BatchSize   int // バッチ1件あたりの通知数
+	DataSize    int // custom_data に加えるバイト数
+	Tokens      int // 送信先に使うトークンの種類数
+
+	seq atomic.Int64
+}
+
+// result は1件のリクエストの結果です。
+type result struct {
+	kind          string
+	latency       time.Duration
+	outcome       string
+	notifications int        // FCMに送信した通知数
+	batch         BatchCount // バッチの場合の通知ごとの結果
+}
+
+// Run は Duration の間リクエストを送り、すべての応答を待ってから集計を返します。
+func (g *Generator) Run(ctx context.Context) Report {
+	interval := time.Duration(float64(time.Second) / g.RPS)
+	ctx, cancel := context.WithTimeout(ctx, g.Duration)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		results []result
+		wg      sync.WaitGroup
+		dropped int
+	)
+	slots := make(chan struct{}, g.Concurrency)
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			r := g.send(context.WithoutCancel(ctx), g.Mix.pick())
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return newReport(g, results, dropped, time.Since(start))
+}
+
+// send は kind のリクエストを1件送ります。
+func (g *Generator) send(ctx context.Context, kind string) result {
+	seq := g.seq.Add(1)
+	body := g.envelope(kind, seq)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(g.BaseURL, "/")+kinds[kind], bytes.NewReader(body))
+	if err != nil {
+		return result{kind: kind, outcome: "error: " + err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return result{kind: kind, latency: time.Since(start), outcome: errorOutcome(err)}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	latency := time.Since(start)
+
+	r := result{kind: kind, latency: latency, outcome: capture.Outcome(resp.StatusCode, respBody)}
+	switch {
+	case r.outcome == "sent":
+		r.notifications = 1
+	case strings.HasPrefix(r.outcome, "batch "):
+		json.Unmarshal(respBody, &r.batch)
+		r.notifications = r.batch.Sent
+		r.outcome = "batch"
+	}
+	return r
+}
+
+// errorOutcome は応答を受け取れなかった理由を分類します。
+func errorOutcome(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return "error: timeout"
+	}
+	return "error: connection"
+}
+
+// envelope は kind のペイロードをPub/SubのPushリクエストの形式で包みます。
+func (g *Generator) envelope(kind string, seq int64) []byte {
+	var payload any
+	switch kind {
+	case "token":
+		payload = handlers.DevicePushPayload{Title: "load test", Body: "notification", Token: g.token(seq), CustomData: g.customData()}
+	case "topic":
+		payload = handlers.TopicPushPayload{Title: "load test", Body: "notification", Topic: fmt.Sprintf("load-%d", seq%10), CustomData: g.customData()}
+	case "batch":
+		notifications := make([]json.RawMessage, g.BatchSize)
+		for i := range notifications {
+			notifications[i], _ = json.Marshal(handlers.DevicePushPayload{
+				Title:      "load test",
+				Body:       "notification",
+				Token:      g.token(seq*int64(g.BatchSize) + int64(i)),
+				CustomData: g.customData(),
+			})
+		}
+		payload = handlers.BatchPushPayload{Notifications: notifications}
+	case "invalid":
+		payload = handlers.DevicePushPayload{Title: "load test", Token: g.token(seq)} // body がない
+	}
+
+	data, _ := json.Marshal(payload)
+	body, _ := json.Marshal(handlers.PubSubPushRequest{
+		Message: handlers.PubSubInternalMessage{
+			Data:        base64.StdEncoding.EncodeToString(data),
+			MessageID:   strconv.FormatInt(seq, 10),
+			PublishTime: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		Subscription: "projects/loadgen/subscriptions/loadgen",
+	})
+	return body
+}
+
+func (g *Generator) customData() map[string]string {
+	if g.DataSize <= 0 {
+		return nil
+	}
+	return map[string]string{"padding": strings.Repeat("x", g.DataSize)}
+}
+
+func (g *Generator) token(seq int64) string {
+	return fmt.Sprintf("load-%d", seq%int64(max(g.Tokens, 1)))
+}
+
+// Report は負荷試験の結果です。
+type Report struct {
+	Target    string  `json:"target"`
+	RPS       float64 `json:"rps"` // 目標のレート
+	Duration  string  `json:"duration"`
+	Requests  int     `json:"requests"`  // 送ったリクエスト数
+	Dropped   int     `json:"dropped"`   // 処理中のリクエストが上限に達していて送らなかった数
+	Succeeded int     `json:"succeeded"` // 応答が返り、nack されなかったリクエスト数
+
+	Throughput              float64 `json:"throughput"` // 1秒あたりに完了したリクエスト数
+	Notifications           int     `json:"notifications"`
+	NotificationsThroughput float64 `json:"notifications_throughput"` // 1秒あたりにFCMに送信した通知数
+
+	Latency  Latency            `json:"latency"`
+	ByKind   map[string]Latency `json:"by_kind"`
+	Outcomes map[string]int     `json:"outcomes"` // 処理結果 (capture.Outcome、バッチは "batch") ごとのリクエスト数
+	Batch    BatchCount         `json:"batch"`    // バッチに含まれていた通知の結果の合計
+
+	FakeFCM *fakefcm.Stats `json:"fake_fcm,omitempty"` // 同じプロセスで起動した偽のFCMの集計
+}
+
+// BatchCount はバッチの応答に含まれる通知ごとの結果の数です。
+type BatchCount struct {
+	Sent        int `json:"sent"`
+	Invalid     int `json:"invalid"`
+	Failed      int `json:"failed"`
+	Republished int `json:"republished"`
+}
+
+// Latency はリクエスト数と応答時間の分布です。時間はミリ秒です。
+type Latency struct {
+	Requests int     `json:"requests"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+	Max      float64 `json:"max_ms"`
+}
+
+func newReport(g *Generator, results []result, dropped int, elapsed time.Duration) Report {
+	report := Report{
+		Target:   g.BaseURL,
+		RPS:      g.RPS,
+		Duration: elapsed.Round(time.Millisecond).String(),
+		Requests: len(results),
+		Dropped:  dropped,
+		ByKind:   map[string]Latency{},
+		Outcomes: map[string]int{},
+	}
+
+	all := make([]time.Duration, 0, len(results))
+	byKind := map[string][]time.Duration{}
+	for _, r := range results {
+		report.Outcomes[r.outcome]++
+		if strings.HasPrefix(r.outcome, "error: ") {
+			continue
+		}
+		if r.outcome != "nacked" {
+			report.Succeeded++
+		}
+		report.Notifications += r.notifications
+		report.Batch.Sent += r.batch.Sent
+		report.Batch.Invalid += r.batch.Invalid
+		report.Batch.Failed += r.batch.Failed
+		report.Batch.Republished += r.batch.Republished
+		all = append(all, r.latency)
+		byKind[r.kind] = append(byKind[r.kind], r.latency)
+	}
+
+	report.Latency = latencyOf(all)
+	for kind, latencies := range byKind {
+		report.ByKind[kind] = latencyOf(latencies)
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		report.Throughput = float64(len(all)) / seconds
+		report.NotificationsThroughput = float64(report.Notifications) / seconds
+	}
+	return report
+}
+
+// latencyOf は応答時間の分布を求めます。
+func latencyOf(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	percentile := func(p float64) float64 {
+		i := int(float64(len(latencies))*p+0.5) - 1
+		return milliseconds(latencies[min(max(i, 0), len(latencies)-1)])
+	}
+	return Latency{
+		Requests: len(latencies),
+		P50:      percentile(0.50),
+		P90:      percentile(0.90),
+		P95:      percentile(0.95),
+		P99:      percentile(0.99),
+		Max:      milliseconds(latencies[len(latencies)-1]),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      Mix
+		expectedError bool
+	}{
+		{input: "token=8,topic=1,batch=1", expected: Mix{"token": 8, "topic": 1, "batch": 1}},
+		{input: " token=1, invalid=0 ", expected: Mix{"token": 1, "invalid": 0}},
+		{input: "token", expectedError: true},
+		{input: "token=-1", expectedError: true},
+		{input: "email=1", expectedError: true},
+		{input: "token=0", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		mix, err := parseMix(tt.input)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("parseMix(%q) error = %v, want error %v", tt.input, err, tt.expectedError)
+			continue
+		}
+		if len(mix) != len(tt.expected) {
+			t.Errorf("parseMix(%q) = %v, want %v", tt.input, mix, tt.expected)
+		}
+		for kind, n := range tt.expected {
+			if mix[kind] != n {
+				t.Errorf("parseMix(%q)[%s] = %d, want %d", tt.input, kind, mix[kind], n)
+			}
+		}
+	}
+}
+
+func TestGenerator_Run(t *testing.T) {
+	// 受信したペイロードを検証し、ハンドラと同じ形式の応答を返す
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, err := handlers.DecodePushRequest(r)
+		if err != nil {
+			t.Errorf("decoding %s: %v", r.URL.Path, err)
+		}
+		kind, err := handlers.ValidatePayload(msg.Data)
+		switch {
+		case err != nil:
+			w.WriteHeader(http.StatusNoContent)
+		case kind == "batch":
+			w.Write([]byte(`{"sent":2,"invalid":0,"failed":1,"republished":0}`))
+		case kind == "topic":
+			http.Error(w, "Failed to send notification", http.StatusInternalServerError)
+		default:
+			time.Sleep(5 * time.Millisecond)
+			w.Write([]byte(`{"status":"processed","message_id":"projects/p/messages/1"}`))
+		}
+	}))
+	defer service.Close()
+
+	gen := &Generator{
+		BaseURL:     service.URL,
+		Client:      service.Client(),
+		RPS:         200,
+		Duration:    300 * time.Millisecond,
+		Concurrency: 10,
+		Mix:         Mix{"token": 2, "topic": 1, "batch": 1, "invalid": 1},
+		BatchSize:   3,
+		DataSize:    10,
+		Tokens:      5,
+	}
+	report := gen.Run(context.Background())
+
+	if report.Requests < 20 || report.Requests > 70 {
+		t.Errorf("sent %d requests in 300ms at 200/s", report.Requests)
+	}
+	for _, kind := range []string{"token", "topic", "batch", "invalid"} {
+		if report.ByKind[kind].Requests == 0 {
+			t.Errorf("no %s requests were sent: %+v", kind, report.ByKind)
+		}
+	}
+	if got := report.Outcomes["sent"] + report.Outcomes["nacked"] + report.Outcomes["acked"] + report.Outcomes["batch"]; got != report.Requests {
+		t.Errorf("outcomes %v do not add up to %d requests", report.Outcomes, report.Requests)
+	}
+	if report.Outcomes["acked"] != report.ByKind["invalid"].Requests {
+		t.Errorf("invalid payloads should be acked: %v", report.Outcomes)
+	}
+	if report.Outcomes["nacked"] != report.ByKind["topic"].Requests || report.Succeeded != report.Requests-report.Outcomes["nacked"] {
+		t.Errorf("succeeded %d, outcomes %v", report.Succeeded, report.Outcomes)
+	}
+	if report.Batch.Sent != 2*report.Outcomes["batch"] || report.Batch.Failed != report.Outcomes["batch"] {
+		t.Errorf("batch counts %+v for %d batches", report.Batch, report.Outcomes["batch"])
+	}
+	if expected := report.Outcomes["sent"] + report.Batch.Sent; report.Notifications != expected {
+		t.Errorf("notifications: got %d want %d", report.Notifications, expected)
+	}
+	if l := report.ByKind["token"]; l.P50 < 5 || l.P50 > l.P99 || l.P99 > l.Max {
+		t.Errorf("token latency: %+v", l)
+	}
+
+	var out bytes.Buffer
+	printReport(&out, report)
+	for _, want := range []string{"throughput", "p99", "nacked", "batch notifications"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("encoding report: %v", err)
+	}
+}
+
+func TestGenerator_Dropped(t *testing.T) {
+	block := make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer service.Close()
+	defer close(block)
+
+	gen := &Generator{
+		BaseURL:     service.URL,
+		Client:      service.Client(),
+		RPS:         200,
+		Duration:    100 * time.Millisecond,
+		Concurrency: 2,
+		Mix:         Mix{"token": 1},
+		BatchSize:   1,
+	}
+	done := make(chan Report)
+	go func() { done <- gen.Run(context.Background()) }()
+
+	time.Sleep(150 * time.Millisecond)
+	block <- struct{}{}
+	block <- struct{}{}
+	report := <-done
+
+	if report.Requests != 2 || report.Dropped == 0 {
+		t.Errorf("with 2 slots and a stuck service: requests %d, dropped %d", report.Requests, report.Dropped)
+	}
+}
+
+func TestLatencyOf(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(100-i) * time.Millisecond
+	}
+
+	l := latencyOf(latencies)
+	if l.Requests != 100 || l.P50 != 50 || l.P90 != 90 || l.P99 != 99 || l.Max != 100 {
+		t.Errorf("latencyOf() = %+v", l)
+	}
+	if l := latencyOf(nil); l != (Latency{}) {
+		t.Errorf("latencyOf(nil) = %+v", l)
+	}
+}
@@ -0,0 +1,256 @@
+// loadgen は /publish/* に一定のレートでPushリクエストを送り、スループット、応答時間の分布、処理結果の内訳を報告します。
+//
+//	go run ./cmd/loadgen -rps 500 -duration 1m -mix token=8,topic=1,batch=1 -fcm-latency 50ms
+//
+// -target を指定しなければ、偽のFCM (internal/fakefcm) に送るサービスを同じプロセスで起動し、
+// 偽のFCMの応答に遅延とエラーを注入します。-target を指定した場合は起動中のサービスに送ります。
+// 同時に処理中にできるリクエスト数 (-concurrency) を超えた分は送らずに dropped として数えるので、
+// dropped が増え始めるレートがそのサービスの処理能力の上限の目安です。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/internal/app"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// defaultProjectID は設定でプロジェクトIDを指定しなかった場合の偽のFCMのプロジェクトIDです。
+const defaultProjectID = "loadgen"
+
+func main() {
+	target := flag.String("target", "", "base URL of a running service; empty starts the service in-process with a fake FCM")
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file for the in-process service")
+	rps := flag.Float64("rps", 100, "requests per second")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send requests")
+	concurrency := flag.Int("concurrency", 256, "maximum in-flight requests; requests over the limit are dropped")
+	mixFlag := flag.String("mix", "token=8,topic=1,batch=1", "weights of request kinds: token, topic, batch and invalid")
+	batchSize := flag.Int("batch-size", 10, "notifications per batch request")
+	dataSize := flag.Int("data-size", 0, "bytes of custom_data added to each notification")
+	tokens := flag.Int("tokens", 1000, "number of distinct device tokens")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of each request")
+	fcmLatency := flag.Duration("fcm-latency", 50*time.Millisecond, "latency of the fake FCM")
+	fcmJitter := flag.Duration("fcm-jitter", 0, "random latency of the fake FCM added to -fcm-latency")
+	fcmErrorRate := flag.Float64("fcm-error-rate", 0, "fraction (0 to 1) of messages the fake FCM fails")
+	fcmError := flag.String("fcm-error", "INTERNAL", "FCM error code of injected failures (e.g. INTERNAL, QUOTA_EXCEEDED, UNREGISTERED)")
+	jsonOutput := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		fatal("Invalid flags", fmt.Errorf("-mix: %w", err))
+	}
+	failure, ok := fakefcm.FailureFor(*fcmError)
+	if !ok {
+		fatal("Invalid flags", fmt.Errorf("-fcm-error: unknown error code %q", *fcmError))
+	}
+	if *rps <= 0 || *duration <= 0 || *concurrency <= 0 || *batchSize <= 0 || *fcmErrorRate < 0 || *fcmErrorRate > 1 {
+		fatal("Invalid flags", errors.New("require positive -rps, -duration, -concurrency and -batch-size, and -fcm-error-rate between 0 and 1"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	gen := &Generator{
+		BaseURL:     *target,
+		Client:      &http.Client{Timeout: *timeout, Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}},
+		RPS:         *rps,
+		Duration:    *duration,
+		Concurrency: *concurrency,
+		Mix:         mix,
+		BatchSize:   *batchSize,
+		DataSize:    *dataSize,
+		Tokens:      *tokens,
+	}
+
+	var fake *fakefcm.Server
+	if *target == "" {
+		fake = fakefcm.NewServer().WithLatency(*fcmLatency, *fcmJitter).WithErrorRate(*fcmErrorRate, failure)
+		baseURL, stopService, err := startService(*configPath, fake)
+		if err != nil {
+			fatal("Failed to start the service", err)
+		}
+		defer stopService()
+		gen.BaseURL = baseURL
+	} else {
+		setupLogging(slog.LevelInfo, "text")
+	}
+
+	slog.Info("sending load", "target", gen.BaseURL, "rps", *rps, "duration", duration.String(), "mix", *mixFlag)
+	report := gen.Run(ctx)
+	if fake != nil {
+		stats := fake.Stats()
+		report.FakeFCM = &stats
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	printReport(os.Stdout, report)
+}
+
+// startService は fake に送るサービスを同じプロセスで起動し、そのURLと停止する関数を返します。
+// 負荷試験が外部に影響しないよう、配信イベントの送出、バッチの再送、Pub/Subのpull、リクエストの記録は無効にします。
+func startService(configPath string, fake *fakefcm.Server) (string, func(), error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
+	// 1リクエストごとのログが結果に影響しないよう、指定がなければエラーだけ出力する
+	logLevel := slog.LevelError
+	if os.Getenv("LOG_LEVEL") != "" {
+		_ = logLevel.UnmarshalText([]byte(cfg.Logging.Level)) // config.Load で検証済み
+	}
+	format := cfg.Logging.Format
+	if os.Getenv("LOG_FORMAT") == "" {
+		format = "text"
+	}
+	setupLogging(logLevel, format)
+
+	stateDir, err := os.MkdirTemp("", "fcm-loadgen-")
+	if err != nil {
+		return "", nil, err
+	}
+	cfg.Events = config.Events{}
+	cfg.Capture = config.Capture{}
+	cfg.Chaos = config.Chaos{} // 障害は -fcm-error-rate で偽のFCMに起こす
+	cfg.Batch.RetryTopic = ""
+	cfg.Pull.DeviceSubscription, cfg.Pull.TopicSubscription, cfg.Pull.BatchSubscription = "", "", ""
+	cfg.Storage.ScheduleStorePath = filepath.Join(stateDir, "schedules.json")
+	cfg.Storage.PreferenceStorePath = filepath.Join(stateDir, "preferences.json")
+	if cfg.FCM.ProjectID == "" {
+		cfg.FCM.ProjectID = defaultProjectID
+	}
+
+	fcmListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	fcmServer := &http.Server{Handler: fake, ReadHeaderTimeout: 10 * time.Second}
+	go fcmServer.Serve(fcmListener)
+	cfg.FCM.Endpoint = fmt.Sprintf("http://%s/v1", fcmListener.Addr())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	baseURL := "http://" + listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx, cfg, app.Options{Listener: listener}) }()
+
+	stopService := func() {
+		cancel()
+		if err := <-done; err != nil {
+			slog.Error("service stopped with an error", "error", err)
+		}
+		fcmServer.Close()
+		os.RemoveAll(stateDir)
+	}
+	if err := waitReady(baseURL, done); err != nil {
+		fcmServer.Close()
+		os.RemoveAll(stateDir)
+		return "", nil, err
+	}
+	return baseURL, stopService, nil
+}
+
+// waitReady はサービスがリクエストを受け付けられるようになるまで待ちます。
+func waitReady(baseURL string, done <-chan error) error {
+	deadline := time.After(30 * time.Second)
+	for {
+		if resp, err := http.Get(baseURL + "/health/live"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case err := <-done:
+			return errors.Join(errors.New("service exited"), err)
+		case <-deadline:
+			return errors.New("service did not become ready in 30s")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// printReport は結果を表にして w に出力します。
+func printReport(w io.Writer, r Report) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "target\t%s\n", r.Target)
+	fmt.Fprintf(tw, "duration\t%s\n", r.Duration)
+	fmt.Fprintf(tw, "requests\t%d sent, %d dropped, %d succeeded (target %.0f/s)\n", r.Requests, r.Dropped, r.Succeeded, r.RPS)
+	fmt.Fprintf(tw, "throughput\t%.1f requests/s, %.1f notifications/s\n", r.Throughput, r.NotificationsThroughput)
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "latency (ms)\trequests\tp50\tp90\tp95\tp99\tmax")
+	printLatency := func(name string, l Latency) {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n", name, l.Requests, l.P50, l.P90, l.P95, l.P99, l.Max)
+	}
+	printLatency("all", r.Latency)
+	for _, kind := range sortedKeys(r.ByKind) {
+		printLatency(kind, r.ByKind[kind])
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "outcome\trequests")
+	for _, outcome := range sortedKeys(r.Outcomes) {
+		fmt.Fprintf(tw, "%s\t%d\n", outcome, r.Outcomes[outcome])
+	}
+	if r.Batch != (BatchCount{}) {
+		fmt.Fprintf(tw, "batch notifications\tsent=%d invalid=%d failed=%d republished=%d\n", r.Batch.Sent, r.Batch.Invalid, r.Batch.Failed, r.Batch.Republished)
+	}
+
+	if r.FakeFCM != nil {
+		fmt.Fprintln(tw)
+		fmt.Fprintf(tw, "fake FCM\t%d messages received\n", r.FakeFCM.Received)
+		for _, code := range sortedKeys(r.FakeFCM.Failed) {
+			fmt.Fprintf(tw, "%s\t%d\n", code, r.FakeFCM.Failed[code])
+		}
+	}
+	tw.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func setupLogging(level slog.Level, format string) {
+	if _, err := logging.Setup(os.Stderr, logging.Options{Level: level, Format: format, ProjectID: defaultProjectID}); err != nil {
+		fatal("Failed to initialize logging", err)
+	}
+}
+
+// fatal はエラーをログに出力してプロセスを終了します。
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,199 @@
+// replay は CAPTURE_FILE_PATH で記録したPushリクエストを、偽のFCMまたはドライランのFCMを使うサービスに送り直し、
+// リクエストごとに元の処理結果との違いを報告します。
+//
+//	go run ./cmd/replay -rate 20 captured.jsonl > report.jsonl
+//
+// サービスは同じプロセスで起動します。設定はサービスと同じく読み込みますが、再実行が外部に影響しないよう、
+// 配信イベントの送出、バッチの再送、Pub/Subのpull、リクエストの記録、障害の注入は無効にし、予約は一時ディレクトリに保存します。
+// -fcm dry-run では秘匿化したトークン宛てのリクエストは送らずに skipped として報告します。
+// 報告は1行1件のJSONで標準出力に出力し、元の結果と異なるリクエストがあれば終了コード 1 で終了します。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/capture"
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/internal/app"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// defaultProjectID は偽のFCMに送るときに設定でプロジェクトIDを指定しなかった場合のプロジェクトIDです。
+const defaultProjectID = "replay"
+
+func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	fcmMode := flag.String("fcm", "fake", "FCM to send to: fake (in-process fake FCM) or dry-run (real FCM with validate_only)")
+	rate := flag.Float64("rate", 10, "requests per second; 0 sends as fast as possible")
+	onlyDiffs := flag.Bool("only-diffs", false, "report only requests whose outcome differs from the original run")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: replay [flags] [FILE]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *fcmMode != "fake" && *fcmMode != "dry-run" {
+		fatal("Invalid flags", fmt.Errorf("-fcm must be fake or dry-run, got %q", *fcmMode))
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if os.Getenv("LOG_FORMAT") == "" {
+		cfg.Logging.Format = "text"
+	}
+	var logLevel slog.Level
+	_ = logLevel.UnmarshalText([]byte(cfg.Logging.Level)) // config.Load で検証済み
+	if _, err := logging.Setup(os.Stderr, logging.Options{Level: logLevel, Format: cfg.Logging.Format, ProjectID: cfg.FCM.ProjectID}); err != nil {
+		fatal("Failed to initialize logging", err)
+	}
+
+	var records []capture.Record
+	if name := flag.Arg(0); name != "" && name != "-" {
+		records, err = capture.ReadFile(name)
+	} else {
+		records, err = capture.Read(os.Stdin)
+	}
+	if err != nil {
+		fatal("Failed to read captured requests", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	stateDir, err := os.MkdirTemp("", "fcm-replay-")
+	if err != nil {
+		fatal("Failed to create a state directory", err)
+	}
+	isolate(&cfg, stateDir)
+	os.Exit(replay(ctx, cfg, records, *fcmMode, *rate, *onlyDiffs, stateDir))
+}
+
+// replay はサービスを起動して records を再実行し、終了コードを返します。
+func replay(ctx context.Context, cfg config.Config, records []capture.Record, fcmMode string, rate float64, onlyDiffs bool, stateDir string) int {
+	defer os.RemoveAll(stateDir)
+
+	switch fcmMode {
+	case "fake":
+		fcmListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			slog.Error("Failed to listen", "error", err)
+			return 1
+		}
+		fake := &http.Server{Handler: fakefcm.NewServer(), ReadHeaderTimeout: 10 * time.Second}
+		go fake.Serve(fcmListener)
+		defer fake.Close()
+		cfg.FCM.Endpoint = fmt.Sprintf("http://%s/v1", fcmListener.Addr())
+		if cfg.FCM.ProjectID == "" {
+			cfg.FCM.ProjectID = defaultProjectID
+		}
+	case "dry-run":
+		cfg.FCM.Endpoint = ""
+		cfg.FCM.DryRun = true
+	}
+
+	// サービスを起動する
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		slog.Error("Failed to listen", "error", err)
+		return 1
+	}
+	baseURL := "http://" + listener.Addr().String()
+	serviceCtx, stopService := context.WithCancel(context.Background())
+	serviceDone := make(chan error, 1)
+	go func() { serviceDone <- app.Run(serviceCtx, cfg, app.Options{Listener: listener}) }()
+
+	defer stopService()
+	if err := waitReady(ctx, baseURL, serviceDone); err != nil {
+		slog.Error("Service did not start", "error", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	replayer := &Replayer{baseURL: baseURL, client: &http.Client{Timeout: 2 * cfg.FCM.SendTimeout}, rate: rate}
+	if fcmMode == "dry-run" {
+		// 秘匿化したトークンは本物のFCMでは INVALID_ARGUMENT になり、元の結果と比較できない
+		replayer.skip = func(rec capture.Record) string {
+			if capture.HasRedactedToken([]byte(rec.Body)) {
+				return "redacted token cannot be sent to FCM"
+			}
+			return ""
+		}
+	}
+	summary, err := replayer.Replay(ctx, records, func(res Result) error {
+		if onlyDiffs && (res.Match || res.Skipped != "") {
+			return nil
+		}
+		return enc.Encode(res)
+	})
+
+	stopService()
+	if serviceErr := <-serviceDone; serviceErr != nil {
+		slog.Error("service stopped with an error", "error", serviceErr)
+	}
+
+	slog.Info("replay finished", "fcm", fcmMode, "total", summary.Total, "matched", summary.Matched, "differ", summary.Differ,
+		"skipped", summary.Skipped)
+	if err != nil {
+		slog.Error("Replay failed", "error", err)
+		return 1
+	}
+	if summary.Differ > 0 {
+		return 1
+	}
+	return 0
+}
+
+// isolate は再実行が本番の外部システムや状態に影響しないよう cfg を変更します。
+func isolate(cfg *config.Config, stateDir string) {
+	cfg.Events = config.Events{}
+	cfg.Capture = config.Capture{}
+	cfg.Chaos = config.Chaos{}
+	cfg.Batch.RetryTopic = ""
+	cfg.Pull.DeviceSubscription, cfg.Pull.TopicSubscription, cfg.Pull.BatchSubscription = "", "", ""
+	cfg.Storage.ScheduleStorePath = filepath.Join(stateDir, "schedules.json")
+	cfg.Storage.PreferenceStorePath = filepath.Join(stateDir, "preferences.json")
+}
+
+// waitReady はサービスがリクエストを受け付けられるようになるまで待ちます。
+func waitReady(ctx context.Context, baseURL string, serviceDone <-chan error) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	for {
+		if resp, err := http.Get(baseURL + "/health/live"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case err := <-serviceDone:
+			return errors.Join(errors.New("service exited"), err)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// fatal はエラーをログに出力してプロセスを終了します。
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/capture"
+)
+
+// Result は1件のリクエストを再実行した結果です。
+type Result struct {
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Original  Run    `json:"original"`
+	Replay    Run    `json:"replay"`
+	Match     bool   `json:"match"`             // 元の実行と処理結果 (Outcome) が同じか
+	Skipped   string `json:"skipped,omitempty"` // 再実行しなかった場合の理由
+}
+
+// Run は1回の実行の応答です。
+type Run struct {
+	Status   int    `json:"status"`
+	Outcome  string `json:"outcome"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"` // リクエストを送れなかった場合のエラー
+}
+
+// Summary は再実行全体の集計です。
+type Summary struct {
+	Total   int `json:"total"`
+	Matched int `json:"matched"`
+	Differ  int `json:"differ"`
+	Skipped int `json:"skipped"`
+}
+
+// Replayer は記録したリクエストを起動中のサービスに送り直します。
+type Replayer struct {
+	baseURL string
+	client  *http.Client
+	rate    float64 // 1秒あたりのリクエスト数。0 以下なら待たずに送る
+	// skip が空でない理由を返した記録は送らずに、その理由を付けて報告する。nil ならすべて送る
+	skip func(capture.Record) string
+}
+
+// Replay は records を記録順に rate の間隔で送り、1件ごとに report を呼び出します。
+// ctx がキャンセルされた場合は、それまでの集計とエラーを返します。
+func (r *Replayer) Replay(ctx context.Context, records []capture.Record, report func(Result) error) (Summary, error) {
+	var interval time.Duration
+	if r.rate > 0 {
+		interval = time.Duration(float64(time.Second) / r.rate)
+	}
+
+	var summary Summary
+	next := time.Now()
+	for _, rec := range records {
+		if reason := r.skipReason(rec); reason != "" {
+			summary.Total++
+			summary.Skipped++
+			res := Result{RequestID: rec.RequestID, Path: rec.Path, Original: Run{Status: rec.Status, Outcome: rec.Outcome, Response: rec.Response}, Skipped: reason}
+			if err := report(res); err != nil {
+				return summary, err
+			}
+			continue
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return summary, ctx.Err()
+		}
+		next = next.Add(interval)
+
+		res := Result{
+			RequestID: rec.RequestID,
+			Path:      rec.Path,
+			Original:  Run{Status: rec.Status, Outcome: rec.Outcome, Response: rec.Response},
+			Replay:    r.send(ctx, rec),
+		}
+		res.Match = res.Replay.Error == "" && res.Replay.Outcome == res.Original.Outcome
+
+		summary.Total++
+		if res.Match {
+			summary.Matched++
+		} else {
+			summary.Differ++
+		}
+		if err := report(res); err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
+
+func (r *Replayer) skipReason(rec capture.Record) string {
+	if r.skip == nil {
+		return ""
+	}
+	return r.skip(rec)
+}
+
+// send は記録したリクエストを1件送り、応答を返します。
+func (r *Replayer) send(ctx context.Context, rec capture.Record) Run {
+	method := rec.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(r.baseURL, "/")+rec.Path, bytes.NewReader([]byte(rec.Body)))
+	if err != nil {
+		return Run{Error: err.Error()}
+	}
+	for name, value := range rec.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return Run{Error: fmt.Sprintf("sending request: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return Run{
+		Status:   resp.StatusCode,
+		Outcome:  capture.Outcome(resp.StatusCode, body),
+		Response: strings.TrimSpace(string(body)),
+	}
+}
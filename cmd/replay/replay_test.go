@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/capture"
+)
+
+func TestReplayer_Replay(t *testing.T) {
+	type request struct {
+		path, contentType, body string
+	}
+	var received []request
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, request{r.URL.Path, r.Header.Get("Content-Type"), string(body)})
+		switch r.URL.Path {
+		case "/publish/token":
+			w.Write([]byte(`{"status":"processed","message_id":"projects/p/messages/2"}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer service.Close()
+
+	records := []capture.Record{
+		{RequestID: "a", Method: http.MethodPost, Path: "/publish/token", Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"n":1}`, Status: http.StatusOK, Outcome: "sent"},
+		{RequestID: "b", Method: http.MethodPost, Path: "/publish/topic", Body: `{"n":2}`, Status: http.StatusInternalServerError, Outcome: "nacked"},
+		{RequestID: "c", Path: "/publish/topic", Body: `{"n":3}`, Status: http.StatusNoContent, Outcome: "acked"},
+	}
+
+	replayer := &Replayer{baseURL: service.URL, client: service.Client(), rate: 50}
+	var results []Result
+	start := time.Now()
+	summary, err := replayer.Replay(context.Background(), records, func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 requests at 50/s took %v, want at least 40ms", elapsed)
+	}
+	if summary != (Summary{Total: 3, Matched: 2, Differ: 1}) {
+		t.Errorf("summary: got %+v", summary)
+	}
+	if len(received) != 3 || received[0] != (request{"/publish/token", "application/json", `{"n":1}`}) || received[2].body != `{"n":3}` {
+		t.Errorf("received: got %+v", received)
+	}
+
+	expected := []struct {
+		id      string
+		outcome string
+		match   bool
+	}{
+		{"a", "sent", true},
+		{"b", "acked", false},
+		{"c", "acked", true},
+	}
+	for i, e := range expected {
+		res := results[i]
+		if res.RequestID != e.id || res.Replay.Outcome != e.outcome || res.Match != e.match {
+			t.Errorf("result %d: got %+v", i, res)
+		}
+	}
+	if results[1].Original.Status != http.StatusInternalServerError || results[1].Replay.Status != http.StatusNoContent {
+		t.Errorf("statuses: got %+v", results[1])
+	}
+}
+
+func TestReplayer_ServiceUnavailable(t *testing.T) {
+	replayer := &Replayer{baseURL: "http://127.0.0.1:1", client: http.DefaultClient}
+	var result Result
+	summary, err := replayer.Replay(context.Background(), []capture.Record{{RequestID: "a", Path: "/publish/token", Outcome: "sent"}}, func(res Result) error {
+		result = res
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if summary.Differ != 1 || result.Match || result.Replay.Error == "" {
+		t.Errorf("a request that could not be sent should be reported as a difference: %+v", result)
+	}
+}
+
+func TestReplayer_Skip(t *testing.T) {
+	var received int
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer service.Close()
+
+	records := []capture.Record{
+		{RequestID: "a", Path: "/publish/token", Body: `{"token":"redacted:0123456789abcdef"}`, Status: http.StatusOK, Outcome: "sent"},
+		{RequestID: "b", Path: "/publish/topic", Body: `{"topic":"news"}`, Status: http.StatusNoContent, Outcome: "acked"},
+	}
+
+	replayer := &Replayer{baseURL: service.URL, client: service.Client(), skip: func(rec capture.Record) string {
+		if capture.HasRedactedToken([]byte(rec.Body)) {
+			return "redacted token"
+		}
+		return ""
+	}}
+	var results []Result
+	summary, err := replayer.Replay(context.Background(), records, func(res Result) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if summary != (Summary{Total: 2, Matched: 1, Skipped: 1}) {
+		t.Errorf("summary: got %+v", summary)
+	}
+	if received != 1 {
+		t.Errorf("service received %d requests, want 1", received)
+	}
+	if len(results) != 2 || results[0].Skipped != "redacted token" || results[0].Match || results[0].Replay != (Run{}) || results[1].Skipped != "" {
+		t.Errorf("results: got %+v", results)
+	}
+}
@@ -0,0 +1,530 @@
+// Package config はサービスの設定を環境変数と (任意の) YAMLファイルから読み込み、検証します。
+//
+// 設定値はデフォルト値、YAMLファイル、環境変数の順に上書きされます。
+// 各フィールドの yaml タグがYAMLのキー、env タグが環境変数名です。secret タグの付いたフィールドはログに出力されません。
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/teamzidi/example-go-fcm/chaos"
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/frequencycap"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+)
+
+// Config はサービス全体の設定です。
+type Config struct {
+	Server   Server   `yaml:"server"`
+	FCM      FCM      `yaml:"fcm"`
+	Retry    Retry    `yaml:"retry"`
+	Limits   Limits   `yaml:"limits"`
+	Delivery Delivery `yaml:"delivery"`
+	Storage  Storage  `yaml:"storage"`
+	Auth     Auth     `yaml:"auth"`
+	Events   Events   `yaml:"events"`
+	Capture  Capture  `yaml:"capture"`
+	Chaos    Chaos    `yaml:"chaos"`
+	Pull     Pull     `yaml:"pull"`
+	Batch    Batch    `yaml:"batch"`
+	Health   Health   `yaml:"health"`
+	Logging  Logging  `yaml:"logging"`
+}
+
+// Server はHTTPサーバーの設定です。タイムアウトの 0 は無制限を表します。
+type Server struct {
+	Port              int           `yaml:"port" env:"PORT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // SIGTERM を受けてから終了するまでの上限。Cloud Runの猶予 (10秒) より短くする
+	DrainTimeout      time.Duration `yaml:"drain_timeout" env:"DRAIN_TIMEOUT"`       // ShutdownTimeout のうち処理中のリクエストを待つ時間。残りはイベントの送出などに使う
+}
+
+// FCM はFCMクライアントの設定です。
+type FCM struct {
+	ProjectID       string `yaml:"project_id" env:"GOOGLE_CLOUD_PROJECT"`
+	CredentialsFile string `yaml:"credentials_file" env:"GOOGLE_APPLICATION_CREDENTIALS"` // 空ならApplication Default Credentials
+	DryRun          bool   `yaml:"dry_run" env:"FCM_DRY_RUN"`                             // true ならFCMはメッセージを検証するだけで配信しない
+	// Endpoint はFCM APIのベースURLです (例: "http://localhost:9099/v1")。ローカルの偽のFCMに送信する場合に設定し、
+	// 設定した場合は認証情報を使いません。空なら本物のFCMに送信します。
+	Endpoint string `yaml:"endpoint" env:"FCM_ENDPOINT"`
+	// SendTimeout は1回の送信を待つ時間です。Pushサブスクリプションの確認応答期限より短くします。
+	SendTimeout time.Duration `yaml:"send_timeout" env:"FCM_SEND_TIMEOUT"`
+	// Tenants はテナント名からそのFirebaseプロジェクトのサービスアカウントキーのパスへのマップです。
+	// 環境変数では "app-a=/secrets/a.json,app-b=/secrets/b.json" の形式で指定します。
+	// テナントを指定しないメッセージは上記の設定 (テナント名 "default") で送信します。
+	Tenants map[string]string `yaml:"tenants" env:"FCM_TENANTS"`
+	// BreakerFailures はテナントごとのサーキットブレーカーが開くまでの、FCMへの送信の一時的な失敗の連続回数です。0 なら無効です。
+	BreakerFailures int `yaml:"breaker_failures" env:"FCM_BREAKER_FAILURES"`
+	// BreakerCooldown はサーキットブレーカーが開いてから、試しに送信を再開するまでの時間です。
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown" env:"FCM_BREAKER_COOLDOWN"`
+}
+
+// Retry は再試行の設定です。
+type Retry struct {
+	ScheduleBaseDelay time.Duration `yaml:"schedule_base_delay" env:"SCHEDULE_RETRY_BASE_DELAY"` // 予約送信の再送までの最初の待ち時間
+	ScheduleMaxDelay  time.Duration `yaml:"schedule_max_delay" env:"SCHEDULE_RETRY_MAX_DELAY"`
+	// ScheduleMaxAttempts は1件の予約を送信する回数の上限です。上限に達した予約は失敗として残ります。
+	ScheduleMaxAttempts int           `yaml:"schedule_max_attempts" env:"SCHEDULE_MAX_ATTEMPTS"`
+	WebhookMaxAttempts  int           `yaml:"webhook_max_attempts" env:"EVENT_WEBHOOK_MAX_ATTEMPTS"`
+	WebhookBaseDelay    time.Duration `yaml:"webhook_base_delay" env:"EVENT_WEBHOOK_RETRY_DELAY"`
+}
+
+// Limits はリクエストサイズや送信数の上限の設定です。
+type Limits struct {
+	NotificationsMaxRequestBytes int64  `yaml:"notifications_max_request_bytes" env:"NOTIFICATIONS_MAX_REQUEST_BYTES"`
+	FrequencyCap                 string `yaml:"frequency_cap" env:"FREQUENCY_CAP"`                       // 例: "10/24h"
+	FrequencyCapCategories       string `yaml:"frequency_cap_categories" env:"FREQUENCY_CAP_CATEGORIES"` // 例: "marketing=3/24h,reminder=5/1h"
+	FrequencyCapPolicy           string `yaml:"frequency_cap_policy" env:"FREQUENCY_CAP_POLICY"`         // drop または defer
+	TenantSendRate               int    `yaml:"tenant_send_rate" env:"TENANT_SEND_RATE"`                 // テナントごとの1秒あたりのFCMへの送信数の上限。0 なら制限しない
+	TenantSendBurst              int    `yaml:"tenant_send_burst" env:"TENANT_SEND_BURST"`               // 瞬間的に送信できる数。0 なら TenantSendRate と同じ
+}
+
+// Delivery は配信制御の設定です。
+type Delivery struct {
+	QuietHours                string   `yaml:"quiet_hours" env:"QUIET_HOURS"` // 例: "22:00-08:00"
+	QuietHoursDefaultTimeZone string   `yaml:"quiet_hours_default_time_zone" env:"QUIET_HOURS_DEFAULT_TZ"`
+	PreferenceOptInCategories []string `yaml:"preference_opt_in_categories" env:"PREFERENCE_OPT_IN_CATEGORIES"`
+}
+
+// Storage は永続化するファイルの設定です。
+type Storage struct {
+	// ScheduleStorePath は予約を保存するJSONファイルです。予約・送信のたびにファイル全体を書き直すため、件数に比例して遅くなります。
+	ScheduleStorePath   string `yaml:"schedule_store_path" env:"SCHEDULE_STORE_PATH"`
+	PreferenceStorePath string `yaml:"preference_store_path" env:"PREFERENCE_STORE_PATH"`
+}
+
+// Auth は /v1/notifications の認証の設定です。
+type Auth struct {
+	APIKeys              []string `yaml:"api_keys" env:"API_KEYS" secret:"true"`
+	IDTokenAudience      string   `yaml:"id_token_audience" env:"API_ID_TOKEN_AUDIENCE"`
+	IDTokenAllowedEmails []string `yaml:"id_token_allowed_emails" env:"API_ID_TOKEN_ALLOWED_EMAILS"`
+}
+
+// Events は配信イベントの送出先の設定です。
+type Events struct {
+	PubSubTopic   string   `yaml:"pubsub_topic" env:"EVENT_PUBSUB_TOPIC"`
+	WebhookURLs   []string `yaml:"webhook_urls" env:"EVENT_WEBHOOK_URLS"`
+	WebhookSecret string   `yaml:"webhook_secret" env:"EVENT_WEBHOOK_SECRET" secret:"true"`
+	FilePath      string   `yaml:"file_path" env:"EVENT_FILE_PATH"`
+}
+
+// Capture は受信したPushリクエストの記録の設定です。記録したリクエストは cmd/replay で再実行できます。
+type Capture struct {
+	// FilePath が空でなければ、Pushエンドポイントとpullで受信したリクエストと応答を秘匿化してJSONLで追記する
+	FilePath string `yaml:"file_path" env:"CAPTURE_FILE_PATH"`
+}
+
+// Chaos はFCMへの送信に障害を注入するカオスモードの設定です。本番環境では有効にしません。
+type Chaos struct {
+	// Enabled が true なら起動時から以下の設定で障害を注入する
+	Enabled bool `yaml:"enabled" env:"CHAOS_ENABLED"`
+	// AdminEnabled が true なら /admin/chaos で実行中に障害の注入を切り替えられる
+	AdminEnabled bool `yaml:"admin_enabled" env:"CHAOS_ADMIN_ENABLED"`
+	// Faults は障害 (FCMのエラーコードまたは TIMEOUT) ごとの割合です。環境変数では "UNAVAILABLE=0.1,TIMEOUT=0.01" の形式で指定します。
+	Faults  map[string]string `yaml:"faults" env:"CHAOS_FAULTS"`
+	Latency time.Duration     `yaml:"latency" env:"CHAOS_LATENCY"` // 対象の送信に加える遅延
+	// Topics と Tokens は障害を注入する送信先です。どちらも空ならすべての送信が対象です。
+	Topics []string `yaml:"topics" env:"CHAOS_TOPICS"`
+	Tokens []string `yaml:"tokens" env:"CHAOS_TOKENS" secret:"true"`
+}
+
+// Pull はPub/Subのストリーミングpullで通知を受信する設定です。サブスクリプションを指定したハンドラだけpullで動きます。
+// Pushエンドポイントは引き続き公開されます。
+type Pull struct {
+	DeviceSubscription     string        `yaml:"device_subscription" env:"PULL_DEVICE_SUBSCRIPTION"` // デバイス宛ての通知のサブスクリプションID
+	TopicSubscription      string        `yaml:"topic_subscription" env:"PULL_TOPIC_SUBSCRIPTION"`   // トピック宛ての通知のサブスクリプションID
+	BatchSubscription      string        `yaml:"batch_subscription" env:"PULL_BATCH_SUBSCRIPTION"`   // 通知のバッチのサブスクリプションID
+	Concurrency            int           `yaml:"concurrency" env:"PULL_CONCURRENCY"`                 // サブスクリプションごとに同時に処理するメッセージ数
+	MaxOutstandingMessages int           `yaml:"max_outstanding_messages" env:"PULL_MAX_OUTSTANDING_MESSAGES"`
+	MaxOutstandingBytes    int           `yaml:"max_outstanding_bytes" env:"PULL_MAX_OUTSTANDING_BYTES"`
+	MaxExtension           time.Duration `yaml:"max_extension" env:"PULL_MAX_EXTENSION"`               // ack期限を延長し続ける時間の上限
+	MaxExtensionPeriod     time.Duration `yaml:"max_extension_period" env:"PULL_MAX_EXTENSION_PERIOD"` // 1回の延長で延ばすack期限の上限
+}
+
+// Enabled はpullで受信するサブスクリプションが1つ以上設定されていれば true を返します。
+func (p Pull) Enabled() bool {
+	return p.DeviceSubscription != "" || p.TopicSubscription != "" || p.BatchSubscription != ""
+}
+
+// Batch は通知のバッチ (/publish/batch) の設定です。
+type Batch struct {
+	RetryTopic  string `yaml:"retry_topic" env:"BATCH_RETRY_TOPIC"`   // 再送すべき通知を publish し直すトピックID。空なら再送しない
+	MaxAttempts int    `yaml:"max_attempts" env:"BATCH_MAX_ATTEMPTS"` // 1件の通知を送信する試行回数の上限
+}
+
+// Health はヘルスチェックの設定です。
+type Health struct {
+	ReadinessCacheTTL time.Duration `yaml:"readiness_cache_ttl" env:"READINESS_CACHE_TTL"`
+}
+
+// Logging はログの設定です。
+type Logging struct {
+	Level        string `yaml:"level" env:"LOG_LEVEL"`
+	Format       string `yaml:"format" env:"LOG_FORMAT"`
+	RevealTokens bool   `yaml:"reveal_tokens" env:"LOG_REVEAL_TOKENS"`
+}
+
+// Default はデフォルトの設定を返します。
+func Default() Config {
+	return Config{
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   9 * time.Second,
+			DrainTimeout:      6 * time.Second,
+		},
+		FCM: FCM{
+			SendTimeout:     30 * time.Second,
+			BreakerCooldown: 30 * time.Second,
+		},
+		Retry: Retry{
+			ScheduleBaseDelay:   10 * time.Second,
+			ScheduleMaxDelay:    10 * time.Minute,
+			ScheduleMaxAttempts: 10,
+			WebhookMaxAttempts:  5,
+			WebhookBaseDelay:    time.Second,
+		},
+		Limits: Limits{
+			NotificationsMaxRequestBytes: 1 << 20,
+			FrequencyCapPolicy:           string(frequencycap.PolicyDrop),
+		},
+		Delivery: Delivery{
+			QuietHoursDefaultTimeZone: "UTC",
+		},
+		Storage: Storage{
+			ScheduleStorePath:   filepath.Join(os.TempDir(), "fcm-schedules.json"),
+			PreferenceStorePath: filepath.Join(os.TempDir(), "fcm-preferences.json"),
+		},
+		Pull: Pull{
+			Concurrency:            10,
+			MaxOutstandingMessages: 100,
+			MaxOutstandingBytes:    100 << 20,
+			MaxExtension:           10 * time.Minute,
+		},
+		Batch: Batch{
+			MaxAttempts: 5,
+		},
+		Health: Health{
+			ReadinessCacheTTL: 30 * time.Second,
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: "json",
+		},
+	}
+}
+
+// Load はデフォルト値に path のYAMLファイル (空なら読み込まない) と環境変数を適用し、検証した設定を返します。
+func Load(path string) (Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem(), lookupEnv); err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// applyEnv は env タグの付いたフィールドに環境変数の値を設定します。
+func applyEnv(v reflect.Value, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		fv := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(fv, lookupEnv); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		raw, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setValue(fv, strings.TrimSpace(raw)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setValue(fv reflect.Value, raw string) error {
+	switch {
+	case fv.Type() == durationType:
+		if raw == "" {
+			fv.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q (e.g. 30s, 5m)", raw)
+		}
+		fv.SetInt(int64(d))
+	case fv.Kind() == reflect.String:
+		fv.SetString(raw)
+	case fv.Kind() == reflect.Bool:
+		if raw == "" {
+			fv.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q (use true or false)", raw)
+		}
+		fv.SetBool(b)
+	case fv.Kind() == reflect.Int || fv.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		fv.SetInt(n)
+	case fv.Kind() == reflect.Map && fv.Type().Key().Kind() == reflect.String && fv.Type().Elem().Kind() == reflect.String:
+		m := make(map[string]string)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("invalid entry %q (use key=value)", item)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		fv.Set(reflect.ValueOf(m))
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		fv.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+
+	return nil
+}
+
+// Validate は設定値を検証し、問題をすべてまとめたエラーを返します。
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port (PORT)", "must be between 1 and 65535, got %d", c.Server.Port)
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout (SERVER_READ_HEADER_TIMEOUT)", "must not be negative")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout (SERVER_READ_TIMEOUT)", "must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout (SERVER_WRITE_TIMEOUT)", "must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout (SERVER_IDLE_TIMEOUT)", "must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout (SHUTDOWN_TIMEOUT)", "must be positive")
+	check(c.Server.DrainTimeout > 0 && c.Server.DrainTimeout < c.Server.ShutdownTimeout, "server.drain_timeout (DRAIN_TIMEOUT)",
+		"must be positive and less than server.shutdown_timeout (%s)", c.Server.ShutdownTimeout)
+
+	if c.FCM.CredentialsFile != "" {
+		_, err := os.Stat(c.FCM.CredentialsFile)
+		check(err == nil, "fcm.credentials_file (GOOGLE_APPLICATION_CREDENTIALS)", "%v", err)
+	}
+
+	check(c.FCM.SendTimeout > 0, "fcm.send_timeout (FCM_SEND_TIMEOUT)", "must be positive")
+	if c.Server.WriteTimeout > 0 {
+		check(c.FCM.SendTimeout < c.Server.WriteTimeout, "fcm.send_timeout (FCM_SEND_TIMEOUT)",
+			"must be less than server.write_timeout (%s) so that the response can still be written", c.Server.WriteTimeout)
+	}
+
+	for name, path := range c.FCM.Tenants {
+		check(name != "" && name != fcm.DefaultTenant, "fcm.tenants (FCM_TENANTS)", "invalid tenant name %q", name)
+		_, err := os.Stat(path)
+		check(err == nil, "fcm.tenants (FCM_TENANTS)", "tenant %q: %v", name, err)
+	}
+
+	check(c.FCM.BreakerFailures >= 0, "fcm.breaker_failures (FCM_BREAKER_FAILURES)", "must not be negative")
+	check(c.FCM.BreakerCooldown > 0, "fcm.breaker_cooldown (FCM_BREAKER_COOLDOWN)", "must be positive")
+
+	check(c.Retry.ScheduleBaseDelay > 0, "retry.schedule_base_delay (SCHEDULE_RETRY_BASE_DELAY)", "must be positive")
+	check(c.Retry.ScheduleMaxDelay >= c.Retry.ScheduleBaseDelay, "retry.schedule_max_delay (SCHEDULE_RETRY_MAX_DELAY)",
+		"must not be less than retry.schedule_base_delay (%s)", c.Retry.ScheduleBaseDelay)
+	check(c.Retry.ScheduleMaxAttempts >= 1, "retry.schedule_max_attempts (SCHEDULE_MAX_ATTEMPTS)", "must be at least 1")
+	check(c.Retry.WebhookMaxAttempts >= 1, "retry.webhook_max_attempts (EVENT_WEBHOOK_MAX_ATTEMPTS)", "must be at least 1")
+	check(c.Retry.WebhookBaseDelay >= 0, "retry.webhook_base_delay (EVENT_WEBHOOK_RETRY_DELAY)", "must not be negative")
+
+	check(c.Limits.NotificationsMaxRequestBytes > 0, "limits.notifications_max_request_bytes (NOTIFICATIONS_MAX_REQUEST_BYTES)", "must be positive")
+	if c.Limits.FrequencyCap != "" {
+		_, err := frequencycap.ParseRule(c.Limits.FrequencyCap)
+		check(err == nil, "limits.frequency_cap (FREQUENCY_CAP)", "%v", err)
+	}
+	_, err := frequencycap.ParseCategoryRules(c.Limits.FrequencyCapCategories)
+	check(err == nil, "limits.frequency_cap_categories (FREQUENCY_CAP_CATEGORIES)", "%v", err)
+	switch frequencycap.Policy(c.Limits.FrequencyCapPolicy) {
+	case frequencycap.PolicyDrop, frequencycap.PolicyDefer:
+	default:
+		check(false, "limits.frequency_cap_policy (FREQUENCY_CAP_POLICY)", "must be %q or %q, got %q",
+			frequencycap.PolicyDrop, frequencycap.PolicyDefer, c.Limits.FrequencyCapPolicy)
+	}
+	check(c.Limits.TenantSendRate >= 0, "limits.tenant_send_rate (TENANT_SEND_RATE)", "must not be negative")
+	check(c.Limits.TenantSendBurst >= 0, "limits.tenant_send_burst (TENANT_SEND_BURST)", "must not be negative")
+
+	if c.Delivery.QuietHours != "" {
+		_, err := quiethours.Parse(c.Delivery.QuietHours)
+		check(err == nil, "delivery.quiet_hours (QUIET_HOURS)", "%v", err)
+	}
+	_, err = time.LoadLocation(c.Delivery.QuietHoursDefaultTimeZone)
+	check(err == nil, "delivery.quiet_hours_default_time_zone (QUIET_HOURS_DEFAULT_TZ)", "%v", err)
+
+	check(c.Storage.ScheduleStorePath != "", "storage.schedule_store_path (SCHEDULE_STORE_PATH)", "is required")
+	check(c.Storage.PreferenceStorePath != "", "storage.preference_store_path (PREFERENCE_STORE_PATH)", "is required")
+
+	if c.Events.PubSubTopic != "" {
+		check(c.FCM.ProjectID != "", "fcm.project_id (GOOGLE_CLOUD_PROJECT)", "is required when events.pubsub_topic is set")
+	}
+	for _, u := range c.Events.WebhookURLs {
+		parsed, err := url.Parse(u)
+		check(err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "",
+			"events.webhook_urls (EVENT_WEBHOOK_URLS)", "%q is not an http(s) URL", u)
+	}
+	if len(c.Events.WebhookURLs) > 0 {
+		check(c.Events.WebhookSecret != "", "events.webhook_secret (EVENT_WEBHOOK_SECRET)", "is required when events.webhook_urls is set")
+	}
+
+	if c.Pull.Enabled() {
+		check(c.FCM.ProjectID != "", "fcm.project_id (GOOGLE_CLOUD_PROJECT)", "is required when pull subscriptions are set")
+	}
+	check(c.Pull.Concurrency > 0, "pull.concurrency (PULL_CONCURRENCY)", "must be positive")
+	check(c.Pull.MaxOutstandingMessages >= c.Pull.Concurrency, "pull.max_outstanding_messages (PULL_MAX_OUTSTANDING_MESSAGES)",
+		"must be at least pull.concurrency (%d)", c.Pull.Concurrency)
+	check(c.Pull.MaxOutstandingBytes > 0, "pull.max_outstanding_bytes (PULL_MAX_OUTSTANDING_BYTES)", "must be positive")
+	check(c.Pull.MaxExtension > 0, "pull.max_extension (PULL_MAX_EXTENSION)", "must be positive")
+	check(c.Pull.MaxExtensionPeriod == 0 || (c.Pull.MaxExtensionPeriod >= 10*time.Second && c.Pull.MaxExtensionPeriod <= 10*time.Minute),
+		"pull.max_extension_period (PULL_MAX_EXTENSION_PERIOD)", "must be 0 or between 10s and 10m")
+
+	if c.FCM.Endpoint != "" {
+		check(c.FCM.ProjectID != "", "fcm.project_id (GOOGLE_CLOUD_PROJECT)", "is required when fcm.endpoint is set")
+	}
+	if c.Batch.RetryTopic != "" {
+		check(c.FCM.ProjectID != "", "fcm.project_id (GOOGLE_CLOUD_PROJECT)", "is required when batch.retry_topic is set")
+	}
+	check(c.Batch.MaxAttempts > 0, "batch.max_attempts (BATCH_MAX_ATTEMPTS)", "must be positive")
+
+	_, err = chaos.ParseFaults(c.Chaos.Faults)
+	check(err == nil, "chaos.faults (CHAOS_FAULTS)", "%v", err)
+	check(c.Chaos.Latency >= 0, "chaos.latency (CHAOS_LATENCY)", "must not be negative")
+	if c.Chaos.AdminEnabled {
+		authEnabled := c.Auth.IDTokenAudience != "" || slices.ContainsFunc(c.Auth.APIKeys, func(key string) bool { return strings.TrimSpace(key) != "" })
+		check(authEnabled, "chaos.admin_enabled (CHAOS_ADMIN_ENABLED)", "requires auth.api_keys (API_KEYS) or auth.id_token_audience (API_ID_TOKEN_AUDIENCE) to authenticate /admin/chaos")
+	}
+
+	check(c.Health.ReadinessCacheTTL >= 0, "health.readiness_cache_ttl (READINESS_CACHE_TTL)", "must not be negative")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Logging.Level)) == nil, "logging.level (LOG_LEVEL)",
+		"must be debug, info, warn or error, got %q", c.Logging.Level)
+	check(c.Logging.Format == "json" || c.Logging.Format == "text", "logging.format (LOG_FORMAT)",
+		"must be json or text, got %q", c.Logging.Format)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// redacted は secret タグの付いたフィールドの値の代わりに出力する文字列です。
+const redacted = "[REDACTED]"
+
+// LogValue は slog.LogValuer の実装です。secret タグの付いたフィールドは値を出力しません。
+func (c Config) LogValue() slog.Value {
+	return logValue(reflect.ValueOf(c))
+}
+
+func logValue(v reflect.Value) slog.Value {
+	attrs := make([]slog.Attr, 0, v.NumField())
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		fv := v.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			attrs = append(attrs, slog.Attr{Key: key, Value: logValue(fv)})
+		case field.Tag.Get("secret") == "true":
+			value := ""
+			if !fv.IsZero() {
+				value = redacted
+			}
+			attrs = append(attrs, slog.String(key, value))
+		case field.Type == durationType:
+			attrs = append(attrs, slog.String(key, fv.Interface().(time.Duration).String()))
+		case fv.Kind() == reflect.Map:
+			m := fv.Interface().(map[string]string)
+			entries := make([]string, 0, len(m))
+			for _, k := range slices.Sorted(maps.Keys(m)) {
+				entries = append(entries, k+"="+m[k])
+			}
+			attrs = append(attrs, slog.String(key, strings.Join(entries, ",")))
+		case fv.Kind() == reflect.Slice:
+			attrs = append(attrs, slog.String(key, strings.Join(fv.Interface().([]string), ",")))
+		default:
+			attrs = append(attrs, slog.Any(key, fv.Interface()))
+		}
+	}
+
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,224 @@
+package config_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/config"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Server.Port != 8080 {
+		t.Errorf("Server.Port = %d, want 8080", cfg.Server.Port)
+	}
+	if cfg.Server.ShutdownTimeout != 9*time.Second {
+		t.Errorf("Server.ShutdownTimeout = %s, want 9s", cfg.Server.ShutdownTimeout)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 9090
+  write_timeout: 2m
+limits:
+  frequency_cap: 10/24h
+auth:
+  api_keys: [file-key]
+`)
+	t.Setenv("PORT", "7070")
+	t.Setenv("API_KEYS", "key-a, key-b")
+	t.Setenv("FCM_DRY_RUN", "true")
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Server.Port != 7070 {
+		t.Errorf("Server.Port = %d, want 7070 (env overrides file)", cfg.Server.Port)
+	}
+	if cfg.Server.WriteTimeout != 2*time.Minute {
+		t.Errorf("Server.WriteTimeout = %s, want 2m (from file)", cfg.Server.WriteTimeout)
+	}
+	if cfg.Server.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("Server.ReadHeaderTimeout = %s, want 10s (default)", cfg.Server.ReadHeaderTimeout)
+	}
+	if cfg.Limits.FrequencyCap != "10/24h" {
+		t.Errorf("Limits.FrequencyCap = %q, want 10/24h", cfg.Limits.FrequencyCap)
+	}
+	if got := strings.Join(cfg.Auth.APIKeys, ","); got != "key-a,key-b" {
+		t.Errorf("Auth.APIKeys = %q, want key-a,key-b", got)
+	}
+	if !cfg.FCM.DryRun {
+		t.Error("FCM.DryRun = false, want true")
+	}
+}
+
+func TestLoad_Tenants(t *testing.T) {
+	creds := writeConfigFile(t, "{}")
+	t.Setenv("FCM_TENANTS", "app-a="+creds+", app-b = "+creds)
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(cfg.FCM.Tenants) != 2 || cfg.FCM.Tenants["app-a"] != creds || cfg.FCM.Tenants["app-b"] != creds {
+		t.Errorf("FCM.Tenants = %v", cfg.FCM.Tenants)
+	}
+
+	t.Setenv("FCM_TENANTS", "default="+creds+",app-c=/does/not/exist")
+	_, err = config.Load("")
+	for _, want := range []string{`invalid tenant name "default"`, `tenant "app-c"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load() error = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr []string
+	}{
+		{
+			name:    "unknown key in file",
+			file:    "server:\n  prot: 80\n",
+			wantErr: []string{"field prot not found"},
+		},
+		{
+			name:    "malformed env value",
+			env:     map[string]string{"SHUTDOWN_TIMEOUT": "ten", "PORT": "http"},
+			wantErr: []string{`SHUTDOWN_TIMEOUT: invalid duration "ten"`, `PORT: invalid integer "http"`},
+		},
+		{
+			name: "all validation errors are reported",
+			env: map[string]string{
+				"PORT":                 "70000",
+				"FREQUENCY_CAP_POLICY": "queue",
+				"QUIET_HOURS":          "22:00",
+				"EVENT_WEBHOOK_URLS":   "https://example.com/hook",
+				"LOG_LEVEL":            "verbose",
+			},
+			wantErr: []string{
+				"server.port (PORT): must be between 1 and 65535",
+				"limits.frequency_cap_policy (FREQUENCY_CAP_POLICY)",
+				"delivery.quiet_hours (QUIET_HOURS)",
+				"events.webhook_secret (EVENT_WEBHOOK_SECRET): is required",
+				"logging.level (LOG_LEVEL)",
+			},
+		},
+		{
+			name: "pull subscriptions without project",
+			env: map[string]string{
+				"GOOGLE_CLOUD_PROJECT":          "",
+				"PULL_DEVICE_SUBSCRIPTION":      "notifications-device",
+				"PULL_CONCURRENCY":              "20",
+				"PULL_MAX_OUTSTANDING_MESSAGES": "10",
+			},
+			wantErr: []string{
+				"fcm.project_id (GOOGLE_CLOUD_PROJECT): is required when pull subscriptions are set",
+				"pull.max_outstanding_messages (PULL_MAX_OUTSTANDING_MESSAGES): must be at least pull.concurrency (20)",
+			},
+		},
+		{
+			name: "invalid chaos faults",
+			env:  map[string]string{"CHAOS_FAULTS": "UNAVAILABLE=0.8,NOT_FOUND=0.1,TIMEOUT=0.5", "CHAOS_LATENCY": "-1s"},
+			wantErr: []string{
+				`chaos.faults (CHAOS_FAULTS): unknown fault "NOT_FOUND"`,
+				"fault rates must add up to at most 1",
+				"chaos.latency (CHAOS_LATENCY): must not be negative",
+			},
+		},
+		{
+			name:    "chaos admin endpoint without authentication",
+			env:     map[string]string{"CHAOS_ADMIN_ENABLED": "true", "API_KEYS": " "},
+			wantErr: []string{"chaos.admin_enabled (CHAOS_ADMIN_ENABLED): requires auth.api_keys (API_KEYS)"},
+		},
+		{
+			name:    "negative tenant limits",
+			env:     map[string]string{"TENANT_SEND_RATE": "-1", "FCM_BREAKER_FAILURES": "-1", "FCM_BREAKER_COOLDOWN": "0s"},
+			wantErr: []string{"limits.tenant_send_rate (TENANT_SEND_RATE)", "fcm.breaker_failures (FCM_BREAKER_FAILURES)", "fcm.breaker_cooldown (FCM_BREAKER_COOLDOWN)"},
+		},
+		{
+			name:    "no schedule attempts",
+			env:     map[string]string{"SCHEDULE_MAX_ATTEMPTS": "0"},
+			wantErr: []string{"retry.schedule_max_attempts (SCHEDULE_MAX_ATTEMPTS)"},
+		},
+		{
+			name:    "retry max below base",
+			file:    "retry:\n  schedule_base_delay: 1m\n  schedule_max_delay: 30s\n",
+			wantErr: []string{"retry.schedule_max_delay (SCHEDULE_RETRY_MAX_DELAY)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			path := ""
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file)
+			}
+
+			_, err := config.Load(path)
+			if err == nil {
+				t.Fatal("Load() error = nil, want error")
+			}
+
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Load() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_LogValue(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.APIKeys = []string{"super-secret-key"}
+	cfg.Events.WebhookSecret = "hmac-secret"
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("configuration loaded", "config", cfg)
+	out := buf.String()
+
+	for _, secret := range []string{"super-secret-key", "hmac-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output contains secret %q: %s", secret, out)
+		}
+	}
+
+	for _, want := range []string{`"api_keys":"[REDACTED]"`, `"shutdown_timeout":"9s"`, `"port":8080`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output does not contain %s: %s", want, out)
+		}
+	}
+}
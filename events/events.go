@@ -0,0 +1,191 @@
+// Package events は通知の最終的な処理結果 (送信・失敗・破棄) を配信イベントとして外部に送出します。
+// イベントは Emitter から Pub/Subトピック、Webhook、JSONLファイルなどの Sink に非同期で書き込まれます。
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Type はイベントの種類です。
+type Type string
+
+const (
+	TypeSent       Type = "sent"       // FCMへの送信に成功した
+	TypeFailed     Type = "failed"     // 再送しても成功しないため送信を諦めた
+	TypeSuppressed Type = "suppressed" // 配信ポリシー (オプトアウト、送信数の上限など) により送信しなかった
+)
+
+// 失敗したイベントのエラー分類。
+const (
+	ErrorClassInvalid   = "invalid"   // ペイロードが不正
+	ErrorClassPermanent = "permanent" // FCMが恒久的なエラーを返した (無効なトークンなど)
+)
+
+// Event は1件の通知の最終的な処理結果です。
+type Event struct {
+	ID            string       `json:"id"`
+	Type          Type         `json:"type"`
+	Time          time.Time    `json:"time"`
+	Handler       string       `json:"handler"`                  // 通知を受け付けた経路 (push_device, push_topic, notifications, scheduler)
+	MessageID     string       `json:"message_id,omitempty"`     // Pub/SubのメッセージID
+	CorrelationID string       `json:"correlation_id,omitempty"` // プロデューサーが指定した相関ID
+	Tenant        string       `json:"tenant,omitempty"`         // 送信に使ったテナント (未指定なら空)
+	TargetType    string       `json:"target_type,omitempty"`    // "token" または "topic" (バッチ全体が不正な場合は "batch")
+	Target        string       `json:"target,omitempty"`         // 送信先のデバイストークンまたはトピック名
+	FCMMessageID  string       `json:"fcm_message_id,omitempty"` // 送信に成功した場合のFCMのメッセージID
+	ErrorClass    string       `json:"error_class,omitempty"`    // 失敗した場合のエラー分類
+	FCMErrorCode  string       `json:"fcm_error_code,omitempty"` // FCMのエラーコード (例: UNREGISTERED)
+	Error         string       `json:"error,omitempty"`
+	FieldErrors   []FieldError `json:"field_errors,omitempty"` // 検証で不正と判定したフィールド (error_class が invalid の場合)
+	Reason        string       `json:"reason,omitempty"`       // 破棄した理由 (opted_out, frequency_cap)
+}
+
+// FieldError は通知の検証で不正と判定した1つのフィールドです。
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewID はイベントIDを生成します。
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand は失敗しない
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Sink はイベントの書き込み先です。Write の再試行は各 Sink が行います。
+type Sink interface {
+	Write(ctx context.Context, e Event) error
+}
+
+// defaultBufferSize は Sink ごとに書き込み待ちにできるイベントの数です。
+const defaultBufferSize = 1024
+
+// Emitter はイベントを複数の Sink に非同期で書き込みます。
+// Sink ごとに書き込み待ちのキューを持つため、遅い Sink が他の Sink への書き込みを遅らせることはありません。
+type Emitter struct {
+	workers []*worker
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type worker struct {
+	name  string
+	sink  Sink
+	queue chan Event
+}
+
+// NewEmitter は sinks に書き込む Emitter を作成し、書き込みを開始します。sinks のキーはログに使う名前です。
+func NewEmitter(sinks map[string]Sink) *Emitter {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Emitter{cancel: cancel}
+
+	for name, sink := range sinks {
+		w := &worker{name: name, sink: sink, queue: make(chan Event, defaultBufferSize)}
+		e.workers = append(e.workers, w)
+
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			w.run(ctx)
+		}()
+	}
+
+	return e
+}
+
+func (w *worker) run(ctx context.Context) {
+	for ev := range w.queue {
+		if err := w.sink.Write(ctx, ev); err != nil {
+			slog.ErrorContext(ctx, "writing delivery event", "component", "events", "sink", w.name,
+				"eventId", ev.ID, "type", ev.Type, "error", err)
+		}
+	}
+}
+
+// Emit はイベントを書き込み待ちのキューに追加します。ブロックはせず、キューが一杯の Sink には書き込みません。
+// ID と Time が空の場合は設定します。
+func (e *Emitter) Emit(ev Event) {
+	if ev.ID == "" {
+		ev.ID = NewID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		slog.Warn("dropping delivery event after shutdown", "component", "events", "eventId", ev.ID, "type", ev.Type)
+		return
+	}
+
+	for _, w := range e.workers {
+		select {
+		case w.queue <- ev:
+		default:
+			slog.Warn("dropping delivery event, sink queue is full", "component", "events", "sink", w.name,
+				"eventId", ev.ID, "type", ev.Type)
+		}
+	}
+}
+
+// Close は新しいイベントの受け付けを止め、キューに残ったイベントを書き込んでから Sink を閉じます。
+// ctx が先に終了した場合は書き込み中の再試行を打ち切り、ctx のエラーを返します。
+func (e *Emitter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	for _, w := range e.workers {
+		close(w.queue)
+	}
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, w := range e.workers {
+			if n := len(w.queue); n > 0 {
+				slog.WarnContext(ctx, "abandoning unwritten delivery events", "component", "events", "sink", w.name, "count", n)
+			}
+		}
+		e.cancel()
+		<-done
+		err = ctx.Err()
+	}
+	e.cancel()
+
+	for _, w := range e.workers {
+		if c, ok := w.sink.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = errors.Join(err, cerr)
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,156 @@
+package events_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/events"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []events.Event
+	block  chan struct{} // 閉じられるまで Write をブロックする
+	closed bool
+}
+
+func (s *recordingSink) Write(ctx context.Context, e events.Event) error {
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *recordingSink) recorded() []events.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]events.Event(nil), s.events...)
+}
+
+func TestEmitter(t *testing.T) {
+	a := &recordingSink{}
+	b := &recordingSink{}
+	emitter := events.NewEmitter(map[string]events.Sink{"a": a, "b": b})
+
+	emitter.Emit(events.Event{Type: events.TypeSent, Handler: "push_device", MessageID: "m1", CorrelationID: "c1"})
+	emitter.Emit(events.Event{Type: events.TypeFailed, Handler: "push_topic", MessageID: "m2"})
+
+	if err := emitter.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for name, sink := range map[string]*recordingSink{"a": a, "b": b} {
+		got := sink.recorded()
+		if len(got) != 2 {
+			t.Fatalf("sink %s: got %d events want 2", name, len(got))
+		}
+		if got[0].MessageID != "m1" || got[0].CorrelationID != "c1" || got[1].MessageID != "m2" {
+			t.Errorf("sink %s: unexpected events %+v", name, got)
+		}
+		if got[0].ID == "" || got[0].Time.IsZero() {
+			t.Errorf("sink %s: ID and Time should be set: %+v", name, got[0])
+		}
+		if !sink.closed {
+			t.Errorf("sink %s was not closed", name)
+		}
+	}
+
+	// Close 後のイベントは破棄される
+	emitter.Emit(events.Event{Type: events.TypeSent})
+	if got := len(a.recorded()); got != 2 {
+		t.Errorf("event emitted after Close was written: got %d events", got)
+	}
+}
+
+func TestEmitter_CloseTimeout(t *testing.T) {
+	slow := &recordingSink{block: make(chan struct{})}
+	emitter := events.NewEmitter(map[string]events.Sink{"slow": slow})
+
+	emitter.Emit(events.Event{Type: events.TypeSent})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := emitter.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close: got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "events.jsonl")
+
+	sink, err := events.NewFileSink(path)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+
+	want := []events.Event{
+		{ID: "1", Type: events.TypeSent, Handler: "push_device", FCMMessageID: "fcm-1"},
+		{ID: "2", Type: events.TypeSuppressed, Handler: "push_device", Reason: "opted_out"},
+	}
+	for _, e := range want {
+		if err := sink.Write(context.Background(), e); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// 再度開いても追記される
+	sink, err = events.NewFileSink(path)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	want = append(want, events.Event{ID: "3", Type: events.TypeFailed, ErrorClass: events.ErrorClassPermanent})
+	if err := sink.Write(context.Background(), want[2]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	sink.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening event file: %v", err)
+	}
+	defer f.Close()
+
+	var got []events.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line is not JSON: %v (%q)", err, scanner.Text())
+		}
+		got = append(got, e)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d events want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Type != want[i].Type {
+			t.Errorf("event %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+}
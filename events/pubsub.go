@@ -0,0 +1,54 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSubSink はイベントをJSONとしてPub/Subトピックにpublishします。
+// 購読側でフィルタできるよう、イベントの種類と相関IDをメッセージ属性にも設定します。
+type PubSubSink struct {
+	topic *pubsub.Topic
+}
+
+func NewPubSubSink(topic *pubsub.Topic) *PubSubSink {
+	return &PubSubSink{topic: topic}
+}
+
+// Write はイベントをpublishし、Pub/Subが受け付けるまで待ちます。再試行はクライアントライブラリが行います。
+func (s *PubSubSink) Write(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	attrs := map[string]string{
+		"event_type": string(e.Type),
+		"handler":    e.Handler,
+	}
+	if e.MessageID != "" {
+		attrs["message_id"] = e.MessageID
+	}
+	if e.CorrelationID != "" {
+		attrs["correlation_id"] = e.CorrelationID
+	}
+	if e.Tenant != "" {
+		attrs["tenant"] = e.Tenant
+	}
+
+	if _, err := s.topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attrs}).Get(ctx); err != nil {
+		return fmt.Errorf("publishing event: %w", err)
+	}
+
+	return nil
+}
+
+// Close は未送信のメッセージをpublishしてからトピックの送信処理を止めます。
+func (s *PubSubSink) Close() error {
+	s.topic.Stop()
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/teamzidi/example-go-fcm/events"
+)
+
+func TestPubSubSink(t *testing.T) {
+	ctx := context.Background()
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("connecting to fake Pub/Sub: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	topic, err := client.CreateTopic(ctx, "delivery-events")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+
+	sink := events.NewPubSubSink(topic)
+	if err := sink.Write(ctx, events.Event{ID: "event-1", Type: events.TypeFailed, Handler: "push_device", MessageID: "m1", CorrelationID: "order-42"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	sink.Close()
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d published messages want 1", len(msgs))
+	}
+
+	expectedAttrs := map[string]string{
+		"event_type":     "failed",
+		"handler":        "push_device",
+		"message_id":     "m1",
+		"correlation_id": "order-42",
+	}
+	for k, v := range expectedAttrs {
+		if msgs[0].Attributes[k] != v {
+			t.Errorf("attribute %s: got %q want %q", k, msgs[0].Attributes[k], v)
+		}
+	}
+
+	var e events.Event
+	if err := json.Unmarshal(msgs[0].Data, &e); err != nil {
+		t.Fatalf("message data is not an event: %v", err)
+	}
+	if e.ID != "event-1" {
+		t.Errorf("event ID: got %q want %q", e.ID, "event-1")
+	}
+}
@@ -0,0 +1,151 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Webhookリクエストのヘッダー。
+const (
+	EventIDHeader   = "X-FCM-Event-ID"
+	TimestampHeader = "X-FCM-Timestamp" // 署名した時刻 (Unix秒)
+	SignatureHeader = "X-FCM-Signature" // "sha256=" + HMAC-SHA256(secret, timestamp + "." + body) の16進数
+)
+
+const (
+	defaultWebhookAttempts  = 5
+	defaultWebhookBaseDelay = time.Second
+	defaultWebhookTimeout   = 10 * time.Second
+)
+
+// WebhookSink はイベントをHMAC-SHA256で署名したJSONとしてHTTP POSTで送信します。
+// 通信エラー、429、5xx の場合は指数バックオフで再試行します。
+type WebhookSink struct {
+	url         string
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	now         func() time.Time
+}
+
+func NewWebhookSink(url, secret string) *WebhookSink {
+	return &WebhookSink{
+		url:         url,
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: defaultWebhookTimeout},
+		maxAttempts: defaultWebhookAttempts,
+		baseDelay:   defaultWebhookBaseDelay,
+		now:         time.Now,
+	}
+}
+
+// WithHTTPClient は送信に使う http.Client を設定します。
+func (s *WebhookSink) WithHTTPClient(c *http.Client) *WebhookSink {
+	s.client = c
+
+	return s
+}
+
+// WithRetry は最大試行回数と、再試行までの最初の待ち時間を設定します。待ち時間は再試行ごとに倍になります。
+func (s *WebhookSink) WithRetry(maxAttempts int, baseDelay time.Duration) *WebhookSink {
+	s.maxAttempts = max(maxAttempts, 1)
+	s.baseDelay = baseDelay
+
+	return s
+}
+
+// Write はイベントを送信します。
+func (s *WebhookSink) Write(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	delay := s.baseDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, e.ID, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= s.maxAttempts {
+			return fmt.Errorf("posting event to webhook (attempt %d): %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("posting event to webhook (attempt %d): %w", attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post は1回送信し、失敗した場合は再試行すべきかどうかを返します。
+func (s *WebhookSink) post(ctx context.Context, eventID string, body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, eventID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// Sign はWebhookの署名ヘッダーの値を計算します。
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature はWebhookの受信側で、リクエストの署名が正しく、かつ時刻が tolerance 以内であることを確認します。
+func VerifySignature(secret []byte, header http.Header, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", TimestampHeader)
+	}
+
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("timestamp is outside the allowed tolerance")
+	}
+
+	if !hmac.Equal([]byte(header.Get(SignatureHeader)), []byte(Sign(secret, timestamp, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
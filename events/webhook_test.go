@@ -0,0 +1,156 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/events"
+)
+
+func TestWebhookSink(t *testing.T) {
+	const secret = "s3cret"
+
+	tests := []struct {
+		name             string
+		responses        []int // 試行ごとのステータスコード (足りない分は最後の値)
+		expectedAttempts int32
+		expectError      bool
+	}{
+		{
+			name:             "success",
+			responses:        []int{http.StatusOK},
+			expectedAttempts: 1,
+		},
+		{
+			name:             "retry on server error",
+			responses:        []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusNoContent},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "retry on 429",
+			responses:        []int{http.StatusTooManyRequests, http.StatusOK},
+			expectedAttempts: 2,
+		},
+		{
+			name:             "no retry on client error",
+			responses:        []int{http.StatusBadRequest},
+			expectedAttempts: 1,
+			expectError:      true,
+		},
+		{
+			name:             "give up after max attempts",
+			responses:        []int{http.StatusBadGateway},
+			expectedAttempts: 4,
+			expectError:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			var received events.Event
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(attempts.Add(1))
+
+				body, _ := io.ReadAll(r.Body)
+				if err := events.VerifySignature([]byte(secret), r.Header, body, time.Now(), time.Minute); err != nil {
+					t.Errorf("signature verification failed: %v", err)
+				}
+				if err := json.Unmarshal(body, &received); err != nil {
+					t.Errorf("body is not an event: %v", err)
+				}
+				if r.Header.Get(events.EventIDHeader) != "event-1" {
+					t.Errorf("%s: got %q want %q", events.EventIDHeader, r.Header.Get(events.EventIDHeader), "event-1")
+				}
+
+				w.WriteHeader(tt.responses[min(n, len(tt.responses))-1])
+			}))
+			defer server.Close()
+
+			sink := events.NewWebhookSink(server.URL, secret).WithRetry(4, time.Millisecond)
+			err := sink.Write(context.Background(), events.Event{ID: "event-1", Type: events.TypeSent, CorrelationID: "order-42"})
+
+			if tt.expectError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if got := attempts.Load(); got != tt.expectedAttempts {
+				t.Errorf("attempts: got %d want %d", got, tt.expectedAttempts)
+			}
+			if received.CorrelationID != "order-42" {
+				t.Errorf("correlation_id: got %q want %q", received.CorrelationID, "order-42")
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("s3cret")
+	body := []byte(`{"id":"1"}`)
+	now := time.Unix(1700000000, 0)
+
+	header := func(timestamp, signature string) http.Header {
+		h := http.Header{}
+		h.Set(events.TimestampHeader, timestamp)
+		h.Set(events.SignatureHeader, signature)
+		return h
+	}
+
+	tests := []struct {
+		name        string
+		header      http.Header
+		body        []byte
+		expectError bool
+	}{
+		{
+			name:   "valid",
+			header: header("1700000000", events.Sign(secret, "1700000000", body)),
+			body:   body,
+		},
+		{
+			name:        "tampered body",
+			header:      header("1700000000", events.Sign(secret, "1700000000", body)),
+			body:        []byte(`{"id":"2"}`),
+			expectError: true,
+		},
+		{
+			name:        "wrong secret",
+			header:      header("1700000000", events.Sign([]byte("other"), "1700000000", body)),
+			body:        body,
+			expectError: true,
+		},
+		{
+			name:        "stale timestamp",
+			header:      header("1699999000", events.Sign(secret, "1699999000", body)),
+			body:        body,
+			expectError: true,
+		},
+		{
+			name:        "missing timestamp",
+			header:      header("", events.Sign(secret, "", body)),
+			body:        body,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := events.VerifySignature(secret, tt.header, tt.body, now, 5*time.Minute)
+			if tt.expectError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
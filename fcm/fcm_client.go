@@ -6,26 +6,138 @@ import (
 	"fmt"
 
 	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/errorutils"
 	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/option"
+
+	"github.com/teamzidi/example-go-fcm/logging"
 )
 
+// DefaultTenant はテナントを指定しないメッセージの送信に使うテナントの名前です。
+const DefaultTenant = "default"
+
+// MessagingScope はFCMへの送信に必要なOAuth2スコープです。
+const MessagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// ErrThrottled はテナントの送信レートの上限やサーキットブレーカーによって、FCMに送信しなかったことを表します。
+var ErrThrottled = errors.New("fcm: send throttled")
+
+// IsRetryableError は err が再送すれば成功しうる一時的なエラーかどうかを判定します。
+// ラップされたエラーも判定し、FCMの一時的なエラーに加えて送信のタイムアウトと ErrThrottled も再送対象とします。
 func IsRetryableError(err error) bool {
 	if err == nil {
 		return false
 	}
 
-	return messaging.IsInternal(err) || messaging.IsUnavailable(err) || messaging.IsQuotaExceeded(err)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrThrottled) {
+		return true
+	}
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if messaging.IsInternal(e) || messaging.IsUnavailable(e) || messaging.IsQuotaExceeded(e) || errorutils.IsDeadlineExceeded(e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrorCode は err に含まれるFCMのエラーコード (例: "UNREGISTERED") を返します。
+// err が nil の場合は空文字列、FCMのエラーでない場合は "UNKNOWN" を返します。
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch {
+		case messaging.IsUnregistered(e):
+			return "UNREGISTERED"
+		case messaging.IsInvalidArgument(e):
+			return "INVALID_ARGUMENT"
+		case messaging.IsSenderIDMismatch(e):
+			return "SENDER_ID_MISMATCH"
+		case messaging.IsQuotaExceeded(e):
+			return "QUOTA_EXCEEDED"
+		case messaging.IsUnavailable(e):
+			return "UNAVAILABLE"
+		case messaging.IsInternal(e):
+			return "INTERNAL"
+		case messaging.IsThirdPartyAuthError(e):
+			return "THIRD_PARTY_AUTH_ERROR"
+		}
+	}
+
+	return "UNKNOWN"
+}
+
+// Sender はFCMへメッセージを送信します。*messaging.Client が実装します。
+type Sender interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+	// SendEach は最大 MaxBatchSize 件のメッセージを1回の呼び出しで送信します。
+	// メッセージごとの結果は BatchResponse に、呼び出し全体の失敗はエラーとして返ります。
+	SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error)
+}
+
+// MaxBatchSize は SendEach の1回の呼び出しで送信できるメッセージ数の上限です。
+const MaxBatchSize = 500
+
+// Middleware は Sender をラップして、メトリクス計測などの処理を追加します。
+type Middleware func(Sender) Sender
+
+// TargetType はメッセージの送信先の種類 ("token", "topic", "condition") を返します。
+func TargetType(message *messaging.Message) string {
+	switch {
+	case message.Token != "":
+		return "token"
+	case message.Topic != "":
+		return "topic"
+	case message.Condition != "":
+		return "condition"
+	default:
+		return "unknown"
+	}
 }
 
 // Client はFirebase Cloud Messagingのクライアントです。(旧 FCMClient)
 type Client struct {
-	msg *messaging.Client
+	msg    Sender
+	topics TopicManager // nil ならトピックの登録と解除はできない
+}
+
+// Config はFCMクライアントの設定です。
+type Config struct {
+	ProjectID       string // 空なら認証情報から決定する
+	CredentialsFile string // 空ならApplication Default Credentials (GOOGLE_APPLICATION_CREDENTIALS など) を使う
+	DryRun          bool   // true ならFCMはメッセージを検証するだけで配信しない
+	// Endpoint が空でなければ、FCM APIの代わりにこのURL (例: "http://localhost:9099/v1") に認証なしで送信する。
+	// ローカルの偽のFCM (internal/fakefcm) を使う場合に設定する。ProjectID が必要。
+	Endpoint string
+}
+
+// ClientOptions は cfg の認証情報を使うGoogle APIクライアントのオプションを返します。
+func (cfg Config) ClientOptions() []option.ClientOption {
+	if cfg.CredentialsFile == "" {
+		return nil
+	}
+
+	return []option.ClientOption{option.WithCredentialsFile(cfg.CredentialsFile)}
 }
 
 // NewClient は新しいClientのインスタンスを作成します。(旧 NewFCMClient)
-// 環境変数 GOOGLE_APPLICATION_CREDENTIALS が設定されている必要があります。
-func NewClient(ctx context.Context) (*Client, error) {
-	app, err := firebase.NewApp(ctx, nil)
+// middlewares は先頭のものが最も外側になるように送信処理をラップします。
+func NewClient(ctx context.Context, cfg Config, middlewares ...Middleware) (*Client, error) {
+	var appConfig *firebase.Config
+	if cfg.ProjectID != "" {
+		appConfig = &firebase.Config{ProjectID: cfg.ProjectID}
+	}
+
+	opts := cfg.ClientOptions()
+	if cfg.Endpoint != "" {
+		opts = []option.ClientOption{option.WithEndpoint(cfg.Endpoint), option.WithoutAuthentication()}
+	}
+
+	app, err := firebase.NewApp(ctx, appConfig, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -35,7 +147,41 @@ func NewClient(ctx context.Context) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{msg: msgClient}, nil
+	var sender Sender = msgClient
+	if cfg.DryRun {
+		sender = dryRunSender{msgClient}
+	}
+
+	client := NewClientWithSender(sender, middlewares...)
+	if !cfg.DryRun {
+		// トピックの登録と解除には検証だけのAPIがないため、ドライランでは使えない
+		client.topics = msgClient
+	}
+	return client, nil
+}
+
+// dryRunSender はメッセージを検証のみ (validate_only) でFCMに送信します。
+type dryRunSender struct {
+	client *messaging.Client
+}
+
+func (s dryRunSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return s.client.SendDryRun(ctx, message)
+}
+
+func (s dryRunSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	return s.client.SendEachDryRun(ctx, messages)
+}
+
+// NewClientWithSender は任意の Sender を使う Client を作成します。テスト用の偽のFCMなどに使用します。
+// sender が TopicManager も実装していれば、トピックの登録と解除にも使います。
+func NewClientWithSender(sender Sender, middlewares ...Middleware) *Client {
+	topics, _ := sender.(TopicManager)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		sender = middlewares[i](sender)
+	}
+
+	return &Client{msg: sender, topics: topics}
 }
 
 // SendToToken は指定された単一のデバイストークンに通知とデータペイロードを送信します。
@@ -43,6 +189,9 @@ func (c *Client) SendToToken(ctx context.Context, token string, title string, bo
 	if token == "" {
 		return "", errors.New("token cannot be empty")
 	}
+	if err := Validate(Notification{Token: token, Title: title, Body: body, CustomData: customData}); err != nil {
+		return "", err
+	}
 
 	message := &messaging.Message{
 		Notification: &messaging.Notification{
@@ -55,7 +204,7 @@ func (c *Client) SendToToken(ctx context.Context, token string, title string, bo
 
 	response, err := c.msg.Send(ctx, message)
 	if err != nil {
-		return "", fmt.Errorf("sending message to token %s: %w", token, err)
+		return "", fmt.Errorf("sending message to token %s: %w", logging.RedactToken(token), err)
 	}
 
 	return response, nil
@@ -66,6 +215,9 @@ func (c *Client) SendToTopic(ctx context.Context, topic string, title string, bo
 	if topic == "" {
 		return "", fmt.Errorf("topic cannot be empty")
 	}
+	if err := Validate(Notification{Topic: topic, Title: title, Body: body, CustomData: customData}); err != nil {
+		return "", err
+	}
 
 	message := &messaging.Message{
 		Notification: &messaging.Notification{
@@ -83,3 +235,136 @@ func (c *Client) SendToTopic(ctx context.Context, topic string, title string, bo
 
 	return response, nil
 }
+
+// Notification は SendEach で送信する1件の通知です。Token、Topic、Condition のいずれか1つを指定します。
+type Notification struct {
+	Token      string
+	Topic      string
+	Condition  string // トピックの条件式 (例: "'news' in topics && 'jp' in topics")
+	Title      string
+	Body       string
+	CustomData map[string]string
+}
+
+// message は n をFCMに送信するメッセージにします。
+func (n Notification) message() *messaging.Message {
+	return &messaging.Message{
+		Notification: &messaging.Notification{
+			Title: n.Title,
+			Body:  n.Body,
+		},
+		Data:      n.CustomData,
+		Token:     n.Token,
+		Topic:     n.Topic,
+		Condition: n.Condition,
+	}
+}
+
+// messageTarget はエラーメッセージに含める message の送信先です。エラーはログや配信イベントに出力されるため、トークンは秘匿化します。
+func messageTarget(message *messaging.Message) string {
+	switch {
+	case message.Token != "":
+		return "token " + logging.RedactToken(message.Token)
+	case message.Topic != "":
+		return "topic " + message.Topic
+	default:
+		return "condition " + message.Condition
+	}
+}
+
+// SendResult は SendEach で送信した1件の通知の結果です。
+type SendResult struct {
+	MessageID string
+	Err       error
+}
+
+// SendEach は notifications を MaxBatchSize 件ずつに分けて送信し、通知ごとの結果を同じ順序で返します。
+// Validate で不正と判定した通知は送信せず、その *ValidationError を結果にします。
+// 呼び出し全体が失敗した場合 (認証エラーや ctx のキャンセルなど) は、その呼び出しに含まれる通知すべての結果がそのエラーになります。
+func (c *Client) SendEach(ctx context.Context, notifications []Notification) []SendResult {
+	messages := make([]*messaging.Message, len(notifications))
+	for i, n := range notifications {
+		messages[i] = n.message()
+	}
+
+	return c.SendMessages(ctx, messages)
+}
+
+// Send は任意のオプション (Android、APNs、Web Push の設定など) を持つメッセージを1件送信します。
+// 送信前に ValidateMessage で検証します。
+func (c *Client) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := ValidateMessage(message); err != nil {
+		return "", err
+	}
+
+	response, err := c.msg.Send(ctx, message)
+	if err != nil {
+		return "", fmt.Errorf("sending message to %s: %w", messageTarget(message), err)
+	}
+
+	return response, nil
+}
+
+// SendMessages は SendEach と同じく messages を MaxBatchSize 件ずつに分けて送信し、メッセージごとの結果を同じ順序で返します。
+// ValidateMessage で不正と判定したメッセージは送信しません。
+func (c *Client) SendMessages(ctx context.Context, messages []*messaging.Message) []SendResult {
+	results := make([]SendResult, len(messages))
+
+	for start := 0; start < len(messages); start += MaxBatchSize {
+		chunk := messages[start:min(start+MaxBatchSize, len(messages))]
+
+		var valid []*messaging.Message
+		var indexes []int
+		for i, m := range chunk {
+			if err := ValidateMessage(m); err != nil {
+				results[start+i].Err = err
+				continue
+			}
+
+			valid = append(valid, m)
+			indexes = append(indexes, start+i)
+		}
+
+		if len(valid) == 0 {
+			continue
+		}
+
+		resp, err := c.msg.SendEach(ctx, valid)
+		for j, i := range indexes {
+			switch {
+			case err != nil:
+				results[i].Err = fmt.Errorf("sending batch of %d messages: %w", len(valid), err)
+			case j >= len(resp.Responses):
+				results[i].Err = fmt.Errorf("no response for message %d of the batch", j)
+			case resp.Responses[j].Success:
+				results[i].MessageID = resp.Responses[j].MessageID
+			default:
+				results[i].Err = fmt.Errorf("sending message to %s: %w", messageTarget(messages[i]), resp.Responses[j].Error)
+			}
+		}
+	}
+
+	return results
+}
+
+// TopicManager はデバイストークンのトピックへの登録と解除を行います。*messaging.Client が実装します。
+type TopicManager interface {
+	SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+	UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+}
+
+// SubscribeToTopic は tokens をトピックに登録します。トークンごとの失敗は TopicManagementResponse の Errors に入ります。
+func (c *Client) SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	if c.topics == nil {
+		return nil, errors.New("topic management is not supported by this client")
+	}
+	return c.topics.SubscribeToTopic(ctx, tokens, topic)
+}
+
+// UnsubscribeFromTopic は tokens のトピックへの登録を解除します。
+func (c *Client) UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	if c.topics == nil {
+		return nil, errors.New("topic management is not supported by this client")
+	}
+	return c.topics.UnsubscribeFromTopic(ctx, tokens, topic)
+}
@@ -0,0 +1,190 @@
+package fcm_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// batchSender は呼び出しごとのメッセージ数を記録し、token が "bad" のメッセージだけ失敗させます。
+type batchSender struct {
+	calls []int
+	err   error
+}
+
+func (s *batchSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return "id", nil
+}
+
+func (s *batchSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	s.calls = append(s.calls, len(messages))
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	resp := &messaging.BatchResponse{}
+	for i, m := range messages {
+		if m.Token == "bad" {
+			resp.Responses = append(resp.Responses, &messaging.SendResponse{Error: errors.New("invalid token")})
+			continue
+		}
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: true, MessageID: fmt.Sprintf("id-%d", i)})
+	}
+	return resp, nil
+}
+
+func TestClient_SendEach(t *testing.T) {
+	notifications := make([]fcm.Notification, 1001)
+	for i := range notifications {
+		notifications[i] = fcm.Notification{Token: fmt.Sprintf("token-%d", i), Title: "t", Body: "b"}
+	}
+	notifications[3].Token = "bad"
+	notifications[700] = fcm.Notification{Title: "t", Body: "b"} // 送信先なし
+
+	sender := &batchSender{}
+	results := fcm.NewClientWithSender(sender).SendEach(context.Background(), notifications)
+
+	if !slices.Equal(sender.calls, []int{500, 499, 1}) {
+		t.Errorf("SendEach calls: got %v want [500 499 1]", sender.calls)
+	}
+	if len(results) != len(notifications) {
+		t.Fatalf("results: got %d want %d", len(results), len(notifications))
+	}
+	if results[0].Err != nil || results[0].MessageID != "id-0" {
+		t.Errorf("results[0] = %+v, want success", results[0])
+	}
+	if results[3].Err == nil {
+		t.Error("results[3].Err = nil, want the per-message error")
+	}
+	if results[700].Err == nil {
+		t.Error("results[700].Err = nil, want an error for a notification without target")
+	}
+	if results[701].Err != nil || results[701].MessageID != "id-200" {
+		t.Errorf("results[701] = %+v, want success with the response of its own index", results[701])
+	}
+
+	failing := &batchSender{err: errors.New("unauthenticated")}
+	results = fcm.NewClientWithSender(failing).SendEach(context.Background(), notifications[:2])
+	for i, r := range results {
+		if !errors.Is(r.Err, failing.err) {
+			t.Errorf("results[%d].Err = %v, want the batch error", i, r.Err)
+		}
+	}
+}
+
+// topicSender はトピックの登録と解除も行う Sender です。
+type topicSender struct {
+	batchSender
+	subscribed map[string][]string
+}
+
+func (s *topicSender) SubscribeToTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	s.subscribed[topic] = append(s.subscribed[topic], tokens...)
+	return &messaging.TopicManagementResponse{SuccessCount: len(tokens)}, nil
+}
+
+func (s *topicSender) UnsubscribeFromTopic(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error) {
+	delete(s.subscribed, topic)
+	return &messaging.TopicManagementResponse{SuccessCount: len(tokens)}, nil
+}
+
+func TestClient_SubscribeToTopic(t *testing.T) {
+	passthrough := func(s fcm.Sender) fcm.Sender { return s }
+
+	sender := &topicSender{subscribed: map[string][]string{}}
+	client := fcm.NewClientWithSender(sender, passthrough)
+	resp, err := client.SubscribeToTopic(context.Background(), []string{"a", "b"}, "news")
+	if err != nil || resp.SuccessCount != 2 {
+		t.Fatalf("SubscribeToTopic() = %+v, %v", resp, err)
+	}
+	if !slices.Equal(sender.subscribed["news"], []string{"a", "b"}) {
+		t.Errorf("subscribed: got %v", sender.subscribed["news"])
+	}
+
+	// TopicManager を実装しない Sender ではエラーになる
+	if _, err := fcm.NewClientWithSender(&batchSender{}).UnsubscribeFromTopic(context.Background(), []string{"a"}, "news"); err == nil {
+		t.Error("UnsubscribeFromTopic() = nil error, want an error for a sender without topic management")
+	}
+}
+
+func TestClient_Send(t *testing.T) {
+	client := fcm.NewClientWithSender(&batchSender{})
+
+	id, err := client.Send(context.Background(), &messaging.Message{
+		Condition: "'news' in topics",
+		Android:   &messaging.AndroidConfig{Priority: "high"},
+	})
+	if err != nil || id != "id" {
+		t.Errorf("Send() = %q, %v", id, err)
+	}
+
+	var ve *fcm.ValidationError
+	if _, err := client.Send(context.Background(), &messaging.Message{Token: "t", Topic: "news"}); !errors.As(err, &ve) {
+		t.Errorf("Send() = %v, want *fcm.ValidationError", err)
+	}
+}
+
+// failingSender はすべての送信を err で失敗させます。
+type failingSender struct {
+	err error
+}
+
+func (s failingSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return "", s.err
+}
+
+func (s failingSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	resp := &messaging.BatchResponse{FailureCount: len(messages)}
+	for range messages {
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Error: s.err})
+	}
+	return resp, nil
+}
+
+// TestClient_ErrorsRedactTokens はエラーメッセージにデバイストークンがそのまま含まれないことを確認します。
+func TestClient_ErrorsRedactTokens(t *testing.T) {
+	const token = "fGx1abcdefghijklmnopqrstuvwxyz0123456789:APA91bXyZ"
+	client := fcm.NewClientWithSender(failingSender{err: errors.New("unregistered")})
+	ctx := context.Background()
+
+	_, sendToTokenErr := client.SendToToken(ctx, token, "t", "b", nil)
+	_, sendErr := client.Send(ctx, &messaging.Message{Token: token})
+	sendEachErr := client.SendEach(ctx, []fcm.Notification{{Token: token, Title: "t", Body: "b"}})[0].Err
+
+	for name, err := range map[string]error{"SendToToken": sendToTokenErr, "Send": sendErr, "SendEach": sendEachErr} {
+		if err == nil {
+			t.Errorf("%s: error = nil, want the send error", name)
+			continue
+		}
+		if strings.Contains(err.Error(), token) || !strings.Contains(err.Error(), logging.RedactToken(token)) {
+			t.Errorf("%s: error %q should contain the redacted token only", name, err)
+		}
+	}
+}
+
+// BenchmarkClient_SendEach は送信を除いたクライアントの処理 (検証、メッセージの組み立て、結果の対応付け) を計測します。
+func BenchmarkClient_SendEach(b *testing.B) {
+	client := fcm.NewClientWithSender(&batchSender{})
+	data := map[string]string{"article_id": "12345", "category": "news"}
+
+	for _, size := range []int{1, 100, 500} {
+		notifications := make([]fcm.Notification, size)
+		for i := range notifications {
+			notifications[i] = fcm.Notification{Token: fmt.Sprintf("token-%d", i), Title: "Title", Body: "Body", CustomData: data}
+		}
+
+		b.Run(fmt.Sprintf("%d notifications", size), func(b *testing.B) {
+			for b.Loop() {
+				client.SendEach(context.Background(), notifications)
+			}
+		})
+	}
+}
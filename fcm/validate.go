@@ -0,0 +1,176 @@
+package fcm
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// MaxPayloadSize はFCMが受け付けるメッセージのペイロード (通知とデータ) の最大バイト数です。
+// APNs に転送される通知の上限も同じ 4KB です。
+const MaxPayloadSize = 4096
+
+// MaxTokenLength はデバイストークンとして受け付ける最大の長さです。
+const MaxTokenLength = 4096
+
+var (
+	// topicPattern はFCMのトピック名として有効な文字列です。
+	topicPattern = regexp.MustCompile(`^[a-zA-Z0-9-_.~%]+$`)
+	// tokenPattern はデバイストークンに使われる文字です (FCMの登録トークンは英数字と "-", "_", ":", "." からなる)。
+	tokenPattern = regexp.MustCompile(`^[a-zA-Z0-9-_:.]+$`)
+	// conditionTopicPattern は条件式の中のトピックの指定 ('news' in topics) です。
+	conditionTopicPattern = regexp.MustCompile(`'([^']*)'\s+in\s+topics`)
+)
+
+// MaxConditionTopics は1つの条件式で指定できるトピックの数の上限です。
+const MaxConditionTopics = 5
+
+// reservedDataKeys はFCMが予約しているため CustomData に使えないキーです。
+var reservedDataKeys = []string{"from", "notification", "message_type"}
+
+// reservedDataKeyPrefixes はFCMが予約しているため CustomData に使えないキーの接頭辞です。
+var reservedDataKeyPrefixes = []string{"google.", "gcm."}
+
+// FieldError は通知の1つのフィールドの検証エラーです。
+type FieldError struct {
+	Field   string `json:"field"` // "token", "topic", "custom_data.<キー>", "payload" など
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string { return e.Field + ": " + e.Message }
+
+// ValidationError は通知がFCMに送信できない理由をフィールドごとにまとめたエラーです。
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "invalid notification: " + strings.Join(msgs, "; ")
+}
+
+// Validate は n がFCMに受け付けられる形式かどうかを送信前に検証します。
+// 問題がある場合は、見つかったすべてのフィールドのエラーを持つ *ValidationError を返します。
+func Validate(n Notification) error {
+	var fields []FieldError
+	add := func(field, format string, args ...any) {
+		fields = append(fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	targets := 0
+	for _, t := range []string{n.Token, n.Topic, n.Condition} {
+		if t != "" {
+			targets++
+		}
+	}
+
+	switch {
+	case targets != 1:
+		add("target", "exactly one of token, topic and condition is required")
+	case n.Token != "":
+		switch {
+		case len(n.Token) > MaxTokenLength:
+			add("token", "must be at most %d characters, got %d", MaxTokenLength, len(n.Token))
+		case !tokenPattern.MatchString(n.Token):
+			add("token", "contains characters not used in registration tokens")
+		}
+	case n.Topic != "":
+		switch {
+		case strings.HasPrefix(n.Topic, "/topics/"):
+			add("topic", "must not include the /topics/ prefix")
+		case !topicPattern.MatchString(n.Topic):
+			add("topic", "must match %s", topicPattern)
+		}
+	case n.Condition != "":
+		topics := conditionTopicPattern.FindAllStringSubmatch(n.Condition, -1)
+		switch {
+		case len(topics) == 0:
+			add("condition", "must contain at least one 'topic' in topics expression")
+		case len(topics) > MaxConditionTopics:
+			add("condition", "must contain at most %d topics, got %d", MaxConditionTopics, len(topics))
+		}
+		for _, m := range topics {
+			if !topicPattern.MatchString(m[1]) {
+				add("condition", "topic %q must match %s", m[1], topicPattern)
+			}
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(n.CustomData)) {
+		if reason := reservedKeyReason(key); reason != "" {
+			add("custom_data."+key, "%s", reason)
+		}
+	}
+
+	if size := payloadSize(n); size > MaxPayloadSize {
+		add("payload", "serialized size %d bytes exceeds the limit of %d bytes", size, MaxPayloadSize)
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// ValidateMessage は Client.Send で送信する任意のメッセージを Validate と同じ規則で検証します。
+// Android、APNs、Web Push の設定は検証しません (FCMが送信時に検証します)。
+func ValidateMessage(message *messaging.Message) error {
+	if message == nil {
+		return &ValidationError{Fields: []FieldError{{Field: "message", Message: "is required"}}}
+	}
+
+	n := Notification{Token: message.Token, Topic: message.Topic, Condition: message.Condition, CustomData: message.Data}
+	if message.Notification != nil {
+		n.Title, n.Body = message.Notification.Title, message.Notification.Body
+	}
+	return Validate(n)
+}
+
+// reservedKeyReason は key がFCMの予約済みのキーであればその理由を、使えるキーであれば空文字列を返します。
+func reservedKeyReason(key string) string {
+	if key == "" {
+		return "key must not be empty"
+	}
+	for _, k := range reservedDataKeys {
+		if key == k {
+			return "key is reserved by FCM"
+		}
+	}
+	for _, p := range reservedDataKeyPrefixes {
+		if strings.HasPrefix(strings.ToLower(key), p) {
+			return fmt.Sprintf("keys starting with %q are reserved by FCM", p)
+		}
+	}
+	return ""
+}
+
+// wirePayload はFCMに送信するメッセージのうち、サイズの上限の対象になる部分です。
+type wirePayload struct {
+	Notification struct {
+		Title string `json:"title,omitempty"`
+		Body  string `json:"body,omitempty"`
+	} `json:"notification"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// payloadSize はFCMに送信するメッセージの通知とデータをJSONにした場合のバイト数を返します。
+func payloadSize(n Notification) int {
+	var p wirePayload
+	p.Notification.Title = n.Title
+	p.Notification.Body = n.Body
+	p.Data = n.CustomData
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
@@ -0,0 +1,147 @@
+package fcm_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name           string
+		notification   fcm.Notification
+		expectedFields []string // 不正と判定されるフィールド。nil なら有効
+	}{
+		{
+			name:         "valid token",
+			notification: fcm.Notification{Token: "dGVzdA:APA91bH-x_y.z", Title: "T", Body: "B", CustomData: map[string]string{"key": "v"}},
+		},
+		{
+			name:         "valid topic",
+			notification: fcm.Notification{Topic: "news-2025_jp.~%20", Title: "T", Body: "B"},
+		},
+		{
+			name:           "no target",
+			notification:   fcm.Notification{Title: "T", Body: "B"},
+			expectedFields: []string{"target"},
+		},
+		{
+			name:           "both targets",
+			notification:   fcm.Notification{Token: "token", Topic: "news", Title: "T", Body: "B"},
+			expectedFields: []string{"target"},
+		},
+		{
+			name:         "valid condition",
+			notification: fcm.Notification{Condition: "'news' in topics && ('jp' in topics || 'us' in topics)", Title: "T", Body: "B"},
+		},
+		{
+			name:           "token and condition",
+			notification:   fcm.Notification{Token: "token", Condition: "'news' in topics", Title: "T", Body: "B"},
+			expectedFields: []string{"target"},
+		},
+		{
+			name:           "condition without topics",
+			notification:   fcm.Notification{Condition: "news", Title: "T", Body: "B"},
+			expectedFields: []string{"condition"},
+		},
+		{
+			name:           "condition with too many topics",
+			notification:   fcm.Notification{Condition: "'a' in topics || 'b' in topics || 'c' in topics || 'd' in topics || 'e' in topics || 'f' in topics", Title: "T", Body: "B"},
+			expectedFields: []string{"condition"},
+		},
+		{
+			name:           "token with whitespace",
+			notification:   fcm.Notification{Token: "token with spaces", Title: "T", Body: "B"},
+			expectedFields: []string{"token"},
+		},
+		{
+			name:           "token too long",
+			notification:   fcm.Notification{Token: strings.Repeat("a", fcm.MaxTokenLength+1), Title: "T", Body: "B"},
+			expectedFields: []string{"token"},
+		},
+		{
+			name:           "topic with prefix",
+			notification:   fcm.Notification{Topic: "/topics/news", Title: "T", Body: "B"},
+			expectedFields: []string{"topic"},
+		},
+		{
+			name:           "topic with invalid characters",
+			notification:   fcm.Notification{Topic: "news!", Title: "T", Body: "B"},
+			expectedFields: []string{"topic"},
+		},
+		{
+			name: "reserved data keys",
+			notification: fcm.Notification{Token: "token", Title: "T", Body: "B", CustomData: map[string]string{
+				"from": "x", "message_type": "x", "google.sent_time": "1", "GCM.ttl": "1", "": "x", "ok": "x",
+			}},
+			expectedFields: []string{"custom_data.", "custom_data.GCM.ttl", "custom_data.from", "custom_data.google.sent_time", "custom_data.message_type"},
+		},
+		{
+			name:           "payload over the limit",
+			notification:   fcm.Notification{Token: "token", Title: "T", Body: strings.Repeat("あ", fcm.MaxPayloadSize/3)},
+			expectedFields: []string{"payload"},
+		},
+		{
+			name:         "payload just under the limit",
+			notification: fcm.Notification{Token: "token", Title: "T", Body: strings.Repeat("a", fcm.MaxPayloadSize-50)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fcm.Validate(tt.notification)
+
+			if tt.expectedFields == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+
+			var ve *fcm.ValidationError
+			if !errors.As(err, &ve) {
+				t.Fatalf("Validate() = %v, want *fcm.ValidationError", err)
+			}
+			var fields []string
+			for _, f := range ve.Fields {
+				fields = append(fields, f.Field)
+			}
+			if !slices.Equal(fields, tt.expectedFields) {
+				t.Errorf("fields: got %v want %v (%v)", fields, tt.expectedFields, err)
+			}
+		})
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	benchmarks := []struct {
+		name         string
+		notification fcm.Notification
+	}{
+		{
+			name:         "token",
+			notification: fcm.Notification{Token: "dGVzdA:APA91bH-x_y.z", Title: "Title", Body: "Body", CustomData: map[string]string{"article_id": "12345", "category": "news"}},
+		},
+		{
+			name:         "condition",
+			notification: fcm.Notification{Condition: "'news' in topics && ('jp' in topics || 'us' in topics)", Title: "Title", Body: "Body"},
+		},
+		{
+			name:         "large data",
+			notification: fcm.Notification{Topic: "news", Title: "Title", Body: strings.Repeat("b", 1000), CustomData: map[string]string{"payload": strings.Repeat("x", 2000)}},
+		},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if err := fcm.Validate(bm.notification); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
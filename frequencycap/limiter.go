@@ -0,0 +1,200 @@
+package frequencycap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy は上限を超えた通知の扱いです。
+type Policy string
+
+const (
+	PolicyDrop  Policy = "drop"  // 破棄する (Pub/Subメッセージはackされる)
+	PolicyDefer Policy = "defer" // 送信可能になる時刻まで延期する
+)
+
+// Action は Limiter.Check の判定結果です。
+type Action int
+
+const (
+	Allow Action = iota
+	Drop
+	Defer
+)
+
+// String はメトリクスのラベルに使う判定結果の名前を返します。
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allowed"
+	case Drop:
+		return "dropped"
+	case Defer:
+		return "deferred"
+	}
+
+	return "unknown"
+}
+
+// defaultCategory はカテゴリ別の Rule がない通知の判定を記録するカテゴリです。
+const defaultCategory = "default"
+
+// Rule は1ユーザー (またはトークン) あたりの送信上限です。
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// ParseRule は "10/24h" 形式の文字列を Rule に変換します。
+func ParseRule(s string) (Rule, error) {
+	limit, window, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("frequency cap %q must be in N/duration format", s)
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return Rule{}, fmt.Errorf("frequency cap %q must have a positive limit", s)
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Rule{}, fmt.Errorf("frequency cap %q must have a positive window", s)
+	}
+
+	return Rule{Limit: n, Window: d}, nil
+}
+
+// ParseCategoryRules は "marketing=3/24h,reminder=5/1h" 形式の文字列をカテゴリ別の Rule に変換します。
+func ParseCategoryRules(s string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	if strings.TrimSpace(s) == "" {
+		return rules, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		category, rule, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(category) == "" {
+			return nil, fmt.Errorf("category frequency cap %q must be in category=N/duration format", entry)
+		}
+
+		r, err := ParseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		rules[strings.TrimSpace(category)] = r
+	}
+
+	return rules, nil
+}
+
+// MetricsRecorder は判定結果を記録します。metrics.Metrics が実装しています。
+type MetricsRecorder interface {
+	ObserveFrequencyCap(category, decision string)
+}
+
+// Decision は Limiter.Check の結果です。
+type Decision struct {
+	Action  Action
+	RetryAt time.Time // Action が Defer の場合の送信可能時刻
+}
+
+// Limiter はユーザー (またはトークン) ごとの送信数をローリングウィンドウで制限します。
+// カテゴリ別の Rule があればそれを、なければデフォルトの Rule を適用します。
+type Limiter struct {
+	store      Store
+	policy     Policy
+	defaults   *Rule
+	categories map[string]Rule
+
+	metrics MetricsRecorder
+}
+
+// NewLimiter は新しい Limiter を作成します。defaults が nil の場合、カテゴリ別の Rule がない通知は制限しません。
+func NewLimiter(store Store, policy Policy, defaults *Rule, categories map[string]Rule) (*Limiter, error) {
+	if policy != PolicyDrop && policy != PolicyDefer {
+		return nil, fmt.Errorf("unknown frequency cap policy %q", policy)
+	}
+
+	return &Limiter{
+		store:      store,
+		policy:     policy,
+		defaults:   defaults,
+		categories: categories,
+	}, nil
+}
+
+// WithMetrics は判定結果を m に記録するよう設定します。カテゴリ別の Rule がない通知は "default" として記録します。
+func (l *Limiter) WithMetrics(m MetricsRecorder) *Limiter {
+	l.metrics = m
+
+	return l
+}
+
+// Check は key 宛ての category の通知を now に送信してよいか判定し、許可した場合は送信を記録します。
+// 許可した通知を送信できなかった場合は Release で記録を取り消してください。
+func (l *Limiter) Check(key, category string, now time.Time) (Decision, error) {
+	rule, storeKey, ok := l.rule(key, category)
+	if !ok {
+		return Decision{Action: Allow}, nil
+	}
+
+	allowed, next, err := l.store.Take(storeKey, now, rule.Window, rule.Limit)
+	if err != nil {
+		return Decision{}, fmt.Errorf("checking frequency cap: %w", err)
+	}
+
+	var d Decision
+	switch {
+	case allowed:
+		d = Decision{Action: Allow}
+	case l.policy == PolicyDefer:
+		d = Decision{Action: Defer, RetryAt: next}
+	default:
+		d = Decision{Action: Drop}
+	}
+
+	if l.metrics != nil {
+		l.metrics.ObserveFrequencyCap(l.metricsCategory(category), d.Action.String())
+	}
+
+	return d, nil
+}
+
+// Release は Check が許可した key 宛ての category の通知の送信の記録を取り消します。送信に失敗した通知を上限に数えないためです。
+func (l *Limiter) Release(key, category string) error {
+	_, storeKey, ok := l.rule(key, category)
+	if !ok {
+		return nil
+	}
+
+	if err := l.store.Release(storeKey); err != nil {
+		return fmt.Errorf("releasing frequency cap: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Limiter) rule(key, category string) (Rule, string, bool) {
+	if r, ok := l.categories[category]; ok && category != "" {
+		return r, key + "|" + category, true
+	}
+
+	if l.defaults != nil {
+		return *l.defaults, key, true
+	}
+
+	return Rule{}, "", false
+}
+
+// metricsCategory はメトリクスのラベルの種類を設定済みのカテゴリに限るため、カテゴリ別の Rule がなければ "default" を返します。
+func (l *Limiter) metricsCategory(category string) string {
+	if _, ok := l.categories[category]; ok && category != "" {
+		return category
+	}
+
+	return defaultCategory
+}
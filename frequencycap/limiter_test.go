@@ -0,0 +1,158 @@
+package frequencycap_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/frequencycap"
+)
+
+func TestLimiter_Check(t *testing.T) {
+	base := time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)
+	defaults := frequencycap.Rule{Limit: 2, Window: time.Hour}
+	categories := map[string]frequencycap.Rule{"marketing": {Limit: 1, Window: 24 * time.Hour}}
+
+	type call struct {
+		key, category string
+		at            time.Duration // base からの経過時間
+		want          frequencycap.Action
+		wantRetryAt   time.Duration
+	}
+
+	tests := []struct {
+		name   string
+		policy frequencycap.Policy
+		calls  []call
+	}{
+		{
+			name:   "default rule drops over cap and recovers after window",
+			policy: frequencycap.PolicyDrop,
+			calls: []call{
+				{key: "u1", at: 0, want: frequencycap.Allow},
+				{key: "u1", at: time.Minute, want: frequencycap.Allow},
+				{key: "u1", at: 2 * time.Minute, want: frequencycap.Drop},
+				{key: "u2", at: 2 * time.Minute, want: frequencycap.Allow},
+				{key: "u1", at: time.Hour + time.Second, want: frequencycap.Allow},
+			},
+		},
+		{
+			name:   "defer policy returns time when oldest send leaves window",
+			policy: frequencycap.PolicyDefer,
+			calls: []call{
+				{key: "u1", at: 0, want: frequencycap.Allow},
+				{key: "u1", at: 10 * time.Minute, want: frequencycap.Allow},
+				{key: "u1", at: 20 * time.Minute, want: frequencycap.Defer, wantRetryAt: time.Hour},
+			},
+		},
+		{
+			name:   "category rule is counted separately",
+			policy: frequencycap.PolicyDrop,
+			calls: []call{
+				{key: "u1", category: "marketing", at: 0, want: frequencycap.Allow},
+				{key: "u1", category: "marketing", at: time.Hour, want: frequencycap.Drop},
+				{key: "u1", category: "reminder", at: time.Hour, want: frequencycap.Allow},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), tt.policy, &defaults, categories)
+			if err != nil {
+				t.Fatalf("NewLimiter: %v", err)
+			}
+
+			for i, c := range tt.calls {
+				d, err := l.Check(c.key, c.category, base.Add(c.at))
+				if err != nil {
+					t.Fatalf("call %d: Check: %v", i, err)
+				}
+
+				if d.Action != c.want {
+					t.Errorf("call %d: action = %v, want %v", i, d.Action, c.want)
+				}
+
+				if c.wantRetryAt != 0 && !d.RetryAt.Equal(base.Add(c.wantRetryAt)) {
+					t.Errorf("call %d: retry at = %s, want %s", i, d.RetryAt, base.Add(c.wantRetryAt))
+				}
+			}
+		})
+	}
+}
+
+type fakeRecorder struct {
+	decisions []string
+}
+
+func (r *fakeRecorder) ObserveFrequencyCap(category, decision string) {
+	r.decisions = append(r.decisions, category+"/"+decision)
+}
+
+func TestLimiter_Metrics(t *testing.T) {
+	recorder := &fakeRecorder{}
+	l, _ := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), frequencycap.PolicyDrop, &frequencycap.Rule{Limit: 1, Window: time.Hour},
+		map[string]frequencycap.Rule{"marketing": {Limit: 1, Window: time.Hour}})
+	l.WithMetrics(recorder)
+
+	now := time.Now()
+	l.Check("u1", "marketing", now)
+	l.Check("u1", "marketing", now)
+	l.Check("u1", "unconfigured", now)
+
+	want := []string{"marketing/allowed", "marketing/dropped", "default/allowed"}
+	if !slices.Equal(recorder.decisions, want) {
+		t.Errorf("decisions = %v, want %v", recorder.decisions, want)
+	}
+}
+
+func TestLimiter_Release(t *testing.T) {
+	l, _ := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), frequencycap.PolicyDrop, &frequencycap.Rule{Limit: 1, Window: time.Hour}, nil)
+
+	now := time.Now()
+	if d, _ := l.Check("u1", "", now); d.Action != frequencycap.Allow {
+		t.Fatalf("first Check = %v, want allowed", d.Action)
+	}
+	if err := l.Release("u1", ""); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if d, _ := l.Check("u1", "", now); d.Action != frequencycap.Allow {
+		t.Errorf("Check after Release = %v, want allowed", d.Action)
+	}
+	if d, _ := l.Check("u1", "", now); d.Action != frequencycap.Drop {
+		t.Errorf("Check over cap = %v, want dropped", d.Action)
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	s := frequencycap.NewMemoryStore()
+	base := time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	for _, key := range []string{"u1", "u2", "u3"} {
+		s.Take(key, base, time.Minute, 1)
+	}
+	s.Take("u4", base.Add(30*time.Minute), time.Hour, 1)
+
+	// ウィンドウから外れた key はどこからも参照されなくなっても捨てられる
+	s.Take("u5", base.Add(time.Hour), time.Hour, 1)
+	if got := s.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+}
+
+func TestParseCategoryRules(t *testing.T) {
+	rules, err := frequencycap.ParseCategoryRules("marketing=3/24h, reminder=5/1h")
+	if err != nil {
+		t.Fatalf("ParseCategoryRules: %v", err)
+	}
+
+	if rules["marketing"] != (frequencycap.Rule{Limit: 3, Window: 24 * time.Hour}) || rules["reminder"] != (frequencycap.Rule{Limit: 5, Window: time.Hour}) {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	for _, in := range []string{"marketing", "marketing=0/1h", "marketing=3/forever", "=3/1h"} {
+		if _, err := frequencycap.ParseCategoryRules(in); err == nil {
+			t.Errorf("ParseCategoryRules(%q) succeeded, want error", in)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package frequencycap
+
+import (
+	"sync"
+	"time"
+)
+
+// Store は送信履歴を保持し、ローリングウィンドウ内の送信数を数えます。
+// 複数インスタンスで上限を共有する場合は共有ストレージ上の実装に差し替えてください。
+type Store interface {
+	// Take は key について (at-window, at] の送信数が limit 未満であれば at を記録して true を返します。
+	// 上限に達している場合は記録せず、最も古い記録がウィンドウから外れる時刻とともに false を返します。
+	Take(key string, at time.Time, window time.Duration, limit int) (ok bool, next time.Time, err error)
+	// Release は key について Take で記録した最も新しい送信を取り消します。
+	Release(key string) error
+}
+
+// sweepInterval は MemoryStore がすべての key を走査して期限切れの記録を捨てる間隔です。
+const sweepInterval = time.Minute
+
+// MemoryStore はプロセス内メモリに送信履歴を保持する Store です。
+type MemoryStore struct {
+	mu        sync.Mutex
+	sent      map[string]*history
+	lastSweep time.Time
+}
+
+// history は1つの key の送信時刻 (時刻順) と、それを数えるウィンドウです。
+type history struct {
+	times  []time.Time
+	window time.Duration
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sent: make(map[string]*history)}
+}
+
+func (s *MemoryStore) Take(key string, at time.Time, window time.Duration, limit int) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 以後送信のない key の記録が残り続けないよう、定期的にまとめて捨てる
+	if at.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(at)
+		s.lastSweep = at
+	}
+
+	h, ok := s.sent[key]
+	if !ok {
+		h = &history{}
+		s.sent[key] = h
+	}
+	h.window = window
+
+	// ウィンドウから外れた記録を捨てる
+	times := h.times
+	i := 0
+	for i < len(times) && !times[i].After(at.Add(-window)) {
+		i++
+	}
+	times = times[i:]
+
+	if len(times) >= limit {
+		h.times = times
+		return false, times[len(times)-limit].Add(window), nil
+	}
+
+	if len(times) == 0 {
+		times = nil // 古い配列を解放する
+	}
+	h.times = append(times, at)
+
+	return true, time.Time{}, nil
+}
+
+func (s *MemoryStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.sent[key]
+	if !ok {
+		return nil
+	}
+
+	h.times = h.times[:max(len(h.times)-1, 0)]
+	if len(h.times) == 0 {
+		delete(s.sent, key)
+	}
+
+	return nil
+}
+
+// Len は送信履歴を保持している key の数を返します。
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sent)
+}
+
+// sweep はすべての記録がウィンドウから外れた key を捨てます。
+func (s *MemoryStore) sweep(at time.Time) {
+	for key, h := range s.sent {
+		if len(h.times) == 0 || !h.times[len(h.times)-1].After(at.Add(-h.window)) {
+			delete(s.sent, key)
+		}
+	}
+}
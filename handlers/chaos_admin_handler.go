@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/teamzidi/example-go-fcm/chaos"
+)
+
+// ChaosAdminHandler はFCMへの送信への障害の注入 (カオスモード) を切り替える管理用エンドポイントです。
+//
+//	GET    /admin/chaos  注入が有効かどうかと、そのルールを返します。トークンは数だけを返します。
+//	PUT    /admin/chaos  リクエストボディのルールで注入を始めます。有効ならルールを置き換えます。
+//	DELETE /admin/chaos  注入をやめます。
+type ChaosAdminHandler struct {
+	injector *chaos.Injector
+}
+
+func NewChaosAdminHandler(injector *chaos.Injector) *ChaosAdminHandler {
+	return &ChaosAdminHandler{
+		injector: injector,
+	}
+}
+
+// Get は現在の注入の状態をJSONで返します。
+func (h *ChaosAdminHandler) Get(w http.ResponseWriter, r *http.Request) {
+	h.writeState(r.Context(), w)
+}
+
+// Put はリクエストボディのルール ({"faults":{"UNAVAILABLE":0.1},"latency":"500ms","topics":["news"]}) で注入を始めます。
+func (h *ChaosAdminHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var rules chaos.Rules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.injector.Enable(rules); err != nil {
+		http.Error(w, "Invalid chaos rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.WarnContext(r.Context(), "chaos mode enabled", "handler", "ChaosAdminHandler", "faults", rules.Faults,
+		"latency", rules.Latency.String(), "topics", rules.Topics, "tokens", len(rules.Tokens))
+	h.writeState(r.Context(), w)
+}
+
+// Delete は注入をやめます。
+func (h *ChaosAdminHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	h.injector.Disable()
+
+	slog.WarnContext(r.Context(), "chaos mode disabled", "handler", "ChaosAdminHandler")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ChaosAdminHandler) writeState(ctx context.Context, w http.ResponseWriter) {
+	enabled, rules := h.injector.State()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": enabled,
+		"rules":   rules.Summary(),
+	}); err != nil {
+		slog.ErrorContext(ctx, "encoding response", "handler", "ChaosAdminHandler", "error", err)
+	}
+}
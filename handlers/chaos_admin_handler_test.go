@@ -0,0 +1,68 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/teamzidi/example-go-fcm/chaos"
+	. "github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestChaosAdminHandler(t *testing.T) {
+	injector := chaos.NewInjector()
+
+	mux := http.NewServeMux()
+	admin := NewChaosAdminHandler(injector)
+	mux.HandleFunc("GET /admin/chaos", admin.Get)
+	mux.HandleFunc("PUT /admin/chaos", admin.Put)
+	mux.HandleFunc("DELETE /admin/chaos", admin.Delete)
+
+	tests := []struct {
+		name            string
+		method          string
+		body            string
+		expectedStatus  int
+		expectedEnabled bool
+	}{
+		{name: "disabled by default", method: http.MethodGet, expectedStatus: http.StatusOK},
+		{name: "enable", method: http.MethodPut, body: `{"faults":{"UNAVAILABLE":0.2,"TIMEOUT":0.01},"latency":"100ms","topics":["news"],"tokens":["secret-token"]}`, expectedStatus: http.StatusOK, expectedEnabled: true},
+		{name: "unknown fault", method: http.MethodPut, body: `{"faults":{"NOT_FOUND":0.2}}`, expectedStatus: http.StatusBadRequest, expectedEnabled: true},
+		{name: "rates over 1", method: http.MethodPut, body: `{"faults":{"UNAVAILABLE":0.6,"INTERNAL":0.6}}`, expectedStatus: http.StatusBadRequest, expectedEnabled: true},
+		{name: "invalid latency", method: http.MethodPut, body: `{"latency":"soon"}`, expectedStatus: http.StatusBadRequest, expectedEnabled: true},
+		{name: "enabled", method: http.MethodGet, expectedStatus: http.StatusOK, expectedEnabled: true},
+		{name: "disable", method: http.MethodDelete, expectedStatus: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(tt.method, "/admin/chaos", strings.NewReader(tt.body)))
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+			if enabled, _ := injector.State(); enabled != tt.expectedEnabled {
+				t.Errorf("enabled: got %v want %v", enabled, tt.expectedEnabled)
+			}
+
+			if rr.Code == http.StatusOK {
+				var resp struct {
+					Enabled bool               `json:"enabled"`
+					Rules   chaos.RulesSummary `json:"rules"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Enabled != tt.expectedEnabled {
+					t.Errorf("response %s: %v", rr.Body.String(), err)
+				}
+				if tt.expectedEnabled && (resp.Rules.Faults["UNAVAILABLE"] != 0.2 || resp.Rules.Latency != "100ms" || resp.Rules.Tokens != 1) {
+					t.Errorf("rules: %+v", resp.Rules)
+				}
+				if strings.Contains(rr.Body.String(), "secret-token") {
+					t.Errorf("response contains a token: %s", rr.Body.String())
+				}
+			}
+		})
+	}
+}
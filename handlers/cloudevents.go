@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CloudEvents (https://github.com/cloudevents/spec) で受信する場合の定義。
+// EventarcのPub/Subトリガーは MessagePublishedData をデータとするイベントを送ります。
+const (
+	cloudEventsSpecVersion     = "1.0"
+	cloudEventsContentType     = "application/cloudevents+json"
+	cloudEventsHeaderPrefix    = "Ce-"
+	pubsubMessagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+)
+
+// cloudEventsCoreAttributes は拡張属性として扱わないCloudEventsの属性です。
+var cloudEventsCoreAttributes = map[string]bool{
+	"specversion":     true,
+	"id":              true,
+	"source":          true,
+	"type":            true,
+	"subject":         true,
+	"time":            true,
+	"datacontenttype": true,
+	"dataschema":      true,
+	"data":            true,
+	"data_base64":     true,
+}
+
+// cloudEvent はCloudEventsのイベントのうち、ハンドラが使用する属性とデータです。
+type cloudEvent struct {
+	SpecVersion string
+	ID          string
+	Source      string
+	Type        string
+	Time        string
+	Data        []byte
+	Extensions  map[string]string // 拡張属性。Pub/Subのメッセージ属性として扱う
+}
+
+// decodeBinaryCloudEvent はバイナリモードのCloudEventsをデコードします。属性はヘッダー、データはボディです。
+func decodeBinaryCloudEvent(r *http.Request) (cloudEvent, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return cloudEvent{}, fmt.Errorf("reading CloudEvent data: %v", err)
+	}
+
+	ce := cloudEvent{Data: data}
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, cloudEventsHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+
+		attr := strings.ToLower(strings.TrimPrefix(name, cloudEventsHeaderPrefix))
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			value = values[0]
+		}
+
+		ce.set(attr, value)
+	}
+
+	return ce, ce.validate()
+}
+
+// decodeStructuredCloudEvent は構造化モードのCloudEventsをデコードします。属性とデータはJSONのボディです。
+func decodeStructuredCloudEvent(body io.Reader) (cloudEvent, error) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&fields); err != nil {
+		return cloudEvent{}, fmt.Errorf("decoding CloudEvent: %v", err)
+	}
+
+	var ce cloudEvent
+	for attr, raw := range fields {
+		switch attr {
+		case "data":
+			// JSON以外のデータは文字列として格納される
+			var s string
+			if err := json.Unmarshal(raw, &s); err == nil {
+				ce.Data = []byte(s)
+			} else if !bytes.Equal(raw, []byte("null")) {
+				ce.Data = raw
+			}
+			continue
+		case "data_base64":
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return cloudEvent{}, fmt.Errorf("CloudEvent data_base64 must be a string")
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return cloudEvent{}, fmt.Errorf("decoding CloudEvent data_base64: %w", err)
+			}
+			ce.Data = data
+			continue
+		}
+
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			if cloudEventsCoreAttributes[attr] {
+				return cloudEvent{}, fmt.Errorf("CloudEvent attribute %q must be a string", attr)
+			}
+			value = string(raw) // 拡張属性の数値・真偽値はそのまま文字列にする
+		}
+
+		ce.set(attr, value)
+	}
+
+	return ce, ce.validate()
+}
+
+// set は属性 attr の値を設定します。使用しない標準の属性は無視します。
+func (ce *cloudEvent) set(attr, value string) {
+	switch attr {
+	case "specversion":
+		ce.SpecVersion = value
+	case "id":
+		ce.ID = value
+	case "source":
+		ce.Source = value
+	case "type":
+		ce.Type = value
+	case "time":
+		ce.Time = value
+	default:
+		if !cloudEventsCoreAttributes[attr] {
+			if ce.Extensions == nil {
+				ce.Extensions = make(map[string]string)
+			}
+			ce.Extensions[attr] = value
+		}
+	}
+}
+
+func (ce cloudEvent) validate() error {
+	if ce.SpecVersion != cloudEventsSpecVersion {
+		return fmt.Errorf("unsupported CloudEvents specversion %q", ce.SpecVersion)
+	}
+	for _, a := range []struct{ name, value string }{{"id", ce.ID}, {"source", ce.Source}, {"type", ce.Type}} {
+		if a.value == "" {
+			return fmt.Errorf("CloudEvent attribute %q is required", a.name)
+		}
+	}
+
+	return nil
+}
+
+// pushMessage はイベントをハンドラが処理するメッセージに変換します。
+// EventarcのPub/Subトリガーのイベントは、データの MessagePublishedData からPub/Subのメッセージを取り出します。
+// それ以外のイベントはデータを業務ペイロード、拡張属性をメッセージ属性として扱います。
+func (ce cloudEvent) pushMessage() (pushMessage, error) {
+	if ce.Type == pubsubMessagePublishedType {
+		// MessagePublishedData はPub/SubのPushリクエストと同じ形式
+		return decodeData(bytes.NewReader(ce.Data))
+	}
+
+	msg := pushMessage{
+		Data:         ce.Data,
+		MessageID:    ce.ID,
+		Subscription: ce.Source,
+		Attributes:   ce.Extensions,
+	}
+	msg.PublishTime, _ = time.Parse(time.RFC3339Nano, ce.Time)
+
+	if len(ce.Data) == 0 {
+		return msg, fmt.Errorf("CloudEvent data is empty")
+	}
+
+	return msg, nil
+}
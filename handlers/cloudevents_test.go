@@ -0,0 +1,170 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestPushDeviceHandler_CloudEvents(t *testing.T) {
+	payload, _ := json.Marshal(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"})
+	messagePublished := newPushPubSubRequestWithAttributes(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+		map[string]string{"tenant": "app-a"})
+
+	binaryHeaders := map[string]string{
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "event-1",
+		"Ce-Source":      "//example.com/orders",
+		"Ce-Type":        "com.example.notification.v1",
+		"Content-Type":   "application/json",
+	}
+
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		body           []byte
+		expectedStatus int
+		wantTenant     string // 送信に使ったテナント。送信しない場合は空
+	}{
+		{
+			name:           "binary mode",
+			headers:        binaryHeaders,
+			body:           payload,
+			expectedStatus: http.StatusOK,
+			wantTenant:     "default",
+		},
+		{
+			name:           "binary mode extension is a message attribute",
+			headers:        merge(binaryHeaders, map[string]string{"Ce-Tenant": "app-a"}),
+			body:           payload,
+			expectedStatus: http.StatusOK,
+			wantTenant:     "app-a",
+		},
+		{
+			name: "binary mode Eventarc Pub/Sub event",
+			headers: merge(binaryHeaders, map[string]string{
+				"Ce-Type":   "google.cloud.pubsub.topic.v1.messagePublished",
+				"Ce-Source": "//pubsub.googleapis.com/projects/p/topics/notifications",
+			}),
+			body:           messagePublished,
+			expectedStatus: http.StatusOK,
+			wantTenant:     "app-a",
+		},
+		{
+			name:           "binary mode without id is acked without sending",
+			headers:        merge(binaryHeaders, map[string]string{"Ce-Id": ""}),
+			body:           payload,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "binary mode unsupported specversion",
+			headers:        merge(binaryHeaders, map[string]string{"Ce-Specversion": "0.3"}),
+			body:           payload,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:    "structured mode with JSON data",
+			headers: map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+			body: mustMarshal(t, map[string]any{
+				"specversion": "1.0", "id": "event-1", "source": "//example.com/orders", "type": "com.example.notification.v1",
+				"datacontenttype": "application/json", "tenant": "app-a",
+				"data": json.RawMessage(payload),
+			}),
+			expectedStatus: http.StatusOK,
+			wantTenant:     "app-a",
+		},
+		{
+			name:    "structured mode with data_base64",
+			headers: map[string]string{"Content-Type": "application/cloudevents+json"},
+			body: mustMarshal(t, map[string]any{
+				"specversion": "1.0", "id": "event-1", "source": "//example.com/orders", "type": "com.example.notification.v1",
+				"data_base64": base64.StdEncoding.EncodeToString(payload),
+			}),
+			expectedStatus: http.StatusOK,
+			wantTenant:     "default",
+		},
+		{
+			name:    "structured mode Eventarc Pub/Sub event",
+			headers: map[string]string{"Content-Type": "application/cloudevents+json"},
+			body: mustMarshal(t, map[string]any{
+				"specversion": "1.0", "id": "event-1", "source": "//pubsub.googleapis.com/projects/p/topics/notifications",
+				"type": "google.cloud.pubsub.topic.v1.messagePublished",
+				"data": json.RawMessage(messagePublished),
+			}),
+			expectedStatus: http.StatusOK,
+			wantTenant:     "app-a",
+		},
+		{
+			name:    "structured mode without data is acked without sending",
+			headers: map[string]string{"Content-Type": "application/cloudevents+json"},
+			body: mustMarshal(t, map[string]any{
+				"specversion": "1.0", "id": "event-1", "source": "//example.com/orders", "type": "com.example.notification.v1",
+			}),
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:    "structured mode invalid payload is acked without sending",
+			headers: map[string]string{"Content-Type": "application/cloudevents+json"},
+			body: mustMarshal(t, map[string]any{
+				"specversion": "1.0", "id": "event-1", "source": "//example.com/orders", "type": "com.example.notification.v1",
+				"data": map[string]string{"title": "Title"},
+			}),
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "structured mode malformed JSON",
+			headers:        map[string]string{"Content-Type": "application/cloudevents+json"},
+			body:           []byte("not json"),
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sentWith string
+			mockFor := func(tenant string) *MockFCMClient {
+				return &MockFCMClient{
+					MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+						sentWith = tenant
+						return "fcm-id", nil
+					},
+				}
+			}
+			handler := NewPushDeviceHandler(nil).
+				WithMock(mockFor("default")).
+				WithMockTenants(map[string]any{"app-a": mockFor("app-a")})
+
+			req := httptest.NewRequest(http.MethodPost, "/publish/token", bytes.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("status: got %d want %d (body %q)", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+			if sentWith != tt.wantTenant {
+				t.Errorf("sent with tenant %q, want %q", sentWith, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func merge(base, overrides map[string]string) map[string]string {
+	m := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range overrides {
+		m[k] = v
+	}
+	return m
+}
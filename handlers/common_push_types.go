@@ -1,20 +1,35 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+	"github.com/teamzidi/example-go-fcm/tracing"
 )
 
 // PubSubInternalMessage はPub/SubからのPushリクエストのメッセージ部分の内部構造体です。
 // PubSubPushRequest の Message フィールドとして使用されます。
 type PubSubInternalMessage struct {
-	Data        string `json:"data"` // Base64エンコードされた実際の業務ペイロード
-	MessageID   string `json:"messageId"`
-	PublishTime string `json:"publishTime"`
-	// Attributes map[string]string `json:"attributes,omitempty"` // 必要であれば属性も
+	Data        string            `json:"data"` // Base64エンコードされた実際の業務ペイロード
+	MessageID   string            `json:"messageId"`
+	PublishTime string            `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
 }
 
 // PubSubPushRequest はPub/SubからのPushリクエスト全体の構造体です。
@@ -24,23 +39,402 @@ type PubSubPushRequest struct {
 	Subscription string                `json:"subscription"`
 }
 
-func decodeData(body io.Reader) ([]byte, error) {
+// pushMessage はPub/Subから受信したメッセージのうち、ハンドラが使用する情報です。
+type pushMessage struct {
+	Data         []byte // Base64デコード済みの業務ペイロード
+	MessageID    string
+	PublishTime  time.Time // publishTime が解釈できない場合はゼロ値
+	Subscription string
+	Attributes   map[string]string
+}
+
+// decodeRequest はPushリクエストを形式に応じてデコードします。
+// Pub/SubのPushリクエスト (ラップを解除したものを含む)、CloudEventsのバイナリモード (ce-* ヘッダー)、
+// 構造化モード (application/cloudevents+json) を受け付けます。
+func decodeRequest(r *http.Request) (pushMessage, error) {
+	if r.Header.Get(cloudEventsHeaderPrefix+"Specversion") != "" {
+		ce, err := decodeBinaryCloudEvent(r)
+		if err != nil {
+			return pushMessage{}, err
+		}
+		return ce.pushMessage()
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == cloudEventsContentType {
+		ce, err := decodeStructuredCloudEvent(r.Body)
+		if err != nil {
+			return pushMessage{}, err
+		}
+		return ce.pushMessage()
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return pushMessage{}, fmt.Errorf("reading request body: %v", err)
+	}
+	if !isWrapped(r.Header, body) {
+		return decodeUnwrapped(r.Header, body)
+	}
+
+	return decodeData(bytes.NewReader(body))
+}
+
+func decodeData(body io.Reader) (pushMessage, error) {
 	var pubSubReq PubSubPushRequest
 	if err := json.NewDecoder(body).Decode(&pubSubReq); err != nil {
-		return nil, fmt.Errorf("decoding Pub/Sub envelope: %v", err)
+		return pushMessage{}, fmt.Errorf("decoding Pub/Sub envelope: %v", err)
 	}
 
-	log.Printf("PushDeviceHandler: Received Pub/Sub message ID %s from subscription %s published at %s",
-		pubSubReq.Message.MessageID, pubSubReq.Subscription, pubSubReq.Message.PublishTime)
+	msg := pushMessage{
+		MessageID:    pubSubReq.Message.MessageID,
+		Subscription: pubSubReq.Subscription,
+		Attributes:   pubSubReq.Message.Attributes,
+	}
+	msg.PublishTime, _ = time.Parse(time.RFC3339Nano, pubSubReq.Message.PublishTime)
 
 	if pubSubReq.Message.Data == "" {
-		return nil, fmt.Errorf("Pub/Sub message data is empty")
+		return msg, fmt.Errorf("Pub/Sub message data is empty")
 	}
 
 	decodedData, err := base64.StdEncoding.DecodeString(pubSubReq.Message.Data)
 	if err != nil {
-		return nil, fmt.Errorf("decoding base64 data: %w", err)
+		return msg, fmt.Errorf("decoding base64 data: %w", err)
+	}
+	msg.Data = decodedData
+
+	return msg, nil
+}
+
+// ReceivedMessage はPub/Subのpullで受信したメッセージです。
+type ReceivedMessage struct {
+	ID           string
+	Data         []byte // 業務ペイロード (Base64エンコードされていないもの)
+	Attributes   map[string]string
+	PublishTime  time.Time
+	Subscription string // サブスクリプション名 (projects/<プロジェクトID>/subscriptions/<名前>)
+}
+
+func (m ReceivedMessage) pushMessage() (pushMessage, error) {
+	msg := pushMessage{
+		Data:         m.Data,
+		MessageID:    m.ID,
+		PublishTime:  m.PublishTime,
+		Subscription: m.Subscription,
+		Attributes:   m.Attributes,
+	}
+
+	if len(m.Data) == 0 {
+		return msg, fmt.Errorf("Pub/Sub message data is empty")
+	}
+
+	return msg, nil
+}
+
+// MessageCapturer はpullで受信したメッセージと、同じメッセージをPushで受信した場合の応答を記録します。
+// capture.Recorder が実装しています。path は対応するPushエンドポイントのパスです。
+type MessageCapturer interface {
+	CaptureMessage(ctx context.Context, path string, m ReceivedMessage, status int, response []byte)
+}
+
+// captureMessage は c が設定されていれば、pullで受信したメッセージを writePushResponse と同じ応答で記録します。
+func captureMessage(ctx context.Context, c MessageCapturer, kind string, m ReceivedMessage, response map[string]interface{}, err error) {
+	if c == nil {
+		return
+	}
+
+	status, body := pushResponse(ctx, response, err)
+	c.CaptureMessage(ctx, "/publish/"+kind, m, status, body)
+}
+
+// writePushResponse はPub/Sub Pushへの応答を書き込みます。成功時は処理結果のJSON、再送すべき失敗は 500 (nack)、
+// 再送しない失敗は 204 (ack) を返します。
+func writePushResponse(ctx context.Context, w http.ResponseWriter, response map[string]interface{}, err error) {
+	status, body := pushResponse(ctx, response, err)
+	switch status {
+	case http.StatusInternalServerError:
+		http.Error(w, string(body), status) // Nack
+	case http.StatusNoContent:
+		w.WriteHeader(status) // Ack
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// pushResponse は writePushResponse が返す応答のステータスコードとボディを返します。
+func pushResponse(ctx context.Context, response map[string]interface{}, err error) (int, []byte) {
+	if err != nil {
+		if shouldRetry(err) {
+			return http.StatusInternalServerError, []byte("Failed to send notification via FCM (retryable)")
+		}
+		return http.StatusNoContent, nil
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "encoding success response", "error", err)
+	}
+	return http.StatusOK, append(body, '\n')
+}
+
+// 予約ジョブの種別。エンドポイント名 (/publish/token, /publish/topic) に対応します。
+const (
+	tokenScheduleKind = "token"
+	topicScheduleKind = "topic"
+)
+
+// priorityUrgent はおやすみ時間帯などの配信制御を無視して即時送信する通知の優先度です。
+const priorityUrgent = "urgent"
+
+// ScheduleOptions は送信予約のためのペイロード共通フィールドです。
+// SendAt と Delay はどちらか一方のみ指定できます。どちらも空なら即時送信します。
+type ScheduleOptions struct {
+	SendAt string `json:"send_at,omitempty"` // RFC3339形式の送信時刻 (例: "2025-01-02T09:00:00+09:00")
+	Delay  string `json:"delay,omitempty"`   // 受信時刻からの遅延 (例: "30m", "2h")
+}
+
+// scheduledTime は now を基準にした送信予定時刻を返します。
+// 即時送信すべき場合 (未指定、または指定時刻を過ぎている場合) は ok が false になります。
+func (o ScheduleOptions) scheduledTime(now time.Time) (at time.Time, ok bool, err error) {
+	switch {
+	case o.SendAt != "" && o.Delay != "":
+		return time.Time{}, false, fmt.Errorf("send_at and delay cannot be used together")
+	case o.SendAt != "":
+		at, err = time.Parse(time.RFC3339, o.SendAt)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("parsing send_at: %w", err)
+		}
+	case o.Delay != "":
+		d, err := time.ParseDuration(o.Delay)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("parsing delay: %w", err)
+		}
+		if d < 0 {
+			return time.Time{}, false, fmt.Errorf("delay must not be negative")
+		}
+		at = now.Add(d)
+	default:
+		return time.Time{}, false, nil
+	}
+
+	return at, at.After(now), nil
+}
+
+// 送信しなかった通知の理由。
+const (
+	suppressedByFrequencyCap = "frequency_cap"
+	suppressedByPreference   = "opted_out"
+)
+
+// pushResult は1件のPub/Subメッセージの処理結果です。
+type pushResult struct {
+	MessageID  string    // FCMのメッセージID (即時送信時)
+	ScheduleID string    // 予約ジョブのID (予約時)
+	SendAt     time.Time // 予約された送信時刻 (予約時)
+	Suppressed string    // 配信ポリシーにより送信しなかった理由 (破棄時)
+}
+
+// response は成功時のレスポンスボディを返します。
+func (r pushResult) response() map[string]interface{} {
+	if r.Suppressed != "" {
+		return map[string]interface{}{
+			"status": "suppressed",
+			"reason": r.Suppressed,
+		}
+	}
+
+	if r.ScheduleID != "" {
+		return map[string]interface{}{
+			"status":      "scheduled",
+			"schedule_id": r.ScheduleID,
+			"send_at":     r.SendAt.Format(time.RFC3339),
+		}
+	}
+
+	return map[string]interface{}{
+		"status":     "processed", // "processed" indicates successful delivery or a non-retryable FCM error.
+		"message_id": r.MessageID,
+	}
+}
+
+// defaultSendTimeout は1回のFCMへの送信を待つ時間のデフォルト値です。
+// Pushサブスクリプションの確認応答期限 (60秒) までに応答できるよう、それより短くします。
+const defaultSendTimeout = 30 * time.Second
+
+// sendContext はFCMへの送信に使う、timeout で打ち切られる ctx を返します。timeout が 0 以下なら打ち切りません。
+func sendContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// interrupted は ctx のタイムアウトやキャンセル (リクエストの切断、シャットダウン) で中断された送信のエラーを、
+// 再送対象の retryableError にします。中断されていなければ err をそのまま返します。
+func interrupted(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+
+	return retryableError{fmt.Errorf("%w (%w)", err, context.Cause(ctx))}
+}
+
+// retryableError はFCM以外の要因 (予約ストアへの書き込み失敗など) による一時的な失敗を表します。
+// このエラーで失敗したメッセージは nack され、Pub/Subによって再送されます。
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+
+func (e retryableError) Unwrap() error { return e.err }
+
+// payloadError は業務ペイロードの内容が不正であることを表します。再送しても成功しないため ack されます。
+type payloadError struct {
+	err error
+}
+
+func (e payloadError) Error() string { return e.err.Error() }
+
+func (e payloadError) Unwrap() error { return e.err }
+
+// permanentError は再送すれば成功しうるエラーでも、再送を諦めたことを表します (バッチの再送回数の上限など)。
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (e permanentError) Unwrap() error { return e.err }
+
+// exhausted は予約ジョブの最後の試行 (scheduler.LastAttempt) で再送対象のエラーになった場合、
+// 失敗として配信イベントに記録し、スケジューラがジョブを失敗として残すエラーにします。
+// シャットダウンで中断された送信は次回の起動時に再送されるため、そのまま返します。
+func exhausted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil || !shouldRetry(err) || !scheduler.LastAttempt(ctx) {
+		return err
+	}
+
+	return permanentError{scheduler.Exhausted(err)}
+}
+
+// shouldRetry は err が Pub/Sub に再送させるべきエラーかどうかを判定します。
+func shouldRetry(err error) bool {
+	var pe permanentError
+	if errors.As(err, &pe) {
+		return false
+	}
+
+	var re retryableError
+	return errors.As(err, &re) || IsRetryable(err)
+}
+
+// MetricsRecorder は通知ごとの処理結果を記録します。metrics.Metrics が実装します。
+type MetricsRecorder interface {
+	ObserveNotification(handler, targetType, outcome, fcmErrorCode string)
+	ObservePublishDelay(handler, outcome string, d time.Duration)
+}
+
+// ログの handler フィールドに使うハンドラ名。
+const (
+	pushDeviceHandlerLogName    = "PushDeviceHandler"
+	pushTopicHandlerLogName     = "PushTopicHandler"
+	pushBatchHandlerLogName     = "PushBatchHandler"
+	notificationsHandlerLogName = "NotificationsHandler"
+)
+
+// messageLogger は受信したPub/SubメッセージのIDとサブスクリプションを持つ、リクエスト単位のロガーを返します。
+func messageLogger(ctx context.Context, handler string, msg pushMessage) *slog.Logger {
+	return logging.FromContext(ctx).With("handler", handler, "messageId", msg.MessageID, "subscription", msg.Subscription)
+}
+
+// logFailure は通知の処理に失敗したことを、再送されるかどうかとあわせてログに出力します。
+func logFailure(ctx context.Context, err error) {
+	logger := logging.FromContext(ctx)
+
+	var pe payloadError
+	var ve *fcm.ValidationError
+	switch {
+	case errors.As(err, &ve):
+		logger.WarnContext(ctx, "discarding notification rejected by validation", "error", err, "fieldErrors", ve.Fields)
+	case errors.As(err, &pe):
+		logger.WarnContext(ctx, "discarding invalid notification payload", "error", err)
+	case shouldRetry(err):
+		logger.WarnContext(ctx, "notification failed, will be retried", "error", err, "fcmErrorCode", fcm.ErrorCode(err))
+	default:
+		logger.ErrorContext(ctx, "notification failed permanently", "error", err, "fcmErrorCode", fcm.ErrorCode(err))
+	}
+}
+
+// メトリクスのラベルに使うハンドラ名。
+const (
+	pushDeviceHandlerName    = "push_device"
+	pushTopicHandlerName     = "push_topic"
+	pushBatchHandlerName     = "push_batch"
+	notificationsHandlerName = "notifications"
+)
+
+// outcome は処理結果をメトリクス用の分類に変換します。
+func outcome(result pushResult, err error) string {
+	var pe payloadError
+	switch {
+	case err == nil && result.Suppressed != "":
+		return "suppressed"
+	case err == nil && result.ScheduleID != "":
+		return "scheduled"
+	case err == nil:
+		return "sent"
+	case errors.As(err, &pe):
+		return "invalid"
+	case shouldRetry(err):
+		return "failed_retryable"
+	default:
+		return "failed_permanent"
+	}
+}
+
+// recordOutcome は1件の通知の処理結果を rec に記録します。publishTime がゼロ値の場合は遅延を記録しません。
+func recordOutcome(rec MetricsRecorder, handler, targetType string, publishTime time.Time, result pushResult, err error) {
+	if rec == nil {
+		return
+	}
+
+	o := outcome(result, err)
+	rec.ObserveNotification(handler, targetType, o, fcm.ErrorCode(err))
+
+	if !publishTime.IsZero() {
+		rec.ObservePublishDelay(handler, o, time.Since(publishTime))
+	}
+}
+
+// startMessageSpan はPub/Subメッセージの処理スパンを開始します。
+// メッセージ属性にプロデューサーのトレースコンテキストがあればそれを親とし、HTTPリクエストのスパンはリンクとして関連付けます。
+func startMessageSpan(ctx context.Context, name string, msg pushMessage) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "gcp_pubsub"),
+			attribute.String("messaging.message.id", msg.MessageID),
+			attribute.String("messaging.gcp_pubsub.subscription", msg.Subscription),
+		),
+	}
+
+	parent := tracing.ExtractAttributes(ctx, msg.Attributes)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() && !sc.Equal(trace.SpanContextFromContext(parent)) {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+
+	return tracing.Tracer().Start(parent, name, opts...)
+}
+
+// endSpan は err があればスパンにエラーとして記録してから終了します。
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 
-	return decodedData, nil
+	span.End()
 }
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func benchmarkPayload(dataSize int) []byte {
+	return fmt.Appendf(nil, `{"title":"Title","body":"Body","token":"token-1","custom_data":{"payload":%q}}`, strings.Repeat("x", dataSize))
+}
+
+func BenchmarkDecodeData(b *testing.B) {
+	for _, size := range []int{100, 64 << 10} {
+		body := fmt.Appendf(nil, `{"message":{"data":%q,"messageId":"1","publishTime":"2025-01-01T00:00:00Z","attributes":{"tenant":"a"}},"subscription":"projects/p/subscriptions/s"}`,
+			base64.StdEncoding.EncodeToString(benchmarkPayload(size)))
+
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				if _, err := decodeData(bytes.NewReader(body)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecodeRequest はPushリクエストの形式ごとに、ボディの読み込みからペイロードの取り出しまでを計測します。
+func BenchmarkDecodeRequest(b *testing.B) {
+	payload := benchmarkPayload(100)
+	data := base64.StdEncoding.EncodeToString(payload)
+
+	benchmarks := []struct {
+		name    string
+		body    []byte
+		headers map[string]string
+	}{
+		{
+			name:    "wrapped",
+			body:    fmt.Appendf(nil, `{"message":{"data":%q,"messageId":"1"},"subscription":"projects/p/subscriptions/s"}`, data),
+			headers: map[string]string{"Content-Type": "application/json"},
+		},
+		{
+			name:    "unwrapped",
+			body:    payload,
+			headers: map[string]string{"Content-Type": "application/json", noWrapperMessageIDHeader: "1", noWrapperSubscriptionHeader: "projects/p/subscriptions/s"},
+		},
+		{
+			name:    "structured CloudEvent",
+			body:    fmt.Appendf(nil, `{"specversion":"1.0","type":"google.cloud.pubsub.topic.v1.messagePublished","source":"//pubsub.googleapis.com/projects/p/topics/t","id":"1","data":{"message":{"data":%q,"messageId":"1"},"subscription":"projects/p/subscriptions/s"}}`, data),
+			headers: map[string]string{"Content-Type": cloudEventsContentType},
+		},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				req := httptest.NewRequest(http.MethodPost, "/publish/token", bytes.NewReader(bm.body))
+				for name, value := range bm.headers {
+					req.Header.Set(name, value)
+				}
+				if msg, err := decodeRequest(req); err != nil || len(msg.Data) == 0 {
+					b.Fatalf("decodeRequest: %v", err)
+				}
+			}
+		})
+	}
+}
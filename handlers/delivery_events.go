@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/teamzidi/example-go-fcm/events"
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// correlationIDAttribute はプロデューサーが相関IDを指定するPub/Subメッセージ属性です。
+// ペイロードの correlation_id が優先されます。
+const correlationIDAttribute = "correlation_id"
+
+// schedulerHandlerName は予約時刻を迎えて送信した通知のイベントの handler です。
+const schedulerHandlerName = "scheduler"
+
+// EventEmitter は通知の最終的な処理結果をイベントとして送出します。events.Emitter が実装します。
+type EventEmitter interface {
+	Emit(e events.Event)
+}
+
+// eventSource は配信イベントに含める、通知を受け付けた経路の情報です。
+type eventSource struct {
+	handler       string
+	messageID     string
+	correlationID string
+}
+
+type eventSourceKey struct{}
+
+func withEventSource(ctx context.Context, src eventSource) context.Context {
+	return context.WithValue(ctx, eventSourceKey{}, src)
+}
+
+func eventSourceFrom(ctx context.Context) eventSource {
+	src, _ := ctx.Value(eventSourceKey{}).(eventSource)
+	return src
+}
+
+// messageEventSource は受信したPub/Subメッセージの eventSource を返します。
+func messageEventSource(handler string, msg pushMessage) eventSource {
+	return eventSource{
+		handler:       handler,
+		messageID:     msg.MessageID,
+		correlationID: msg.Attributes[correlationIDAttribute],
+	}
+}
+
+// eventTarget は配信イベントに含める、通知の送信先の情報です。
+type eventTarget struct {
+	targetType    string
+	target        string
+	tenant        string
+	correlationID string
+}
+
+func (p DevicePushPayload) eventTarget() eventTarget {
+	return eventTarget{targetType: tokenScheduleKind, target: p.Token, tenant: p.Tenant, correlationID: p.CorrelationID}
+}
+
+func (p TopicPushPayload) eventTarget() eventTarget {
+	return eventTarget{targetType: topicScheduleKind, target: p.Topic, tenant: p.Tenant, correlationID: p.CorrelationID}
+}
+
+// emitOutcome は処理結果が最終的なもの (送信・破棄・再送しない失敗) であればイベントを送出します。
+// 予約した通知と再送される失敗は、後の処理で結果が決まるため送出しません。
+func emitOutcome(ctx context.Context, emitter EventEmitter, target eventTarget, result pushResult, err error) {
+	if emitter == nil {
+		return
+	}
+
+	src := eventSourceFrom(ctx)
+	correlationID := target.correlationID
+	if correlationID == "" {
+		correlationID = src.correlationID
+	}
+
+	e := events.Event{
+		Handler:       src.handler,
+		MessageID:     src.messageID,
+		CorrelationID: correlationID,
+		Tenant:        target.tenant,
+		TargetType:    target.targetType,
+		Target:        target.target,
+	}
+
+	var pe payloadError
+	var ve *fcm.ValidationError
+	switch {
+	case err == nil && result.Suppressed != "":
+		e.Type = events.TypeSuppressed
+		e.Reason = result.Suppressed
+	case err == nil && result.ScheduleID != "":
+		return
+	case err == nil:
+		e.Type = events.TypeSent
+		e.FCMMessageID = result.MessageID
+	case errors.As(err, &pe), errors.As(err, &ve):
+		e.Type = events.TypeFailed
+		e.ErrorClass = events.ErrorClassInvalid
+		e.Error = err.Error()
+		if errors.As(err, &ve) {
+			for _, f := range ve.Fields {
+				e.FieldErrors = append(e.FieldErrors, events.FieldError{Field: f.Field, Message: f.Message})
+			}
+		}
+	case shouldRetry(err):
+		return
+	default:
+		e.Type = events.TypeFailed
+		e.ErrorClass = events.ErrorClassPermanent
+		e.FCMErrorCode = fcm.ErrorCode(err)
+		e.Error = err.Error()
+	}
+
+	emitter.Emit(e)
+}
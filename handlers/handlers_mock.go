@@ -5,11 +5,14 @@ package handlers
 import (
 	"context"
 	"strings"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
 )
 
 type fcmClient interface {
 	SendToToken(ctx context.Context, token, title, body string, customData map[string]string) (string, error)
 	SendToTopic(ctx context.Context, topic, title, body string, customData map[string]string) (string, error)
+	SendEach(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult
 }
 
 func IsRetryable(err error) bool {
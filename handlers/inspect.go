@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DecodePushRequest はPushリクエストをハンドラと同じ規則でデコードします。
+// キャプチャしたリクエストを調べるデバッグ用です (fcmctl decode)。
+// デコードに失敗した場合も、分かった範囲のメタデータを返します。
+func DecodePushRequest(r *http.Request) (ReceivedMessage, error) {
+	msg, err := decodeRequest(r)
+	return ReceivedMessage{
+		ID:           msg.MessageID,
+		Data:         msg.Data,
+		Attributes:   msg.Attributes,
+		PublishTime:  msg.PublishTime,
+		Subscription: msg.Subscription,
+	}, err
+}
+
+// ValidatePayload は業務ペイロードをハンドラと同じ規則で検証し、その種類 ("token", "topic", "batch") を返します。
+// バッチの場合は、不正な通知ごとのエラーをまとめて返します。
+func ValidatePayload(data []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("decoding payload: %w", err)
+	}
+
+	if _, ok := fields["notifications"]; !ok {
+		req, err := parseNotification(data)
+		return req.target, err
+	}
+
+	var payload BatchPushPayload
+	if err := decodePayload(data, &payload); err != nil {
+		return batchTargetType, fmt.Errorf("unmarshalling batch payload (%d bytes): %v", len(data), err)
+	}
+	if len(payload.Notifications) == 0 {
+		return batchTargetType, fmt.Errorf("notifications is required in batch payload")
+	}
+
+	var errs []error
+	for i, item := range payload.Notifications {
+		if _, err := parseBatchItem(i, item, payload.Tenant, payload.SchemaVersion, true); err != nil {
+			errs = append(errs, fmt.Errorf("notification %d: %w", i, err))
+		}
+	}
+	return batchTargetType, errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+package handlers_test
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestValidatePayload(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		expectedType  string
+		expectedError bool
+	}{
+		{name: "device", payload: `{"title":"T","body":"B","token":"t"}`, expectedType: "token"},
+		{name: "topic", payload: `{"title":"T","body":"B","topic":"news"}`, expectedType: "topic"},
+		{name: "batch", payload: `{"notifications":[{"title":"T","body":"B","token":"t"},{"title":"T","body":"B","topic":"news"}]}`, expectedType: "batch"},
+		{name: "missing body", payload: `{"title":"T","token":"t"}`, expectedType: "token", expectedError: true},
+		{name: "invalid batch item", payload: `{"notifications":[{"title":"T","body":"B","token":"t","delay":"1m"}]}`, expectedType: "batch", expectedError: true},
+		{name: "no target", payload: `{"title":"T","body":"B"}`, expectedError: true},
+		{name: "not JSON", payload: `hello`, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, err := ValidatePayload([]byte(tt.payload))
+			if kind != tt.expectedType {
+				t.Errorf("type: got %q want %q", kind, tt.expectedType)
+			}
+			if (err != nil) != tt.expectedError {
+				t.Errorf("error: got %v, want error %v", err, tt.expectedError)
+			}
+		})
+	}
+}
+
+// BenchmarkValidatePayload はハンドラがペイロードをデコードして検証する処理を計測します。
+func BenchmarkValidatePayload(b *testing.B) {
+	benchmarks := []struct {
+		name    string
+		payload string
+	}{
+		{name: "device", payload: `{"title":"T","body":"B","token":"t","custom_data":{"article_id":"12345"},"user_id":"u-1","category":"news"}`},
+		{name: "v2 device", payload: `{"schema_version":2,"title":"T","body":"B","token":"t","custom_data":{"article_id":"12345"}}`},
+		{name: "batch of 10", payload: `{"notifications":[` + strings.TrimSuffix(strings.Repeat(`{"title":"T","body":"B","token":"t"},`, 10), ",") + `]}`},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := ValidatePayload([]byte(bm.payload)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"log"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
 )
 
 func (h *PushDeviceHandler) WithMock(mock any) *PushDeviceHandler {
@@ -17,6 +20,27 @@ func (h *PushDeviceHandler) WithMock(mock any) *PushDeviceHandler {
 	return h
 }
 
+// WithMockTenants はテナントごとのクライアントをモックに差し替えます。
+func (h *PushDeviceHandler) WithMockTenants(mocks map[string]any) *PushDeviceHandler {
+	h.tenants = make(tenantClients, len(mocks))
+	for name, mock := range mocks {
+		c, ok := mock.(fcmClient)
+		if !ok {
+			panic("mock must implement fcmClient interface")
+		}
+		h.tenants[name] = c
+	}
+
+	return h
+}
+
+// WithClock はテスト用に現在時刻を返す関数を差し替えます。
+func (h *PushDeviceHandler) WithClock(now func() time.Time) *PushDeviceHandler {
+	h.now = now
+
+	return h
+}
+
 func (h *PushTopicHandler) WithMock(mock any) *PushTopicHandler {
 	c, ok := mock.(fcmClient)
 	if !ok {
@@ -28,9 +52,35 @@ func (h *PushTopicHandler) WithMock(mock any) *PushTopicHandler {
 	return h
 }
 
+// WithMockTenants はテナントごとのクライアントをモックに差し替えます。
+func (h *PushTopicHandler) WithMockTenants(mocks map[string]any) *PushTopicHandler {
+	h.tenants = make(tenantClients, len(mocks))
+	for name, mock := range mocks {
+		c, ok := mock.(fcmClient)
+		if !ok {
+			panic("mock must implement fcmClient interface")
+		}
+		h.tenants[name] = c
+	}
+
+	return h
+}
+
+func (h *PushBatchHandler) WithMock(mock any) *PushBatchHandler {
+	c, ok := mock.(fcmClient)
+	if !ok {
+		panic("mock must implement fcmClient interface")
+	}
+
+	h.fcmClient = c
+
+	return h
+}
+
 type MockFCMClient struct {
 	MockSendToToken func(ctx context.Context, token, title, body string, customData map[string]string) (string, error)
 	MockSendToTopic func(ctx context.Context, topic, title, body string, customData map[string]string) (string, error)
+	MockSendEach    func(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult
 }
 
 func (m *MockFCMClient) SendToToken(ctx context.Context, token string, title string, body string, customData map[string]string) (string, error) {
@@ -57,3 +107,21 @@ func (m *MockFCMClient) SendToTopic(ctx context.Context, topic string, title str
 	}
 	return "mock-message-id-for-topic-" + topic, nil
 }
+
+// SendEach は MockSendEach が未設定なら通知ごとに SendToToken / SendToTopic を呼び出します。
+func (m *MockFCMClient) SendEach(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult {
+	if m.MockSendEach != nil {
+		return m.MockSendEach(ctx, notifications)
+	}
+
+	results := make([]fcm.SendResult, len(notifications))
+	for i, n := range notifications {
+		if n.Token != "" {
+			results[i].MessageID, results[i].Err = m.SendToToken(ctx, n.Token, n.Title, n.Body, n.CustomData)
+		} else {
+			results[i].MessageID, results[i].Err = m.SendToTopic(ctx, n.Topic, n.Title, n.Body, n.CustomData)
+		}
+	}
+
+	return results
+}
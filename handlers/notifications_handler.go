@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// defaultMaxNotificationsRequestBytes は /v1/notifications が受け付けるリクエストボディの上限のデフォルト値です。
+const defaultMaxNotificationsRequestBytes = 1 << 20
+
+// NotificationsHandler はPub/Subのエンベロープを介さずに通知を直接送信するREST APIです (POST /v1/notifications)。
+// リクエストボディは DevicePushPayload または TopicPushPayload のJSON、あるいはそれらの配列で、
+// token を持つものはデバイストークン宛て、topic を持つものはトピック宛てとして処理されます。
+//
+// ステータスコード:
+//   - 200: すべての通知を処理した (送信・予約・ポリシーによる破棄を含む)
+//   - 400: リクエストボディがJSONとして不正
+//   - 422: ペイロードの検証に失敗した (この場合は1件も送信しない)
+//   - 502: FCMへの送信に失敗した通知がある
+//   - 503: 予約ストアなど内部の一時的なエラーで処理できなかった通知がある
+type NotificationsHandler struct {
+	device  *PushDeviceHandler
+	topic   *PushTopicHandler
+	metrics MetricsRecorder
+
+	maxRequestBytes int64
+}
+
+func NewNotificationsHandler(device *PushDeviceHandler, topic *PushTopicHandler) *NotificationsHandler {
+	return &NotificationsHandler{
+		device:          device,
+		topic:           topic,
+		maxRequestBytes: defaultMaxNotificationsRequestBytes,
+	}
+}
+
+// WithMetrics は処理結果をメトリクスとして記録するよう設定します。
+func (h *NotificationsHandler) WithMetrics(m MetricsRecorder) *NotificationsHandler {
+	h.metrics = m
+
+	return h
+}
+
+// WithMaxRequestBytes は受け付けるリクエストボディの上限 (バイト) を設定します。
+func (h *NotificationsHandler) WithMaxRequestBytes(n int64) *NotificationsHandler {
+	h.maxRequestBytes = n
+
+	return h
+}
+
+// notificationResult は1件の通知の処理結果です。
+type notificationResult struct {
+	Index      int    `json:"index"`
+	Target     string `json:"target,omitempty"` // "token" または "topic"
+	Status     string `json:"status"`           // "processed", "scheduled", "suppressed", "invalid", "failed"
+	MessageID  string `json:"message_id,omitempty"`
+	ScheduleID string `json:"schedule_id,omitempty"`
+	SendAt     string `json:"send_at,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Retryable  bool   `json:"retryable,omitempty"`
+}
+
+// notificationRequest は検証済みの1件の通知です。
+type notificationRequest struct {
+	target string
+	data   []byte
+	device DevicePushPayload
+	topic  TopicPushPayload
+}
+
+// ServeHTTP はHTTPリクエストを処理します。
+func (h *NotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, err := readNotifications(http.MaxBytesReader(w, r.Body, h.maxRequestBytes))
+	if err != nil {
+		writeNotificationResults(r.Context(), w, http.StatusBadRequest, nil, err.Error())
+		return
+	}
+
+	reqs := make([]notificationRequest, len(items))
+	var invalid []notificationResult
+	for i, item := range items {
+		req, err := parseNotification(item)
+		if err != nil {
+			recordOutcome(h.metrics, notificationsHandlerName, req.target, time.Time{}, pushResult{}, payloadError{err})
+			invalid = append(invalid, notificationResult{Index: i, Target: req.target, Status: "invalid", Error: err.Error()})
+			continue
+		}
+		reqs[i] = req
+	}
+
+	if len(invalid) > 0 {
+		writeNotificationResults(r.Context(), w, http.StatusUnprocessableEntity, invalid, "invalid notification payload")
+		return
+	}
+
+	status := http.StatusOK
+	results := make([]notificationResult, len(reqs))
+	for i, req := range reqs {
+		logger := logging.FromContext(r.Context()).With("handler", notificationsHandlerLogName, "index", i, "target", req.target)
+		ctx := logging.WithLogger(r.Context(), logger)
+		ctx = withEventSource(ctx, eventSource{handler: notificationsHandlerName})
+
+		var result pushResult
+		var err error
+		switch req.target {
+		case tokenScheduleKind:
+			result, err = h.device.process(ctx, req.device, req.data)
+		case topicScheduleKind:
+			result, err = h.topic.process(ctx, req.topic, req.data)
+		}
+
+		recordOutcome(h.metrics, notificationsHandlerName, req.target, time.Time{}, result, err)
+		results[i] = newNotificationResult(i, req.target, result, err)
+		if err != nil {
+			logFailure(ctx, err)
+			status = max(status, errorStatus(err))
+		}
+	}
+
+	writeNotificationResults(r.Context(), w, status, results, "")
+}
+
+// readNotifications はリクエストボディを1件または配列の通知として読み込みます。
+func readNotifications(body io.Reader) ([]json.RawMessage, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, fmt.Errorf("request body is empty")
+	}
+
+	if b[0] != '[' {
+		if !json.Valid(b) {
+			return nil, fmt.Errorf("request body is not valid JSON")
+		}
+		return []json.RawMessage{b}, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("decoding request body: %w", err)
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("request body contains no notifications")
+	}
+
+	return items, nil
+}
+
+// parseNotification は token / topic の有無で送信先の種類を判定し、対応するペイロードとして検証します。
+func parseNotification(data []byte) (notificationRequest, error) {
+	var target struct {
+		Token string `json:"token"`
+		Topic string `json:"topic"`
+	}
+	if err := json.Unmarshal(data, &target); err != nil {
+		return notificationRequest{}, fmt.Errorf("decoding notification: %w", err)
+	}
+
+	req := notificationRequest{data: data}
+	var err error
+	switch {
+	case target.Token != "" && target.Topic != "":
+		return req, fmt.Errorf("token and topic cannot be used together")
+	case target.Token != "":
+		req.target = tokenScheduleKind
+		req.device, err = parseDevicePushPayload(data)
+	case target.Topic != "":
+		req.target = topicScheduleKind
+		req.topic, err = parseTopicPushPayload(data)
+	default:
+		return req, fmt.Errorf("token or topic is required in payload")
+	}
+
+	return req, err
+}
+
+func newNotificationResult(index int, target string, result pushResult, err error) notificationResult {
+	res := notificationResult{Index: index, Target: target}
+
+	if err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+		res.Retryable = shouldRetry(err)
+		return res
+	}
+
+	switch {
+	case result.Suppressed != "":
+		res.Status = "suppressed"
+		res.Reason = result.Suppressed
+	case result.ScheduleID != "":
+		res.Status = "scheduled"
+		res.ScheduleID = result.ScheduleID
+		res.SendAt = result.SendAt.Format(time.RFC3339)
+	default:
+		res.Status = "processed"
+		res.MessageID = result.MessageID
+	}
+
+	return res
+}
+
+// errorStatus は送信に失敗した通知のエラーに対応するHTTPステータスコードを返します。
+func errorStatus(err error) int {
+	var pe payloadError
+	var re retryableError
+	switch {
+	case errors.As(err, &pe):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &re):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeNotificationResults(ctx context.Context, w http.ResponseWriter, status int, results []notificationResult, message string) {
+	body := map[string]interface{}{}
+	if message != "" {
+		body["error"] = message
+	}
+	if results != nil {
+		body["results"] = results
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.ErrorContext(ctx, "encoding response", "handler", notificationsHandlerLogName, "error", err)
+	}
+}
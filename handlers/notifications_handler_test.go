@@ -0,0 +1,151 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestNotificationsHandler(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		body             string
+		mockSendToToken  func(ctx context.Context, token, title, body string, customData map[string]string) (string, error)
+		expectedStatus   int
+		expectedStatuses []string
+		expectedIDs      []string // 結果ごとの message_id。nil なら確認しない
+		expectedSends    int
+	}{
+		{
+			name:             "single token notification",
+			method:           http.MethodPost,
+			body:             `{"title":"Title","body":"Body","token":"token"}`,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"processed"},
+			expectedSends:    1,
+		},
+		{
+			name:             "token and topic notifications",
+			method:           http.MethodPost,
+			body:             `[{"title":"Title","body":"Body","token":"token"},{"title":"Title","body":"Body","topic":"news"}]`,
+			expectedStatus:   http.StatusOK,
+			expectedStatuses: []string{"processed", "processed"},
+			expectedIDs:      []string{"fcm-token-id", "fcm-topic-id"},
+			expectedSends:    2,
+		},
+		{
+			name:           "malformed JSON",
+			method:         http.MethodPost,
+			body:           `{"title":`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:             "invalid payload sends nothing",
+			method:           http.MethodPost,
+			body:             `[{"title":"Title","body":"Body","token":"token"},{"title":"Title","token":"token"}]`,
+			expectedStatus:   http.StatusUnprocessableEntity,
+			expectedStatuses: []string{"invalid"},
+		},
+		{
+			name:             "missing target",
+			method:           http.MethodPost,
+			body:             `{"title":"Title","body":"Body"}`,
+			expectedStatus:   http.StatusUnprocessableEntity,
+			expectedStatuses: []string{"invalid"},
+		},
+		{
+			name:             "invalid delay",
+			method:           http.MethodPost,
+			body:             `{"title":"Title","body":"Body","token":"token","delay":"soon"}`,
+			expectedStatus:   http.StatusUnprocessableEntity,
+			expectedStatuses: []string{"invalid"},
+		},
+		{
+			name:   "FCM failure",
+			method: http.MethodPost,
+			body:   `[{"title":"Title","body":"Body","token":"bad-token"},{"title":"Title","body":"Body","topic":"news"}]`,
+			mockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+				return "", errors.New("invalid registration token")
+			},
+			expectedStatus:   http.StatusBadGateway,
+			expectedStatuses: []string{"failed", "processed"},
+			expectedIDs:      []string{"", "fcm-topic-id"},
+			expectedSends:    1,
+		},
+		{
+			name:           "invalid HTTP method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sends := 0
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					if tt.mockSendToToken != nil {
+						return tt.mockSendToToken(ctx, token, title, body, customData)
+					}
+					sends++
+					return "fcm-token-id", nil
+				},
+				MockSendToTopic: func(ctx context.Context, topic, title, body string, customData map[string]string) (string, error) {
+					sends++
+					return "fcm-topic-id", nil
+				},
+			}
+
+			handler := NewNotificationsHandler(new(PushDeviceHandler).WithMock(mockClient), new(PushTopicHandler).WithMock(mockClient))
+
+			req := httptest.NewRequest(tt.method, "/v1/notifications", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+
+			if sends != tt.expectedSends {
+				t.Errorf("FCM sends: got %d want %d", sends, tt.expectedSends)
+			}
+
+			if tt.expectedStatuses == nil {
+				return
+			}
+
+			var resp struct {
+				Results []struct {
+					Status    string `json:"status"`
+					MessageID string `json:"message_id"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+
+			if len(resp.Results) != len(tt.expectedStatuses) {
+				t.Fatalf("results: got %s want statuses %v", rr.Body.String(), tt.expectedStatuses)
+			}
+
+			for i, want := range tt.expectedStatuses {
+				if resp.Results[i].Status != want {
+					t.Errorf("result %d status: got %q want %q", i, resp.Results[i].Status, want)
+				}
+			}
+			for i, want := range tt.expectedIDs {
+				if resp.Results[i].MessageID != want {
+					t.Errorf("result %d message_id: got %q want %q", i, resp.Results[i].MessageID, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ペイロードのラップを解除したPushサブスクリプション (--push-no-wrapper) のメタデータのヘッダー。
+// --push-no-wrapper-write-metadata を指定した場合に付きます。
+const (
+	noWrapperHeaderPrefix       = "X-Goog-Pubsub-"
+	noWrapperSubscriptionHeader = noWrapperHeaderPrefix + "Subscription-Name"
+	noWrapperMessageIDHeader    = noWrapperHeaderPrefix + "Message-Id"
+	noWrapperPublishTimeHeader  = noWrapperHeaderPrefix + "Publish-Time"
+)
+
+// isWrapped は body がPub/SubのPushリクエスト (ラップされたメッセージ) かどうかを判定します。
+// メタデータのヘッダーがあればラップされていません。ヘッダーがない場合 (メタデータを書き込まない設定) は
+// ボディが message オブジェクトを持つJSONかどうかで判定します。JSONとして解釈できないボディはラップされたものとして扱い、
+// デコードの失敗として報告します。
+func isWrapped(header http.Header, body []byte) bool {
+	for name := range header {
+		if strings.HasPrefix(name, noWrapperHeaderPrefix) {
+			return false
+		}
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return true
+	}
+
+	message, ok := envelope["message"]
+	if !ok {
+		return false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return false
+	}
+	_, hasData := fields["data"]
+	_, hasID := fields["messageId"]
+
+	return hasData || hasID
+}
+
+// decodeUnwrapped はラップを解除したPushリクエストをデコードします。ボディが業務ペイロードそのもので、
+// メッセージID・publishTime・サブスクリプション名と属性は X-Goog-Pubsub-* ヘッダーに入っています。
+// HTTPヘッダーは大文字小文字を区別しないため、属性名は小文字にします。
+func decodeUnwrapped(header http.Header, body []byte) (pushMessage, error) {
+	msg := pushMessage{
+		MessageID:    header.Get(noWrapperMessageIDHeader),
+		Subscription: header.Get(noWrapperSubscriptionHeader),
+	}
+	msg.PublishTime, _ = time.Parse(time.RFC3339Nano, header.Get(noWrapperPublishTimeHeader))
+
+	for name, values := range header {
+		switch name {
+		case noWrapperSubscriptionHeader, noWrapperMessageIDHeader, noWrapperPublishTimeHeader:
+			continue
+		}
+		if !strings.HasPrefix(name, noWrapperHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+
+		if msg.Attributes == nil {
+			msg.Attributes = make(map[string]string)
+		}
+		msg.Attributes[strings.ToLower(strings.TrimPrefix(name, noWrapperHeaderPrefix))] = values[0]
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return msg, fmt.Errorf("Pub/Sub message data is empty")
+	}
+	msg.Data = body
+
+	return msg, nil
+}
@@ -0,0 +1,125 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+)
+
+func TestPushHandlers_NoWrapper(t *testing.T) {
+	metadata := map[string]string{
+		"X-Goog-Pubsub-Subscription-Name": "projects/p/subscriptions/notifications",
+		"X-Goog-Pubsub-Message-Id":        "123",
+		"X-Goog-Pubsub-Publish-Time":      "2025-01-02T09:00:00Z",
+	}
+
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		device         any // デバイス宛てハンドラへのボディ
+		topic          any // トピック宛てハンドラへのボディ
+		expectedStatus int
+		wantTenant     string // 送信に使ったテナント。送信しない場合は空
+	}{
+		{
+			name:           "unwrapped with metadata headers",
+			headers:        metadata,
+			device:         DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+			topic:          TopicPushPayload{Title: "Title", Body: "Body", Topic: "news"},
+			expectedStatus: http.StatusOK,
+			wantTenant:     "default",
+		},
+		{
+			name:           "unwrapped without metadata headers",
+			device:         DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+			topic:          TopicPushPayload{Title: "Title", Body: "Body", Topic: "news"},
+			expectedStatus: http.StatusOK,
+			wantTenant:     "default",
+		},
+		{
+			name:           "attribute header selects tenant",
+			headers:        merge(metadata, map[string]string{"X-Goog-Pubsub-Tenant": "app-a"}),
+			device:         DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+			topic:          TopicPushPayload{Title: "Title", Body: "Body", Topic: "news"},
+			expectedStatus: http.StatusOK,
+			wantTenant:     "app-a",
+		},
+		{
+			name:           "wrapped delivery is still accepted",
+			device:         newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			topic:          newPushPubSubRequest(TopicPushPayload{Title: "Title", Body: "Body", Topic: "news"}),
+			expectedStatus: http.StatusOK,
+			wantTenant:     "default",
+		},
+		{
+			name:           "empty unwrapped body is acked without sending",
+			headers:        metadata,
+			device:         []byte{},
+			topic:          []byte{},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "invalid unwrapped payload is acked without sending",
+			headers:        metadata,
+			device:         []byte(`{"title":"Title"}`),
+			topic:          []byte(`{"title":"Title"}`),
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, target := range []string{"device", "topic"} {
+			t.Run(tt.name+"/"+target, func(t *testing.T) {
+				var sentWith string
+				mockFor := func(tenant string) *MockFCMClient {
+					return &MockFCMClient{
+						MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+							sentWith = tenant
+							return "fcm-id", nil
+						},
+						MockSendToTopic: func(ctx context.Context, topic, title, body string, customData map[string]string) (string, error) {
+							sentWith = tenant
+							return "fcm-id", nil
+						},
+					}
+				}
+
+				var handler http.Handler
+				body := tt.device
+				if target == "device" {
+					handler = NewPushDeviceHandler(nil).
+						WithMock(mockFor("default")).
+						WithMockTenants(map[string]any{"app-a": mockFor("app-a")})
+				} else {
+					handler = NewPushTopicHandler(nil).
+						WithMock(mockFor("default")).
+						WithMockTenants(map[string]any{"app-a": mockFor("app-a")})
+					body = tt.topic
+				}
+
+				b, ok := body.([]byte)
+				if !ok {
+					b = mustMarshal(t, body)
+				}
+				req := httptest.NewRequest(http.MethodPost, "/publish/"+target, bytes.NewReader(b))
+				for k, v := range tt.headers {
+					req.Header.Set(k, v)
+				}
+				rr := httptest.NewRecorder()
+
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != tt.expectedStatus {
+					t.Errorf("status: got %d want %d (body %q)", rr.Code, tt.expectedStatus, rr.Body.String())
+				}
+				if sentWith != tt.wantTenant {
+					t.Errorf("sent with tenant %q, want %q", sentWith, tt.wantTenant)
+				}
+			})
+		}
+	}
+}
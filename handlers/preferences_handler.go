@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/preferences"
+)
+
+// PreferencesHandler はユーザー (またはデバイストークン) ごとの通知設定を参照・更新するエンドポイントです。
+//
+//	GET /preferences/users/{user_id}        PUT /preferences/users/{user_id}
+//	POST /preferences/tokens/lookup         PUT /preferences/tokens
+//
+// デバイストークンはアクセスログやトレースに残らないよう、URLではなくリクエストボディの token で指定します。
+// PUT のリクエストボディは {"categories": {"marketing": false}} の形式で、カテゴリごとの設定を置き換えます。
+type PreferencesHandler struct {
+	registry *preferences.Registry
+}
+
+// preferencesRequest は通知設定のエンドポイントのリクエストボディです。
+type preferencesRequest struct {
+	Token      string          `json:"token"` // /preferences/tokens でのみ使う
+	Categories map[string]bool `json:"categories"`
+}
+
+func NewPreferencesHandler(r *preferences.Registry) *PreferencesHandler {
+	return &PreferencesHandler{
+		registry: r,
+	}
+}
+
+// Get は通知設定をJSONで返します。デバイストークンの場合はリクエストボディの token で対象を指定します。
+func (h *PreferencesHandler) Get(w http.ResponseWriter, r *http.Request) {
+	var req preferencesRequest
+	if r.PathValue("user_id") == "" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, ok := preferenceKey(r, req)
+	if !ok {
+		http.Error(w, "User ID or token is required", http.StatusBadRequest)
+		return
+	}
+
+	p, err := h.registry.Get(key)
+	if err != nil {
+		preferenceLogger(r, req).ErrorContext(r.Context(), "reading preferences", "error", err)
+		http.Error(w, "Failed to read preferences", http.StatusInternalServerError)
+		return
+	}
+
+	writePreferences(r.Context(), w, p)
+}
+
+// Put は通知設定を更新し、更新後の設定をJSONで返します。
+func (h *PreferencesHandler) Put(w http.ResponseWriter, r *http.Request) {
+	var req preferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, ok := preferenceKey(r, req)
+	if !ok {
+		http.Error(w, "User ID or token is required", http.StatusBadRequest)
+		return
+	}
+
+	p, err := h.registry.Update(key, req.Categories, time.Now())
+	if err != nil {
+		preferenceLogger(r, req).ErrorContext(r.Context(), "updating preferences", "error", err)
+		http.Error(w, "Failed to update preferences", http.StatusInternalServerError)
+		return
+	}
+
+	preferenceLogger(r, req).InfoContext(r.Context(), "updated preferences")
+	writePreferences(r.Context(), w, p)
+}
+
+// preferenceKey はパスの user_id、またはリクエストボディの token から通知設定のキーを返します。
+func preferenceKey(r *http.Request, req preferencesRequest) (string, bool) {
+	if id := r.PathValue("user_id"); id != "" {
+		return preferences.UserKey(id), true
+	}
+
+	if req.Token != "" {
+		return preferences.TokenKey(req.Token), true
+	}
+
+	return "", false
+}
+
+// preferenceLogger は通知設定の対象 (ユーザーID、または秘匿化したデバイストークン) を持つロガーを返します。
+func preferenceLogger(r *http.Request, req preferencesRequest) *slog.Logger {
+	logger := logging.FromContext(r.Context()).With("handler", "PreferencesHandler")
+	if id := r.PathValue("user_id"); id != "" {
+		return logger.With("userId", id)
+	}
+
+	return logger.With("token", logging.Token(req.Token))
+}
+
+func writePreferences(ctx context.Context, w http.ResponseWriter, p preferences.Preferences) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.ErrorContext(ctx, "encoding response", "handler", "PreferencesHandler", "error", err)
+	}
+}
@@ -0,0 +1,123 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/preferences"
+)
+
+func TestPreferencesHandler(t *testing.T) {
+	registry := preferences.NewRegistry(preferences.NewMemoryStore(), nil)
+
+	mux := http.NewServeMux()
+	h := NewPreferencesHandler(registry)
+	mux.HandleFunc("GET /preferences/users/{user_id}", h.Get)
+	mux.HandleFunc("PUT /preferences/users/{user_id}", h.Put)
+	mux.HandleFunc("POST /preferences/tokens/lookup", h.Get)
+	mux.HandleFunc("PUT /preferences/tokens", h.Put)
+
+	tests := []struct {
+		name               string
+		method             string
+		path               string
+		body               string
+		expectedStatus     int
+		expectedCategories map[string]bool
+	}{
+		{
+			name:               "get unknown user returns empty preferences",
+			method:             http.MethodGet,
+			path:               "/preferences/users/u1",
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{},
+		},
+		{
+			name:               "put user preferences",
+			method:             http.MethodPut,
+			path:               "/preferences/users/u1",
+			body:               `{"categories":{"marketing":false}}`,
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{"marketing": false},
+		},
+		{
+			name:               "get stored user preferences",
+			method:             http.MethodGet,
+			path:               "/preferences/users/u1",
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{"marketing": false},
+		},
+		{
+			name:               "token preferences are separate from user preferences",
+			method:             http.MethodPost,
+			path:               "/preferences/tokens/lookup",
+			body:               `{"token":"u1"}`,
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{},
+		},
+		{
+			name:               "put token preferences",
+			method:             http.MethodPut,
+			path:               "/preferences/tokens",
+			body:               `{"token":"t1","categories":{"reminder":true}}`,
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{"reminder": true},
+		},
+		{
+			name:               "get stored token preferences",
+			method:             http.MethodPost,
+			path:               "/preferences/tokens/lookup",
+			body:               `{"token":"t1"}`,
+			expectedStatus:     http.StatusOK,
+			expectedCategories: map[string]bool{"reminder": true},
+		},
+		{
+			name:           "missing token",
+			method:         http.MethodPut,
+			path:           "/preferences/tokens",
+			body:           `{"categories":{"reminder":true}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid body",
+			method:         http.MethodPut,
+			path:           "/preferences/tokens",
+			body:           `not json`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+
+			if tt.expectedCategories == nil {
+				return
+			}
+
+			var p preferences.Preferences
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+
+			if len(p.Categories) != len(tt.expectedCategories) {
+				t.Fatalf("categories = %v, want %v", p.Categories, tt.expectedCategories)
+			}
+
+			for k, v := range tt.expectedCategories {
+				if got, ok := p.Categories[k]; !ok || got != v {
+					t.Errorf("categories = %v, want %v", p.Categories, tt.expectedCategories)
+				}
+			}
+		})
+	}
+}
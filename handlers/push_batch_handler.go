@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/tracing"
+)
+
+// BatchPushPayload は /publish/batch エンドポイントの業務ペイロードです。1件のPub/Subメッセージで複数の通知を送信します。
+type BatchPushPayload struct {
+	// SchemaVersion はペイロードのスキーマバージョンです。未指定なら 1 として扱います (LatestSchemaVersion を参照)。
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Notifications は送信する通知です。それぞれ DevicePushPayload (token を持つもの) または TopicPushPayload (topic を持つもの) です。
+	Notifications []json.RawMessage `json:"notifications"`
+	// Tenant はバッチ全体の送信に使うテナントです。未指定ならPub/Subメッセージの tenant 属性、それもなければ既定のテナントを使います。
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// batchTargetType はバッチ全体が不正な場合のメトリクスと配信イベントの送信先の種類です。
+const batchTargetType = "batch"
+
+// batchAttemptAttribute は再送のために publish し直したバッチの試行回数を表すPub/Subメッセージ属性です。
+const batchAttemptAttribute = "batch_attempt"
+
+// defaultBatchMaxAttempts はバッチ内の通知を送信する試行回数の上限のデフォルト値です。
+const defaultBatchMaxAttempts = 5
+
+// Republisher はバッチのうち再送すべき通知を、新しいPub/Subメッセージとして publish し直します。
+type Republisher interface {
+	Republish(ctx context.Context, data []byte, attributes map[string]string) error
+}
+
+// RepublishFunc は関数を Republisher として使うためのアダプタです。
+type RepublishFunc func(ctx context.Context, data []byte, attributes map[string]string) error
+
+func (f RepublishFunc) Republish(ctx context.Context, data []byte, attributes map[string]string) error {
+	return f(ctx, data, attributes)
+}
+
+// PushBatchHandler は1件のPub/Subメッセージに含まれる複数の通知を、FCMの SendEach で fcm.MaxBatchSize 件ずつ送信します。
+//
+// 通知ごとに結果を判定し、再送すれば成功しうる失敗の通知だけを Republisher で publish し直すため、
+// 送信済みの通知を含むバッチ全体が nack されることはありません。publish し直すのに失敗した場合は、
+// それらの通知を恒久的な失敗として記録します。
+// バッチ内の通知に send_at / delay は指定できません。トークン宛ての通知には WithDeviceHandler で
+// PushDeviceHandler と同じおやすみ時間帯、通知設定、送信数の上限を適用します。
+type PushBatchHandler struct {
+	fcmClient fcmClient
+	tenants   tenantClients
+	metrics   MetricsRecorder
+	events    EventEmitter
+	capture   MessageCapturer
+	device    *PushDeviceHandler
+
+	republisher Republisher
+	maxAttempts int
+	sendTimeout time.Duration
+}
+
+func NewPushBatchHandler(fc *fcm.Client) *PushBatchHandler {
+	return &PushBatchHandler{
+		fcmClient:   fc,
+		maxAttempts: defaultBatchMaxAttempts,
+		sendTimeout: defaultSendTimeout,
+	}
+}
+
+// WithMetrics は処理結果をメトリクスとして記録するよう設定します。
+func (h *PushBatchHandler) WithMetrics(m MetricsRecorder) *PushBatchHandler {
+	h.metrics = m
+
+	return h
+}
+
+// WithTenants はテナントごとのFCMクライアントを設定します。PushDeviceHandler.WithTenants と同じです。
+func (h *PushBatchHandler) WithTenants(clients map[string]*fcm.Client) *PushBatchHandler {
+	h.tenants = newTenantClients(clients)
+
+	return h
+}
+
+// WithSendTimeout は fcm.MaxBatchSize 件ごとのFCMへの送信を待つ時間を設定します。0 なら打ち切りません。
+func (h *PushBatchHandler) WithSendTimeout(d time.Duration) *PushBatchHandler {
+	h.sendTimeout = d
+
+	return h
+}
+
+// WithCapture はpullで受信したメッセージと処理結果を c で記録するよう設定します。
+func (h *PushBatchHandler) WithCapture(c MessageCapturer) *PushBatchHandler {
+	h.capture = c
+
+	return h
+}
+
+// WithEvents は通知の最終的な処理結果を配信イベントとして送出するよう設定します。
+func (h *PushBatchHandler) WithEvents(e EventEmitter) *PushBatchHandler {
+	h.events = e
+
+	return h
+}
+
+// WithDeviceHandler はトークン宛ての通知に d のおやすみ時間帯、通知設定、送信数の上限を適用するよう設定します。
+// 時間帯明けや上限の解除まで延期する通知は d の Scheduler に予約し、d が送信します。
+// 設定しない場合、user_id、category、priority、time_zone を持つトークン宛ての通知は不正として扱います。
+func (h *PushBatchHandler) WithDeviceHandler(d *PushDeviceHandler) *PushBatchHandler {
+	h.device = d
+
+	return h
+}
+
+// WithRepublisher は再送すべき通知を r で publish し直すよう設定します。試行回数が maxAttempts に達した通知は再送しません。
+// 設定しない場合、再送すべき通知は再送せずに失敗として扱います。
+func (h *PushBatchHandler) WithRepublisher(r Republisher, maxAttempts int) *PushBatchHandler {
+	h.republisher = r
+	h.maxAttempts = maxAttempts
+
+	return h
+}
+
+// batchResult は1件のバッチの処理結果です。
+type batchResult struct {
+	Sent        int
+	Scheduled   int
+	Suppressed  int
+	Invalid     int
+	Failed      int
+	Republished int
+}
+
+func (r batchResult) response() map[string]interface{} {
+	return map[string]interface{}{
+		"status":      "processed",
+		"sent":        r.Sent,
+		"scheduled":   r.Scheduled,
+		"suppressed":  r.Suppressed,
+		"invalid":     r.Invalid,
+		"failed":      r.Failed,
+		"republished": r.Republished,
+	}
+}
+
+// batchItem は送信する1件の通知です。
+type batchItem struct {
+	index        int
+	data         json.RawMessage
+	target       eventTarget
+	notification fcm.Notification
+	device       *DevicePushPayload // トークン宛ての通知の場合のみ
+}
+
+// retryItem は再送すべき通知と、その失敗の理由です。
+type retryItem struct {
+	item batchItem
+	err  error
+}
+
+// ServeHTTP はHTTPリクエストを処理します。
+func (h *PushBatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, decodeSpan := tracing.Tracer().Start(r.Context(), "decodeData")
+	msg, err := decodeRequest(r)
+	endSpan(decodeSpan, err)
+
+	result, err := h.handle(r.Context(), msg, err)
+	writePushResponse(r.Context(), w, result.response(), err)
+}
+
+// HandleMessage はPub/Subのpullで受信したメッセージを処理し、ackすべきなら true を返します。
+func (h *PushBatchHandler) HandleMessage(ctx context.Context, m ReceivedMessage) bool {
+	msg, err := m.pushMessage()
+	result, err := h.handle(ctx, msg, err)
+	captureMessage(ctx, h.capture, batchTargetType, m, result.response(), err)
+
+	return err == nil || !shouldRetry(err)
+}
+
+func (h *PushBatchHandler) handle(ctx context.Context, msg pushMessage, decodeErr error) (batchResult, error) {
+	logger := messageLogger(ctx, pushBatchHandlerLogName, msg)
+	ctx = withEventSource(ctx, messageEventSource(pushBatchHandlerName, msg))
+	if decodeErr != nil {
+		err := payloadError{decodeErr}
+		recordOutcome(h.metrics, pushBatchHandlerName, batchTargetType, msg.PublishTime, pushResult{}, err)
+		logger.WarnContext(ctx, "discarding undecodable Pub/Sub message", "error", decodeErr)
+		emitOutcome(ctx, h.events, eventTarget{targetType: batchTargetType}, pushResult{}, err)
+		return batchResult{}, err
+	}
+
+	ctx, span := startMessageSpan(ctx, "PushBatchHandler process", msg)
+	ctx = logging.WithLogger(ctx, logger)
+	logger.InfoContext(ctx, "received Pub/Sub message", "publishTime", msg.PublishTime)
+	result, err := h.send(ctx, msg)
+	endSpan(span, err)
+	if err != nil {
+		var pe payloadError
+		if errors.As(err, &pe) {
+			// バッチ全体が不正な場合。通知ごとの結果は send が記録する
+			recordOutcome(h.metrics, pushBatchHandlerName, batchTargetType, msg.PublishTime, pushResult{}, err)
+			emitOutcome(ctx, h.events, eventTarget{targetType: batchTargetType}, pushResult{}, err)
+		}
+		logFailure(ctx, err)
+		return result, err
+	}
+
+	logger.InfoContext(ctx, "processed notification batch", "sent", result.Sent, "scheduled", result.Scheduled,
+		"suppressed", result.Suppressed, "invalid", result.Invalid,
+		"failed", result.Failed, "republished", result.Republished)
+
+	return result, nil
+}
+
+func (h *PushBatchHandler) send(ctx context.Context, msg pushMessage) (batchResult, error) {
+	var payload BatchPushPayload
+	if err := decodePayload(msg.Data, &payload); err != nil {
+		return batchResult{}, payloadError{fmt.Errorf("unmarshalling batch payload (%d bytes): %v", len(msg.Data), err)}
+	}
+	if len(payload.Notifications) == 0 {
+		return batchResult{}, payloadError{fmt.Errorf("notifications is required in batch payload")}
+	}
+
+	if payload.Tenant == "" {
+		payload.Tenant = msg.Attributes[tenantAttribute]
+	}
+	ctx = withTenantLogger(ctx, payload.Tenant)
+	client, err := h.tenants.clientFor(h.fcmClient, payload.Tenant)
+	if err != nil {
+		return batchResult{}, err
+	}
+
+	attempt := 1
+	if n, err := strconv.Atoi(msg.Attributes[batchAttemptAttribute]); err == nil && n > 0 {
+		attempt = n
+	}
+
+	var result batchResult
+	var items []batchItem
+	for i, data := range payload.Notifications {
+		item, err := parseBatchItem(i, data, payload.Tenant, payload.SchemaVersion, h.device != nil)
+		if err != nil {
+			result.Invalid++
+			h.finish(ctx, item, msg.PublishTime, pushResult{}, payloadError{fmt.Errorf("notification %d: %w", i, err)})
+			continue
+		}
+		items = append(items, item)
+	}
+
+	var retry []retryItem
+	items = slices.DeleteFunc(items, func(item batchItem) bool {
+		res, held, err := h.hold(ctx, item, payload.Tenant)
+		switch {
+		case !held && err == nil:
+			return false
+		case err != nil:
+			if h.retryOrFail(ctx, item, msg.PublishTime, attempt, &retry, fmt.Errorf("notification %d: %w", item.index, err)) {
+				result.Failed++
+			}
+		case res.Suppressed != "":
+			result.Suppressed++
+			h.finish(ctx, item, msg.PublishTime, res, nil)
+		default:
+			result.Scheduled++
+			h.finish(ctx, item, msg.PublishTime, res, nil)
+		}
+		return true
+	})
+
+	for start := 0; start < len(items); start += fcm.MaxBatchSize {
+		chunk := items[start:min(start+fcm.MaxBatchSize, len(items))]
+
+		notifications := make([]fcm.Notification, len(chunk))
+		for i, item := range chunk {
+			notifications[i] = item.notification
+		}
+
+		sendCtx, cancel := sendContext(ctx, h.sendTimeout)
+		results := client.SendEach(sendCtx, notifications)
+		for i, item := range chunk {
+			res := results[i]
+			if res.Err == nil {
+				result.Sent++
+				h.finish(ctx, item, msg.PublishTime, pushResult{MessageID: res.MessageID}, nil)
+				continue
+			}
+
+			err := interrupted(sendCtx, fmt.Errorf("notification %d: %w", item.index, res.Err))
+			if h.device != nil && item.device != nil {
+				h.device.release(ctx, batchRecipient(item, payload.Tenant))
+			}
+			if h.retryOrFail(ctx, item, msg.PublishTime, attempt, &retry, err) {
+				result.Failed++
+			}
+		}
+		cancel()
+	}
+
+	if len(retry) == 0 {
+		return result, nil
+	}
+
+	notifications := make([]json.RawMessage, len(retry))
+	for i, r := range retry {
+		notifications[i] = r.item.data
+	}
+	// 送信済みの通知を重複して送らないよう、publish し直すのに失敗してもバッチは nack しない
+	if err := h.republish(ctx, msg, BatchPushPayload{SchemaVersion: payload.SchemaVersion, Notifications: notifications, Tenant: payload.Tenant}, attempt+1); err != nil {
+		for _, r := range retry {
+			result.Failed++
+			h.finish(ctx, r.item, msg.PublishTime, pushResult{}, permanentError{fmt.Errorf("republishing failed (%v): %w", err, r.err)})
+		}
+		return result, nil
+	}
+
+	for _, r := range retry {
+		recordOutcome(h.metrics, pushBatchHandlerName, r.item.target.targetType, msg.PublishTime, pushResult{}, r.err)
+	}
+	result.Republished = len(retry)
+
+	return result, nil
+}
+
+// hold はトークン宛ての通知に WithDeviceHandler で設定したハンドラのおやすみ時間帯、通知設定、送信数の上限を適用します。
+// 今すぐ送信しない場合は予約または破棄した結果と true を返します。
+func (h *PushBatchHandler) hold(ctx context.Context, item batchItem, tenant string) (pushResult, bool, error) {
+	if h.device == nil || item.device == nil {
+		return pushResult{}, false, nil
+	}
+
+	// 予約した通知をバッチと同じテナントで送信するため、テナントを書き加える
+	data := []byte(item.data)
+	if item.device.Tenant == "" && tenant != "" {
+		var err error
+		if data, err = withTenant(data, tenant); err != nil {
+			return pushResult{}, true, err
+		}
+	}
+
+	logger := logging.FromContext(ctx).With("index", item.index)
+
+	return h.device.hold(logging.WithLogger(ctx, logger), batchRecipient(item, tenant), data)
+}
+
+// batchRecipient はトークン宛ての通知の受信者ごとの判定に使うペイロードを返します。テナントはバッチのものを使います。
+func batchRecipient(item batchItem, tenant string) DevicePushPayload {
+	payload := *item.device
+	payload.Tenant = tenant
+
+	return payload
+}
+
+// retryOrFail は送信に失敗した通知を、再送すべきなら retry に加え、そうでなければ失敗として記録して true を返します。
+func (h *PushBatchHandler) retryOrFail(ctx context.Context, item batchItem, publishTime time.Time, attempt int, retry *[]retryItem, err error) bool {
+	switch {
+	case !shouldRetry(err):
+	case h.republisher != nil && attempt < h.maxAttempts:
+		*retry = append(*retry, retryItem{item: item, err: err})
+		return false
+	case h.republisher != nil:
+		err = permanentError{fmt.Errorf("giving up after %d attempts: %w", attempt, err)}
+	default:
+		err = permanentError{fmt.Errorf("batch retry is not enabled: %w", err)}
+	}
+
+	h.finish(ctx, item, publishTime, pushResult{}, err)
+
+	return true
+}
+
+// finish は1件の通知の最終的な処理結果を記録し、配信イベントとして送出します。
+func (h *PushBatchHandler) finish(ctx context.Context, item batchItem, publishTime time.Time, result pushResult, err error) {
+	recordOutcome(h.metrics, pushBatchHandlerName, item.target.targetType, publishTime, result, err)
+	emitOutcome(ctx, h.events, item.target, result, err)
+	if err != nil {
+		logger := logging.FromContext(ctx).With("index", item.index)
+		logFailure(logging.WithLogger(ctx, logger), err)
+	}
+}
+
+// republish は再送すべき通知だけを持つ batch を、元のメッセージの属性を引き継いだ新しいメッセージとして publish します。
+// シャットダウン中でも重複送信を避けるため、リクエストの ctx のキャンセルは引き継ぎません。
+func (h *PushBatchHandler) republish(ctx context.Context, msg pushMessage, batch BatchPushPayload, attempt int) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	attributes := maps.Clone(msg.Attributes)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes[batchAttemptAttribute] = strconv.Itoa(attempt)
+
+	ctx, cancel := sendContext(context.WithoutCancel(ctx), h.sendTimeout)
+	defer cancel()
+
+	logging.FromContext(ctx).InfoContext(ctx, "republishing retryable notifications", "count", len(batch.Notifications), "attempt", attempt)
+
+	return h.republisher.Republish(ctx, data, attributes)
+}
+
+// parseBatchItem はバッチ内の1件の通知を検証します。エラーの場合も送信先が分かれば item.target に設定します。
+// 通知はバッチの schema_version (version) でデコードします (batchItemData を参照)。
+// deviceChecks が false の場合、受信者ごとの判定に使う項目を持つトークン宛ての通知は不正とします。
+func parseBatchItem(index int, data json.RawMessage, tenant string, version int, deviceChecks bool) (batchItem, error) {
+	item := batchItem{index: index, data: data}
+
+	data, err := batchItemData(data, version)
+	if err != nil {
+		return item, err
+	}
+	item.data = data
+
+	req, err := parseNotification(data)
+	switch req.target {
+	case tokenScheduleKind:
+		item.target = req.device.eventTarget()
+		item.notification = fcm.Notification{Token: req.device.Token, Title: req.device.Title, Body: req.device.Body, CustomData: req.device.CustomData}
+		item.device = &req.device
+		err = batchItemError(err, req.device.Tenant, tenant, req.device.ScheduleOptions)
+		if err == nil && !deviceChecks {
+			err = recipientFieldsError(req.device)
+		}
+	case topicScheduleKind:
+		item.target = req.topic.eventTarget()
+		item.notification = fcm.Notification{Topic: req.topic.Topic, Title: req.topic.Title, Body: req.topic.Body, CustomData: req.topic.CustomData}
+		err = batchItemError(err, req.topic.Tenant, tenant, req.topic.ScheduleOptions)
+	}
+	item.target.tenant = tenant
+
+	return item, err
+}
+
+// batchItemError はバッチで指定できない項目を検証します。err が nil でなければそのまま返します。
+func batchItemError(err error, itemTenant, batchTenant string, schedule ScheduleOptions) error {
+	switch {
+	case err != nil:
+		return err
+	case itemTenant != "" && itemTenant != batchTenant:
+		return fmt.Errorf("tenant %q does not match the batch tenant %q", itemTenant, batchTenant)
+	case schedule.SendAt != "" || schedule.Delay != "":
+		return fmt.Errorf("send_at and delay are not supported in batches")
+	}
+
+	return nil
+}
+
+// recipientFieldsError は受信者ごとの判定 (WithDeviceHandler) を設定していないバッチで、その判定に使う項目が指定されていればエラーを返します。
+// 指定された項目を黙って無視しないためです。
+func recipientFieldsError(p DevicePushPayload) error {
+	if p.UserID != "" || p.Category != "" || p.Priority != "" || p.TimeZone != "" {
+		return fmt.Errorf("user_id, category, priority and time_zone are not supported in batches without recipient checks")
+	}
+
+	return nil
+}
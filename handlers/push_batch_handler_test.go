@@ -0,0 +1,397 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/frequencycap"
+	. "github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/preferences"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+)
+
+type fakeRepublisher struct {
+	err        error
+	data       [][]byte
+	attributes []map[string]string
+}
+
+func (r *fakeRepublisher) Republish(ctx context.Context, data []byte, attributes map[string]string) error {
+	r.data = append(r.data, data)
+	r.attributes = append(r.attributes, attributes)
+	return r.err
+}
+
+func newBatch(t *testing.T, tenant string, notifications ...any) BatchPushPayload {
+	t.Helper()
+
+	b := BatchPushPayload{Tenant: tenant}
+	for _, n := range notifications {
+		b.Notifications = append(b.Notifications, mustMarshal(t, n))
+	}
+	return b
+}
+
+func TestPushBatchHandler(t *testing.T) {
+	// token の値で送信結果を決める
+	sendErrs := map[string]error{
+		"token-unregistered": errors.New("registration token is not registered"),
+		"token-retry":        errors.New("retryable"),
+	}
+
+	tests := []struct {
+		name            string
+		payload         BatchPushPayload
+		attributes      map[string]string
+		noRepublisher   bool
+		republishErr    error
+		expectedStatus  int
+		expectedCounts  map[string]int // sent, invalid, failed, republished
+		expectedRetry   []string       // publish し直した通知の token
+		expectedAttempt string
+		expectedEvents  []string // type/target
+		expectedMetrics []string // handler/target_type/outcome。nil なら確認しない
+	}{
+		{
+			name: "mixed outcomes republish only the retryable subset",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-ok"},
+				TopicPushPayload{Title: "T", Body: "B", Topic: "news"},
+				DevicePushPayload{Title: "T", Token: "token-invalid"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-unregistered"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-retry"},
+			),
+			attributes:      map[string]string{"correlation_id": "nightly-1"},
+			expectedStatus:  http.StatusOK,
+			expectedCounts:  map[string]int{"sent": 2, "invalid": 1, "failed": 1, "republished": 1},
+			expectedRetry:   []string{"token-retry"},
+			expectedAttempt: "2",
+			expectedEvents:  []string{"failed/token-invalid", "sent/token-ok", "sent/news", "failed/token-unregistered"},
+		},
+		{
+			name:           "retryable failure at the attempt limit fails permanently",
+			payload:        newBatch(t, "", DevicePushPayload{Title: "T", Body: "B", Token: "token-retry"}),
+			attributes:     map[string]string{"batch_attempt": "3"},
+			expectedStatus: http.StatusOK,
+			expectedCounts: map[string]int{"sent": 0, "invalid": 0, "failed": 1, "republished": 0},
+			expectedEvents: []string{"failed/token-retry"},
+		},
+		{
+			name:           "retryable failure without republisher fails permanently",
+			payload:        newBatch(t, "", DevicePushPayload{Title: "T", Body: "B", Token: "token-retry"}),
+			noRepublisher:  true,
+			expectedStatus: http.StatusOK,
+			expectedCounts: map[string]int{"sent": 0, "invalid": 0, "failed": 1, "republished": 0},
+			expectedEvents: []string{"failed/token-retry"},
+		},
+		{
+			name: "republish failure fails the retryable subset permanently",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-ok"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-retry"},
+			),
+			republishErr:    errors.New("pubsub unavailable"),
+			expectedStatus:  http.StatusOK,
+			expectedCounts:  map[string]int{"sent": 1, "invalid": 0, "failed": 1, "republished": 0},
+			expectedRetry:   []string{"token-retry"},
+			expectedAttempt: "2",
+			expectedEvents:  []string{"sent/token-ok", "failed/token-retry"},
+			expectedMetrics: []string{"push_batch/token/sent", "push_batch/token/failed_permanent"},
+		},
+		{
+			name: "items with schedule or another tenant are invalid",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-ok", ScheduleOptions: ScheduleOptions{Delay: "1h"}},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-ok", Tenant: "app-a"},
+			),
+			expectedStatus: http.StatusOK,
+			expectedCounts: map[string]int{"sent": 0, "invalid": 2, "failed": 0, "republished": 0},
+			expectedEvents: []string{"failed/token-ok", "failed/token-ok"},
+		},
+		{
+			name:           "unknown tenant",
+			payload:        newBatch(t, "app-x", DevicePushPayload{Title: "T", Body: "B", Token: "token-ok"}),
+			expectedStatus: http.StatusNoContent,
+			expectedEvents: []string{"failed/"},
+		},
+		{
+			name:           "empty batch",
+			payload:        BatchPushPayload{},
+			expectedStatus: http.StatusNoContent,
+			expectedEvents: []string{"failed/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					return "fcm-" + token, sendErrs[token]
+				},
+			}
+			republisher := &fakeRepublisher{err: tt.republishErr}
+			emitter := &fakeEventEmitter{}
+			recorder := &fakeMetricsRecorder{}
+			handler := NewPushBatchHandler(nil).WithMock(mock).WithEvents(emitter).WithMetrics(recorder)
+			if !tt.noRepublisher {
+				handler.WithRepublisher(republisher, 3)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/publish/batch",
+				bytes.NewReader(newPushPubSubRequestWithAttributes(tt.payload, tt.attributes)))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("status: got %d want %d (body %q)", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+
+			if tt.expectedCounts != nil {
+				var resp map[string]any
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decoding response: %v", err)
+				}
+				for k, want := range tt.expectedCounts {
+					if got := resp[k]; got != float64(want) {
+						t.Errorf("response %s: got %v want %d", k, got, want)
+					}
+				}
+			}
+
+			var retried []string
+			for _, data := range republisher.data {
+				var batch BatchPushPayload
+				if err := json.Unmarshal(data, &batch); err != nil {
+					t.Fatalf("decoding republished batch: %v", err)
+				}
+				for _, n := range batch.Notifications {
+					var p DevicePushPayload
+					json.Unmarshal(n, &p)
+					retried = append(retried, p.Token)
+				}
+			}
+			if !slices.Equal(retried, tt.expectedRetry) {
+				t.Errorf("republished: got %v want %v", retried, tt.expectedRetry)
+			}
+			for _, attrs := range republisher.attributes {
+				if attrs["batch_attempt"] != tt.expectedAttempt {
+					t.Errorf("batch_attempt: got %q want %q", attrs["batch_attempt"], tt.expectedAttempt)
+				}
+				for k, v := range tt.attributes {
+					if k != "batch_attempt" && attrs[k] != v {
+						t.Errorf("attribute %s: got %q want %q", k, attrs[k], v)
+					}
+				}
+			}
+
+			var gotEvents []string
+			for _, e := range emitter.events {
+				gotEvents = append(gotEvents, string(e.Type)+"/"+e.Target)
+				if e.Handler != "push_batch" {
+					t.Errorf("event handler: got %q want push_batch", e.Handler)
+				}
+				if c := tt.attributes["correlation_id"]; c != "" && e.CorrelationID != c {
+					t.Errorf("event correlation_id: got %q want %q", e.CorrelationID, c)
+				}
+			}
+			if !slices.Equal(gotEvents, tt.expectedEvents) {
+				t.Errorf("events: got %v want %v", gotEvents, tt.expectedEvents)
+			}
+			if tt.expectedMetrics != nil && !slices.Equal(recorder.outcomes, tt.expectedMetrics) {
+				t.Errorf("metrics: got %v want %v", recorder.outcomes, tt.expectedMetrics)
+			}
+		})
+	}
+}
+
+func TestPushBatchHandler_RecipientChecks(t *testing.T) {
+	registry := preferences.NewRegistry(preferences.NewMemoryStore(), nil)
+	registry.Update(preferences.UserKey("u1"), map[string]bool{"marketing": false}, time.Now())
+	window, _ := quiethours.Parse("22:00-08:00")
+	now := time.Date(2025, 1, 2, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		payload         BatchPushPayload
+		noDeviceHandler bool
+		quietHours      bool
+		expectedCounts  map[string]int // sent, scheduled, suppressed, invalid
+		expectedSent    []string
+		expectedPending int
+	}{
+		{
+			name: "opted-out category is suppressed",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-1", UserID: "u1", Category: "marketing"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-2", UserID: "u1", Category: "reminder"},
+			),
+			expectedCounts: map[string]int{"sent": 1, "scheduled": 0, "suppressed": 1, "invalid": 0},
+			expectedSent:   []string{"token-2"},
+		},
+		{
+			name: "over-cap notification is dropped",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-1", UserID: "u2"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-2", UserID: "u2"},
+				TopicPushPayload{Title: "T", Body: "B", Topic: "news"},
+			),
+			expectedCounts: map[string]int{"sent": 2, "scheduled": 0, "suppressed": 1, "invalid": 0},
+			expectedSent:   []string{"token-1", "news"},
+		},
+		{
+			name: "notification in quiet hours is scheduled",
+			payload: newBatch(t, "",
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-1", TimeZone: "UTC"},
+				DevicePushPayload{Title: "T", Body: "B", Token: "token-2", TimeZone: "UTC", Priority: "urgent"},
+			),
+			quietHours:      true,
+			expectedCounts:  map[string]int{"sent": 1, "scheduled": 1, "suppressed": 0, "invalid": 0},
+			expectedSent:    []string{"token-2"},
+			expectedPending: 1,
+		},
+		{
+			name:            "recipient fields without recipient checks are invalid",
+			payload:         newBatch(t, "", DevicePushPayload{Title: "T", Body: "B", Token: "token-1", Category: "marketing"}),
+			noDeviceHandler: true,
+			expectedCounts:  map[string]int{"sent": 0, "scheduled": 0, "suppressed": 0, "invalid": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			mock := &MockFCMClient{
+				MockSendEach: func(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult {
+					results := make([]fcm.SendResult, len(notifications))
+					for _, n := range notifications {
+						sent = append(sent, n.Token+n.Topic)
+					}
+					return results
+				},
+			}
+
+			limiter, err := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), frequencycap.PolicyDrop, &frequencycap.Rule{Limit: 1, Window: time.Hour}, nil)
+			if err != nil {
+				t.Fatalf("NewLimiter: %v", err)
+			}
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			device := new(PushDeviceHandler).WithMock(mock).WithScheduler(sched).WithPreferences(registry).
+				WithFrequencyCap(limiter).WithClock(func() time.Time { return now })
+			if tt.quietHours {
+				device.WithQuietHours(window, time.UTC)
+			}
+
+			handler := NewPushBatchHandler(nil).WithMock(mock)
+			if !tt.noDeviceHandler {
+				handler.WithDeviceHandler(device)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/publish/batch", bytes.NewReader(newPushPubSubRequest(tt.payload))))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status: got %d want %d (body %q)", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			var resp map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			for k, want := range tt.expectedCounts {
+				if got := resp[k]; got != float64(want) {
+					t.Errorf("response %s: got %v want %d", k, got, want)
+				}
+			}
+
+			if !slices.Equal(sent, tt.expectedSent) {
+				t.Errorf("sent: got %v want %v", sent, tt.expectedSent)
+			}
+			if pending, _ := sched.Pending(); len(pending) != tt.expectedPending {
+				t.Errorf("pending jobs: got %d want %d", len(pending), tt.expectedPending)
+			}
+		})
+	}
+}
+
+func TestPushBatchHandler_Chunks(t *testing.T) {
+	var chunkSizes []int
+	mock := &MockFCMClient{
+		MockSendEach: func(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult {
+			chunkSizes = append(chunkSizes, len(notifications))
+			results := make([]fcm.SendResult, len(notifications))
+			for i := range results {
+				results[i].MessageID = fmt.Sprintf("fcm-%d", i)
+			}
+			return results
+		},
+	}
+	emitter := &fakeEventEmitter{}
+	handler := NewPushBatchHandler(nil).WithMock(mock).WithEvents(emitter)
+
+	var notifications []any
+	for i := range 1201 {
+		notifications = append(notifications, DevicePushPayload{Title: "T", Body: "B", Token: fmt.Sprintf("token-%d", i)})
+	}
+
+	ack := handler.HandleMessage(context.Background(), ReceivedMessage{
+		ID:   "m1",
+		Data: mustMarshal(t, newBatch(t, "", notifications...)),
+	})
+
+	if !ack {
+		t.Error("HandleMessage() = false, want true")
+	}
+	if !slices.Equal(chunkSizes, []int{500, 500, 201}) {
+		t.Errorf("chunk sizes: got %v want [500 500 201]", chunkSizes)
+	}
+	if len(emitter.events) != 1201 {
+		t.Errorf("events: got %d want 1201", len(emitter.events))
+	}
+}
+
+func BenchmarkPushBatchHandler(b *testing.B) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	mock := &MockFCMClient{
+		MockSendEach: func(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult {
+			results := make([]fcm.SendResult, len(notifications))
+			for i := range results {
+				results[i].MessageID = fmt.Sprintf("projects/p/messages/%d", i)
+			}
+			return results
+		},
+	}
+	handler := NewPushBatchHandler(nil).WithMock(mock)
+
+	for _, size := range []int{10, 500} {
+		notifications := make([]DevicePushPayload, size)
+		for i := range notifications {
+			notifications[i] = DevicePushPayload{Title: "Title", Body: "Body", Token: fmt.Sprintf("token-%d", i)}
+		}
+		body := newPushPubSubRequest(map[string]any{"notifications": notifications})
+
+		b.Run(fmt.Sprintf("%d notifications", size), func(b *testing.B) {
+			for b.Loop() {
+				req := httptest.NewRequest(http.MethodPost, "/publish/batch", bytes.NewReader(body))
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					b.Fatalf("status: got %d want %d", rr.Code, http.StatusOK)
+				}
+			}
+		})
+	}
+}
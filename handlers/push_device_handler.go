@@ -2,99 +2,455 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/frequencycap"
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/preferences"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+	"github.com/teamzidi/example-go-fcm/tracing"
 )
 
 // DevicePushPayload は /pubsub/push/device エンドポイントでPub/Subメッセージの
 // Base64デコードされた data フィールドが示す実際の業務ペイロード構造体です。
 type DevicePushPayload struct {
-	Title      string            `json:"title"`
-	Body       string            `json:"body"`
-	Token      string            `json:"token"`
-	CustomData map[string]string `json:"custom_data,omitempty"`
+	// SchemaVersion はペイロードのスキーマバージョンです。未指定なら 1 として扱います (LatestSchemaVersion を参照)。
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	Title         string            `json:"title"`
+	Body          string            `json:"body"`
+	Token         string            `json:"token"`
+	CustomData    map[string]string `json:"custom_data,omitempty"`
+	UserID        string            `json:"user_id,omitempty"`   // 受信ユーザーのID。送信数の上限はユーザー単位 (未指定ならトークン単位) で数える
+	Category      string            `json:"category,omitempty"`  // 通知のカテゴリ (例: "marketing")
+	Priority      string            `json:"priority,omitempty"`  // "urgent" の場合はおやすみ時間帯を無視して送信
+	TimeZone      string            `json:"time_zone,omitempty"` // 受信者のタイムゾーン (IANA名。例: "Asia/Tokyo")
+	// Tenant は送信に使うテナント (Firebaseプロジェクト) です。未指定ならPub/Subメッセージの tenant 属性、それもなければ既定のテナントを使います。
+	Tenant string `json:"tenant,omitempty"`
+	// CorrelationID は配信イベントに含めてプロデューサーに返す相関IDです。未指定ならPub/Subメッセージの correlation_id 属性を使います。
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ScheduleOptions
 }
 
 // PushDeviceHandler は特定の単一デバイストークンへのPush通知を処理します。
 type PushDeviceHandler struct {
 	fcmClient fcmClient
+	tenants   tenantClients
+	scheduler *scheduler.Scheduler
+	metrics   MetricsRecorder
+	events    EventEmitter
+	capture   MessageCapturer
+
+	sendTimeout time.Duration
+
+	limiter     *frequencycap.Limiter
+	preferences *preferences.Registry
+
+	quietHours      *quiethours.Window
+	defaultLocation *time.Location
+	now             func() time.Time
 }
 
 func NewPushDeviceHandler(fc *fcm.Client) *PushDeviceHandler {
 	return &PushDeviceHandler{
-		fcmClient: fc,
+		fcmClient:   fc,
+		sendTimeout: defaultSendTimeout,
 	}
 }
 
+// WithMetrics は処理結果をメトリクスとして記録するよう設定します。
+func (h *PushDeviceHandler) WithMetrics(m MetricsRecorder) *PushDeviceHandler {
+	h.metrics = m
+
+	return h
+}
+
+// WithTenants はテナントごとのFCMクライアントを設定します。tenant を指定した通知は該当するクライアントで送信し、
+// 登録されていないテナントの通知は再送しない失敗として ack します。NewPushDeviceHandler に渡したクライアントは
+// テナント fcm.DefaultTenant として使われます。
+func (h *PushDeviceHandler) WithTenants(clients map[string]*fcm.Client) *PushDeviceHandler {
+	h.tenants = newTenantClients(clients)
+
+	return h
+}
+
+// WithSendTimeout は1回のFCMへの送信を待つ時間を設定します。0 なら打ち切りません。
+// タイムアウトした送信は再送対象として nack されるため、Pushサブスクリプションの確認応答期限より短くしてください。
+func (h *PushDeviceHandler) WithSendTimeout(d time.Duration) *PushDeviceHandler {
+	h.sendTimeout = d
+
+	return h
+}
+
+// WithCapture はpullで受信したメッセージと処理結果を c で記録するよう設定します。
+func (h *PushDeviceHandler) WithCapture(c MessageCapturer) *PushDeviceHandler {
+	h.capture = c
+
+	return h
+}
+
+// WithEvents は通知の最終的な処理結果を配信イベントとして送出するよう設定します。
+func (h *PushDeviceHandler) WithEvents(e EventEmitter) *PushDeviceHandler {
+	h.events = e
+
+	return h
+}
+
+// WithScheduler は send_at / delay 付きのメッセージを予約するための Scheduler を設定し、
+// 予約時刻を迎えたジョブをこのハンドラで送信するよう登録します。
+func (h *PushDeviceHandler) WithScheduler(s *scheduler.Scheduler) *PushDeviceHandler {
+	h.scheduler = s
+	s.Register(tokenScheduleKind, h.dispatch)
+
+	return h
+}
+
+// WithFrequencyCap は受信者ごとの送信数の上限を設定します。
+// 上限を超えた通知は Limiter のポリシーに従って破棄または延期されます。延期には WithScheduler が必要です。
+func (h *PushDeviceHandler) WithFrequencyCap(l *frequencycap.Limiter) *PushDeviceHandler {
+	h.limiter = l
+
+	return h
+}
+
+// WithPreferences は受信者の通知設定を参照し、オプトアウトされたカテゴリの通知を送らないよう設定します。
+func (h *PushDeviceHandler) WithPreferences(r *preferences.Registry) *PushDeviceHandler {
+	h.preferences = r
+
+	return h
+}
+
+// WithQuietHours は緊急でない通知を受信者のおやすみ時間帯に送らないよう設定します。
+// 時間帯内に届いた通知は時間帯明けに予約されるため、WithScheduler も設定しておく必要があります。
+// ペイロードに time_zone がない (または不正な) 場合は defaultLocation の時刻で判定します。
+func (h *PushDeviceHandler) WithQuietHours(w quiethours.Window, defaultLocation *time.Location) *PushDeviceHandler {
+	h.quietHours = &w
+	h.defaultLocation = defaultLocation
+
+	return h
+}
+
 // ServeHTTP はHTTPリクエストを処理します。
 func (h *PushDeviceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		log.Printf("PushDeviceHandler: Invalid request method: %s", r.Method)
+		slog.WarnContext(r.Context(), "invalid request method", "handler", pushDeviceHandlerLogName, "method", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	decodedData, err := decodeData(r.Body)
+	_, decodeSpan := tracing.Tracer().Start(r.Context(), "decodeData")
+	msg, err := decodeRequest(r)
+	endSpan(decodeSpan, err)
+
+	result, err := h.handle(r.Context(), msg, err)
+	writePushResponse(r.Context(), w, result.response(), err)
+}
+
+// HandleMessage はPub/Subのpullで受信したメッセージを処理し、ackすべきなら true を返します。
+// Push (ServeHTTP) と同じ処理を行い、ServeHTTP が 2xx を返す場合に true になります。
+func (h *PushDeviceHandler) HandleMessage(ctx context.Context, m ReceivedMessage) bool {
+	msg, err := m.pushMessage()
+	result, err := h.handle(ctx, msg, err)
+	captureMessage(ctx, h.capture, tokenScheduleKind, m, result.response(), err)
+
+	return err == nil || !shouldRetry(err)
+}
+
+// handle はデコードしたPub/Subメッセージを処理します。decodeErr はメッセージのデコードに失敗した場合のエラーです。
+func (h *PushDeviceHandler) handle(ctx context.Context, msg pushMessage, decodeErr error) (pushResult, error) {
+	logger := messageLogger(ctx, pushDeviceHandlerLogName, msg)
+	if decodeErr != nil {
+		err := payloadError{decodeErr}
+		recordOutcome(h.metrics, pushDeviceHandlerName, tokenScheduleKind, msg.PublishTime, pushResult{}, err)
+		logger.WarnContext(ctx, "discarding undecodable Pub/Sub message", "error", decodeErr)
+		emitOutcome(withEventSource(ctx, messageEventSource(pushDeviceHandlerName, msg)), h.events,
+			eventTarget{targetType: tokenScheduleKind}, pushResult{}, err)
+		return pushResult{}, err
+	}
+
+	ctx, span := startMessageSpan(ctx, "PushDeviceHandler process", msg)
+	ctx = logging.WithLogger(ctx, logger)
+	ctx = withEventSource(ctx, messageEventSource(pushDeviceHandlerName, msg))
+	logger.InfoContext(ctx, "received Pub/Sub message", "publishTime", msg.PublishTime)
+	result, err := h.send(ctx, msg)
+	endSpan(span, err)
+	recordOutcome(h.metrics, pushDeviceHandlerName, tokenScheduleKind, msg.PublishTime, result, err)
 	if err != nil {
-		log.Printf("PushDeviceHandler: decoding data: %v", err)
-		w.WriteHeader(http.StatusNoContent) // New: Ack with 204
-		return
+		logFailure(ctx, err)
 	}
 
-	messageID, err := h.send(decodedData)
+	return result, err
+}
+
+func (h *PushDeviceHandler) send(ctx context.Context, msg pushMessage) (pushResult, error) {
+	_, span := tracing.Tracer().Start(ctx, "validatePayload")
+	payload, err := parseDevicePushPayload(msg.Data)
+	decodedData := msg.Data
+	if err == nil {
+		payload.Tenant, decodedData, err = tenantFromAttribute(msg.Data, payload.Tenant, msg)
+	}
+	endSpan(span, err)
 	if err != nil {
-		if IsRetryable(err) {
-			http.Error(w, "Failed to send notification via FCM (retryable)", http.StatusInternalServerError) // Nack
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return pushResult{}, err
+	}
+
+	return h.process(ctx, payload, decodedData)
+}
+
+// process は検証済みのペイロードを、予約が必要なら予約し、そうでなければ送信します。
+// 予約・再送以外の結果は配信イベントとして送出します。
+func (h *PushDeviceHandler) process(ctx context.Context, payload DevicePushPayload, decodedData []byte) (result pushResult, err error) {
+	defer func() {
+		emitOutcome(ctx, h.events, payload.eventTarget(), result, err)
+	}()
+
+	ctx = withTenantLogger(ctx, payload.Tenant)
+	if _, err := h.tenants.clientFor(h.fcmClient, payload.Tenant); err != nil {
+		return pushResult{}, err
+	}
+
+	now := h.clock()
+
+	at, scheduled, err := payload.scheduledTime(now)
+	if err != nil {
+		return pushResult{}, payloadError{err}
+	}
+
+	if !scheduled {
+		at = now
+	}
+
+	if deferred := h.deferForQuietHours(ctx, payload, at); deferred.After(at) {
+		logging.FromContext(ctx).InfoContext(ctx, "deferring notification due to quiet hours", "sendAt", deferred)
+		at, scheduled = deferred, true
+	}
+
+	if scheduled {
+		return h.schedule(ctx, decodedData, at)
+	}
+
+	return h.deliver(ctx, payload, decodedData)
+}
+
+// deliver は受信者の通知設定と送信数の上限を確認したうえで通知を送信します。
+func (h *PushDeviceHandler) deliver(ctx context.Context, payload DevicePushPayload, decodedData []byte) (pushResult, error) {
+	if result, held, err := h.admit(ctx, payload, decodedData); held || err != nil {
+		return result, err
+	}
+
+	messageID, err := h.sendNow(ctx, payload)
+	if err != nil {
+		h.release(ctx, payload)
+		return pushResult{}, err
+	}
+
+	return pushResult{MessageID: messageID}, nil
+}
+
+// release は送信できなかった通知を送信数の上限に数えないよう、admit で記録した送信を取り消します。
+func (h *PushDeviceHandler) release(ctx context.Context, payload DevicePushPayload) {
+	if h.limiter == nil {
+		return
+	}
+
+	if err := h.limiter.Release(payload.recipientKey(), payload.Category); err != nil {
+		logging.FromContext(ctx).WarnContext(ctx, "releasing frequency cap", "error", err)
+	}
+}
+
+// admit は受信者の通知設定と送信数の上限を確認し、通知を今すぐ送信しない場合は破棄または予約した結果と true を返します。
+func (h *PushDeviceHandler) admit(ctx context.Context, payload DevicePushPayload, decodedData []byte) (pushResult, bool, error) {
+	logger := logging.FromContext(ctx)
+
+	if h.preferences != nil {
+		allowed, err := h.preferences.Allows(payload.Category, payload.preferenceKeys()...)
+		if err != nil {
+			return pushResult{}, true, retryableError{err}
+		}
+
+		if !allowed {
+			logger.InfoContext(ctx, "dropping notification opted out by recipient", "category", payload.Category)
+			return pushResult{Suppressed: suppressedByPreference}, true, nil
+		}
+	}
+
+	if h.limiter != nil {
+		d, err := h.limiter.Check(payload.recipientKey(), payload.Category, h.clock())
+		if err != nil {
+			return pushResult{}, true, retryableError{err}
+		}
+
+		switch d.Action {
+		case frequencycap.Drop:
+			logger.InfoContext(ctx, "dropping notification over frequency cap", "category", payload.Category)
+			return pushResult{Suppressed: suppressedByFrequencyCap}, true, nil
+		case frequencycap.Defer:
+			// 上限が解除される時刻がおやすみ時間帯に当たる場合は、時間帯が明けるまで遅らせる
+			at := h.deferForQuietHours(ctx, payload, d.RetryAt)
+			logger.InfoContext(ctx, "deferring notification over frequency cap", "category", payload.Category, "sendAt", at)
+			result, err := h.schedule(ctx, decodedData, at)
+			return result, true, err
+		}
+	}
+
+	return pushResult{}, false, nil
+}
+
+// hold は即時送信する通知に、おやすみ時間帯、通知設定、送信数の上限を適用します。
+// 今すぐ送信しない場合は予約または破棄した結果と true を返します。バッチ内の通知にも使います。
+func (h *PushDeviceHandler) hold(ctx context.Context, payload DevicePushPayload, decodedData []byte) (pushResult, bool, error) {
+	now := h.clock()
+	if deferred := h.deferForQuietHours(ctx, payload, now); deferred.After(now) {
+		logging.FromContext(ctx).InfoContext(ctx, "deferring notification due to quiet hours", "sendAt", deferred)
+		result, err := h.schedule(ctx, decodedData, deferred)
+		return result, true, err
+	}
+
+	return h.admit(ctx, payload, decodedData)
+}
+
+// deferForQuietHours は at が受信者のおやすみ時間帯に当たる場合、時間帯が明ける時刻を返します。
+// priority が "urgent" の通知やおやすみ時間帯が未設定の場合は at をそのまま返します。
+func (h *PushDeviceHandler) deferForQuietHours(ctx context.Context, payload DevicePushPayload, at time.Time) time.Time {
+	if h.quietHours == nil || payload.Priority == priorityUrgent {
+		return at
+	}
+
+	loc := h.defaultLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	if payload.TimeZone != "" {
+		if l, err := time.LoadLocation(payload.TimeZone); err == nil {
+			loc = l
 		} else {
-			w.WriteHeader(http.StatusNoContent) // Ack
+			logging.FromContext(ctx).WarnContext(ctx, "unknown time_zone, using default", "timeZone", payload.TimeZone, "default", loc.String(), "error", err)
 		}
+	}
 
-		return
+	return h.quietHours.Defer(at, loc)
+}
+
+func (h *PushDeviceHandler) clock() time.Time {
+	if h.now != nil {
+		return h.now()
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	return time.Now()
+}
+
+func (h *PushDeviceHandler) schedule(ctx context.Context, decodedData []byte, at time.Time) (pushResult, error) {
+	if h.scheduler == nil {
+		return pushResult{}, payloadError{fmt.Errorf("scheduled delivery is not enabled")}
+	}
+
+	job, err := h.scheduler.Schedule(tokenScheduleKind, decodedData, at)
+	if err != nil {
+		return pushResult{}, retryableError{fmt.Errorf("scheduling notification: %w", err)}
+	}
+
+	logging.FromContext(ctx).InfoContext(ctx, "scheduled notification", "jobId", job.ID, "sendAt", job.SendAt)
+
+	return pushResult{ScheduleID: job.ID, SendAt: job.SendAt}, nil
+}
+
+// dispatch は予約時刻を迎えたジョブを送信します。送信予約フィールドは無視されます。
+func (h *PushDeviceHandler) dispatch(ctx context.Context, decodedData []byte) error {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).With("handler", pushDeviceHandlerLogName))
+	ctx = withEventSource(ctx, eventSource{handler: schedulerHandlerName})
+
+	payload, err := parseDevicePushPayload(decodedData)
+	if err != nil {
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return err
+	}
+	ctx = withTenantLogger(ctx, payload.Tenant)
+
+	result, err := h.deliver(ctx, payload, decodedData)
+	err = exhausted(ctx, err)
+	emitOutcome(ctx, h.events, payload.eventTarget(), result, err)
+	return err
+}
+
+// recipientKey は送信数を数える単位となる受信者のキーを返します。
+// テナントを指定した通知はテナントごとに別々に数えます。
+func (p DevicePushPayload) recipientKey() string {
+	key := "token:" + p.Token
+	if p.UserID != "" {
+		key = "user:" + p.UserID
+	}
+
+	if p.Tenant != "" && p.Tenant != fcm.DefaultTenant {
+		key = "tenant:" + p.Tenant + "/" + key
+	}
+
+	return key
+}
 
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":     "processed", // "processed" indicates successful delivery or a non-retryable FCM error.
-		"message_id": messageID,
-	}); err != nil {
-		log.Printf("PushDeviceHandler: Error encoding success response: %v\n", err)
+// preferenceKeys は通知設定を参照する受信者のキーを返します。
+func (p DevicePushPayload) preferenceKeys() []string {
+	keys := []string{preferences.TokenKey(p.Token)}
+	if p.UserID != "" {
+		keys = append(keys, preferences.UserKey(p.UserID))
 	}
+
+	return keys
 }
 
-func (h *PushDeviceHandler) send(decodedData []byte) (string, error) {
+func parseDevicePushPayload(decodedData []byte) (DevicePushPayload, error) {
 	var payload DevicePushPayload
-	if err := json.Unmarshal(decodedData, &payload); err != nil {
-		return "", fmt.Errorf("unmarshalling actual payload: %v. Decoded data was: %s", err, string(decodedData))
+	if err := decodePayload(decodedData, &payload); err != nil {
+		return payload, payloadError{fmt.Errorf("unmarshalling actual payload (%d bytes): %v", len(decodedData), err)}
 	}
 
 	if payload.Title == "" {
-		return "", fmt.Errorf("title is required in payload")
+		return payload, payloadError{fmt.Errorf("title is required in payload")}
 	}
 
 	if payload.Body == "" {
-		return "", fmt.Errorf("body is required in payload")
+		return payload, payloadError{fmt.Errorf("body is required in payload")}
 	}
 
 	if payload.Token == "" {
-		return "", fmt.Errorf("token is required in payload")
+		return payload, payloadError{fmt.Errorf("token is required in payload")}
+	}
+
+	if err := fcm.Validate(fcm.Notification{Token: payload.Token, Title: payload.Title, Body: payload.Body, CustomData: payload.CustomData}); err != nil {
+		return payload, payloadError{err}
+	}
+
+	if _, _, err := payload.scheduledTime(time.Now()); err != nil {
+		return payload, payloadError{err}
+	}
+
+	return payload, nil
+}
+
+func (h *PushDeviceHandler) sendNow(ctx context.Context, payload DevicePushPayload) (string, error) {
+	logger := logging.FromContext(ctx).With("token", logging.Token(payload.Token))
+	logger.DebugContext(ctx, "sending notification to device", "customDataKeys", logging.Keys(payload.CustomData))
+
+	client, err := h.tenants.clientFor(h.fcmClient, payload.Tenant)
+	if err != nil {
+		return "", err
 	}
 
-	log.Printf("sending notification to device token '%s'. Title: '%s', Data: %v\n",
-		payload.Token, payload.Title, payload.CustomData)
+	// FCM送信。リクエストの切断やシャットダウンに加え、sendTimeout でも打ち切る
+	sendCtx, cancel := sendContext(ctx, h.sendTimeout)
+	defer cancel()
 
-	// FCM送信
-	messageID, err := h.fcmClient.SendToToken(context.Background(), payload.Token, payload.Title, payload.Body, payload.CustomData)
+	messageID, err := client.SendToToken(sendCtx, payload.Token, payload.Title, payload.Body, payload.CustomData)
 	if err != nil {
-		return "", fmt.Errorf("sending FCM message to token %s: %v", payload.Token, err) // Log error
+		return "", interrupted(sendCtx, fmt.Errorf("sending FCM message to token %s: %w", logging.RedactToken(payload.Token), err))
 	}
 
-	log.Printf("PushDeviceHandler: Successfully sent message ID %s to token %s", messageID, payload.Token)
+	logger.InfoContext(ctx, "sent notification", "fcmMessageId", messageID)
 
 	return messageID, nil
 }
@@ -4,12 +4,27 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/events"
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/frequencycap"
 	. "github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/preferences"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+	"github.com/teamzidi/example-go-fcm/tracing/tracingtest"
 )
 
 func TestPushDeviceHandler_Comprehensive(t *testing.T) {
@@ -131,3 +146,1080 @@ func TestPushDeviceHandler_Comprehensive(t *testing.T) {
 		})
 	}
 }
+
+func TestPushDeviceHandler_Schedule(t *testing.T) {
+	tests := []struct {
+		name            string
+		schedule        ScheduleOptions
+		withScheduler   bool
+		expectedStatus  int
+		expectedSends   int
+		expectedPending int
+	}{
+		{
+			name:            "delay schedules the notification",
+			schedule:        ScheduleOptions{Delay: "30m"},
+			withScheduler:   true,
+			expectedStatus:  http.StatusOK,
+			expectedPending: 1,
+		},
+		{
+			name:            "future send_at schedules the notification",
+			schedule:        ScheduleOptions{SendAt: time.Now().Add(time.Hour).Format(time.RFC3339)},
+			withScheduler:   true,
+			expectedStatus:  http.StatusOK,
+			expectedPending: 1,
+		},
+		{
+			name:           "past send_at is sent immediately",
+			schedule:       ScheduleOptions{SendAt: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+			withScheduler:  true,
+			expectedStatus: http.StatusOK,
+			expectedSends:  1,
+		},
+		{
+			name:           "send_at and delay together are rejected",
+			schedule:       ScheduleOptions{SendAt: time.Now().Format(time.RFC3339), Delay: "1m"},
+			withScheduler:  true,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "invalid delay is rejected",
+			schedule:       ScheduleOptions{Delay: "tomorrow"},
+			withScheduler:  true,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "scheduling without scheduler is rejected",
+			schedule:       ScheduleOptions{Delay: "30m"},
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sends := 0
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sends++
+					return "fcm-success-id", nil
+				},
+			}
+
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			handler := new(PushDeviceHandler).WithMock(mockClient)
+			if tt.withScheduler {
+				handler = handler.WithScheduler(sched)
+			}
+
+			payload := DevicePushPayload{Title: "Title", Body: "Body", Token: "token", ScheduleOptions: tt.schedule}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(payload)))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+
+			pending, _ := sched.Pending()
+			if len(pending) != tt.expectedPending {
+				t.Errorf("pending jobs: got %d want %d", len(pending), tt.expectedPending)
+			}
+
+			if sends != tt.expectedSends {
+				t.Errorf("FCM sends: got %d want %d", sends, tt.expectedSends)
+			}
+
+			if tt.expectedPending == 0 {
+				return
+			}
+
+			var resp map[string]string
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp["status"] != "scheduled" || resp["schedule_id"] != pending[0].ID {
+				t.Errorf("unexpected response body: %s", rr.Body.String())
+			}
+
+			// 予約時刻を過ぎたらスケジューラ経由で送信される
+			sched.DispatchDue(context.Background(), pending[0].SendAt)
+
+			if sends != 1 {
+				t.Errorf("FCM sends after dispatch: got %d want 1", sends)
+			}
+
+			if pending, _ := sched.Pending(); len(pending) != 0 {
+				t.Errorf("pending jobs after dispatch: got %d want 0", len(pending))
+			}
+		})
+	}
+}
+
+// TestPushDeviceHandler_ScheduledAttemptsExhausted は試行回数の上限に達した予約が失敗として残り、failed の配信イベントを送出することを確認します。
+func TestPushDeviceHandler_ScheduledAttemptsExhausted(t *testing.T) {
+	sends := 0
+	mockClient := &MockFCMClient{
+		MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+			sends++
+			return "", errors.New("retryable")
+		},
+	}
+	emitter := &fakeEventEmitter{}
+	sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable).WithRetryDelay(time.Second, time.Second).WithMaxAttempts(2)
+	handler := new(PushDeviceHandler).WithMock(mockClient).WithScheduler(sched).WithEvents(emitter)
+
+	payload := DevicePushPayload{Title: "Title", Body: "Body", Token: "token", ScheduleOptions: ScheduleOptions{Delay: "1m"}}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(payload))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	now := time.Now()
+	for i := range 3 {
+		sched.DispatchDue(context.Background(), now.Add(time.Duration(i+1)*time.Hour))
+	}
+
+	if sends != 2 {
+		t.Errorf("FCM sends: got %d want 2", sends)
+	}
+
+	pending, _ := sched.Pending()
+	if len(pending) != 1 || pending[0].Status != scheduler.JobFailed {
+		t.Errorf("pending jobs: got %+v want one failed job", pending)
+	}
+
+	if len(emitter.events) != 1 {
+		t.Fatalf("events: got %+v want one failed event", emitter.events)
+	}
+	if e := emitter.events[0]; e.Type != events.TypeFailed || e.ErrorClass != events.ErrorClassPermanent || e.Handler != "scheduler" {
+		t.Errorf("event: got %+v", e)
+	}
+}
+
+func TestPushDeviceHandler_QuietHours(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	window, _ := quiethours.Parse("22:00-08:00")
+	now := time.Date(2025, 1, 2, 18, 0, 0, 0, time.UTC) // 03:00 JST, 18:00 UTC
+
+	tests := []struct {
+		name           string
+		payload        DevicePushPayload
+		expectedSends  int
+		expectedSendAt time.Time
+	}{
+		{
+			name:           "non-urgent message in quiet hours is deferred",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token", TimeZone: "Asia/Tokyo"},
+			expectedSendAt: time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:          "urgent message bypasses quiet hours",
+			payload:       DevicePushPayload{Title: "Title", Body: "Body", Token: "token", TimeZone: "Asia/Tokyo", Priority: "urgent"},
+			expectedSends: 1,
+		},
+		{
+			name:          "message outside recipient quiet hours is sent",
+			payload:       DevicePushPayload{Title: "Title", Body: "Body", Token: "token", TimeZone: "UTC"},
+			expectedSends: 1,
+		},
+		{
+			name:           "default time zone is used when payload has none",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+			expectedSendAt: time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:           "scheduled send landing in quiet hours is deferred",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token", TimeZone: "UTC", ScheduleOptions: ScheduleOptions{Delay: "5h"}},
+			expectedSendAt: time.Date(2025, 1, 3, 8, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sends := 0
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sends++
+					return "fcm-success-id", nil
+				},
+			}
+
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			handler := new(PushDeviceHandler).WithMock(mockClient).
+				WithScheduler(sched).
+				WithQuietHours(window, tokyo).
+				WithClock(func() time.Time { return now })
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(tt.payload)))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			if sends != tt.expectedSends {
+				t.Errorf("FCM sends: got %d want %d", sends, tt.expectedSends)
+			}
+
+			pending, _ := sched.Pending()
+			if tt.expectedSendAt.IsZero() {
+				if len(pending) != 0 {
+					t.Errorf("pending jobs: got %d want 0", len(pending))
+				}
+				return
+			}
+
+			if len(pending) != 1 || !pending[0].SendAt.Equal(tt.expectedSendAt) {
+				t.Errorf("pending jobs: got %+v want one job at %s", pending, tt.expectedSendAt)
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_FrequencyCap(t *testing.T) {
+	tests := []struct {
+		name            string
+		policy          frequencycap.Policy
+		payloads        []DevicePushPayload
+		expectedSends   int
+		expectedPending int
+		expectedLast    string
+		quietHours      string    // 空ならおやすみ時間帯なし
+		now             time.Time // ゼロ値なら現在時刻
+		expectedSendAt  time.Time // ゼロ値なら予約時刻を確認しない
+	}{
+		{
+			name:   "over-cap message is dropped",
+			policy: frequencycap.PolicyDrop,
+			payloads: []DevicePushPayload{
+				{Title: "Title", Body: "Body", Token: "token-1", UserID: "user", Category: "marketing"},
+				{Title: "Title", Body: "Body", Token: "token-2", UserID: "user", Category: "marketing"},
+			},
+			expectedSends: 1,
+			expectedLast:  "suppressed",
+		},
+		{
+			name:   "over-cap message is deferred",
+			policy: frequencycap.PolicyDefer,
+			payloads: []DevicePushPayload{
+				{Title: "Title", Body: "Body", Token: "token"},
+				{Title: "Title", Body: "Body", Token: "token"},
+			},
+			expectedSends:   1,
+			expectedPending: 1,
+			expectedLast:    "scheduled",
+		},
+		{
+			name:   "different recipients are capped independently",
+			policy: frequencycap.PolicyDrop,
+			payloads: []DevicePushPayload{
+				{Title: "Title", Body: "Body", Token: "token-1"},
+				{Title: "Title", Body: "Body", Token: "token-2"},
+			},
+			expectedSends: 2,
+			expectedLast:  "processed",
+		},
+		{
+			name:   "deferred message whose cap resets in quiet hours waits for them to end",
+			policy: frequencycap.PolicyDefer,
+			payloads: []DevicePushPayload{
+				{Title: "Title", Body: "Body", Token: "token", TimeZone: "UTC"},
+				{Title: "Title", Body: "Body", Token: "token", TimeZone: "UTC"},
+			},
+			quietHours:      "22:00-08:00",
+			now:             time.Date(2025, 1, 2, 21, 30, 0, 0, time.UTC), // 上限は 22:30 に解除される
+			expectedSends:   1,
+			expectedPending: 1,
+			expectedLast:    "scheduled",
+			expectedSendAt:  time.Date(2025, 1, 3, 8, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sends := 0
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sends++
+					return "fcm-success-id", nil
+				},
+			}
+
+			limiter, err := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), tt.policy, &frequencycap.Rule{Limit: 1, Window: time.Hour}, nil)
+			if err != nil {
+				t.Fatalf("NewLimiter: %v", err)
+			}
+
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			handler := new(PushDeviceHandler).WithMock(mockClient).WithScheduler(sched).WithFrequencyCap(limiter)
+			if !tt.now.IsZero() {
+				handler.WithClock(func() time.Time { return tt.now })
+			}
+			if tt.quietHours != "" {
+				window, err := quiethours.Parse(tt.quietHours)
+				if err != nil {
+					t.Fatalf("quiethours.Parse: %v", err)
+				}
+				handler.WithQuietHours(window, time.UTC)
+			}
+
+			var resp map[string]string
+			for _, payload := range tt.payloads {
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(payload)))
+				rr := httptest.NewRecorder()
+
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+
+				resp = nil
+				json.Unmarshal(rr.Body.Bytes(), &resp)
+			}
+
+			if sends != tt.expectedSends {
+				t.Errorf("FCM sends: got %d want %d", sends, tt.expectedSends)
+			}
+
+			pending, _ := sched.Pending()
+			if len(pending) != tt.expectedPending {
+				t.Errorf("pending jobs: got %d want %d", len(pending), tt.expectedPending)
+			}
+			if !tt.expectedSendAt.IsZero() && len(pending) == 1 && !pending[0].SendAt.Equal(tt.expectedSendAt) {
+				t.Errorf("deferred send_at: got %v want %v", pending[0].SendAt, tt.expectedSendAt)
+			}
+
+			if resp["status"] != tt.expectedLast {
+				t.Errorf("last response status: got %q want %q", resp["status"], tt.expectedLast)
+			}
+		})
+	}
+}
+
+// TestPushDeviceHandler_FrequencyCapFailedSend は送信に失敗した通知が送信数の上限に数えられないことを確認します。
+func TestPushDeviceHandler_FrequencyCapFailedSend(t *testing.T) {
+	sendErrs := []error{errors.New("retryable"), nil}
+	mockClient := &MockFCMClient{
+		MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+			err := sendErrs[0]
+			sendErrs = sendErrs[1:]
+			return "fcm-success-id", err
+		},
+	}
+
+	limiter, err := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), frequencycap.PolicyDrop, &frequencycap.Rule{Limit: 1, Window: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("NewLimiter: %v", err)
+	}
+	handler := new(PushDeviceHandler).WithMock(mockClient).WithFrequencyCap(limiter)
+
+	for _, expectedStatus := range []int{http.StatusInternalServerError, http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"})))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		var resp map[string]string
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != expectedStatus || (rr.Code == http.StatusOK && resp["status"] != "processed") {
+			t.Errorf("status: got %d %q want %d. Body: %s", rr.Code, resp["status"], expectedStatus, rr.Body.String())
+		}
+	}
+}
+
+func TestPushDeviceHandler_Preferences(t *testing.T) {
+	registry := preferences.NewRegistry(preferences.NewMemoryStore(), nil)
+	registry.Update(preferences.UserKey("u1"), map[string]bool{"marketing": false}, time.Now())
+
+	tests := []struct {
+		name           string
+		payload        DevicePushPayload
+		expectedSends  int
+		expectedStatus string
+	}{
+		{
+			name:           "opted-out category is suppressed",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token", UserID: "u1", Category: "marketing"},
+			expectedStatus: "suppressed",
+		},
+		{
+			name:           "other category is sent",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token", UserID: "u1", Category: "reminder"},
+			expectedSends:  1,
+			expectedStatus: "processed",
+		},
+		{
+			name:           "other user is sent",
+			payload:        DevicePushPayload{Title: "Title", Body: "Body", Token: "token", UserID: "u2", Category: "marketing"},
+			expectedSends:  1,
+			expectedStatus: "processed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sends := 0
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sends++
+					return "fcm-success-id", nil
+				},
+			}
+
+			handler := new(PushDeviceHandler).WithMock(mockClient).WithPreferences(registry)
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequest(tt.payload)))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			var resp map[string]string
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+
+			if rr.Code != http.StatusOK || resp["status"] != tt.expectedStatus {
+				t.Errorf("Handler returned %v %s, want 200 with status %q", rr.Code, rr.Body.String(), tt.expectedStatus)
+			}
+
+			if sends != tt.expectedSends {
+				t.Errorf("FCM sends: got %d want %d", sends, tt.expectedSends)
+			}
+		})
+	}
+}
+
+type fakeMetricsRecorder struct {
+	outcomes []string
+	delays   int
+}
+
+func (r *fakeMetricsRecorder) ObserveNotification(handler, targetType, outcome, fcmErrorCode string) {
+	r.outcomes = append(r.outcomes, handler+"/"+targetType+"/"+outcome)
+}
+
+func (r *fakeMetricsRecorder) ObservePublishDelay(handler, outcome string, d time.Duration) {
+	r.delays++
+}
+
+func TestPushDeviceHandler_Metrics(t *testing.T) {
+	tests := []struct {
+		name            string
+		body            []byte
+		sendErr         error
+		expectedOutcome string
+	}{
+		{
+			name:            "sent",
+			body:            newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			expectedOutcome: "push_device/token/sent",
+		},
+		{
+			name:            "retryable failure",
+			body:            newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr:         errors.New("retryable"),
+			expectedOutcome: "push_device/token/failed_retryable",
+		},
+		{
+			name:            "permanent failure",
+			body:            newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr:         errors.New("unregistered"),
+			expectedOutcome: "push_device/token/failed_permanent",
+		},
+		{
+			name:            "invalid payload",
+			body:            newPushPubSubRequest(DevicePushPayload{Title: "Title", Token: "token"}),
+			expectedOutcome: "push_device/token/invalid",
+		},
+		{
+			name:            "invalid envelope",
+			body:            []byte("this is not json"),
+			expectedOutcome: "push_device/token/invalid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					return "fcm-success-id", tt.sendErr
+				},
+			}
+
+			recorder := &fakeMetricsRecorder{}
+			handler := new(PushDeviceHandler).WithMock(mockClient).WithMetrics(recorder)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(tt.body)))
+
+			if len(recorder.outcomes) != 1 || recorder.outcomes[0] != tt.expectedOutcome {
+				t.Errorf("recorded outcomes: got %v want [%s]", recorder.outcomes, tt.expectedOutcome)
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_Tracing(t *testing.T) {
+	const producerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent := "00-" + producerTraceID + "-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name            string
+		attributes      map[string]string
+		expectedTraceID string // 空なら decodeData 以外のスパンが同じトレースにあることだけを確認する
+	}{
+		{
+			name:            "traceparent attribute",
+			attributes:      map[string]string{"traceparent": traceparent},
+			expectedTraceID: producerTraceID,
+		},
+		{
+			name:            "Pub/Sub client library attribute",
+			attributes:      map[string]string{"googclient_OpenTelemetryTraceContext": traceparent},
+			expectedTraceID: producerTraceID,
+		},
+		{
+			name: "no trace context",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter, restore := tracingtest.NewInMemoryProvider()
+			defer restore()
+
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					return "fcm-success-id", nil
+				},
+			}
+			handler := new(PushDeviceHandler).WithMock(mockClient)
+
+			body := newPushPubSubRequestWithAttributes(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}, tt.attributes)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body)))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+
+			traceIDs := map[string]string{}
+			for _, s := range exporter.GetSpans() {
+				traceIDs[s.Name] = s.SpanContext.TraceID().String()
+			}
+
+			for _, name := range []string{"decodeData", "validatePayload", "PushDeviceHandler process"} {
+				if _, ok := traceIDs[name]; !ok {
+					t.Fatalf("span %q was not recorded (got %v)", name, traceIDs)
+				}
+			}
+
+			if traceIDs["validatePayload"] != traceIDs["PushDeviceHandler process"] {
+				t.Errorf("validatePayload span is not in the message trace: got %s want %s",
+					traceIDs["validatePayload"], traceIDs["PushDeviceHandler process"])
+			}
+
+			if tt.expectedTraceID != "" && traceIDs["PushDeviceHandler process"] != tt.expectedTraceID {
+				t.Errorf("message span trace ID: got %s want %s", traceIDs["PushDeviceHandler process"], tt.expectedTraceID)
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_Logging(t *testing.T) {
+	const token = "fGx1abcdefghijklmnopqrstuvwxyz0123456789:APA91bXyZ"
+
+	tests := []struct {
+		name    string
+		sendErr error
+		// realClient が true なら、モックの代わりに送信を sendErr で失敗させる fcm.Client を使い、
+		// fcm パッケージのエラーメッセージにもトークンが含まれないことを確認する
+		realClient bool
+	}{
+		{
+			name: "sent",
+		},
+		{
+			name:    "failed",
+			sendErr: errors.New("unregistered"),
+		},
+		{
+			name:       "failed in the FCM client",
+			sendErr:    errors.New("unregistered"),
+			realClient: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := logging.New(&buf, logging.Options{Level: slog.LevelDebug})
+			if err != nil {
+				t.Fatalf("logging.New: %v", err)
+			}
+
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					return "fcm-success-id", tt.sendErr
+				},
+			}
+			handler := new(PushDeviceHandler).WithMock(mockClient)
+			if tt.realClient {
+				handler.WithMock(fcm.NewClientWithSender(failingSender{err: tt.sendErr}))
+			}
+
+			body := newPushPubSubRequest(DevicePushPayload{
+				Title: "Title", Body: "Body", Token: token, CustomData: map[string]string{"secret": "value"},
+			})
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+			req = req.WithContext(logging.WithLogger(req.Context(), logger))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tt.sendErr != nil && !strings.Contains(buf.String(), logging.RedactToken(token)) {
+				t.Errorf("logs do not contain the redacted token:\n%s", buf.String())
+			}
+			if strings.Contains(buf.String(), token) {
+				t.Errorf("logs contain the device token:\n%s", buf.String())
+			}
+			if strings.Contains(buf.String(), `"value"`) {
+				t.Errorf("logs contain custom data values:\n%s", buf.String())
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) < 2 {
+				t.Fatalf("expected at least 2 log lines, got:\n%s", buf.String())
+			}
+
+			for _, line := range lines {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("log line is not JSON: %v (%q)", err, line)
+				}
+
+				if entry["messageId"] != "test-message-id" || entry["subscription"] != "test-subscription" {
+					t.Errorf("log line lacks Pub/Sub message fields: %s", line)
+				}
+			}
+		})
+	}
+}
+
+// failingSender はすべての送信を err で失敗させる fcm.Sender です。
+type failingSender struct {
+	err error
+}
+
+func (s failingSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return "", s.err
+}
+
+func (s failingSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	resp := &messaging.BatchResponse{FailureCount: len(messages)}
+	for range messages {
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Error: s.err})
+	}
+	return resp, nil
+}
+
+type fakeEventEmitter struct {
+	events []events.Event
+}
+
+func (f *fakeEventEmitter) Emit(e events.Event) {
+	f.events = append(f.events, e)
+}
+
+func TestPushDeviceHandler_Events(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          []byte
+		sendErr       error
+		expectedEvent *events.Event // nil ならイベントを送出しない
+	}{
+		{
+			name: "sent with payload correlation_id",
+			body: newPushPubSubRequestWithAttributes(
+				DevicePushPayload{Title: "Title", Body: "Body", Token: "token", CorrelationID: "order-1"},
+				map[string]string{"correlation_id": "ignored"}),
+			expectedEvent: &events.Event{
+				Type: events.TypeSent, Handler: "push_device", MessageID: "test-message-id", CorrelationID: "order-1",
+				TargetType: "token", Target: "token", FCMMessageID: "fcm-success-id",
+			},
+		},
+		{
+			name: "sent with attribute correlation_id",
+			body: newPushPubSubRequestWithAttributes(
+				DevicePushPayload{Title: "Title", Body: "Body", Token: "token"},
+				map[string]string{"correlation_id": "order-2"}),
+			expectedEvent: &events.Event{
+				Type: events.TypeSent, Handler: "push_device", MessageID: "test-message-id", CorrelationID: "order-2",
+				TargetType: "token", Target: "token", FCMMessageID: "fcm-success-id",
+			},
+		},
+		{
+			name:    "permanent failure",
+			body:    newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr: errors.New("unregistered"),
+			expectedEvent: &events.Event{
+				Type: events.TypeFailed, Handler: "push_device", MessageID: "test-message-id",
+				TargetType: "token", Target: "token", ErrorClass: events.ErrorClassPermanent, FCMErrorCode: "UNKNOWN",
+			},
+		},
+		{
+			name:    "retryable failure",
+			body:    newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr: errors.New("retryable"),
+		},
+		{
+			name: "invalid payload",
+			body: newPushPubSubRequest(DevicePushPayload{Title: "Title", Token: "token", CorrelationID: "order-3"}),
+			expectedEvent: &events.Event{
+				Type: events.TypeFailed, Handler: "push_device", MessageID: "test-message-id", CorrelationID: "order-3",
+				TargetType: "token", Target: "token", ErrorClass: events.ErrorClassInvalid,
+			},
+		},
+		{
+			name: "rejected by validation",
+			body: newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token",
+				CustomData: map[string]string{"from": "x", "gcm.notification.e": "1"}}),
+			expectedEvent: &events.Event{
+				Type: events.TypeFailed, Handler: "push_device", MessageID: "test-message-id",
+				TargetType: "token", Target: "token", ErrorClass: events.ErrorClassInvalid,
+				FieldErrors: []events.FieldError{
+					{Field: "custom_data.from", Message: "key is reserved by FCM"},
+					{Field: "custom_data.gcm.notification.e", Message: `keys starting with "gcm." are reserved by FCM`},
+				},
+			},
+		},
+		{
+			name: "invalid envelope",
+			body: []byte("this is not json"),
+			expectedEvent: &events.Event{
+				Type: events.TypeFailed, Handler: "push_device", TargetType: "token", ErrorClass: events.ErrorClassInvalid,
+			},
+		},
+		{
+			name: "scheduled",
+			body: newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token",
+				ScheduleOptions: ScheduleOptions{Delay: "1h"}}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					return "fcm-success-id", tt.sendErr
+				},
+			}
+
+			emitter := &fakeEventEmitter{}
+			handler := new(PushDeviceHandler).WithMock(mockClient).
+				WithScheduler(scheduler.New(scheduler.NewMemoryStore(), IsRetryable)).
+				WithEvents(emitter)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(tt.body)))
+
+			if tt.expectedEvent == nil {
+				if len(emitter.events) != 0 {
+					t.Errorf("expected no events, got %+v", emitter.events)
+				}
+				return
+			}
+
+			if len(emitter.events) != 1 {
+				t.Fatalf("got %d events want 1: %+v", len(emitter.events), emitter.events)
+			}
+
+			got := emitter.events[0]
+			if tt.expectedEvent.ErrorClass != "" && got.Error == "" {
+				t.Errorf("failed event has no error message: %+v", got)
+			}
+			got.Error = ""
+			if !reflect.DeepEqual(got, *tt.expectedEvent) {
+				t.Errorf("event:\n got %+v\nwant %+v", got, *tt.expectedEvent)
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_SendTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		timeout        time.Duration
+		cancelRequest  bool
+		expectedStatus int
+	}{
+		{
+			name:           "send exceeding timeout is nacked",
+			timeout:        10 * time.Millisecond,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "send interrupted by request cancellation is nacked",
+			cancelRequest:  true,
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			mock := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					if tt.cancelRequest {
+						cancel()
+					}
+					<-ctx.Done()
+					return "", errors.New("unknown error while making an http call: " + ctx.Err().Error())
+				},
+			}
+			handler := NewPushDeviceHandler(nil).WithMock(mock)
+			if tt.timeout > 0 {
+				handler.WithSendTimeout(tt.timeout)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/publish/token",
+				bytes.NewReader(newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}))).WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("status: got %d want %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_Tenants(t *testing.T) {
+	tests := []struct {
+		name           string
+		tenant         string
+		attributes     map[string]string
+		schedule       ScheduleOptions
+		expectedStatus int
+		expectedSender string
+	}{
+		{
+			name:           "no tenant uses the default client",
+			expectedStatus: http.StatusOK,
+			expectedSender: "default",
+		},
+		{
+			name:           "payload tenant selects the tenant client",
+			tenant:         "app-b",
+			expectedStatus: http.StatusOK,
+			expectedSender: "app-b",
+		},
+		{
+			name:           "tenant attribute selects the tenant client",
+			attributes:     map[string]string{"tenant": "app-b"},
+			expectedStatus: http.StatusOK,
+			expectedSender: "app-b",
+		},
+		{
+			name:           "payload tenant takes precedence over the attribute",
+			tenant:         "default",
+			attributes:     map[string]string{"tenant": "app-b"},
+			expectedStatus: http.StatusOK,
+			expectedSender: "default",
+		},
+		{
+			name:           "scheduled notification keeps the attribute tenant",
+			attributes:     map[string]string{"tenant": "app-b"},
+			schedule:       ScheduleOptions{Delay: "30m"},
+			expectedStatus: http.StatusOK,
+			expectedSender: "app-b",
+		},
+		{
+			name:           "unknown tenant is acked without sending",
+			tenant:         "app-z",
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var senders []string
+			mockFor := func(name string) *MockFCMClient {
+				return &MockFCMClient{
+					MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+						senders = append(senders, name)
+						return "fcm-success-id", nil
+					},
+				}
+			}
+
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			emitter := &fakeEventEmitter{}
+			handler := new(PushDeviceHandler).
+				WithMock(mockFor("default")).
+				WithMockTenants(map[string]any{"app-b": mockFor("app-b")}).
+				WithScheduler(sched).
+				WithEvents(emitter)
+
+			payload := DevicePushPayload{Title: "Title", Body: "Body", Token: "token", Tenant: tt.tenant, ScheduleOptions: tt.schedule}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPushPubSubRequestWithAttributes(payload, tt.attributes)))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("status: got %d want %d. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+
+			if pending, _ := sched.Pending(); len(pending) == 1 {
+				sched.DispatchDue(context.Background(), pending[0].SendAt)
+			}
+
+			want := []string{}
+			if tt.expectedSender != "" {
+				want = append(want, tt.expectedSender)
+			}
+			if strings.Join(senders, ",") != strings.Join(want, ",") {
+				t.Errorf("senders: got %v want %v", senders, want)
+			}
+
+			if tt.expectedSender == "" {
+				if len(emitter.events) != 1 || emitter.events[0].ErrorClass != events.ErrorClassInvalid {
+					t.Errorf("events: got %+v, want one invalid failure", emitter.events)
+				}
+			}
+		})
+	}
+}
+
+func TestPushDeviceHandler_HandleMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		attributes map[string]string
+		sendErr    error
+		wantAck    bool
+		wantToken  string
+		wantStatus int // 記録される、Pushで受信した場合の応答のステータスコード
+	}{
+		{
+			name:       "successful send is acked",
+			data:       mustMarshal(t, DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			wantAck:    true,
+			wantStatus: http.StatusOK,
+			wantToken:  "token",
+		},
+		{
+			name:       "retryable error is nacked",
+			data:       mustMarshal(t, DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr:    errors.New("retryable"),
+			wantAck:    false,
+			wantStatus: http.StatusInternalServerError,
+			wantToken:  "token",
+		},
+		{
+			name:       "permanent error is acked",
+			data:       mustMarshal(t, DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			sendErr:    errors.New("registration token is not valid"),
+			wantAck:    true,
+			wantStatus: http.StatusNoContent,
+			wantToken:  "token",
+		},
+		{
+			name:       "empty data is acked without sending",
+			wantAck:    true,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "invalid payload is acked without sending",
+			data:       []byte(`{"title":"Title"}`),
+			wantAck:    true,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "unknown tenant attribute is acked without sending",
+			data:       mustMarshal(t, DevicePushPayload{Title: "Title", Body: "Body", Token: "token"}),
+			attributes: map[string]string{"tenant": "app-x"},
+			wantAck:    true,
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sentTo string
+			mock := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sentTo = token
+					return "fcm-id", tt.sendErr
+				},
+			}
+			capturer := &fakeCapturer{}
+			handler := NewPushDeviceHandler(nil).WithMock(mock).WithCapture(capturer)
+
+			ack := handler.HandleMessage(context.Background(), ReceivedMessage{
+				ID:           "m1",
+				Data:         tt.data,
+				Attributes:   tt.attributes,
+				PublishTime:  time.Now(),
+				Subscription: "projects/p/subscriptions/s",
+			})
+
+			if ack != tt.wantAck {
+				t.Errorf("HandleMessage() = %v, want %v", ack, tt.wantAck)
+			}
+			if sentTo != tt.wantToken {
+				t.Errorf("sent to %q, want %q", sentTo, tt.wantToken)
+			}
+			if len(capturer.captured) != 1 {
+				t.Fatalf("captured %d messages, want 1", len(capturer.captured))
+			}
+			if c := capturer.captured[0]; c.path != "/publish/token" || c.m.ID != "m1" || c.status != tt.wantStatus {
+				t.Errorf("captured %s %s with status %d, want /publish/token m1 with status %d", c.path, c.m.ID, c.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// fakeCapturer はpullで受信したメッセージの記録を保持します。
+type fakeCapturer struct {
+	captured []capturedMessage
+}
+
+type capturedMessage struct {
+	path     string
+	m        ReceivedMessage
+	status   int
+	response []byte
+}
+
+func (c *fakeCapturer) CaptureMessage(ctx context.Context, path string, m ReceivedMessage, status int, response []byte) {
+	c.captured = append(c.captured, capturedMessage{path: path, m: m, status: status, response: response})
+}
+
+// BenchmarkPushDeviceHandler はFCMへの送信を除いた、Pushリクエスト1件あたりのハンドラの処理を計測します。
+func BenchmarkPushDeviceHandler(b *testing.B) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	mock := &MockFCMClient{
+		MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+			return "projects/p/messages/1", nil
+		},
+	}
+	handler := NewPushDeviceHandler(nil).WithMock(mock)
+	body := newPushPubSubRequest(DevicePushPayload{Title: "Title", Body: "Body", Token: "token-1", CustomData: map[string]string{"article_id": "12345"}})
+
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, "/publish/token", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			b.Fatalf("status: got %d want %d", rr.Code, http.StatusOK)
+		}
+	}
+}
@@ -2,98 +2,276 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+	"github.com/teamzidi/example-go-fcm/tracing"
 )
 
 // TopicPushPayload は /pubsub/push/Topic エンドポイントでPub/Subメッセージの
 // Base64デコードされた data フィールドが示す実際の業務ペイロード構造体です。
 type TopicPushPayload struct {
-	Title      string            `json:"title"`
-	Body       string            `json:"body"`
-	Topic      string            `json:"topic"`
-	CustomData map[string]string `json:"custom_data,omitempty"`
+	// SchemaVersion はペイロードのスキーマバージョンです。未指定なら 1 として扱います (LatestSchemaVersion を参照)。
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	Title         string            `json:"title"`
+	Body          string            `json:"body"`
+	Topic         string            `json:"topic"`
+	CustomData    map[string]string `json:"custom_data,omitempty"`
+	// Tenant は送信に使うテナント (Firebaseプロジェクト) です。未指定ならPub/Subメッセージの tenant 属性、それもなければ既定のテナントを使います。
+	Tenant string `json:"tenant,omitempty"`
+	// CorrelationID は配信イベントに含めてプロデューサーに返す相関IDです。未指定ならPub/Subメッセージの correlation_id 属性を使います。
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ScheduleOptions
 }
 
 // PushTopicHandler は特定の単一デバイストークンへのPush通知を処理します。
 type PushTopicHandler struct {
 	fcmClient fcmClient
+	tenants   tenantClients
+	scheduler *scheduler.Scheduler
+	metrics   MetricsRecorder
+	events    EventEmitter
+	capture   MessageCapturer
+
+	sendTimeout time.Duration
 }
 
 func NewPushTopicHandler(fc *fcm.Client) *PushTopicHandler {
 	return &PushTopicHandler{
-		fcmClient: fc,
+		fcmClient:   fc,
+		sendTimeout: defaultSendTimeout,
 	}
 }
 
+// WithMetrics は処理結果をメトリクスとして記録するよう設定します。
+func (h *PushTopicHandler) WithMetrics(m MetricsRecorder) *PushTopicHandler {
+	h.metrics = m
+
+	return h
+}
+
+// WithTenants はテナントごとのFCMクライアントを設定します。tenant を指定した通知は該当するクライアントで送信し、
+// 登録されていないテナントの通知は再送しない失敗として ack します。NewPushTopicHandler に渡したクライアントは
+// テナント fcm.DefaultTenant として使われます。
+func (h *PushTopicHandler) WithTenants(clients map[string]*fcm.Client) *PushTopicHandler {
+	h.tenants = newTenantClients(clients)
+
+	return h
+}
+
+// WithSendTimeout は1回のFCMへの送信を待つ時間を設定します。0 なら打ち切りません。
+// タイムアウトした送信は再送対象として nack されるため、Pushサブスクリプションの確認応答期限より短くしてください。
+func (h *PushTopicHandler) WithSendTimeout(d time.Duration) *PushTopicHandler {
+	h.sendTimeout = d
+
+	return h
+}
+
+// WithCapture はpullで受信したメッセージと処理結果を c で記録するよう設定します。
+func (h *PushTopicHandler) WithCapture(c MessageCapturer) *PushTopicHandler {
+	h.capture = c
+
+	return h
+}
+
+// WithEvents は通知の最終的な処理結果を配信イベントとして送出するよう設定します。
+func (h *PushTopicHandler) WithEvents(e EventEmitter) *PushTopicHandler {
+	h.events = e
+
+	return h
+}
+
+// WithScheduler は send_at / delay 付きのメッセージを予約するための Scheduler を設定し、
+// 予約時刻を迎えたジョブをこのハンドラで送信するよう登録します。
+func (h *PushTopicHandler) WithScheduler(s *scheduler.Scheduler) *PushTopicHandler {
+	h.scheduler = s
+	s.Register(topicScheduleKind, h.dispatch)
+
+	return h
+}
+
 // ServeHTTP はHTTPリクエストを処理します。
 func (h *PushTopicHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		slog.WarnContext(r.Context(), "invalid request method", "handler", pushTopicHandlerLogName, "method", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	decodedData, err := decodeData(r.Body)
+	_, decodeSpan := tracing.Tracer().Start(r.Context(), "decodeData")
+	msg, err := decodeRequest(r)
+	endSpan(decodeSpan, err)
+
+	result, err := h.handle(r.Context(), msg, err)
+	writePushResponse(r.Context(), w, result.response(), err)
+}
+
+// HandleMessage はPub/Subのpullで受信したメッセージを処理し、ackすべきなら true を返します。
+// Push (ServeHTTP) と同じ処理を行い、ServeHTTP が 2xx を返す場合に true になります。
+func (h *PushTopicHandler) HandleMessage(ctx context.Context, m ReceivedMessage) bool {
+	msg, err := m.pushMessage()
+	result, err := h.handle(ctx, msg, err)
+	captureMessage(ctx, h.capture, topicScheduleKind, m, result.response(), err)
+
+	return err == nil || !shouldRetry(err)
+}
+
+// handle はデコードしたPub/Subメッセージを処理します。decodeErr はメッセージのデコードに失敗した場合のエラーです。
+func (h *PushTopicHandler) handle(ctx context.Context, msg pushMessage, decodeErr error) (pushResult, error) {
+	logger := messageLogger(ctx, pushTopicHandlerLogName, msg)
+	if decodeErr != nil {
+		err := payloadError{decodeErr}
+		recordOutcome(h.metrics, pushTopicHandlerName, topicScheduleKind, msg.PublishTime, pushResult{}, err)
+		logger.WarnContext(ctx, "discarding undecodable Pub/Sub message", "error", decodeErr)
+		emitOutcome(withEventSource(ctx, messageEventSource(pushTopicHandlerName, msg)), h.events,
+			eventTarget{targetType: topicScheduleKind}, pushResult{}, err)
+		return pushResult{}, err
+	}
+
+	ctx, span := startMessageSpan(ctx, "PushTopicHandler process", msg)
+	ctx = logging.WithLogger(ctx, logger)
+	ctx = withEventSource(ctx, messageEventSource(pushTopicHandlerName, msg))
+	logger.InfoContext(ctx, "received Pub/Sub message", "publishTime", msg.PublishTime)
+	result, err := h.send(ctx, msg)
+	endSpan(span, err)
+	recordOutcome(h.metrics, pushTopicHandlerName, topicScheduleKind, msg.PublishTime, result, err)
 	if err != nil {
-		log.Printf("PushDeviceHandler: decoding data: %v", err)
-		w.WriteHeader(http.StatusNoContent) // New: Ack with 204
-		return
+		logFailure(ctx, err)
 	}
 
-	messageID, err := h.send(decodedData)
+	return result, err
+}
+
+func (h *PushTopicHandler) send(ctx context.Context, msg pushMessage) (pushResult, error) {
+	_, span := tracing.Tracer().Start(ctx, "validatePayload")
+	payload, err := parseTopicPushPayload(msg.Data)
+	decodedData := msg.Data
+	if err == nil {
+		payload.Tenant, decodedData, err = tenantFromAttribute(msg.Data, payload.Tenant, msg)
+	}
+	endSpan(span, err)
 	if err != nil {
-		if IsRetryable(err) {
-			http.Error(w, "Failed to send notification via FCM (retryable)", http.StatusInternalServerError) // Nack
-		} else {
-			w.WriteHeader(http.StatusNoContent) // Ack
-		}
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return pushResult{}, err
+	}
 
-		return
+	return h.process(ctx, payload, decodedData)
+}
+
+// process は検証済みのペイロードを、予約が必要なら予約し、そうでなければ送信します。
+func (h *PushTopicHandler) process(ctx context.Context, payload TopicPushPayload, decodedData []byte) (pushResult, error) {
+	ctx = withTenantLogger(ctx, payload.Tenant)
+	if _, err := h.tenants.clientFor(h.fcmClient, payload.Tenant); err != nil {
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return pushResult{}, err
+	}
+
+	at, scheduled, err := payload.scheduledTime(time.Now())
+	if err != nil {
+		err = payloadError{err}
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return pushResult{}, err
+	}
+
+	if scheduled {
+		return h.schedule(ctx, decodedData, at)
+	}
+
+	messageID, err := h.sendNow(ctx, payload)
+	emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{MessageID: messageID}, err)
+	if err != nil {
+		return pushResult{}, err
+	}
+
+	return pushResult{MessageID: messageID}, nil
+}
+
+func (h *PushTopicHandler) schedule(ctx context.Context, decodedData []byte, at time.Time) (pushResult, error) {
+	if h.scheduler == nil {
+		return pushResult{}, payloadError{fmt.Errorf("scheduled delivery is not enabled")}
+	}
+
+	job, err := h.scheduler.Schedule(topicScheduleKind, decodedData, at)
+	if err != nil {
+		return pushResult{}, retryableError{fmt.Errorf("scheduling notification: %w", err)}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	logging.FromContext(ctx).InfoContext(ctx, "scheduled notification", "jobId", job.ID, "sendAt", job.SendAt)
+
+	return pushResult{ScheduleID: job.ID, SendAt: job.SendAt}, nil
+}
+
+// dispatch は予約時刻を迎えたジョブを送信します。送信予約フィールドは無視されます。
+func (h *PushTopicHandler) dispatch(ctx context.Context, decodedData []byte) error {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).With("handler", pushTopicHandlerLogName))
+	ctx = withEventSource(ctx, eventSource{handler: schedulerHandlerName})
 
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":     "processed",
-		"message_id": messageID,
-	}); err != nil {
-		log.Printf("PushDeviceHandler: Error encoding success response: %v\n", err)
+	payload, err := parseTopicPushPayload(decodedData)
+	if err != nil {
+		emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{}, err)
+		return err
 	}
+	ctx = withTenantLogger(ctx, payload.Tenant)
+
+	messageID, err := h.sendNow(ctx, payload)
+	err = exhausted(ctx, err)
+	emitOutcome(ctx, h.events, payload.eventTarget(), pushResult{MessageID: messageID}, err)
+	return err
 }
 
-func (h *PushTopicHandler) send(decodedData []byte) (string, error) {
+func parseTopicPushPayload(decodedData []byte) (TopicPushPayload, error) {
 	var payload TopicPushPayload
-	if err := json.Unmarshal(decodedData, &payload); err != nil {
-		return "", fmt.Errorf("unmarshalling payload: %v. Decoded data was: %s", err, string(decodedData))
+	if err := decodePayload(decodedData, &payload); err != nil {
+		return payload, payloadError{fmt.Errorf("unmarshalling payload (%d bytes): %v", len(decodedData), err)}
 	}
 
 	if payload.Title == "" {
-		return "", fmt.Errorf("title is required in payload")
+		return payload, payloadError{fmt.Errorf("title is required in payload")}
 	}
 
 	if payload.Body == "" {
-		return "", fmt.Errorf("body is required in payload")
+		return payload, payloadError{fmt.Errorf("body is required in payload")}
 	}
 
 	if payload.Topic == "" {
-		return "", fmt.Errorf("topic is required in payload")
+		return payload, payloadError{fmt.Errorf("topic is required in payload")}
+	}
+
+	if err := fcm.Validate(fcm.Notification{Topic: payload.Topic, Title: payload.Title, Body: payload.Body, CustomData: payload.CustomData}); err != nil {
+		return payload, payloadError{err}
+	}
+
+	if _, _, err := payload.scheduledTime(time.Now()); err != nil {
+		return payload, payloadError{err}
+	}
+
+	return payload, nil
+}
+
+func (h *PushTopicHandler) sendNow(ctx context.Context, payload TopicPushPayload) (string, error) {
+	logger := logging.FromContext(ctx).With("topic", payload.Topic)
+	logger.DebugContext(ctx, "sending notification to topic", "customDataKeys", logging.Keys(payload.CustomData))
+
+	client, err := h.tenants.clientFor(h.fcmClient, payload.Tenant)
+	if err != nil {
+		return "", err
 	}
 
-	log.Printf("PushTopicHandler: Sending notification to Topic: topic=%q title=%q data=%v",
-		payload.Topic, payload.Title, payload.CustomData)
+	// FCM送信。リクエストの切断やシャットダウンに加え、sendTimeout でも打ち切る
+	sendCtx, cancel := sendContext(ctx, h.sendTimeout)
+	defer cancel()
 
-	// FCM送信
-	messageID, err := h.fcmClient.SendToTopic(context.Background(), payload.Topic, payload.Title, payload.Body, payload.CustomData)
+	messageID, err := client.SendToTopic(sendCtx, payload.Topic, payload.Title, payload.Body, payload.CustomData)
 	if err != nil {
-		return "", fmt.Errorf("sending FCM message to topic %s: %v", payload.Topic, err)
+		return "", interrupted(sendCtx, fmt.Errorf("sending FCM message to topic %s: %w", payload.Topic, err))
 	}
 
-	log.Printf("PushTopicHandler: Successfully sent message ID %s to topic %s", messageID, payload.Topic)
+	logger.InfoContext(ctx, "sent notification", "fcmMessageId", messageID)
 
-	return "", nil
+	return messageID, nil
 }
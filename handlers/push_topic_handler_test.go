@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -19,6 +20,7 @@ func TestPushTopicHandler_Comprehensive(t *testing.T) {
 		body           []byte
 		mockSendFunc   func(ctx context.Context, topic string, title string, body string, customData map[string]string) (string, error)
 		expectedStatus int
+		expectedID     string // 成功時の message_id
 	}{
 		{
 			name:   "successful FCM send to topic",
@@ -30,6 +32,7 @@ func TestPushTopicHandler_Comprehensive(t *testing.T) {
 				return "fcm-topic-success-id", nil
 			},
 			expectedStatus: http.StatusOK,
+			expectedID:     "fcm-topic-success-id",
 		},
 		{
 			name:   "retryable FCM error on send to topic",
@@ -130,6 +133,16 @@ func TestPushTopicHandler_Comprehensive(t *testing.T) {
 				t.Errorf("Handler returned wrong status code for '%s': got %v want %v. Body: %s",
 					tt.name, rr.Code, tt.expectedStatus, rr.Body.String())
 			}
+
+			if tt.expectedID != "" {
+				var resp map[string]string
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decoding response: %v", err)
+				}
+				if resp["message_id"] != tt.expectedID {
+					t.Errorf("message_id: got %q want %q", resp["message_id"], tt.expectedID)
+				}
+			}
 		})
 	}
 }
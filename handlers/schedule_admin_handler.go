@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/teamzidi/example-go-fcm/scheduler"
+)
+
+// ScheduleAdminHandler は予約済み通知の一覧取得・取り消しを行う管理用エンドポイントです。
+//
+//	GET    /admin/schedules       未送信の予約を送信予定時刻順に返します。
+//	DELETE /admin/schedules/{id}  指定IDの予約を取り消します。
+type ScheduleAdminHandler struct {
+	scheduler *scheduler.Scheduler
+}
+
+func NewScheduleAdminHandler(s *scheduler.Scheduler) *ScheduleAdminHandler {
+	return &ScheduleAdminHandler{
+		scheduler: s,
+	}
+}
+
+// List は未送信の予約一覧をJSONで返します。
+func (h *ScheduleAdminHandler) List(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.scheduler.Pending()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "listing scheduled jobs", "handler", "ScheduleAdminHandler", "error", err)
+		http.Error(w, "Failed to list scheduled notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"schedules": jobs,
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "encoding response", "handler", "ScheduleAdminHandler", "error", err)
+	}
+}
+
+// Cancel はパスの {id} で指定された予約を取り消します。
+func (h *ScheduleAdminHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	ok, err := h.scheduler.Cancel(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "cancelling scheduled job", "handler", "ScheduleAdminHandler", "jobId", id, "error", err)
+		http.Error(w, "Failed to cancel scheduled notification", http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		http.Error(w, "Scheduled notification not found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "cancelled scheduled job", "handler", "ScheduleAdminHandler", "jobId", id)
+	w.WriteHeader(http.StatusNoContent)
+}
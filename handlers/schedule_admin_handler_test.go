@@ -0,0 +1,61 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+)
+
+func TestScheduleAdminHandler(t *testing.T) {
+	sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+
+	job, err := sched.Schedule("token", []byte(`{"title":"t"}`), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	admin := NewScheduleAdminHandler(sched)
+	mux.HandleFunc("GET /admin/schedules", admin.List)
+	mux.HandleFunc("DELETE /admin/schedules/{id}", admin.Cancel)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/schedules", nil))
+
+	var resp struct {
+		Schedules []scheduler.Job `json:"schedules"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("list returned %d %s", rr.Code, rr.Body.String())
+	}
+
+	if len(resp.Schedules) != 1 || resp.Schedules[0].ID != job.ID {
+		t.Fatalf("list returned %+v, want job %s", resp.Schedules, job.ID)
+	}
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{name: "cancel pending job", id: job.ID, expectedStatus: http.StatusNoContent},
+		{name: "cancel already cancelled job", id: job.ID, expectedStatus: http.StatusNotFound},
+		{name: "cancel unknown job", id: "unknown", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/admin/schedules/"+tt.id, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Handler returned wrong status code: got %v want %v. Body: %s", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ペイロードのスキーマバージョン (schema_version)。
+const (
+	// SchemaVersion1 は schema_version を持たない従来のペイロードです。未知のフィールドは無視します。
+	SchemaVersion1 = 1
+	// SchemaVersion2 は未知のフィールドを含むペイロードを不正として拒否します。
+	SchemaVersion2 = 2
+	// LatestSchemaVersion はプロデューサーが新しく使うべきバージョンです。
+	LatestSchemaVersion = SchemaVersion2
+)
+
+// decodePayload は data の schema_version に応じて業務ペイロードを v にデコードします。
+// schema_version がない、または 1 の場合は従来どおり未知のフィールドを無視し、2 の場合は未知のフィールドをエラーにします。
+func decodePayload(data []byte, v any) error {
+	var header struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	version := SchemaVersion1
+	if header.SchemaVersion != nil {
+		version = *header.SchemaVersion
+	}
+
+	switch version {
+	case SchemaVersion1:
+		return json.Unmarshal(data, v)
+	case SchemaVersion2:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			return err
+		}
+		if dec.More() {
+			return fmt.Errorf("unexpected data after the payload")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported schema_version %d (supported: %d, %d)", version, SchemaVersion1, SchemaVersion2)
+	}
+}
+
+// batchItemData はバッチ内の通知 data を、バッチの schema_version (version) でデコードできるようにします。
+// 通知が schema_version を持たなければバッチのものを書き加え、異なる schema_version を持てばエラーを返します。
+// 書き加えた data は予約や再送でもそのまま使うため、後で送信するときも同じバージョンで検証されます。
+func batchItemData(data json.RawMessage, version int) (json.RawMessage, error) {
+	if version == 0 {
+		return data, nil
+	}
+
+	var header struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return data, fmt.Errorf("decoding notification: %w", err)
+	}
+	switch {
+	case header.SchemaVersion == nil:
+		return withField(data, "schema_version", version)
+	case *header.SchemaVersion != version:
+		return data, fmt.Errorf("schema_version %d does not match the batch schema_version %d", *header.SchemaVersion, version)
+	}
+
+	return data, nil
+}
+
+// payloadSchema はJSON Schemaを公開するペイロードの型です。
+type payloadSchema struct {
+	name     string // URLのファイル名 (<name>.json)
+	typ      reflect.Type
+	required []string
+	// override は型から生成できないプロパティのスキーマを version ごとに返します。
+	override func(version int) map[string]any
+}
+
+var (
+	deviceSchema = payloadSchema{
+		name:     "device",
+		typ:      reflect.TypeFor[DevicePushPayload](),
+		required: []string{"title", "body", "token"},
+	}
+	topicSchema = payloadSchema{
+		name:     "topic",
+		typ:      reflect.TypeFor[TopicPushPayload](),
+		required: []string{"title", "body", "topic"},
+	}
+	payloadSchemas = []payloadSchema{
+		deviceSchema,
+		topicSchema,
+		{
+			name:     "batch",
+			typ:      reflect.TypeFor[BatchPushPayload](),
+			required: []string{"notifications"},
+			override: func(version int) map[string]any {
+				return map[string]any{
+					"notifications": map[string]any{
+						"type":     "array",
+						"minItems": 1,
+						"items": map[string]any{
+							"anyOf": []any{deviceSchema.objectSchema(version, true), topicSchema.objectSchema(version, true)},
+						},
+					},
+				}
+			},
+		},
+	}
+)
+
+// schemaDocument は version のペイロードのJSON Schema (draft 2020-12) を生成します。
+func (s payloadSchema) schemaDocument(version int) map[string]any {
+	doc := s.objectSchema(version, false)
+	doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	doc["title"] = fmt.Sprintf("%s (schema_version %d)", s.typ.Name(), version)
+
+	return doc
+}
+
+// objectSchema は version のペイロードのオブジェクトのスキーマを生成します。
+// item が true ならバッチ内の通知のスキーマで、schema_version を省略するとバッチのものを使うため必須にしません。
+func (s payloadSchema) objectSchema(version int, item bool) map[string]any {
+	properties := map[string]any{}
+	addProperties(properties, s.typ)
+	if s.override != nil {
+		for k, v := range s.override(version) {
+			properties[k] = v
+		}
+	}
+
+	required := s.required
+	versionSchema := map[string]any{"type": "integer", "const": version}
+	switch {
+	case item:
+		versionSchema["description"] = "省略可。省略した場合はバッチの schema_version として扱います。"
+	case version == SchemaVersion1:
+		// v1 では schema_version を省略できる
+		versionSchema["description"] = "省略可。省略した場合は 1 として扱います。"
+	default:
+		required = append([]string{"schema_version"}, required...)
+	}
+	properties["schema_version"] = versionSchema
+
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": version == SchemaVersion1,
+	}
+}
+
+// addProperties は構造体 t のJSONのフィールドを properties に追加します。埋め込みの構造体のフィールドも追加します。
+func addProperties(properties map[string]any, t reflect.Type) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			addProperties(properties, f.Type)
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = typeSchema(f.Type)
+	}
+}
+
+var rawMessageType = reflect.TypeFor[json.RawMessage]()
+
+// typeSchema はGoの型 t に対応するJSON Schemaを返します。
+func typeSchema(t reflect.Type) map[string]any {
+	switch {
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case t.Kind() == reflect.Struct:
+		properties := map[string]any{}
+		addProperties(properties, t)
+		return map[string]any{"type": "object", "properties": properties}
+	default:
+		return map[string]any{}
+	}
+}
+
+// SchemaHandler はペイロードのJSON Schemaを公開します。プロデューサーがCIでペイロードを検証するのに使います。
+//
+//	GET /schemas                     公開しているスキーマの一覧を返します。
+//	GET /schemas/{version}/{name}    指定したバージョン (v1, v2) のスキーマ (device.json, topic.json, batch.json) を返します。
+type SchemaHandler struct {
+	documents map[string][]byte // "v2/device.json" などのパスからスキーマ
+}
+
+func NewSchemaHandler() *SchemaHandler {
+	h := &SchemaHandler{documents: map[string][]byte{}}
+	for _, version := range []int{SchemaVersion1, SchemaVersion2} {
+		for _, s := range payloadSchemas {
+			b, err := json.MarshalIndent(s.schemaDocument(version), "", "  ")
+			if err != nil {
+				panic(err) // map と基本型だけなので失敗しない
+			}
+			h.documents[fmt.Sprintf("v%d/%s.json", version, s.name)] = b
+		}
+	}
+	return h
+}
+
+// Index は公開しているスキーマのパスと最新のバージョンを返します。
+func (h *SchemaHandler) Index(w http.ResponseWriter, r *http.Request) {
+	var schemas []string
+	for _, version := range []int{SchemaVersion1, SchemaVersion2} {
+		for _, s := range payloadSchemas {
+			schemas = append(schemas, fmt.Sprintf("/schemas/v%d/%s.json", version, s.name))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"latest_schema_version": LatestSchemaVersion,
+		"schemas":               schemas,
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "encoding response", "handler", "SchemaHandler", "error", err)
+	}
+}
+
+// Get はパスの {version} と {name} で指定されたスキーマを返します。
+func (h *SchemaHandler) Get(w http.ResponseWriter, r *http.Request) {
+	doc, ok := h.documents[r.PathValue("version")+"/"+r.PathValue("name")]
+	if !ok {
+		http.Error(w, "Schema not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(doc); err != nil {
+		slog.ErrorContext(r.Context(), "writing response", "handler", "SchemaHandler", "error", err)
+	}
+}
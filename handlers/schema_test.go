@@ -0,0 +1,269 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	. "github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+)
+
+func TestPushDeviceHandler_SchemaVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		payload        string
+		expectedStatus int
+	}{
+		{
+			name:           "v1 ignores unknown fields",
+			payload:        `{"title":"T","body":"B","token":"token","custom-data":{"k":"v"}}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "explicit v1 ignores unknown fields",
+			payload:        `{"schema_version":1,"title":"T","body":"B","token":"token","custom-data":{"k":"v"}}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "v2 with known fields",
+			payload:        `{"schema_version":2,"title":"T","body":"B","token":"token","custom_data":{"k":"v"},"delay":"0s"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "v2 rejects unknown fields",
+			payload:        `{"schema_version":2,"title":"T","body":"B","token":"token","custom-data":{"k":"v"}}`,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "unsupported version",
+			payload:        `{"schema_version":3,"title":"T","body":"B","token":"token"}`,
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			mock := &MockFCMClient{
+				MockSendToToken: func(ctx context.Context, token, title, body string, customData map[string]string) (string, error) {
+					sent = true
+					return "fcm-id", nil
+				},
+			}
+			handler := NewPushDeviceHandler(nil).WithMock(mock)
+
+			req := httptest.NewRequest(http.MethodPost, "/publish/token", bytes.NewReader(newPushPubSubRequest(json.RawMessage(tt.payload))))
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("status: got %d want %d (body %q)", rr.Code, tt.expectedStatus, rr.Body.String())
+			}
+			if sent != (tt.expectedStatus == http.StatusOK) {
+				t.Errorf("sent = %v, want %v", sent, tt.expectedStatus == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestPushBatchHandler_SchemaVersion(t *testing.T) {
+	window, _ := quiethours.Parse("22:00-08:00")
+	now := time.Date(2025, 1, 2, 23, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name              string
+		payload           string
+		expectedCounts    map[string]int // sent, scheduled, invalid
+		expectedScheduled string         // 予約したジョブのペイロードの schema_version
+	}{
+		{
+			name:           "v2 items use the batch version",
+			payload:        `{"schema_version":2,"notifications":[{"title":"T","body":"B","topic":"news"}]}`,
+			expectedCounts: map[string]int{"sent": 1, "scheduled": 0, "invalid": 0},
+		},
+		{
+			name:           "v2 item without schema_version rejects unknown fields",
+			payload:        `{"schema_version":2,"notifications":[{"title":"T","body":"B","topic":"news","custom-data":{"k":"v"}}]}`,
+			expectedCounts: map[string]int{"sent": 0, "scheduled": 0, "invalid": 1},
+		},
+		{
+			name:           "item version must match the batch",
+			payload:        `{"schema_version":2,"notifications":[{"schema_version":1,"title":"T","body":"B","topic":"news"}]}`,
+			expectedCounts: map[string]int{"sent": 0, "scheduled": 0, "invalid": 1},
+		},
+		{
+			name:           "v1 items ignore unknown fields",
+			payload:        `{"notifications":[{"title":"T","body":"B","topic":"news","custom-data":{"k":"v"}}]}`,
+			expectedCounts: map[string]int{"sent": 1, "scheduled": 0, "invalid": 0},
+		},
+		{
+			name:              "scheduled item keeps the batch version",
+			payload:           `{"schema_version":2,"notifications":[{"title":"T","body":"B","token":"token-1","time_zone":"UTC"}]}`,
+			expectedCounts:    map[string]int{"sent": 0, "scheduled": 1, "invalid": 0},
+			expectedScheduled: "2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockFCMClient{
+				MockSendEach: func(ctx context.Context, notifications []fcm.Notification) []fcm.SendResult {
+					return make([]fcm.SendResult, len(notifications))
+				},
+			}
+			sched := scheduler.New(scheduler.NewMemoryStore(), IsRetryable)
+			device := new(PushDeviceHandler).WithMock(mock).WithScheduler(sched).WithQuietHours(window, time.UTC).
+				WithClock(func() time.Time { return now })
+			handler := NewPushBatchHandler(nil).WithMock(mock).WithDeviceHandler(device)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/publish/batch", bytes.NewReader(newPushPubSubRequest(json.RawMessage(tt.payload)))))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status: got %d want %d (body %q)", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			var resp map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			for k, want := range tt.expectedCounts {
+				if got := resp[k]; got != float64(want) {
+					t.Errorf("response %s: got %v want %d", k, got, want)
+				}
+			}
+
+			pending, _ := sched.Pending()
+			for _, job := range pending {
+				var payload map[string]json.RawMessage
+				if err := json.Unmarshal(job.Payload, &payload); err != nil {
+					t.Fatalf("decoding scheduled payload: %v", err)
+				}
+				if got := string(payload["schema_version"]); got != tt.expectedScheduled {
+					t.Errorf("scheduled schema_version: got %q want %q", got, tt.expectedScheduled)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	h := NewSchemaHandler()
+	mux.HandleFunc("GET /schemas", h.Index)
+	mux.HandleFunc("GET /schemas/{version}/{name}", h.Get)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	var index struct {
+		LatestSchemaVersion int      `json:"latest_schema_version"`
+		Schemas             []string `json:"schemas"`
+	}
+	if err := json.Unmarshal(get("/schemas").Body.Bytes(), &index); err != nil {
+		t.Fatalf("decoding index: %v", err)
+	}
+	if index.LatestSchemaVersion != LatestSchemaVersion {
+		t.Errorf("latest_schema_version: got %d want %d", index.LatestSchemaVersion, LatestSchemaVersion)
+	}
+	for _, path := range index.Schemas {
+		if rr := get(path); rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/schema+json" {
+			t.Errorf("GET %s: status %d, content type %q", path, rr.Code, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	tests := []struct {
+		path                 string
+		expectedRequired     []string
+		additionalProperties bool
+		expectedProperties   []string // 含まれているべきプロパティの一部
+	}{
+		{
+			path:               "/schemas/v1/device.json",
+			expectedRequired:   []string{"title", "body", "token"},
+			expectedProperties: []string{"schema_version", "custom_data", "send_at", "delay", "tenant"},
+			// v1 は未知のフィールドを無視する
+			additionalProperties: true,
+		},
+		{
+			path:               "/schemas/v2/device.json",
+			expectedRequired:   []string{"schema_version", "title", "body", "token"},
+			expectedProperties: []string{"schema_version", "custom_data", "send_at", "delay", "tenant"},
+		},
+		{
+			path:               "/schemas/v2/topic.json",
+			expectedRequired:   []string{"schema_version", "title", "body", "topic"},
+			expectedProperties: []string{"topic", "correlation_id"},
+		},
+		{
+			path:               "/schemas/v2/batch.json",
+			expectedRequired:   []string{"schema_version", "notifications"},
+			expectedProperties: []string{"notifications", "tenant"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var schema struct {
+				Required             []string                   `json:"required"`
+				AdditionalProperties bool                       `json:"additionalProperties"`
+				Properties           map[string]json.RawMessage `json:"properties"`
+			}
+			if err := json.Unmarshal(get(tt.path).Body.Bytes(), &schema); err != nil {
+				t.Fatalf("decoding schema: %v", err)
+			}
+
+			if !slices.Equal(schema.Required, tt.expectedRequired) {
+				t.Errorf("required: got %v want %v", schema.Required, tt.expectedRequired)
+			}
+			if schema.AdditionalProperties != tt.additionalProperties {
+				t.Errorf("additionalProperties: got %v want %v", schema.AdditionalProperties, tt.additionalProperties)
+			}
+			for _, p := range tt.expectedProperties {
+				if _, ok := schema.Properties[p]; !ok {
+					t.Errorf("property %q is missing", p)
+				}
+			}
+		})
+	}
+
+	// バッチ内の通知は schema_version を省略できる
+	var batch struct {
+		Properties struct {
+			Notifications struct {
+				Items struct {
+					AnyOf []struct {
+						Required []string `json:"required"`
+					} `json:"anyOf"`
+				} `json:"items"`
+			} `json:"notifications"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(get("/schemas/v2/batch.json").Body.Bytes(), &batch); err != nil {
+		t.Fatalf("decoding batch schema: %v", err)
+	}
+	if items := batch.Properties.Notifications.Items.AnyOf; len(items) != 2 {
+		t.Errorf("batch item schemas: got %d want 2", len(items))
+	}
+	for _, item := range batch.Properties.Notifications.Items.AnyOf {
+		if slices.Contains(item.Required, "schema_version") {
+			t.Errorf("batch item schema requires schema_version: %v", item.Required)
+		}
+	}
+
+	if rr := get("/schemas/v3/device.json"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown schema: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+// tenantAttribute はテナントを指定するPub/Subメッセージ属性です。ペイロードの tenant が優先されます。
+const tenantAttribute = "tenant"
+
+// tenantClients はテナント名ごとのFCMクライアントです。fcm.DefaultTenant は含みません。
+type tenantClients map[string]fcmClient
+
+func newTenantClients(clients map[string]*fcm.Client) tenantClients {
+	t := make(tenantClients, len(clients))
+	for name, c := range clients {
+		t[name] = c
+	}
+
+	return t
+}
+
+// clientFor は tenant への送信に使うクライアントを返します。tenant が空か fcm.DefaultTenant なら def を返します。
+// 登録されていないテナントは再送しても成功しないため payloadError を返します。
+func (t tenantClients) clientFor(def fcmClient, tenant string) (fcmClient, error) {
+	if tenant == "" || tenant == fcm.DefaultTenant {
+		return def, nil
+	}
+
+	if c, ok := t[tenant]; ok {
+		return c, nil
+	}
+
+	return nil, payloadError{fmt.Errorf("unknown tenant %q", tenant)}
+}
+
+// tenantFromAttribute は payloadTenant が空でPub/Subメッセージ属性でテナントが指定されている場合、
+// そのテナントと、テナントを書き加えた decodedData を返します。予約した通知も同じテナントで送信するためです。
+// それ以外の場合は payloadTenant と decodedData をそのまま返します。
+func tenantFromAttribute(decodedData []byte, payloadTenant string, msg pushMessage) (string, []byte, error) {
+	tenant := msg.Attributes[tenantAttribute]
+	if payloadTenant != "" || tenant == "" {
+		return payloadTenant, decodedData, nil
+	}
+
+	b, err := withTenant(decodedData, tenant)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tenant, b, nil
+}
+
+// withTenant はペイロードに tenant フィールドを追加します。
+func withTenant(decodedData []byte, tenant string) ([]byte, error) {
+	return withField(decodedData, "tenant", tenant)
+}
+
+// withField はペイロードに name フィールドを追加します。既にあれば value で上書きします。
+func withField(decodedData []byte, name string, value any) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(decodedData, &fields); err != nil {
+		return nil, payloadError{fmt.Errorf("unmarshalling payload (%d bytes): %v", len(decodedData), err)}
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, payloadError{fmt.Errorf("adding %s to payload: %v", name, err)}
+	}
+	fields[name] = b
+
+	if b, err = json.Marshal(fields); err != nil {
+		return nil, payloadError{fmt.Errorf("adding %s to payload: %v", name, err)}
+	}
+
+	return b, nil
+}
+
+// withTenantLogger は tenant が指定されていればロガーにテナントを追加します。
+func withTenantLogger(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+
+	return logging.WithLogger(ctx, logging.FromContext(ctx).With("tenant", tenant))
+}
@@ -3,12 +3,18 @@ package handlers_test
 import (
 	"encoding/base64"
 	"encoding/json"
+	"testing"
 
 	"github.com/teamzidi/example-go-fcm/handlers"
 )
 
 // newPushPubSubRequest encodes a payload into the Pub/Sub message structure.
 func newPushPubSubRequest(payload any) []byte {
+	return newPushPubSubRequestWithAttributes(payload, nil)
+}
+
+// newPushPubSubRequestWithAttributes is newPushPubSubRequest with Pub/Sub message attributes.
+func newPushPubSubRequestWithAttributes(payload any, attributes map[string]string) []byte {
 	var payloadBytes []byte
 
 	if b, ok := payload.([]byte); ok {
@@ -26,6 +32,7 @@ func newPushPubSubRequest(payload any) []byte {
 			Data:        base64.StdEncoding.EncodeToString(payloadBytes),
 			MessageID:   "test-message-id",
 			PublishTime: "test-publish-time",
+			Attributes:  attributes,
 		},
 		Subscription: "test-subscription",
 	}
@@ -36,3 +43,14 @@ func newPushPubSubRequest(payload any) []byte {
 	}
 	return requestBytes
 }
+
+// mustMarshal encodes a payload or request body as JSON.
+func mustMarshal(t *testing.T, payload any) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshalling test payload: %v", err)
+	}
+	return b
+}
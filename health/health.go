@@ -0,0 +1,245 @@
+// Package health はliveness/readinessプローブ用のエンドポイントと、依存先のヘルスチェックを提供します。
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultTTL     = 30 * time.Second
+	defaultTimeout = 5 * time.Second
+)
+
+// CheckFunc は依存先が利用可能かどうかを確認し、利用できなければエラーを返します。
+type CheckFunc func(ctx context.Context) error
+
+// Status はチェックの結果です。
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusFail Status = "fail"
+	StatusWarn Status = "warn" // AddWarning で登録したチェックの失敗。readinessは失敗させない
+)
+
+// CheckResult は1つのチェックの結果です。
+type CheckResult struct {
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Duration  string    `json:"duration"`
+}
+
+// Report はすべてのチェックの結果です。
+type Report struct {
+	Status Status                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Checker は登録されたチェックを実行し、結果を一定時間キャッシュします。
+// プローブのたびにGoogleのAPIなどを呼び出さないよう、キャッシュが有効な間はチェックを再実行しません。
+type Checker struct {
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	checks []*check
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+
+	uncached bool
+	warning  bool
+
+	mu     sync.Mutex // 同じチェックを同時に実行しないためのロック
+	result CheckResult
+	valid  bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		ttl:     defaultTTL,
+		timeout: defaultTimeout,
+		now:     time.Now,
+	}
+}
+
+// WithTTL はチェック結果をキャッシュする時間を設定します。
+func (c *Checker) WithTTL(ttl time.Duration) *Checker {
+	c.ttl = ttl
+
+	return c
+}
+
+// WithTimeout は1つのチェックの実行時間の上限を設定します。
+func (c *Checker) WithTimeout(timeout time.Duration) *Checker {
+	c.timeout = timeout
+
+	return c
+}
+
+// Add はチェックを登録します。
+func (c *Checker) Add(name string, fn CheckFunc) *Checker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, &check{name: name, fn: fn})
+
+	return c
+}
+
+// AddUncached は結果をキャッシュしないチェックを登録します。シャットダウン中かどうかなど、
+// プロセス内の状態だけを見る安価で、変化をすぐに反映する必要があるチェックに使います。
+func (c *Checker) AddUncached(name string, fn CheckFunc) *Checker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, &check{name: name, fn: fn, uncached: true})
+
+	return c
+}
+
+// AddWarning は失敗しても readiness を失敗させないチェックを登録します。結果はキャッシュしません。
+// 一部のテナントの状態など、レポートには表示したいがインスタンス全体をトラフィックから外す理由にはならないものに使います。
+func (c *Checker) AddWarning(name string, fn CheckFunc) *Checker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, &check{name: name, fn: fn, uncached: true, warning: true})
+
+	return c
+}
+
+// Run はすべてのチェックを並行して実行し (キャッシュが有効なものは結果を再利用し)、結果を返します。
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]*check(nil), c.checks...)
+	c.mu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, chk := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, chk)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, chk := range checks {
+		report.Checks[chk.name] = results[i]
+		if results[i].Status == StatusFail {
+			report.Status = StatusFail
+		}
+	}
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, chk *check) CheckResult {
+	chk.mu.Lock()
+	defer chk.mu.Unlock()
+
+	if chk.valid && !chk.uncached && c.now().Sub(chk.result.CheckedAt) < c.ttl {
+		return chk.result
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := c.now()
+	err := chk.fn(checkCtx)
+
+	result := CheckResult{Status: StatusOK, CheckedAt: start, Duration: c.now().Sub(start).String()}
+	if err != nil {
+		result.Status = StatusFail
+		if chk.warning {
+			result.Status = StatusWarn
+		}
+		result.Error = err.Error()
+		slog.WarnContext(ctx, "health check failed", "component", "health", "check", chk.name, "error", err)
+	}
+
+	// プローブのリクエストが切断されるなどして ctx がキャンセルされた結果はキャッシュしない
+	if ctx.Err() == nil || err == nil {
+		chk.result, chk.valid = result, true
+	}
+
+	return result
+}
+
+// ReadyHandler はすべてのチェックが成功すれば 200、いずれかが失敗すれば 503 を返すreadinessプローブ用のハンドラです。
+// レスポンスボディは Report のJSONです。
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, report)
+	})
+}
+
+// LiveHandler はプロセスが応答できる限り 200 を返すlivenessプローブ用のハンドラです。依存先は確認しません。
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]Status{"status": StatusOK})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("encoding health response", "component", "health", "error", err)
+	}
+}
+
+// TokenSourceCheck は ts からアクセストークンを取得できることを確認するチェックです。
+// 認証情報が不正な場合や、トークンを発行するGoogleのエンドポイントに到達できない場合に失敗します。
+func TokenSourceCheck(ts oauth2.TokenSource) CheckFunc {
+	return func(ctx context.Context) error {
+		type result struct {
+			tok *oauth2.Token
+			err error
+		}
+
+		// oauth2.TokenSource は ctx を受け取らないため、タイムアウトは呼び出し側で待つ
+		ch := make(chan result, 1)
+		go func() {
+			tok, err := ts.Token()
+			ch <- result{tok, err}
+		}()
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("fetching access token: %w", ctx.Err())
+		case r := <-ch:
+			if r.err != nil {
+				return fmt.Errorf("fetching access token: %w", r.err)
+			}
+			if !r.tok.Valid() {
+				return fmt.Errorf("access token is invalid or expired")
+			}
+			return nil
+		}
+	}
+}
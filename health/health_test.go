@@ -0,0 +1,238 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/teamzidi/example-go-fcm/health"
+)
+
+func TestChecker_ReadyHandler(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("store unavailable") }
+
+	tests := []struct {
+		name           string
+		checks         map[string]health.CheckFunc
+		expectedStatus int
+		expectedBody   health.Status
+		expectedFailed []string
+	}{
+		{
+			name:           "all ok",
+			checks:         map[string]health.CheckFunc{"a": ok, "b": ok},
+			expectedStatus: http.StatusOK,
+			expectedBody:   health.StatusOK,
+		},
+		{
+			name:           "one failing",
+			checks:         map[string]health.CheckFunc{"a": ok, "b": fail},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   health.StatusFail,
+			expectedFailed: []string{"b"},
+		},
+		{
+			name: "timeout",
+			checks: map[string]health.CheckFunc{"slow": func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			}},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   health.StatusFail,
+			expectedFailed: []string{"slow"},
+		},
+		{
+			name:           "no checks",
+			checks:         map[string]health.CheckFunc{},
+			expectedStatus: http.StatusOK,
+			expectedBody:   health.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := health.NewChecker().WithTimeout(20 * time.Millisecond)
+			for name, fn := range tt.checks {
+				checker.Add(name, fn)
+			}
+
+			rr := httptest.NewRecorder()
+			checker.ReadyHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedStatus)
+			}
+
+			var report health.Report
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("response is not a report: %v", err)
+			}
+
+			if report.Status != tt.expectedBody {
+				t.Errorf("report status: got %s want %s", report.Status, tt.expectedBody)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Errorf("got %d check results want %d", len(report.Checks), len(tt.checks))
+			}
+			for _, name := range tt.expectedFailed {
+				if r := report.Checks[name]; r.Status != health.StatusFail || r.Error == "" {
+					t.Errorf("check %s: got %+v want failure with error", name, r)
+				}
+			}
+		})
+	}
+}
+
+func TestChecker_Cache(t *testing.T) {
+	var calls atomic.Int32
+	checker := health.NewChecker().WithTTL(50*time.Millisecond).Add("counted", func(context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		checker.Run(context.Background())
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls within TTL: got %d want 1", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	checker.Run(context.Background())
+	if got := calls.Load(); got != 2 {
+		t.Errorf("calls after TTL: got %d want 2", got)
+	}
+}
+
+func TestChecker_AddUncached(t *testing.T) {
+	var draining atomic.Bool
+	checker := health.NewChecker().AddUncached("lifecycle", func(context.Context) error {
+		if draining.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	})
+
+	if report := checker.Run(context.Background()); report.Status != health.StatusOK {
+		t.Fatalf("report status: got %s want %s", report.Status, health.StatusOK)
+	}
+
+	draining.Store(true)
+	if report := checker.Run(context.Background()); report.Status != health.StatusFail {
+		t.Errorf("report status after state change: got %s want %s", report.Status, health.StatusFail)
+	}
+}
+
+func TestChecker_AddWarning(t *testing.T) {
+	checker := health.NewChecker().
+		Add("store", func(context.Context) error { return nil }).
+		AddWarning("breaker", func(context.Context) error { return errors.New("circuit breaker is open") })
+
+	rr := httptest.NewRecorder()
+	checker.ReadyHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var report health.Report
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("response is not a report: %v", err)
+	}
+	if report.Status != health.StatusOK {
+		t.Errorf("report status: got %s want %s", report.Status, health.StatusOK)
+	}
+	if r := report.Checks["breaker"]; r.Status != health.StatusWarn || r.Error == "" {
+		t.Errorf("check breaker: got %+v want warning with error", r)
+	}
+}
+
+func TestChecker_CanceledProbeIsNotCached(t *testing.T) {
+	var calls atomic.Int32
+	checker := health.NewChecker().Add("ctx", func(ctx context.Context) error {
+		calls.Add(1)
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := checker.Run(ctx); report.Status != health.StatusFail {
+		t.Errorf("report status with canceled context: got %s want %s", report.Status, health.StatusFail)
+	}
+
+	if report := checker.Run(context.Background()); report.Status != health.StatusOK {
+		t.Errorf("report status after canceled probe: got %s want %s", report.Status, health.StatusOK)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("calls: got %d want 2", got)
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	health.LiveHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) { return f() }
+
+func TestTokenSourceCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		ts          oauth2.TokenSource
+		expectError bool
+	}{
+		{
+			name: "valid token",
+			ts:   oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}),
+		},
+		{
+			name: "error",
+			ts: tokenSourceFunc(func() (*oauth2.Token, error) {
+				return nil, errors.New("invalid_grant")
+			}),
+			expectError: true,
+		},
+		{
+			name:        "expired token",
+			ts:          oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(-time.Hour)}),
+			expectError: true,
+		},
+		{
+			name: "hangs",
+			ts: tokenSourceFunc(func() (*oauth2.Token, error) {
+				time.Sleep(time.Second)
+				return nil, nil
+			}),
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err := health.TokenSourceCheck(tt.ts)(ctx)
+			if tt.expectError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
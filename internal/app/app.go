@@ -0,0 +1,509 @@
+// Package app は設定からFCMバックエンドサービスの各コンポーネントを組み立てて実行します。
+// main と、ローカル開発用のコマンド (cmd/devstack など) から使います。
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2/google"
+
+	"github.com/teamzidi/example-go-fcm/auth"
+	"github.com/teamzidi/example-go-fcm/capture"
+	"github.com/teamzidi/example-go-fcm/chaos"
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/events"
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/frequencycap"
+	"github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/health"
+	"github.com/teamzidi/example-go-fcm/lifecycle"
+	"github.com/teamzidi/example-go-fcm/metrics"
+	"github.com/teamzidi/example-go-fcm/preferences"
+	"github.com/teamzidi/example-go-fcm/pull"
+	"github.com/teamzidi/example-go-fcm/quiethours"
+	"github.com/teamzidi/example-go-fcm/resilience"
+	"github.com/teamzidi/example-go-fcm/scheduler"
+	"github.com/teamzidi/example-go-fcm/tracing"
+)
+
+// Options は Run で組み立てるサービスの一部を差し替えます。ゼロ値なら本番と同じ構成です。
+type Options struct {
+	// Listener が nil でなければ、cfg.Server.Port の代わりにこのリスナーでHTTPリクエストを受け付けます。
+	Listener net.Listener
+}
+
+// Run はサービスを起動し、ctx がキャンセルされるまでリクエストとPub/Subのメッセージを処理します。
+// ctx がキャンセルされると、新しい受け付けを止めて処理中のものを待ち、cfg.Server.ShutdownTimeout 以内に終了処理を行って nil を返します。
+// 起動に失敗した場合や、HTTPサーバー・pullワーカーが異常終了した場合はエラーを返します。
+func Run(ctx context.Context, cfg config.Config, opts Options) error {
+	// 初期化に使う ctx。終了処理は ctx のキャンセルを合図に行うため、キャンセルは引き継がない
+	stop := ctx.Done()
+	ctx = context.WithoutCancel(ctx)
+
+	// HTTPサーバーとpullワーカーの異常終了
+	errc := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	// メトリクスの初期化
+	serviceMetrics := metrics.New()
+
+	// トレースの初期化 (OTEL_TRACES_EXPORTER などの標準の環境変数で設定する)
+	shutdownTracing, err := tracing.Setup(ctx, "fcm-backend")
+	if err != nil {
+		return fmt.Errorf("initializing tracing: %w", err)
+	}
+
+	// FCMクライアントの初期化
+	fcmConfig := fcm.Config{
+		ProjectID:       cfg.FCM.ProjectID,
+		CredentialsFile: cfg.FCM.CredentialsFile,
+		DryRun:          cfg.FCM.DryRun,
+		Endpoint:        cfg.FCM.Endpoint,
+	}
+	// テナントごとのサーキットブレーカーと送信レートの上限は最も外側に置き、送信しなかった呼び出しをFCMのメトリクスに含めない。
+	// ブレーカーが開いている間は送信レートの枠を使わないよう、ブレーカーを外側にする。
+	// カオスモード: 障害の注入は最も内側に置き、メトリクスとトレースには本物の障害と同じように記録させる
+	var injector *chaos.Injector
+	breakers := make(map[string]*resilience.Breaker) // readinessチェックに使う
+	fcmMiddlewares := func(tenant string) []fcm.Middleware {
+		var middlewares []fcm.Middleware
+		if cfg.FCM.BreakerFailures > 0 {
+			breakers[tenant] = resilience.NewBreaker(tenant, cfg.FCM.BreakerFailures, cfg.FCM.BreakerCooldown)
+			middlewares = append(middlewares, breakers[tenant].Middleware())
+		}
+		if cfg.Limits.TenantSendRate > 0 {
+			middlewares = append(middlewares, resilience.NewRateLimiter(tenant, cfg.Limits.TenantSendRate, cfg.Limits.TenantSendBurst).Middleware())
+		}
+		middlewares = append(middlewares, serviceMetrics.FCMMiddleware(tenant), tracing.FCMMiddleware())
+		if injector != nil {
+			middlewares = append(middlewares, injector.Middleware(tenant))
+		}
+		return middlewares
+	}
+	if cfg.Chaos.Enabled || cfg.Chaos.AdminEnabled {
+		injector = chaos.NewInjector().WithMetrics(serviceMetrics)
+	}
+	if cfg.Chaos.Enabled {
+		faults, _ := chaos.ParseFaults(cfg.Chaos.Faults) // config.Load で検証済み
+		rules := chaos.Rules{Faults: faults, Latency: cfg.Chaos.Latency, Topics: cfg.Chaos.Topics, Tokens: cfg.Chaos.Tokens}
+		if err := injector.Enable(rules); err != nil {
+			return fmt.Errorf("enabling chaos mode: %w", err)
+		}
+		slog.Warn("chaos mode enabled: injecting faults into FCM sends", "faults", faults, "latency", cfg.Chaos.Latency.String(),
+			"topics", cfg.Chaos.Topics, "tokens", len(cfg.Chaos.Tokens))
+	}
+
+	fcmClient, err := fcm.NewClient(ctx, fcmConfig, fcmMiddlewares(fcm.DefaultTenant)...)
+	if err != nil {
+		return fmt.Errorf("initializing FCM client: %w", err)
+	}
+	slog.Info("FCM client initialized", "dryRun", cfg.FCM.DryRun, "breakerFailures", cfg.FCM.BreakerFailures,
+		"tenantSendRate", cfg.Limits.TenantSendRate)
+
+	// テナント (Firebaseプロジェクト) ごとのFCMクライアント
+	tenantConfigs := make(map[string]fcm.Config, len(cfg.FCM.Tenants))
+	tenantClients := make(map[string]*fcm.Client, len(cfg.FCM.Tenants))
+	for name, credentialsFile := range cfg.FCM.Tenants {
+		tenantConfigs[name] = fcm.Config{CredentialsFile: credentialsFile, DryRun: cfg.FCM.DryRun}
+		if cfg.FCM.Endpoint != "" {
+			// 偽のFCMに送信する場合は認証情報からプロジェクトを決められないため、テナント名をプロジェクトIDとして使う
+			tenantConfigs[name] = fcm.Config{ProjectID: name, DryRun: cfg.FCM.DryRun, Endpoint: cfg.FCM.Endpoint}
+		}
+		c, err := fcm.NewClient(ctx, tenantConfigs[name], fcmMiddlewares(name)...)
+		if err != nil {
+			return fmt.Errorf("initializing FCM client for tenant %s: %w", name, err)
+		}
+		tenantClients[name] = c
+	}
+	if len(tenantClients) > 0 {
+		slog.Info("FCM tenants initialized", "tenants", slices.Sorted(maps.Keys(tenantClients)))
+	}
+
+	// 予約送信スケジューラの初期化
+	scheduleStore, err := scheduler.NewFileStore(cfg.Storage.ScheduleStorePath)
+	if err != nil {
+		return fmt.Errorf("opening schedule store: %w", err)
+	}
+	sched := scheduler.New(scheduleStore, handlers.IsRetryable).
+		WithRetryDelay(cfg.Retry.ScheduleBaseDelay, cfg.Retry.ScheduleMaxDelay).
+		WithMaxAttempts(cfg.Retry.ScheduleMaxAttempts)
+	slog.Info("schedule store opened", "path", cfg.Storage.ScheduleStorePath)
+
+	// 通知設定の初期化
+	preferenceStore, err := preferences.NewFileStore(cfg.Storage.PreferenceStorePath)
+	if err != nil {
+		return fmt.Errorf("opening preference store: %w", err)
+	}
+	preferenceRegistry := preferences.NewRegistry(preferenceStore, cfg.Delivery.PreferenceOptInCategories)
+	slog.Info("preference store opened", "path", cfg.Storage.PreferenceStorePath)
+
+	// Pub/Subクライアントは配信イベントの送出、pullでの受信、バッチの再送で共有する
+	var pubsubClient *pubsub.Client
+	if cfg.Events.PubSubTopic != "" || cfg.Pull.Enabled() || cfg.Batch.RetryTopic != "" {
+		pubsubClient, err = pubsub.NewClient(ctx, cfg.FCM.ProjectID, fcmConfig.ClientOptions()...)
+		if err != nil {
+			return fmt.Errorf("initializing Pub/Sub client: %w", err)
+		}
+		defer pubsubClient.Close()
+	}
+
+	// 配信イベントの初期化
+	eventSinks := map[string]events.Sink{}
+	if eventTopic := cfg.Events.PubSubTopic; eventTopic != "" {
+		eventSinks["pubsub:"+eventTopic] = events.NewPubSubSink(pubsubClient.Topic(eventTopic))
+	}
+	for _, u := range cfg.Events.WebhookURLs {
+		eventSinks["webhook:"+u] = events.NewWebhookSink(u, cfg.Events.WebhookSecret).
+			WithRetry(cfg.Retry.WebhookMaxAttempts, cfg.Retry.WebhookBaseDelay)
+	}
+	if eventFilePath := cfg.Events.FilePath; eventFilePath != "" {
+		fileSink, err := events.NewFileSink(eventFilePath)
+		if err != nil {
+			return fmt.Errorf("opening delivery event file: %w", err)
+		}
+		eventSinks["file:"+eventFilePath] = fileSink
+	}
+	var eventEmitter *events.Emitter
+	if len(eventSinks) > 0 {
+		eventEmitter = events.NewEmitter(eventSinks)
+		slog.Info("delivery events enabled", "sinks", len(eventSinks))
+	}
+
+	// シャットダウン時に新しい通知の受け付けを止め、処理中のリクエストを待つ
+	lc := lifecycle.New().WithDrainTimeout(cfg.Server.DrainTimeout)
+
+	// 受信したPushリクエストの記録 (cmd/replay で再実行する)
+	capturePush := func(h http.Handler) http.Handler { return h }
+	var recorder *capture.Recorder
+	if captureFilePath := cfg.Capture.FilePath; captureFilePath != "" {
+		recorder, err = capture.NewRecorder(captureFilePath)
+		if err != nil {
+			return fmt.Errorf("opening capture file: %w", err)
+		}
+		capturePush = recorder.Middleware
+		slog.Info("push request capture enabled", "file", captureFilePath)
+	}
+
+	// HTTPルーターの設定
+	mux := http.NewServeMux()
+
+	// Pub/Sub Push受信用ハンドラ (デバイス指定)
+	pushDeviceHandler := handlers.NewPushDeviceHandler(fcmClient).
+		WithTenants(tenantClients).
+		WithSendTimeout(cfg.FCM.SendTimeout).
+		WithMetrics(serviceMetrics).
+		WithScheduler(sched).
+		WithPreferences(preferenceRegistry)
+	if eventEmitter != nil {
+		pushDeviceHandler.WithEvents(eventEmitter)
+	}
+	if recorder != nil {
+		pushDeviceHandler.WithCapture(recorder)
+	}
+	if limits := cfg.Limits; limits.FrequencyCap != "" || limits.FrequencyCapCategories != "" {
+		// 各値は config.Load で検証済み
+		var defaults *frequencycap.Rule
+		if limits.FrequencyCap != "" {
+			rule, _ := frequencycap.ParseRule(limits.FrequencyCap)
+			defaults = &rule
+		}
+		categories, _ := frequencycap.ParseCategoryRules(limits.FrequencyCapCategories)
+
+		limiter, err := frequencycap.NewLimiter(frequencycap.NewMemoryStore(), frequencycap.Policy(limits.FrequencyCapPolicy), defaults, categories)
+		if err != nil {
+			return fmt.Errorf("invalid frequency cap configuration: %w", err)
+		}
+
+		pushDeviceHandler.WithFrequencyCap(limiter.WithMetrics(serviceMetrics))
+		slog.Info("frequency cap enabled", "policy", limits.FrequencyCapPolicy)
+	}
+
+	if cfg.Delivery.QuietHours != "" {
+		window, _ := quiethours.Parse(cfg.Delivery.QuietHours)
+		loc, _ := time.LoadLocation(cfg.Delivery.QuietHoursDefaultTimeZone)
+
+		pushDeviceHandler.WithQuietHours(window, loc)
+		slog.Info("quiet hours enabled", "window", window.String(), "defaultTimeZone", loc.String())
+	}
+	mux.Handle("/publish/token", serviceMetrics.InstrumentPushHandler("push_device", lc.Middleware(capturePush(tracing.HTTPMiddleware("push_device", pushDeviceHandler)))))
+
+	// Pub/Sub Push受信用ハンドラ (トピック指定)
+	pushTopicHandler := handlers.NewPushTopicHandler(fcmClient).
+		WithTenants(tenantClients).
+		WithSendTimeout(cfg.FCM.SendTimeout).
+		WithMetrics(serviceMetrics).
+		WithScheduler(sched)
+	if eventEmitter != nil {
+		pushTopicHandler.WithEvents(eventEmitter)
+	}
+	if recorder != nil {
+		pushTopicHandler.WithCapture(recorder)
+	}
+	mux.Handle("/publish/topic", serviceMetrics.InstrumentPushHandler("push_topic", lc.Middleware(capturePush(tracing.HTTPMiddleware("push_topic", pushTopicHandler)))))
+
+	// Pub/Sub Push受信用ハンドラ (通知のバッチ)
+	pushBatchHandler := handlers.NewPushBatchHandler(fcmClient).
+		WithTenants(tenantClients).
+		WithSendTimeout(cfg.FCM.SendTimeout).
+		WithMetrics(serviceMetrics).
+		WithDeviceHandler(pushDeviceHandler)
+	if eventEmitter != nil {
+		pushBatchHandler.WithEvents(eventEmitter)
+	}
+	if recorder != nil {
+		pushBatchHandler.WithCapture(recorder)
+	}
+	if retryTopic := cfg.Batch.RetryTopic; retryTopic != "" {
+		topic := pubsubClient.Topic(retryTopic)
+		defer topic.Stop()
+		pushBatchHandler.WithRepublisher(handlers.RepublishFunc(func(ctx context.Context, data []byte, attributes map[string]string) error {
+			_, err := topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}).Get(ctx)
+			return err
+		}), cfg.Batch.MaxAttempts)
+	}
+	mux.Handle("/publish/batch", serviceMetrics.InstrumentPushHandler("push_batch", lc.Middleware(capturePush(tracing.HTTPMiddleware("push_batch", pushBatchHandler)))))
+
+	// 直接送信APIと管理用エンドポイントの認証
+	var tokenValidator auth.TokenValidator
+	if cfg.Auth.IDTokenAudience != "" {
+		tokenValidator = auth.NewGoogleIDTokenValidator(cfg.Auth.IDTokenAudience, cfg.Auth.IDTokenAllowedEmails)
+	}
+	authenticator := auth.NewAuthenticator(cfg.Auth.APIKeys, tokenValidator)
+
+	// 予約送信の管理用エンドポイント (認証が設定されている場合のみ公開)
+	if authenticator.Enabled() {
+		scheduleAdminHandler := handlers.NewScheduleAdminHandler(sched)
+		mux.Handle("GET /admin/schedules", authenticator.Middleware(http.HandlerFunc(scheduleAdminHandler.List)))
+		mux.Handle("DELETE /admin/schedules/{id}", authenticator.Middleware(http.HandlerFunc(scheduleAdminHandler.Cancel)))
+	} else {
+		slog.Warn("API_KEYS and API_ID_TOKEN_AUDIENCE are not set; /admin/schedules is disabled")
+	}
+
+	// カオスモードの管理用エンドポイント (有効にした場合のみ、認証付きで公開)
+	if cfg.Chaos.AdminEnabled {
+		if !authenticator.Enabled() {
+			return errors.New("CHAOS_ADMIN_ENABLED requires API_KEYS or API_ID_TOKEN_AUDIENCE to authenticate /admin/chaos")
+		}
+		chaosAdminHandler := handlers.NewChaosAdminHandler(injector)
+		mux.Handle("GET /admin/chaos", authenticator.Middleware(http.HandlerFunc(chaosAdminHandler.Get)))
+		mux.Handle("PUT /admin/chaos", authenticator.Middleware(http.HandlerFunc(chaosAdminHandler.Put)))
+		mux.Handle("DELETE /admin/chaos", authenticator.Middleware(http.HandlerFunc(chaosAdminHandler.Delete)))
+		slog.Warn("chaos admin endpoint enabled", "path", "/admin/chaos")
+	}
+
+	// 通知設定の参照・更新用エンドポイント (認証が設定されている場合のみ公開)
+	if authenticator.Enabled() {
+		preferencesHandler := handlers.NewPreferencesHandler(preferenceRegistry)
+		mux.Handle("GET /preferences/users/{user_id}", authenticator.Middleware(http.HandlerFunc(preferencesHandler.Get)))
+		mux.Handle("PUT /preferences/users/{user_id}", authenticator.Middleware(http.HandlerFunc(preferencesHandler.Put)))
+		// デバイストークンはURLに含めず、リクエストボディで受け取る
+		mux.Handle("POST /preferences/tokens/lookup", authenticator.Middleware(http.HandlerFunc(preferencesHandler.Get)))
+		mux.Handle("PUT /preferences/tokens", authenticator.Middleware(http.HandlerFunc(preferencesHandler.Put)))
+	} else {
+		slog.Warn("API_KEYS and API_ID_TOKEN_AUDIENCE are not set; /preferences is disabled")
+	}
+
+	// ペイロードのJSON Schema
+	schemaHandler := handlers.NewSchemaHandler()
+	mux.HandleFunc("GET /schemas", schemaHandler.Index)
+	mux.HandleFunc("GET /schemas/{version}/{name}", schemaHandler.Get)
+
+	// 通知を直接送信するREST API (認証が設定されている場合のみ公開)
+	if authenticator.Enabled() {
+		notificationsHandler := handlers.NewNotificationsHandler(pushDeviceHandler, pushTopicHandler).
+			WithMetrics(serviceMetrics).
+			WithMaxRequestBytes(cfg.Limits.NotificationsMaxRequestBytes)
+		mux.Handle("/v1/notifications", serviceMetrics.InstrumentHandler("notifications", lc.Middleware(tracing.HTTPMiddleware("notifications", authenticator.Middleware(notificationsHandler)))))
+	} else {
+		slog.Warn("API_KEYS and API_ID_TOKEN_AUDIENCE are not set; /v1/notifications is disabled")
+	}
+
+	// Prometheusメトリクス
+	mux.Handle("/metrics", serviceMetrics.Handler())
+
+	// ヘルスチェック。/health は従来どおり常に 200 を返す (liveness と同じ)。
+	readiness := health.NewChecker().WithTTL(cfg.Health.ReadinessCacheTTL)
+	addCredentialsCheck := func(name string, cfg fcm.Config) {
+		if creds, err := findCredentials(ctx, cfg); err != nil {
+			readiness.Add(name, func(context.Context) error { return err })
+		} else {
+			readiness.Add(name, health.TokenSourceCheck(creds.TokenSource))
+		}
+	}
+	if cfg.FCM.Endpoint == "" {
+		addCredentialsCheck("fcm_credentials", fcmConfig)
+		for _, name := range slices.Sorted(maps.Keys(tenantConfigs)) {
+			addCredentialsCheck("fcm_credentials:"+name, tenantConfigs[name])
+		}
+	}
+	readiness.
+		AddUncached("lifecycle", lc.Check).
+		Add("scheduler", sched.Check).
+		Add("schedule_store", scheduleStore.Check).
+		Add("preference_store", preferenceStore.Check)
+	// サーキットブレーカーはテナントごとなので、開いていてもほかのテナントのためにインスタンスをトラフィックから外さず、警告として表示する。
+	// TODO: デバイストークンのストアを導入したら、その接続確認もここに登録する
+	for _, name := range slices.Sorted(maps.Keys(breakers)) {
+		readiness.AddWarning("fcm_breaker:"+name, breakers[name].Check)
+	}
+	mux.Handle("/health", health.LiveHandler())
+	mux.Handle("/health/live", health.LiveHandler())
+	mux.Handle("/health/ready", readiness.ReadyHandler())
+
+	slog.Info("starting server", "port", cfg.Server.Port)
+
+	// リクエストの ctx の親。シャットダウンの猶予を過ぎても終わらないFCMへの送信を中断するためにキャンセルする。
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           mux,
+		BaseContext:       func(net.Listener) context.Context { return requestCtx },
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	schedulerCtx, cancelScheduler := context.WithCancel(ctx)
+	defer cancelScheduler()
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		sched.Run(schedulerCtx)
+	}()
+
+	// Pub/Subのストリーミングpullでの受信。Pushエンドポイントと同じハンドラで処理する
+	pullCtx, cancelPull := context.WithCancel(context.Background())
+	defer cancelPull()
+	var pullWorkers sync.WaitGroup
+	pullFlow := pull.FlowControl{
+		MaxOutstandingMessages: cfg.Pull.MaxOutstandingMessages,
+		MaxOutstandingBytes:    cfg.Pull.MaxOutstandingBytes,
+		MaxExtension:           cfg.Pull.MaxExtension,
+		MaxExtensionPeriod:     cfg.Pull.MaxExtensionPeriod,
+	}
+	for name, p := range map[string]struct {
+		subscription string
+		handler      pull.MessageHandler
+	}{
+		"push_device": {cfg.Pull.DeviceSubscription, pushDeviceHandler},
+		"push_topic":  {cfg.Pull.TopicSubscription, pushTopicHandler},
+		"push_batch":  {cfg.Pull.BatchSubscription, pushBatchHandler},
+	} {
+		if p.subscription == "" {
+			continue
+		}
+
+		worker := pull.NewWorker(name, pubsubClient.Subscription(p.subscription), p.handler).
+			WithConcurrency(cfg.Pull.Concurrency).
+			WithFlowControl(pullFlow).
+			WithTracker(lc).
+			WithMetrics(serviceMetrics)
+		pullWorkers.Add(1)
+		go func() {
+			defer pullWorkers.Done()
+			if err := worker.Run(pullCtx); err != nil {
+				fail(fmt.Errorf("Pub/Sub pull worker %s stopped: %w", name, err))
+			}
+		}()
+	}
+
+	listener := opts.Listener
+	if listener == nil {
+		if listener, err = net.Listen("tcp", server.Addr); err != nil {
+			return fmt.Errorf("listening on %s: %w", server.Addr, err)
+		}
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fail(fmt.Errorf("serving HTTP: %w", err))
+		}
+	}()
+
+	// 処理中のリクエストを待った後に、登録順に実行する
+	lc.OnShutdown("http_server", func(ctx context.Context) error {
+		// 待ちきれなかったリクエストはFCMへの送信を中断して nack させる
+		cancelRequests()
+		return server.Shutdown(ctx)
+	})
+	lc.OnShutdown("pubsub_pull", func(ctx context.Context) error {
+		// Draining 中に受信したメッセージは nack 済み。受信を止め、待ちきれなかった送信を中断して nack させる
+		cancelPull()
+		done := make(chan struct{})
+		go func() {
+			pullWorkers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	lc.OnShutdown("scheduler", func(ctx context.Context) error {
+		// 中断された予約はストアに残り、次回の起動時に送信される
+		cancelScheduler()
+		select {
+		case <-schedulerDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if eventEmitter != nil {
+		lc.OnShutdown("delivery_events", eventEmitter.Close)
+	}
+	if recorder != nil {
+		lc.OnShutdown("capture", func(context.Context) error { return recorder.Close() })
+	}
+	lc.OnShutdown("tracing", shutdownTracing)
+
+	select {
+	case <-stop:
+	case err := <-errc:
+		return err
+	}
+	slog.Info("shutting down server", "timeout", cfg.Server.ShutdownTimeout.String())
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer shutdownCancel()
+
+	if err := lc.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown did not complete cleanly", "error", err)
+	}
+
+	return nil
+}
+
+// findCredentials はFCMへの送信に使う認証情報を返します。
+func findCredentials(ctx context.Context, cfg fcm.Config) (*google.Credentials, error) {
+	if cfg.CredentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, fcm.MessagingScope)
+	}
+
+	b, err := os.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials file: %w", err)
+	}
+
+	return google.CredentialsFromJSON(ctx, b, fcm.MessagingScope)
+}
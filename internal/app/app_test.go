@@ -0,0 +1,349 @@
+//go:build !mock
+
+// mock タグではハンドラがエラーの再試行可否を文字列で判定するため、実際のFCMのエラーの分類を確かめるこのテストは実行しない。
+
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/capture"
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/health"
+	"github.com/teamzidi/example-go-fcm/internal/app"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+)
+
+func TestRun(t *testing.T) {
+	fake := fakefcm.NewServer()
+	fcmServer := httptest.NewServer(fake)
+	defer fcmServer.Close()
+
+	cfg := config.Default()
+	cfg.FCM.ProjectID = "demo"
+	cfg.FCM.Endpoint = fcmServer.URL + "/v1"
+	cfg.Storage.ScheduleStorePath = filepath.Join(t.TempDir(), "schedules.json")
+	cfg.Storage.PreferenceStorePath = filepath.Join(t.TempDir(), "preferences.json")
+	cfg.Capture.FilePath = filepath.Join(t.TempDir(), "capture.jsonl")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx, cfg, app.Options{Listener: listener}) }()
+
+	tests := []struct {
+		token          string
+		expectedStatus int
+	}{
+		{"token-1", http.StatusOK},
+		{"unregistered-1", http.StatusNoContent},
+		{"internal-1", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if status := publishToken(t, baseURL, tt.token); status != tt.expectedStatus {
+			t.Errorf("token %s: status %d want %d", tt.token, status, tt.expectedStatus)
+		}
+	}
+
+	if got := len(fake.Messages()); got != len(tests) {
+		t.Errorf("fake FCM received %d messages, want %d", got, len(tests))
+	}
+
+	resp, err := http.Get(baseURL + "/health/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("readiness: got %d want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+	case <-time.After(cfg.Server.ShutdownTimeout + time.Second):
+		t.Fatal("Run did not return after ctx was cancelled")
+	}
+
+	// Pushリクエストは処理結果とともに記録される
+	records, err := capture.ReadFile(cfg.Capture.FilePath)
+	if err != nil {
+		t.Fatalf("reading captured requests: %v", err)
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("captured %d requests, want %d", len(records), len(tests))
+	}
+	for i, expected := range []string{"sent", "acked", "nacked"} {
+		if records[i].Outcome != expected {
+			t.Errorf("captured request %d: outcome %q want %q", i, records[i].Outcome, expected)
+		}
+	}
+}
+
+// TestRun_Chaos は設定と管理用エンドポイントでFCMへの送信に障害を注入できることを確認します。
+func TestRun_Chaos(t *testing.T) {
+	fake := fakefcm.NewServer()
+	fcmServer := httptest.NewServer(fake)
+	defer fcmServer.Close()
+
+	cfg := config.Default()
+	cfg.FCM.ProjectID = "demo"
+	cfg.FCM.Endpoint = fcmServer.URL + "/v1"
+	cfg.Storage.ScheduleStorePath = filepath.Join(t.TempDir(), "schedules.json")
+	cfg.Storage.PreferenceStorePath = filepath.Join(t.TempDir(), "preferences.json")
+	cfg.Chaos = config.Chaos{Enabled: true, AdminEnabled: true, Faults: map[string]string{"UNREGISTERED": "1"}, Tokens: []string{"chaos-1"}}
+	cfg.Auth.APIKeys = []string{"admin-key"}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx, cfg, app.Options{Listener: listener}) }()
+
+	// 設定した送信先だけが失敗し、偽のFCMには送信されない
+	if status := publishToken(t, baseURL, "chaos-1"); status != http.StatusNoContent {
+		t.Errorf("token in scope: status %d want %d", status, http.StatusNoContent)
+	}
+	if status := publishToken(t, baseURL, "token-1"); status != http.StatusOK {
+		t.Errorf("token out of scope: status %d want %d", status, http.StatusOK)
+	}
+	if got := len(fake.Messages()); got != 1 {
+		t.Errorf("fake FCM received %d messages, want 1", got)
+	}
+
+	adminRequest := func(method, body, apiKey string) int {
+		req, _ := http.NewRequest(method, baseURL+"/admin/chaos", strings.NewReader(body))
+		req.Header.Set("X-API-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s /admin/chaos: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// 管理用エンドポイントは認証が必要
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		if status := adminRequest(method, `{"faults":{"INTERNAL":1}}`, "wrong-key"); status != http.StatusUnauthorized {
+			t.Errorf("%s /admin/chaos without a valid key: status %d want %d", method, status, http.StatusUnauthorized)
+		}
+	}
+	if status := publishToken(t, baseURL, "token-1"); status != http.StatusOK {
+		t.Errorf("after unauthenticated admin requests: status %d want %d", status, http.StatusOK)
+	}
+
+	if status := adminRequest(http.MethodPut, `{"faults":{"INTERNAL":1}}`, "admin-key"); status != http.StatusOK {
+		t.Fatalf("PUT /admin/chaos: status %d", status)
+	}
+	if status := publishToken(t, baseURL, "token-1"); status != http.StatusInternalServerError {
+		t.Errorf("all tokens in scope: status %d want %d", status, http.StatusInternalServerError)
+	}
+
+	if status := adminRequest(http.MethodDelete, "", "admin-key"); status != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/chaos: status %d", status)
+	}
+	if status := publishToken(t, baseURL, "chaos-1"); status != http.StatusOK {
+		t.Errorf("after disabling: status %d want %d", status, http.StatusOK)
+	}
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`fcm_backend_fcm_injected_faults_total{fault="UNREGISTERED",target_type="token",tenant="default"} 1`,
+		`fcm_backend_fcm_injected_faults_total{fault="INTERNAL",target_type="token",tenant="default"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run() = %v, want nil", err)
+	}
+}
+
+// TestRun_Authentication は通知設定と予約の管理用エンドポイントが認証を必要とし、認証が設定されていなければ公開されないことを確認します。
+func TestRun_Authentication(t *testing.T) {
+	tests := []struct {
+		name     string
+		apiKeys  []string
+		method   string
+		path     string
+		body     string
+		apiKey   string
+		expected int
+	}{
+		{name: "preferences without a key", apiKeys: []string{"key"}, method: http.MethodPut, path: "/preferences/users/u1", body: `{"categories":{"marketing":false}}`, expected: http.StatusUnauthorized},
+		{name: "preferences with a wrong key", apiKeys: []string{"key"}, method: http.MethodPost, path: "/preferences/tokens/lookup", body: `{"token":"token-1"}`, apiKey: "wrong", expected: http.StatusUnauthorized},
+		{name: "preferences with a key", apiKeys: []string{"key"}, method: http.MethodPut, path: "/preferences/users/u1", body: `{"categories":{"marketing":false}}`, apiKey: "key", expected: http.StatusOK},
+		{name: "preferences without authentication configured", method: http.MethodGet, path: "/preferences/users/u1", expected: http.StatusNotFound},
+		{name: "schedules without a key", apiKeys: []string{"key"}, method: http.MethodGet, path: "/admin/schedules", expected: http.StatusUnauthorized},
+		{name: "cancel a schedule without a key", apiKeys: []string{"key"}, method: http.MethodDelete, path: "/admin/schedules/job-1", expected: http.StatusUnauthorized},
+		{name: "schedules with a key", apiKeys: []string{"key"}, method: http.MethodGet, path: "/admin/schedules", apiKey: "key", expected: http.StatusOK},
+		{name: "schedules without authentication configured", method: http.MethodGet, path: "/admin/schedules", expected: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.FCM.ProjectID = "demo"
+			cfg.FCM.Endpoint = "http://127.0.0.1:1/v1" // 送信しない
+			cfg.Storage.ScheduleStorePath = filepath.Join(t.TempDir(), "schedules.json")
+			cfg.Storage.PreferenceStorePath = filepath.Join(t.TempDir(), "preferences.json")
+			cfg.Auth.APIKeys = tt.apiKeys
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- app.Run(ctx, cfg, app.Options{Listener: listener}) }()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			req, _ := http.NewRequest(tt.method, "http://"+listener.Addr().String()+tt.path, strings.NewReader(tt.body))
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.expected {
+				t.Errorf("%s %s: status %d want %d", tt.method, tt.path, resp.StatusCode, tt.expected)
+			}
+		})
+	}
+}
+
+// TestRun_TenantBreaker はFCMへの送信の失敗が続いたテナントへの送信だけが止まり、ほかのテナントには送信できることを確認します。
+func TestRun_TenantBreaker(t *testing.T) {
+	fake := fakefcm.NewServer()
+	fcmServer := httptest.NewServer(fake)
+	defer fcmServer.Close()
+
+	creds := filepath.Join(t.TempDir(), "app-a.json")
+	if err := os.WriteFile(creds, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.FCM.ProjectID = "demo"
+	cfg.FCM.Endpoint = fcmServer.URL + "/v1"
+	cfg.FCM.Tenants = map[string]string{"app-a": creds}
+	cfg.FCM.BreakerFailures = 2
+	cfg.FCM.BreakerCooldown = time.Hour
+	cfg.Storage.ScheduleStorePath = filepath.Join(t.TempDir(), "schedules.json")
+	cfg.Storage.PreferenceStorePath = filepath.Join(t.TempDir(), "preferences.json")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx, cfg, app.Options{Listener: listener}) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	tests := []struct {
+		tenant         string
+		token          string
+		expectedStatus int
+	}{
+		{"app-a", "internal-1", http.StatusInternalServerError},
+		{"app-a", "internal-2", http.StatusInternalServerError},
+		{"app-a", "token-1", http.StatusInternalServerError}, // ブレーカーが開いているため送信しない
+		{"", "token-2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status := publish(t, baseURL, map[string]string{"title": "T", "body": "B", "token": tt.token, "tenant": tt.tenant}); status != tt.expectedStatus {
+			t.Errorf("tenant %q token %s: status %d want %d", tt.tenant, tt.token, status, tt.expectedStatus)
+		}
+	}
+
+	if got := len(fake.Messages()); got != 3 {
+		t.Errorf("fake FCM received %d messages, want 3", got)
+	}
+
+	// 開いたブレーカーはreadinessに警告として表示されるが、インスタンスはトラフィックから外さない
+	resp, err := http.Get(baseURL + "/health/ready")
+	if err != nil {
+		t.Fatalf("GET /health/ready: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var report health.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decoding readiness report: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("readiness status %d want %d: %+v", resp.StatusCode, http.StatusOK, report)
+	}
+	for name, expected := range map[string]health.Status{"fcm_breaker:app-a": health.StatusWarn, "fcm_breaker:default": health.StatusOK} {
+		if got := report.Checks[name].Status; got != expected {
+			t.Errorf("check %s: got %q want %q", name, got, expected)
+		}
+	}
+}
+
+// publishToken はトークン宛ての通知をPushリクエストとして送り、応答のステータスコードを返します。
+func publishToken(t *testing.T, baseURL, token string) int {
+	t.Helper()
+
+	return publish(t, baseURL, map[string]string{"title": "T", "body": "B", "token": token})
+}
+
+// publish はペイロードをPushリクエストとして /publish/token に送り、応答のステータスコードを返します。
+func publish(t *testing.T, baseURL string, fields map[string]string) int {
+	t.Helper()
+
+	payload, _ := json.Marshal(fields)
+	envelope, _ := json.Marshal(map[string]any{
+		"message": map[string]string{"data": base64.StdEncoding.EncodeToString(payload), "messageId": "1"},
+	})
+	resp, err := http.Post(baseURL+"/publish/token", "application/json", bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatalf("POST /publish/token: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,295 @@
+// Package fakefcm はFCM HTTP v1 API の messages:send を模倣する偽のサーバーです。
+// 受信したメッセージを記録し、送信先の名前に応じてFCMと同じ形式のエラーを返します。
+// 負荷試験用に、応答の遅延と一定の割合のエラーを注入できます。
+// fcm.Config.Endpoint に URL + "/v1" を設定して、ローカル開発やテストで本物のFCMの代わりに使います。
+package fakefcm
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMessages は記録しておくメッセージ数の上限です。超えた分は古いものから捨てます。
+const maxMessages = 1000
+
+// Failure は送信先の名前が Prefix で始まるメッセージに返すエラーです。
+type Failure struct {
+	Prefix    string
+	Status    int    // HTTPステータスコード
+	Code      string // google.rpc.Code の名前 (例: "NOT_FOUND")
+	ErrorCode string // FCMのエラーコード (例: "UNREGISTERED")
+}
+
+// Failures は送信先 (トークン、トピック、条件) の接頭辞ごとに返すエラーです。
+// 例えばトークン "unregistered-1" 宛てのメッセージは UNREGISTERED で失敗します。
+// UNAVAILABLE (503) はFirebase Admin SDKが自動で再試行するため、失敗が確定するまで数秒かかります。
+var Failures = []Failure{
+	{Prefix: "unregistered", Status: http.StatusNotFound, Code: "NOT_FOUND", ErrorCode: "UNREGISTERED"},
+	{Prefix: "invalid", Status: http.StatusBadRequest, Code: "INVALID_ARGUMENT", ErrorCode: "INVALID_ARGUMENT"},
+	{Prefix: "mismatch", Status: http.StatusForbidden, Code: "PERMISSION_DENIED", ErrorCode: "SENDER_ID_MISMATCH"},
+	{Prefix: "quota", Status: http.StatusTooManyRequests, Code: "RESOURCE_EXHAUSTED", ErrorCode: "QUOTA_EXCEEDED"},
+	{Prefix: "unavailable", Status: http.StatusServiceUnavailable, Code: "UNAVAILABLE", ErrorCode: "UNAVAILABLE"},
+	{Prefix: "internal", Status: http.StatusInternalServerError, Code: "INTERNAL", ErrorCode: "INTERNAL"},
+}
+
+// FailureFor は FCMのエラーコード (例: "UNREGISTERED") に対応する Failures の要素を返します。
+func FailureFor(errorCode string) (Failure, bool) {
+	for _, f := range Failures {
+		if f.ErrorCode == errorCode {
+			return f, true
+		}
+	}
+	return Failure{}, false
+}
+
+// Message は偽のFCMが受信した1件のメッセージです。
+type Message struct {
+	Seq          int               `json:"seq"`
+	Time         time.Time         `json:"time"`
+	Project      string            `json:"project"`
+	ValidateOnly bool              `json:"validate_only,omitempty"`
+	Token        string            `json:"token,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Condition    string            `json:"condition,omitempty"`
+	Title        string            `json:"title,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Raw          json.RawMessage   `json:"raw"`            // 受信した message 全体
+	Name         string            `json:"name,omitempty"` // 成功した場合に返したメッセージ名
+	Status       int               `json:"status"`
+	ErrorCode    string            `json:"error_code,omitempty"` // 失敗させた場合のFCMのエラーコード
+}
+
+// Server は偽のFCMのHTTPハンドラです。
+type Server struct {
+	mux *http.ServeMux
+
+	// 注入する遅延とエラー。NewServer の直後に設定し、リクエストの処理中には変更しない
+	latency   time.Duration
+	jitter    time.Duration
+	errorRate float64
+	injected  Failure
+
+	mu          sync.Mutex
+	seq         int
+	stats       Stats
+	messages    []Message
+	subscribers map[chan Message]struct{}
+}
+
+// Stats は偽のFCMが受信したメッセージの集計です。Messages と違い、上限を超えて捨てたメッセージも数えます。
+type Stats struct {
+	Received int            `json:"received"`
+	Failed   map[string]int `json:"failed,omitempty"` // FCMのエラーコードごとの失敗数
+}
+
+func NewServer() *Server {
+	s := &Server{subscribers: make(map[chan Message]struct{})}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST /v1/projects/{project}/messages:send", s.send)
+	return s
+}
+
+// WithLatency は各メッセージの応答を latency に 0 から jitter までのランダムな時間を加えただけ遅らせます。
+func (s *Server) WithLatency(latency, jitter time.Duration) *Server {
+	s.latency = latency
+	s.jitter = jitter
+
+	return s
+}
+
+// WithErrorRate は送信先にかかわらず、rate (0 から 1) の割合のメッセージを f のエラーで失敗させます。
+func (s *Server) WithErrorRate(rate float64, f Failure) *Server {
+	s.errorRate = rate
+	s.injected = f
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Messages は記録しているメッセージを受信順に返します。
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+// Stats は起動してからのメッセージの集計を返します。
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{Received: s.stats.Received, Failed: maps.Clone(s.stats.Failed)}
+}
+
+// Subscribe は以降に受信したメッセージを受け取るチャネルと、購読をやめる関数を返します。
+// 受け取り側が遅れている間に受信したメッセージは、そのチャネルには送られません。
+func (s *Server) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, 64)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+type sendRequest struct {
+	ValidateOnly bool            `json:"validate_only"`
+	Message      json.RawMessage `json:"message"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Topic        string            `json:"topic"`
+	Condition    string            `json:"condition"`
+	Data         map[string]string `json:"data"`
+	Notification struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	} `json:"notification"`
+}
+
+func (s *Server) send(w http.ResponseWriter, r *http.Request) {
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, Failure{Status: http.StatusBadRequest, Code: "INVALID_ARGUMENT", ErrorCode: "INVALID_ARGUMENT"}, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+
+	var m fcmMessage
+	if err := json.Unmarshal(req.Message, &m); err != nil {
+		writeError(w, Failure{Status: http.StatusBadRequest, Code: "INVALID_ARGUMENT", ErrorCode: "INVALID_ARGUMENT"}, fmt.Sprintf("invalid message: %v", err))
+		return
+	}
+
+	msg := Message{
+		Time:         time.Now(),
+		Project:      r.PathValue("project"),
+		ValidateOnly: req.ValidateOnly,
+		Token:        m.Token,
+		Topic:        m.Topic,
+		Condition:    m.Condition,
+		Title:        m.Notification.Title,
+		Body:         m.Notification.Body,
+		Data:         m.Data,
+		Raw:          req.Message,
+		Status:       http.StatusOK,
+	}
+
+	if delay := s.delay(); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// 送信先は token, topic, condition のいずれか1つだけが設定されている
+	failure, failed := failureFor(m.Token + m.Topic + m.Condition)
+	if !failed && s.errorRate > 0 && rand.Float64() < s.errorRate {
+		failure, failed = s.injected, true
+	}
+	if failed {
+		msg.Status = failure.Status
+		msg.ErrorCode = failure.ErrorCode
+	}
+
+	s.record(&msg)
+
+	if failed {
+		writeError(w, failure, fmt.Sprintf("fake FCM rejected the message with %s", failure.ErrorCode))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": msg.Name})
+}
+
+// record は msg に連番とメッセージ名を付けて記録し、購読者に送ります。
+func (s *Server) record(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	msg.Seq = s.seq
+	s.stats.Received++
+	if msg.ErrorCode != "" {
+		if s.stats.Failed == nil {
+			s.stats.Failed = make(map[string]int)
+		}
+		s.stats.Failed[msg.ErrorCode]++
+	}
+	if msg.Status == http.StatusOK {
+		id := fmt.Sprintf("%d", s.seq)
+		if msg.ValidateOnly {
+			id = "fake_message_id" // validate_only の場合にFCMが返す値
+		}
+		msg.Name = fmt.Sprintf("projects/%s/messages/%s", msg.Project, id)
+	}
+
+	s.messages = append(s.messages, *msg)
+	if len(s.messages) > maxMessages {
+		s.messages = s.messages[len(s.messages)-maxMessages:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- *msg:
+		default:
+		}
+	}
+}
+
+// delay は1件のメッセージの応答を遅らせる時間を返します。
+func (s *Server) delay() time.Duration {
+	if s.jitter <= 0 {
+		return s.latency
+	}
+	return s.latency + rand.N(s.jitter)
+}
+
+func failureFor(target string) (Failure, bool) {
+	for _, f := range Failures {
+		if strings.HasPrefix(target, f.Prefix) {
+			return f, true
+		}
+	}
+	return Failure{}, false
+}
+
+// writeError はFCMと同じ形式のエラーレスポンスを書き込みます。
+func writeError(w http.ResponseWriter, f Failure, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.Status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    f.Status,
+			"message": message,
+			"status":  f.Code,
+			"details": []any{
+				map[string]string{
+					"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+					"errorCode": f.ErrorCode,
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package fakefcm_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/internal/fakefcm"
+)
+
+func TestServer(t *testing.T) {
+	fake := fakefcm.NewServer()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	client, err := fcm.NewClient(context.Background(), fcm.Config{ProjectID: "demo", Endpoint: ts.URL + "/v1"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	messages, unsubscribe := fake.Subscribe()
+	defer unsubscribe()
+
+	tests := []struct {
+		name          string
+		send          func() (string, error)
+		wantID        string
+		wantCode      string // FCMのエラーコード。空なら成功
+		wantRetryable bool
+	}{
+		{
+			name: "token",
+			send: func() (string, error) {
+				return client.SendToToken(context.Background(), "token-1", "T", "B", map[string]string{"k": "v"})
+			},
+			wantID: "projects/demo/messages/1",
+		},
+		{
+			name:   "topic",
+			send:   func() (string, error) { return client.SendToTopic(context.Background(), "news", "T", "B", nil) },
+			wantID: "projects/demo/messages/2",
+		},
+		{
+			name: "unregistered token",
+			send: func() (string, error) {
+				return client.SendToToken(context.Background(), "unregistered-1", "T", "B", nil)
+			},
+			wantCode: "UNREGISTERED",
+		},
+		{
+			name: "internal error",
+			send: func() (string, error) {
+				return client.SendToTopic(context.Background(), "internal-news", "T", "B", nil)
+			},
+			wantCode:      "INTERNAL",
+			wantRetryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := tt.send()
+
+			if got := fcm.ErrorCode(err); got != tt.wantCode {
+				t.Errorf("ErrorCode: got %q want %q (%v)", got, tt.wantCode, err)
+			}
+			if got := fcm.IsRetryableError(err); got != tt.wantRetryable {
+				t.Errorf("IsRetryableError: got %v want %v", got, tt.wantRetryable)
+			}
+			if tt.wantCode == "" && id != tt.wantID {
+				t.Errorf("message ID: got %q want %q", id, tt.wantID)
+			}
+
+			m := <-messages
+			if m.ErrorCode != tt.wantCode {
+				t.Errorf("recorded error code: got %q want %q", m.ErrorCode, tt.wantCode)
+			}
+		})
+	}
+
+	recorded := fake.Messages()
+	if len(recorded) != len(tests) {
+		t.Fatalf("recorded %d messages, want %d", len(recorded), len(tests))
+	}
+	if m := recorded[0]; m.Project != "demo" || m.Token != "token-1" || m.Title != "T" || m.Data["k"] != "v" {
+		t.Errorf("recorded message = %+v", m)
+	}
+}
+
+func TestServer_Injection(t *testing.T) {
+	failure, ok := fakefcm.FailureFor("QUOTA_EXCEEDED")
+	if !ok {
+		t.Fatal("FailureFor(QUOTA_EXCEEDED): not found")
+	}
+	fake := fakefcm.NewServer().WithLatency(20*time.Millisecond, 0).WithErrorRate(1, failure)
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	client, err := fcm.NewClient(context.Background(), fcm.Config{ProjectID: "demo", Endpoint: ts.URL + "/v1"})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	start := time.Now()
+	_, err = client.SendToToken(context.Background(), "token-1", "T", "B", nil)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("send took %v, want at least the injected latency", elapsed)
+	}
+	if got := fcm.ErrorCode(err); got != "QUOTA_EXCEEDED" {
+		t.Errorf("ErrorCode: got %q want QUOTA_EXCEEDED (%v)", got, err)
+	}
+
+	// 送信先の名前による失敗は注入したエラーより優先する
+	_, err = client.SendToToken(context.Background(), "unregistered-1", "T", "B", nil)
+	if got := fcm.ErrorCode(err); got != "UNREGISTERED" {
+		t.Errorf("ErrorCode: got %q want UNREGISTERED (%v)", got, err)
+	}
+
+	stats := fake.Stats()
+	if stats.Received != 2 || stats.Failed["QUOTA_EXCEEDED"] != 1 || stats.Failed["UNREGISTERED"] != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+// BenchmarkSend はFirebase Admin SDKでメッセージを組み立ててHTTPで送信し、応答を解釈するまでの送信経路を計測します。
+func BenchmarkSend(b *testing.B) {
+	ts := httptest.NewServer(fakefcm.NewServer())
+	defer ts.Close()
+
+	client, err := fcm.NewClient(context.Background(), fcm.Config{ProjectID: "demo", Endpoint: ts.URL + "/v1"})
+	if err != nil {
+		b.Fatalf("NewClient: %v", err)
+	}
+	data := map[string]string{"article_id": "12345", "category": "news"}
+
+	b.Run("token", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := client.SendToToken(context.Background(), "token-1", "Title", "Body", data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("batch of 10", func(b *testing.B) {
+		notifications := make([]fcm.Notification, 10)
+		for i := range notifications {
+			notifications[i] = fcm.Notification{Token: fmt.Sprintf("token-%d", i), Title: "Title", Body: "Body", CustomData: data}
+		}
+		for b.Loop() {
+			for _, r := range client.SendEach(context.Background(), notifications) {
+				if r.Err != nil {
+					b.Fatal(r.Err)
+				}
+			}
+		}
+	})
+}
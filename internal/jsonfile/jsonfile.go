@@ -0,0 +1,79 @@
+// Package jsonfile はローカルファイルを使った小さな永続ストア向けの読み書きを提供します。
+package jsonfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Read は path のJSONを v にデコードします。ファイルが存在しない、または空の場合は v を変更せず false を返します。
+func Read(path string, v any) (bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(b) == 0) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	return true, nil
+}
+
+// Write は v をJSONにエンコードして path に書き込みます。
+// 一時ファイルへ書き出してからリネームするため、途中で落ちてもファイルは壊れません。
+func Write(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing %s: %w", path, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", path, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// CheckWritable は path のディレクトリに Write で書き込めることを確認します。
+func CheckWritable(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", filepath.Dir(path), err)
+	}
+
+	name := tmp.Name()
+	tmp.Close()
+
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("removing %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+// Package lifecycle はシャットダウン時に新しいリクエストの受け付けを止め、処理中のリクエストを待ってから
+// 後処理 (スケジューラの停止、配信イベントの送出など) を行うための仕組みを提供します。
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultDrainTimeout = 5 * time.Second
+
+// Manager は処理中のリクエストを数え、シャットダウンを順に進めます。
+//
+// Shutdown が呼ばれると Draining になり、Middleware を通るリクエストは 503 で拒否され、Check は失敗します。
+// その後、処理中のリクエストが終わるのを drainTimeout まで待ち、OnShutdown で登録した処理を登録順に実行します。
+type Manager struct {
+	drainTimeout time.Duration
+	now          func() time.Time
+
+	mu       sync.Mutex
+	draining bool
+	inFlight map[*operation]struct{}
+	idle     chan struct{} // Draining 中に処理中のリクエストがなくなると閉じる
+	hooks    []hook
+}
+
+// operation は処理中のリクエストです。待ちきれなかった場合のログに使います。
+type operation struct {
+	name    string
+	started time.Time
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func New() *Manager {
+	return &Manager{
+		drainTimeout: defaultDrainTimeout,
+		now:          time.Now,
+		inFlight:     make(map[*operation]struct{}),
+	}
+}
+
+// WithDrainTimeout は処理中のリクエストを待つ時間の上限を設定します。
+// 残りの時間は OnShutdown で登録した処理に使われます。
+func (m *Manager) WithDrainTimeout(d time.Duration) *Manager {
+	m.drainTimeout = d
+
+	return m
+}
+
+// OnShutdown は処理中のリクエストを待った後に実行する処理を登録します。登録順に実行されます。
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) *Manager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hooks = append(m.hooks, hook{name: name, fn: fn})
+
+	return m
+}
+
+// Draining はシャットダウンが始まっていれば true を返します。
+func (m *Manager) Draining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.draining
+}
+
+// Check はシャットダウンが始まっていれば失敗します。readinessチェックに使います。
+func (m *Manager) Check(context.Context) error {
+	if m.Draining() {
+		return fmt.Errorf("shutting down")
+	}
+
+	return nil
+}
+
+// Start は name の処理を処理中として登録し、終了時に呼ぶ関数を返します。
+// シャットダウンが始まっている場合は登録せずに false を返します。
+func (m *Manager) Start(name string) (done func(), ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.draining {
+		return nil, false
+	}
+
+	op := &operation{name: name, started: m.now()}
+	m.inFlight[op] = struct{}{}
+
+	var once sync.Once
+	return func() { once.Do(func() { m.finish(op) }) }, true
+}
+
+func (m *Manager) finish(op *operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.inFlight, op)
+	if m.draining && len(m.inFlight) == 0 {
+		close(m.idle)
+	}
+}
+
+// Middleware は処理中のリクエストを数えます。シャットダウンが始まった後のリクエストは 503 で拒否し、
+// Pub/Subに別のインスタンスへ再送させます。
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done, ok := m.Start(r.Method + " " + r.URL.Path)
+		if !ok {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer done()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown はシャットダウンを開始し、処理中のリクエストを待ってから登録された処理を実行します。
+// ctx が全体の期限です。待ちきれなかったリクエストや失敗した処理はログに出力し、エラーとして返します。
+func (m *Manager) Shutdown(ctx context.Context) error {
+	logger := slog.With("component", "lifecycle")
+
+	m.mu.Lock()
+	if m.draining {
+		m.mu.Unlock()
+		return fmt.Errorf("shutdown already started")
+	}
+	m.draining = true
+	m.idle = make(chan struct{})
+	if len(m.inFlight) == 0 {
+		close(m.idle)
+	}
+	inFlight := len(m.inFlight)
+	hooks := append([]hook(nil), m.hooks...)
+	m.mu.Unlock()
+
+	logger.InfoContext(ctx, "draining", "inFlight", inFlight)
+
+	var errs []error
+
+	drainCtx, cancel := context.WithTimeout(ctx, m.drainTimeout)
+	select {
+	case <-m.idle:
+		logger.InfoContext(ctx, "all in-flight requests finished")
+	case <-drainCtx.Done():
+		abandoned := m.abandoned()
+		for _, op := range abandoned {
+			logger.WarnContext(ctx, "abandoning in-flight request", "operation", op.name, "age", m.now().Sub(op.started).String())
+		}
+		errs = append(errs, fmt.Errorf("%d in-flight requests did not finish before the drain timeout", len(abandoned)))
+	}
+	cancel()
+
+	for _, h := range hooks {
+		start := m.now()
+		if err := h.fn(ctx); err != nil {
+			logger.ErrorContext(ctx, "shutdown step failed", "step", h.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		logger.InfoContext(ctx, "shutdown step finished", "step", h.name, "duration", m.now().Sub(start).String())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *Manager) abandoned() []operation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := make([]operation, 0, len(m.inFlight))
+	for op := range m.inFlight {
+		ops = append(ops, *op)
+	}
+	slices.SortFunc(ops, func(a, b operation) int { return a.started.Compare(b.started) })
+
+	return ops
+}
@@ -0,0 +1,96 @@
+package lifecycle_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/lifecycle"
+)
+
+func TestManager_Shutdown(t *testing.T) {
+	m := lifecycle.New()
+
+	var mu sync.Mutex
+	var steps []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			steps = append(steps, name)
+			return nil
+		}
+	}
+	m.OnShutdown("http_server", record("http_server")).OnShutdown("delivery_events", record("delivery_events"))
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		record("request")(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	inFlight := httptest.NewRecorder()
+	go handler.ServeHTTP(inFlight, httptest.NewRequest(http.MethodPost, "/publish/token", nil))
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- m.Shutdown(context.Background()) }()
+
+	// Shutdown が始まったら新しいリクエストは拒否され、readinessチェックは失敗する
+	for !m.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	rejected := httptest.NewRecorder()
+	handler.ServeHTTP(rejected, httptest.NewRequest(http.MethodPost, "/publish/token", nil))
+	if rejected.Code != http.StatusServiceUnavailable {
+		t.Errorf("status during drain: got %d want %d", rejected.Code, http.StatusServiceUnavailable)
+	}
+	if err := m.Check(context.Background()); err == nil {
+		t.Error("Check during drain: got nil, want error")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if got := strings.Join(steps, ","); got != "request,http_server,delivery_events" {
+		t.Errorf("shutdown order: got %s", got)
+	}
+}
+
+func TestManager_ShutdownDrainTimeout(t *testing.T) {
+	m := lifecycle.New().WithDrainTimeout(20 * time.Millisecond)
+
+	hookRan := false
+	m.OnShutdown("delivery_events", func(context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	done, ok := m.Start("POST /publish/token")
+	if !ok {
+		t.Fatal("Start before shutdown: got false")
+	}
+	defer done()
+
+	err := m.Shutdown(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 in-flight requests did not finish") {
+		t.Errorf("Shutdown error: got %v", err)
+	}
+
+	if !hookRan {
+		t.Error("shutdown steps did not run after the drain timeout")
+	}
+
+	if _, ok := m.Start("POST /publish/token"); ok {
+		t.Error("Start after shutdown: got true")
+	}
+}
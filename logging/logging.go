@@ -0,0 +1,185 @@
+// Package logging はCloud Loggingの構造化ログ形式に合わせた log/slog の設定と、
+// リクエスト単位のロガーやデバイストークンの秘匿化を提供します。
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Cloud Loggingが構造化ログ (JSONペイロード) から読み取る特殊フィールド。
+// https://cloud.google.com/logging/docs/structured-logging
+const (
+	traceKey        = "logging.googleapis.com/trace"
+	spanIDKey       = "logging.googleapis.com/spanId"
+	traceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+// Options はロガーの設定です。
+type Options struct {
+	Level     slog.Level
+	Format    string // "json" (デフォルト) または "text"
+	ProjectID string // logging.googleapis.com/trace の "projects/<ID>/traces/<トレースID>" 形式に使うプロジェクトID
+	// RevealTokens が true の場合はデバイストークンを秘匿化せずに出力します。ローカルでのデバッグ用です。
+	RevealTokens bool
+}
+
+// Setup は opts に従ったロガーを作成し、slog と標準の log パッケージのデフォルトに設定します。
+func Setup(w io.Writer, opts Options) (*slog.Logger, error) {
+	logger, err := New(w, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	revealTokens.Store(opts.RevealTokens)
+	slog.SetDefault(logger)
+
+	return logger, nil
+}
+
+// New は opts に従ったロガーを作成します。JSON形式では level と msg をCloud Loggingの severity と message として出力し、
+// コンテキストにOpenTelemetryのスパンがあればトレースIDを付与します。
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+
+	var h slog.Handler
+	switch opts.Format {
+	case "", "json":
+		handlerOpts.ReplaceAttr = cloudLoggingAttr
+		h = slog.NewJSONHandler(w, handlerOpts)
+	case "text":
+		h = slog.NewTextHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q (supported: json, text)", opts.Format)
+	}
+
+	return slog.New(&traceHandler{Handler: h, projectID: opts.ProjectID}), nil
+}
+
+// cloudLoggingAttr は slog の標準のキーをCloud Loggingのフィールド名に置き換えます。
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = "severity"
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(severity(level))
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+
+	return a
+}
+
+// severity は slog のレベルをCloud LoggingのLogSeverityに変換します。
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// traceHandler はコンテキストのスパンのトレースIDとスパンIDをレコードに付与します。
+type traceHandler struct {
+	slog.Handler
+	projectID string
+}
+
+func (h *traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceID := sc.TraceID().String()
+		if h.projectID != "" {
+			traceID = "projects/" + h.projectID + "/traces/" + traceID
+		}
+
+		r = r.Clone()
+		r.AddAttrs(
+			slog.String(traceKey, traceID),
+			slog.String(spanIDKey, sc.SpanID().String()),
+			slog.Bool(traceSampledKey, sc.IsSampled()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithAttrs(attrs), projectID: h.projectID}
+}
+
+func (h *traceHandler) WithGroup(name string) slog.Handler {
+	return &traceHandler{Handler: h.Handler.WithGroup(name), projectID: h.projectID}
+}
+
+type loggerKey struct{}
+
+// WithLogger は logger を持つコンテキストを返します。
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext はコンテキストに設定されたロガーを返します。設定されていなければ slog のデフォルトのロガーを返します。
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// revealTokens が true の場合、Token は秘匿化せずに出力されます。
+var revealTokens atomic.Bool
+
+// Token はログに出力するときに秘匿化されるデバイストークンです。
+// 先頭と末尾の数文字と、同じトークンのログを突き合わせるためのハッシュだけを出力します。
+type Token string
+
+// LogValue は slog.LogValuer の実装です。
+func (t Token) LogValue() slog.Value {
+	if revealTokens.Load() {
+		return slog.StringValue(string(t))
+	}
+
+	return slog.StringValue(RedactToken(string(t)))
+}
+
+// RedactToken はデバイストークンを "先頭4文字…末尾4文字 (sha256:ハッシュの先頭12桁)" の形式に秘匿化します。
+// 短いトークンはハッシュのみを返します。
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := "sha256:" + hex.EncodeToString(sum[:])[:12]
+
+	if len(token) < 16 {
+		return hash
+	}
+
+	return token[:4] + "…" + token[len(token)-4:] + " (" + hash + ")"
+}
+
+// Keys は map のキーだけをログに出力します。カスタムデータの値など、内容を出力したくない場合に使います。
+func Keys[V any](m map[string]V) slog.Value {
+	return slog.AnyValue(slices.Sorted(maps.Keys(m)))
+}
@@ -0,0 +1,208 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+func decodeLine(t *testing.T, buf *bytes.Buffer) map[string]any {
+	t.Helper()
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log output is not JSON: %v (%q)", err, buf.String())
+	}
+
+	return entry
+}
+
+func TestNew_CloudLoggingFields(t *testing.T) {
+	tests := []struct {
+		name             string
+		level            slog.Level
+		expectedSeverity string
+	}{
+		{name: "debug", level: slog.LevelDebug, expectedSeverity: "DEBUG"},
+		{name: "info", level: slog.LevelInfo, expectedSeverity: "INFO"},
+		{name: "warn", level: slog.LevelWarn, expectedSeverity: "WARNING"},
+		{name: "error", level: slog.LevelError, expectedSeverity: "ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := logging.New(&buf, logging.Options{Level: slog.LevelDebug})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			logger.Log(context.Background(), tt.level, "hello", "key", "value")
+
+			entry := decodeLine(t, &buf)
+			if entry["severity"] != tt.expectedSeverity {
+				t.Errorf("severity: got %v want %s", entry["severity"], tt.expectedSeverity)
+			}
+			if entry["message"] != "hello" {
+				t.Errorf("message: got %v want %s", entry["message"], "hello")
+			}
+			if entry["key"] != "value" {
+				t.Errorf("key: got %v want %s", entry["key"], "value")
+			}
+			if _, ok := entry["level"]; ok {
+				t.Errorf("unexpected level field in %v", entry)
+			}
+		})
+	}
+}
+
+func TestNew_Trace(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		projectID     string
+		expectedTrace string // 空なら trace フィールドなし
+	}{
+		{
+			name:          "with project",
+			ctx:           ctx,
+			projectID:     "my-project",
+			expectedTrace: "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:          "without project",
+			ctx:           ctx,
+			expectedTrace: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name: "no span",
+			ctx:  context.Background(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := logging.New(&buf, logging.Options{ProjectID: tt.projectID})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			logger.With("handler", "test").InfoContext(tt.ctx, "hello")
+
+			entry := decodeLine(t, &buf)
+			got, _ := entry["logging.googleapis.com/trace"].(string)
+			if got != tt.expectedTrace {
+				t.Errorf("trace: got %q want %q", got, tt.expectedTrace)
+			}
+
+			if tt.expectedTrace != "" {
+				if entry["logging.googleapis.com/spanId"] != "00f067aa0ba902b7" {
+					t.Errorf("spanId: got %v", entry["logging.googleapis.com/spanId"])
+				}
+				if entry["logging.googleapis.com/trace_sampled"] != true {
+					t.Errorf("trace_sampled: got %v", entry["logging.googleapis.com/trace_sampled"])
+				}
+			}
+		})
+	}
+}
+
+func TestNew_InvalidFormat(t *testing.T) {
+	if _, err := logging.New(&bytes.Buffer{}, logging.Options{Format: "xml"}); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	const token = "fGx1abcdefghijklmnopqrstuvwxyz0123456789:APA91bXyZ"
+
+	tests := []struct {
+		name        string
+		token       string
+		expectedPre string
+	}{
+		{name: "long token", token: token, expectedPre: "fGx1…"},
+		{name: "short token", token: "short", expectedPre: "sha256:"},
+		{name: "empty", token: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := logging.RedactToken(tt.token)
+
+			if tt.token == "" {
+				if got != "" {
+					t.Errorf("got %q want empty", got)
+				}
+				return
+			}
+
+			if strings.Contains(got, tt.token) {
+				t.Errorf("redacted token %q contains the original token", got)
+			}
+			if !strings.HasPrefix(got, tt.expectedPre) {
+				t.Errorf("got %q want prefix %q", got, tt.expectedPre)
+			}
+			if got != logging.RedactToken(tt.token) {
+				t.Errorf("redaction is not deterministic")
+			}
+		})
+	}
+}
+
+func TestToken_LogValue(t *testing.T) {
+	const token = "fGx1abcdefghijklmnopqrstuvwxyz0123456789:APA91bXyZ"
+
+	tests := []struct {
+		name         string
+		revealTokens bool
+		expected     string
+	}{
+		{name: "redacted by default", expected: logging.RedactToken(token)},
+		{name: "revealed", revealTokens: true, expected: token},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if _, err := logging.Setup(&buf, logging.Options{RevealTokens: tt.revealTokens}); err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			defer logging.Setup(&bytes.Buffer{}, logging.Options{})
+
+			slog.Info("sent", "token", logging.Token(token))
+
+			entry := decodeLine(t, &buf)
+			if entry["token"] != tt.expected {
+				t.Errorf("token: got %v want %s", entry["token"], tt.expected)
+			}
+		})
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if logging.FromContext(context.Background()) != slog.Default() {
+		t.Error("FromContext without logger should return slog.Default()")
+	}
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if logging.FromContext(logging.WithLogger(context.Background(), logger)) != logger {
+		t.Error("FromContext should return the logger set by WithLogger")
+	}
+}
@@ -2,73 +2,53 @@ package main
 
 import (
 	"context"
-	"log"
-	"net/http"
+	"flag"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/teamzidi/example-go-fcm/fcm"
-	"github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/config"
+	"github.com/teamzidi/example-go-fcm/internal/app"
+	"github.com/teamzidi/example-go-fcm/logging"
 )
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// 設定の読み込み。デフォルト値、-config (または CONFIG_FILE) のYAMLファイル、環境変数の順に適用する。
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	flag.Parse()
 
-	// 環境変数から設定を読み込む
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	// FCMクライアントの初期化
-	fcmClient, err := fcm.NewClient(ctx)
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize FCM client: %v", err)
+		fatal("Invalid configuration", err)
 	}
-	log.Println("FCM client initialized.")
-
-	// HTTPルーターの設定
-	mux := http.NewServeMux()
-
-	// Pub/Sub Push受信用ハンドラ (デバイス指定)
-	pushDeviceHandler := handlers.NewPushDeviceHandler(fcmClient)
-	mux.Handle("/publish/token", pushDeviceHandler)
-
-	// Pub/Sub Push受信用ハンドラ (トピック指定)
-	pushTopicHandler := handlers.NewPushTopicHandler(fcmClient)
-	mux.Handle("/publish/topic", pushTopicHandler)
-
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
 
-	log.Printf("Starting server on port %s\n", port)
-
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	// ログの初期化
+	var logLevel slog.Level
+	_ = logLevel.UnmarshalText([]byte(cfg.Logging.Level)) // config.Load で検証済み
+	if _, err := logging.Setup(os.Stderr, logging.Options{
+		Level:        logLevel,
+		Format:       cfg.Logging.Format,
+		ProjectID:    cfg.FCM.ProjectID,
+		RevealTokens: cfg.Logging.RevealTokens,
+	}); err != nil {
+		fatal("Failed to initialize logging", err)
 	}
+	slog.Info("configuration loaded", "file", *configPath, "config", cfg)
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe: %v", err)
-		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer shutdownCancel()
+	// SIGINT / SIGTERM で終了処理を始める
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	if err := app.Run(ctx, cfg, app.Options{}); err != nil {
+		fatal("Server stopped", err)
 	}
 
-	log.Println("Server exiting")
+	slog.Info("server exiting")
+}
+
+// fatal はエラーをログに出力してプロセスを終了します。
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,261 @@
+// Package metrics は送信結果やレイテンシのPrometheusメトリクスを提供します。
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+const namespace = "fcm_backend"
+
+// Metrics はサービスのメトリクス一式です。
+type Metrics struct {
+	registry *prometheus.Registry
+
+	notifications   *prometheus.CounterVec
+	publishDelay    *prometheus.HistogramVec
+	fcmSends        *prometheus.CounterVec
+	fcmDuration     *prometheus.HistogramVec
+	fcmInFlight     prometheus.Gauge
+	injectedFaults  *prometheus.CounterVec
+	frequencyCap    *prometheus.CounterVec
+	httpRequests    *prometheus.CounterVec
+	httpInFlight    *prometheus.GaugeVec
+	pubsubResponses *prometheus.CounterVec
+	pullMessages    *prometheus.CounterVec
+}
+
+// New は新しい Metrics を作成し、専用のレジストリに登録します。
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_total",
+			Help:      "Notifications handled, by handler, target type, outcome and FCM error code.",
+		}, []string{"handler", "target_type", "outcome", "fcm_error_code"}),
+		publishDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "pubsub_publish_to_send_seconds",
+			Help:      "Delay between Pub/Sub publishTime and the end of handling the message.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+		}, []string{"handler", "outcome"}),
+		fcmSends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fcm_sends_total",
+			Help:      "FCM send calls, by tenant, target type and FCM error code (empty on success).",
+		}, []string{"tenant", "target_type", "fcm_error_code"}),
+		fcmDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fcm_send_duration_seconds",
+			Help:      "Latency of FCM send calls, by tenant and target type.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"tenant", "target_type"}),
+		fcmInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "fcm_sends_in_flight",
+			Help:      "FCM send calls currently in progress.",
+		}),
+		injectedFaults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fcm_injected_faults_total",
+			Help:      "Faults injected into FCM sends by the chaos mode, by tenant, target type and fault.",
+		}, []string{"tenant", "target_type", "fault"}),
+		frequencyCap: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frequency_cap_decisions_total",
+			Help:      "Frequency cap decisions for notifications, by category and decision (allowed, dropped or deferred).",
+		}, []string{"category", "decision"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by handler and status code.",
+		}, []string{"handler", "code"}),
+		httpInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests currently being handled.",
+		}, []string{"handler"}),
+		pubsubResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pubsub_push_responses_total",
+			Help:      "Pub/Sub push deliveries acknowledged (2xx) or negatively acknowledged, by handler.",
+		}, []string{"handler", "result"}),
+		pullMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pubsub_pull_messages_total",
+			Help:      "Pub/Sub messages received by streaming pull and acknowledged or negatively acknowledged, by handler.",
+		}, []string{"handler", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.notifications,
+		m.publishDelay,
+		m.fcmSends,
+		m.fcmDuration,
+		m.fcmInFlight,
+		m.injectedFaults,
+		m.frequencyCap,
+		m.httpRequests,
+		m.httpInFlight,
+		m.pubsubResponses,
+		m.pullMessages,
+	)
+
+	return m
+}
+
+// Registry はメトリクスを登録しているレジストリを返します。
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler は /metrics 用のハンドラを返します。
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveNotification は1件の通知の処理結果を記録します。
+func (m *Metrics) ObserveNotification(handler, targetType, outcome, fcmErrorCode string) {
+	m.notifications.WithLabelValues(handler, targetType, outcome, fcmErrorCode).Inc()
+}
+
+// ObservePublishDelay はPub/Subへのpublishから処理完了までの時間を記録します。
+func (m *Metrics) ObservePublishDelay(handler, outcome string, d time.Duration) {
+	m.publishDelay.WithLabelValues(handler, outcome).Observe(d.Seconds())
+}
+
+// FCMMiddleware はFCMの送信呼び出しの件数・レイテンシ・実行中の数を記録する fcm.Middleware を返します。
+// tenant はテナントごとのクライアントを区別するラベルです。
+func (m *Metrics) FCMMiddleware(tenant string) fcm.Middleware {
+	return func(next fcm.Sender) fcm.Sender {
+		return &instrumentedSender{next: next, m: m, tenant: tenant}
+	}
+}
+
+type instrumentedSender struct {
+	next   fcm.Sender
+	m      *Metrics
+	tenant string
+}
+
+func (s *instrumentedSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	targetType := fcm.TargetType(message)
+
+	s.m.fcmInFlight.Inc()
+	defer s.m.fcmInFlight.Dec()
+
+	start := time.Now()
+	id, err := s.next.Send(ctx, message)
+
+	s.m.fcmDuration.WithLabelValues(s.tenant, targetType).Observe(time.Since(start).Seconds())
+	s.m.fcmSends.WithLabelValues(s.tenant, targetType, fcm.ErrorCode(err)).Inc()
+
+	return id, err
+}
+
+// SendEach は呼び出し全体のレイテンシを target_type "batch" として、送信件数をメッセージごとに記録します。
+func (s *instrumentedSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	s.m.fcmInFlight.Inc()
+	defer s.m.fcmInFlight.Dec()
+
+	start := time.Now()
+	resp, err := s.next.SendEach(ctx, messages)
+
+	s.m.fcmDuration.WithLabelValues(s.tenant, "batch").Observe(time.Since(start).Seconds())
+	for i, message := range messages {
+		msgErr := err
+		if err == nil && i < len(resp.Responses) {
+			msgErr = resp.Responses[i].Error
+		}
+		s.m.fcmSends.WithLabelValues(s.tenant, fcm.TargetType(message), fcm.ErrorCode(msgErr)).Inc()
+	}
+
+	return resp, err
+}
+
+// ObserveInjectedFault はカオスモードでFCMへの送信に注入した障害を記録します。
+func (m *Metrics) ObserveInjectedFault(tenant, targetType, fault string) {
+	m.injectedFaults.WithLabelValues(tenant, targetType, fault).Inc()
+}
+
+// ObserveFrequencyCap は送信数の上限の判定結果を記録します。
+func (m *Metrics) ObserveFrequencyCap(category, decision string) {
+	m.frequencyCap.WithLabelValues(category, decision).Inc()
+}
+
+// ObservePullMessage はストリーミングpullで受信したメッセージのack/nackを記録します。
+func (m *Metrics) ObservePullMessage(handler string, ack bool) {
+	result := "nack"
+	if ack {
+		result = "ack"
+	}
+	m.pullMessages.WithLabelValues(handler, result).Inc()
+}
+
+// InstrumentHandler はリクエスト数と処理中のリクエスト数を記録するよう h をラップします。
+func (m *Metrics) InstrumentHandler(name string, h http.Handler) http.Handler {
+	return m.instrument(name, h, false)
+}
+
+// InstrumentPushHandler は InstrumentHandler に加えて、Pub/Sub Pushのack/nackを記録するよう h をラップします。
+func (m *Metrics) InstrumentPushHandler(name string, h http.Handler) http.Handler {
+	return m.instrument(name, h, true)
+}
+
+func (m *Metrics) instrument(name string, h http.Handler, push bool) http.Handler {
+	inFlight := m.httpInFlight.WithLabelValues(name)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		m.httpRequests.WithLabelValues(name, strconv.Itoa(sw.status)).Inc()
+
+		if push {
+			result := "nack"
+			if sw.status >= 200 && sw.status < 300 {
+				result = "ack"
+			}
+			m.pubsubResponses.WithLabelValues(name, result).Inc()
+		}
+	})
+}
+
+// statusWriter は書き込まれたステータスコードを記録する http.ResponseWriter です。
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/metrics"
+)
+
+type fakeSender struct {
+	err error
+}
+
+func (s fakeSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	return "id", s.err
+}
+
+// SendEach はメッセージごとの結果として err を返します。
+func (s fakeSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	resp := &messaging.BatchResponse{}
+	for range messages {
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: s.err == nil, MessageID: "id", Error: s.err})
+	}
+	return resp, nil
+}
+
+func TestFCMMiddleware(t *testing.T) {
+	m := metrics.New()
+
+	ok := fcm.NewClientWithSender(fakeSender{}, m.FCMMiddleware(fcm.DefaultTenant))
+	failing := fcm.NewClientWithSender(fakeSender{err: errors.New("boom")}, m.FCMMiddleware("app-b"))
+
+	ok.SendToToken(context.Background(), "token", "t", "b", nil)
+	ok.SendToTopic(context.Background(), "news", "t", "b", nil)
+	failing.SendToTopic(context.Background(), "news", "t", "b", nil)
+	ok.SendEach(context.Background(), []fcm.Notification{{Token: "token", Title: "t", Body: "b"}, {Topic: "news", Title: "t", Body: "b"}})
+	failing.SendEach(context.Background(), []fcm.Notification{{Token: "token", Title: "t", Body: "b"}})
+
+	expected := `
+# HELP fcm_backend_fcm_sends_total FCM send calls, by tenant, target type and FCM error code (empty on success).
+# TYPE fcm_backend_fcm_sends_total counter
+fcm_backend_fcm_sends_total{fcm_error_code="",target_type="token",tenant="default"} 2
+fcm_backend_fcm_sends_total{fcm_error_code="",target_type="topic",tenant="default"} 2
+fcm_backend_fcm_sends_total{fcm_error_code="UNKNOWN",target_type="token",tenant="app-b"} 1
+fcm_backend_fcm_sends_total{fcm_error_code="UNKNOWN",target_type="topic",tenant="app-b"} 1
+`
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "fcm_backend_fcm_sends_total"); err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(m.Registry(), "fcm_backend_fcm_send_duration_seconds"); n != 5 {
+		t.Errorf("fcm_send_duration_seconds series: got %d want 5", n)
+	}
+}
+
+func TestInstrumentPushHandler(t *testing.T) {
+	m := metrics.New()
+
+	statuses := []int{http.StatusOK, http.StatusNoContent, http.StatusInternalServerError}
+	for _, status := range statuses {
+		h := m.InstrumentPushHandler("push_device", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/publish/token", nil))
+	}
+
+	expected := `
+# HELP fcm_backend_pubsub_push_responses_total Pub/Sub push deliveries acknowledged (2xx) or negatively acknowledged, by handler.
+# TYPE fcm_backend_pubsub_push_responses_total counter
+fcm_backend_pubsub_push_responses_total{handler="push_device",result="ack"} 2
+fcm_backend_pubsub_push_responses_total{handler="push_device",result="nack"} 1
+`
+	if err := testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "fcm_backend_pubsub_push_responses_total"); err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `fcm_backend_http_requests_total{code="500",handler="push_device"} 1`) {
+		t.Errorf("/metrics output missing http_requests_total:\n%s", rr.Body.String())
+	}
+}
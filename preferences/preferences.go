@@ -0,0 +1,179 @@
+package preferences
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/internal/jsonfile"
+)
+
+// Preferences は1人のユーザー (または1つのデバイストークン) の通知設定です。
+type Preferences struct {
+	Categories map[string]bool `json:"categories"` // カテゴリごとの受信可否 (true: オプトイン, false: オプトアウト)
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// Store は通知設定の保存先です。キーは "user:<ID>" または "token:<トークン>" の形式です。
+type Store interface {
+	Get(key string) (Preferences, bool, error)
+	Put(key string, p Preferences) error
+}
+
+// Registry は保存された通知設定に基づいて通知を送ってよいか判定します。
+type Registry struct {
+	store         Store
+	optInRequired map[string]bool
+}
+
+// NewRegistry は新しい Registry を作成します。
+// optInRequired に含まれるカテゴリは、明示的にオプトインした受信者にだけ送信されます。
+// それ以外のカテゴリは、明示的にオプトアウトしていない限り送信されます。
+func NewRegistry(store Store, optInRequired []string) *Registry {
+	r := &Registry{store: store, optInRequired: make(map[string]bool)}
+	for _, category := range optInRequired {
+		r.optInRequired[category] = true
+	}
+
+	return r
+}
+
+// Get は key の通知設定を返します。未設定の場合は空の Preferences を返します。
+func (r *Registry) Get(key string) (Preferences, error) {
+	p, ok, err := r.store.Get(key)
+	if err != nil {
+		return Preferences{}, fmt.Errorf("reading preferences for %s: %w", key, err)
+	}
+
+	if !ok || p.Categories == nil {
+		p.Categories = map[string]bool{}
+	}
+
+	return p, nil
+}
+
+// Update は key のカテゴリごとの受信可否を categories で置き換えます。
+func (r *Registry) Update(key string, categories map[string]bool, now time.Time) (Preferences, error) {
+	if categories == nil {
+		categories = map[string]bool{}
+	}
+
+	p := Preferences{Categories: categories, UpdatedAt: now.UTC()}
+	if err := r.store.Put(key, p); err != nil {
+		return Preferences{}, fmt.Errorf("storing preferences for %s: %w", key, err)
+	}
+
+	return p, nil
+}
+
+// Allows は keys のすべての受信者が category の通知を受け取る設定になっているかを返します。
+// カテゴリのない通知は常に許可されます。
+func (r *Registry) Allows(category string, keys ...string) (bool, error) {
+	if category == "" {
+		return true, nil
+	}
+
+	for _, key := range keys {
+		p, ok, err := r.store.Get(key)
+		if err != nil {
+			return false, fmt.Errorf("reading preferences for %s: %w", key, err)
+		}
+
+		optedIn, set := p.Categories[category]
+		switch {
+		case ok && set && !optedIn:
+			return false, nil
+		case r.optInRequired[category] && !(ok && set && optedIn):
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// MemoryStore はプロセス内メモリに通知設定を保持する Store です。
+type MemoryStore struct {
+	mu    sync.RWMutex
+	prefs map[string]Preferences
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{prefs: make(map[string]Preferences)}
+}
+
+func (s *MemoryStore) Get(key string) (Preferences, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.prefs[key]
+	return p, ok, nil
+}
+
+func (s *MemoryStore) Put(key string, p Preferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prefs[key] = p
+	return nil
+}
+
+// FileStore は通知設定をJSONファイルに永続化する Store です。更新のたびにファイル全体を書き直します。
+type FileStore struct {
+	mu    sync.RWMutex
+	path  string
+	prefs map[string]Preferences
+}
+
+// NewFileStore は path のファイルから既存の通知設定を読み込んだ FileStore を返します。
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, prefs: make(map[string]Preferences)}
+
+	if _, err := jsonfile.Read(path, &s.prefs); err != nil {
+		return nil, fmt.Errorf("opening preference store: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Get(key string) (Preferences, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.prefs[key]
+	return p, ok, nil
+}
+
+func (s *FileStore) Put(key string, p Preferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.prefs[key]
+	s.prefs[key] = p
+
+	if err := jsonfile.Write(s.path, s.prefs); err != nil {
+		if existed {
+			s.prefs[key] = prev
+		} else {
+			delete(s.prefs, key)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Check は保存先のファイルに書き込めることを確認します。readinessチェックに使います。
+func (s *FileStore) Check(context.Context) error {
+	return jsonfile.CheckWritable(s.path)
+}
+
+// UserKey はユーザーIDに対応する Store のキーを返します。
+func UserKey(userID string) string {
+	return "user:" + userID
+}
+
+// TokenKey はデバイストークンに対応する Store のキーを返します。
+func TokenKey(token string) string {
+	return "token:" + token
+}
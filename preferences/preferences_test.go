@@ -0,0 +1,73 @@
+package preferences_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/preferences"
+)
+
+func TestRegistry_Allows(t *testing.T) {
+	store := preferences.NewMemoryStore()
+	registry := preferences.NewRegistry(store, []string{"marketing"})
+
+	now := time.Now()
+	registry.Update(preferences.UserKey("opted-in"), map[string]bool{"marketing": true}, now)
+	registry.Update(preferences.UserKey("opted-out"), map[string]bool{"marketing": false, "reminder": false}, now)
+	registry.Update(preferences.TokenKey("muted-token"), map[string]bool{"news": false}, now)
+
+	tests := []struct {
+		name     string
+		category string
+		keys     []string
+		want     bool
+	}{
+		{name: "no category is always allowed", category: "", keys: []string{preferences.UserKey("opted-out")}, want: true},
+		{name: "opt-out category is denied", category: "reminder", keys: []string{preferences.UserKey("opted-out")}, want: false},
+		{name: "default category is allowed", category: "news", keys: []string{preferences.UserKey("unknown")}, want: true},
+		{name: "opt-in category without consent is denied", category: "marketing", keys: []string{preferences.UserKey("unknown")}, want: false},
+		{name: "opt-in category with consent is allowed", category: "marketing", keys: []string{preferences.UserKey("opted-in")}, want: true},
+		{name: "token opt-out overrides user", category: "news", keys: []string{preferences.TokenKey("muted-token"), preferences.UserKey("opted-in")}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := registry.Allows(tt.category, tt.keys...)
+			if err != nil {
+				t.Fatalf("Allows: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Allows(%q, %v) = %v, want %v", tt.category, tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "preferences.json")
+
+	store, err := preferences.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	if _, err := preferences.NewRegistry(store, nil).Update(preferences.UserKey("u1"), map[string]bool{"marketing": false}, time.Now()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	reopened, err := preferences.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopening store: %v", err)
+	}
+
+	p, ok, err := reopened.Get(preferences.UserKey("u1"))
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v; want stored preferences", ok, err)
+	}
+
+	if optedIn, set := p.Categories["marketing"]; !set || optedIn {
+		t.Errorf("reopened preferences = %+v, want marketing opted out", p)
+	}
+}
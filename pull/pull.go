@@ -0,0 +1,159 @@
+// Package pull はPub/Subのストリーミングpullでメッセージを受信し、Push用のハンドラと同じ処理を行うワーカーを提供します。
+// Pushエンドポイントを公開できない環境 (プライベートネットワーク内のワーカーなど) で使います。
+package pull
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+)
+
+const defaultConcurrency = 10
+
+// MessageHandler は受信したメッセージを処理し、ackすべきなら true を返します。
+// handlers.PushDeviceHandler と handlers.PushTopicHandler が実装しています。
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, m handlers.ReceivedMessage) bool
+}
+
+// Tracker は処理中のメッセージを数えます。lifecycle.Manager が実装しています。
+// Start が false を返した (シャットダウンが始まっている) 場合、メッセージは処理せずにnackします。
+type Tracker interface {
+	Start(name string) (done func(), ok bool)
+}
+
+// MetricsRecorder はack/nackの結果を記録します。
+type MetricsRecorder interface {
+	ObservePullMessage(handler string, ack bool)
+}
+
+// FlowControl はフロー制御とack期限の延長の設定です。ゼロ値の項目はクライアントライブラリのデフォルトを使います。
+type FlowControl struct {
+	MaxOutstandingMessages int           // 処理待ちにできるメッセージ数の上限
+	MaxOutstandingBytes    int           // 処理待ちにできるメッセージの合計バイト数の上限
+	MaxExtension           time.Duration // ack期限を延長し続ける時間の上限
+	MaxExtensionPeriod     time.Duration // 1回の延長で延ばすack期限の上限
+}
+
+// Worker は1つのサブスクリプションからメッセージを受信して MessageHandler に渡します。
+type Worker struct {
+	name        string
+	sub         *pubsub.Subscription
+	handler     MessageHandler
+	concurrency int
+	flow        FlowControl
+	tracker     Tracker
+	metrics     MetricsRecorder
+}
+
+// NewWorker は sub から受信したメッセージを handler で処理する Worker を作成します。name はログとメトリクスに使う名前です。
+func NewWorker(name string, sub *pubsub.Subscription, handler MessageHandler) *Worker {
+	return &Worker{
+		name:        name,
+		sub:         sub,
+		handler:     handler,
+		concurrency: defaultConcurrency,
+	}
+}
+
+// WithConcurrency は同時に処理するメッセージ数を設定します。
+func (w *Worker) WithConcurrency(n int) *Worker {
+	w.concurrency = n
+
+	return w
+}
+
+// WithFlowControl はフロー制御とack期限の延長を設定します。
+func (w *Worker) WithFlowControl(f FlowControl) *Worker {
+	w.flow = f
+
+	return w
+}
+
+// WithTracker は処理中のメッセージをシャットダウン時に待てるよう t に登録します。
+func (w *Worker) WithTracker(t Tracker) *Worker {
+	w.tracker = t
+
+	return w
+}
+
+// WithMetrics はack/nackの結果を m に記録するよう設定します。
+func (w *Worker) WithMetrics(m MetricsRecorder) *Worker {
+	w.metrics = m
+
+	return w
+}
+
+// Run は ctx が終了するまでメッセージを受信し続けます。
+// ctx が終了すると新しいメッセージの受信を止め、処理中のメッセージが終わるのを待ってから戻ります。
+// 処理中のメッセージの ctx も終了するため、FCMへの送信は打ち切られてnackされます。
+func (w *Worker) Run(ctx context.Context) error {
+	w.sub.ReceiveSettings.NumGoroutines = 1
+	w.sub.ReceiveSettings.MaxOutstandingMessages = w.concurrency
+	if w.flow.MaxOutstandingMessages > 0 {
+		w.sub.ReceiveSettings.MaxOutstandingMessages = w.flow.MaxOutstandingMessages
+	}
+	if w.flow.MaxOutstandingBytes > 0 {
+		w.sub.ReceiveSettings.MaxOutstandingBytes = w.flow.MaxOutstandingBytes
+	}
+	if w.flow.MaxExtension > 0 {
+		w.sub.ReceiveSettings.MaxExtension = w.flow.MaxExtension
+	}
+	if w.flow.MaxExtensionPeriod > 0 {
+		w.sub.ReceiveSettings.MaxExtensionPeriod = w.flow.MaxExtensionPeriod
+	}
+
+	logger := slog.With("component", "pull", "worker", w.name, "subscription", w.sub.String())
+	logger.InfoContext(ctx, "receiving Pub/Sub messages", "concurrency", w.concurrency,
+		"maxOutstandingMessages", w.sub.ReceiveSettings.MaxOutstandingMessages)
+
+	sem := make(chan struct{}, max(w.concurrency, 1))
+	err := w.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			m.Nack()
+			return
+		}
+		defer func() { <-sem }()
+
+		w.receive(ctx, m)
+	})
+
+	logger.InfoContext(ctx, "stopped receiving Pub/Sub messages", "error", err)
+
+	return err
+}
+
+func (w *Worker) receive(ctx context.Context, m *pubsub.Message) {
+	if w.tracker != nil {
+		done, ok := w.tracker.Start("pull " + w.name)
+		if !ok {
+			m.Nack()
+			return
+		}
+		defer done()
+	}
+
+	ack := w.handler.HandleMessage(ctx, handlers.ReceivedMessage{
+		ID:           m.ID,
+		Data:         m.Data,
+		Attributes:   m.Attributes,
+		PublishTime:  m.PublishTime,
+		Subscription: w.sub.String(),
+	})
+
+	if ack {
+		m.Ack()
+	} else {
+		m.Nack()
+	}
+
+	if w.metrics != nil {
+		w.metrics.ObservePullMessage(w.name, ack)
+	}
+}
@@ -0,0 +1,199 @@
+package pull_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/teamzidi/example-go-fcm/handlers"
+	"github.com/teamzidi/example-go-fcm/pull"
+)
+
+// fakeHandler は data が "retry" のメッセージだけnackします。
+type fakeHandler struct {
+	mu       sync.Mutex
+	received map[string]int
+}
+
+func (h *fakeHandler) HandleMessage(_ context.Context, m handlers.ReceivedMessage) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.received[string(m.Data)]++
+
+	return string(m.Data) != "retry"
+}
+
+func (h *fakeHandler) count(data string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.received[data]
+}
+
+type fakeRecorder struct {
+	mu    sync.Mutex
+	acks  int
+	nacks int
+}
+
+func (r *fakeRecorder) ObservePullMessage(_ string, ack bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ack {
+		r.acks++
+	} else {
+		r.nacks++
+	}
+}
+
+type drainingTracker struct{}
+
+func (drainingTracker) Start(string) (func(), bool) { return nil, false }
+
+func newSubscription(t *testing.T, srv *pstest.Server) (*pubsub.Topic, *pubsub.Subscription) {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("connecting to fake Pub/Sub: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("pubsub.NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	topic, err := client.CreateTopic(ctx, "notifications")
+	if err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+	t.Cleanup(topic.Stop)
+
+	sub, err := client.CreateSubscription(ctx, "notifications-pull", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+
+	return topic, sub
+}
+
+func publish(t *testing.T, topic *pubsub.Topic, data string) string {
+	t.Helper()
+
+	id, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte(data)}).Get(context.Background())
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	return id
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorker_AckNack(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	topic, sub := newSubscription(t, srv)
+	okID := publish(t, topic, "ok")
+	retryID := publish(t, topic, "retry")
+
+	handler := &fakeHandler{received: make(map[string]int)}
+	recorder := &fakeRecorder{}
+	worker := pull.NewWorker("push_device", sub, handler).
+		WithConcurrency(2).
+		WithFlowControl(pull.FlowControl{MaxOutstandingMessages: 4, MaxExtension: time.Minute}).
+		WithMetrics(recorder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- worker.Run(ctx) }()
+
+	// nackしたメッセージは再配信される
+	waitFor(t, func() bool { return handler.count("ok") >= 1 && handler.count("retry") >= 2 })
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+
+	for _, m := range srv.Messages() {
+		switch m.ID {
+		case okID:
+			if m.Acks != 1 {
+				t.Errorf("ok message acks = %d, want 1", m.Acks)
+			}
+		case retryID:
+			if m.Acks != 0 {
+				t.Errorf("retry message acks = %d, want 0", m.Acks)
+			}
+		}
+	}
+
+	if handler.count("ok") != 1 {
+		t.Errorf("ok message handled %d times, want 1", handler.count("ok"))
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.acks != 1 || recorder.nacks < 2 {
+		t.Errorf("recorded acks = %d, nacks = %d, want 1 and >= 2", recorder.acks, recorder.nacks)
+	}
+}
+
+func TestWorker_Draining(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+
+	topic, sub := newSubscription(t, srv)
+	id := publish(t, topic, "ok")
+
+	handler := &fakeHandler{received: make(map[string]int)}
+	worker := pull.NewWorker("push_device", sub, handler).WithTracker(drainingTracker{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- worker.Run(ctx) }()
+
+	waitFor(t, func() bool {
+		for _, m := range srv.Messages() {
+			if m.ID == id && m.Deliveries >= 2 {
+				return true
+			}
+		}
+		return false
+	})
+	cancel()
+	<-done
+
+	if n := handler.count("ok"); n != 0 {
+		t.Errorf("message handled %d times while draining, want 0", n)
+	}
+}
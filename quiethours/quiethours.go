@@ -0,0 +1,81 @@
+package quiethours
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+// Window は1日のうち通知を控える時間帯 [Start, End) です。時刻は受信者のローカル時刻で解釈されます。
+// Start が End より後の場合は日付をまたぐ時間帯 (例: 22:00-08:00) を表します。
+type Window struct {
+	Start int // 開始時刻 (0時からの経過分)
+	End   int // 終了時刻 (0時からの経過分)
+}
+
+// Parse は "22:00-08:00" 形式の文字列を Window に変換します。
+func Parse(s string) (Window, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("quiet hours %q must be in HH:MM-HH:MM format", s)
+	}
+
+	var w Window
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, fmt.Errorf("parsing quiet hours start: %w", err)
+	}
+
+	if w.End, err = parseClock(end); err != nil {
+		return Window{}, fmt.Errorf("parsing quiet hours end: %w", err)
+	}
+
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("quiet hours %q must not be empty", s)
+	}
+
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains は t の loc におけるローカル時刻が時間帯内かどうかを返します。
+func (w Window) Contains(t time.Time, loc *time.Location) bool {
+	local := t.In(loc)
+	m := local.Hour()*60 + local.Minute()
+
+	if w.Start < w.End {
+		return w.Start <= m && m < w.End
+	}
+
+	return m >= w.Start || m < w.End
+}
+
+// Defer は t が時間帯内であれば時間帯が明ける時刻を、時間帯外であれば t をそのまま返します。
+func (w Window) Defer(t time.Time, loc *time.Location) time.Time {
+	if !w.Contains(t, loc) {
+		return t
+	}
+
+	local := t.In(loc)
+	day := local
+	if w.Start > w.End && local.Hour()*60+local.Minute() >= w.Start {
+		day = local.AddDate(0, 0, 1) // 日付をまたぐ時間帯の前半 (例: 23:00) は翌日の終了時刻まで
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), w.End/60, w.End%60, 0, 0, loc)
+}
+
+// String は Window を "22:00-08:00" 形式で返します。
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
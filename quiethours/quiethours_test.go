@@ -0,0 +1,97 @@
+package quiethours_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/quiethours"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "22:00-08:00", want: "22:00-08:00"},
+		{in: "01:30 - 06:15", want: "01:30-06:15"},
+		{in: "22:00", wantErr: true},
+		{in: "25:00-08:00", wantErr: true},
+		{in: "08:00-08:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w, err := quiethours.Parse(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+
+			if err == nil && w.String() != tt.want {
+				t.Errorf("Parse(%q) = %s, want %s", tt.in, w, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindow_Defer(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	overnight, _ := quiethours.Parse("22:00-08:00")
+	daytime, _ := quiethours.Parse("12:00-13:00")
+
+	tests := []struct {
+		name   string
+		window quiethours.Window
+		now    time.Time
+		want   time.Time
+	}{
+		{
+			name:   "outside overnight window is unchanged",
+			window: overnight,
+			now:    time.Date(2025, 1, 2, 15, 0, 0, 0, tokyo),
+			want:   time.Date(2025, 1, 2, 15, 0, 0, 0, tokyo),
+		},
+		{
+			name:   "before midnight defers to next morning",
+			window: overnight,
+			now:    time.Date(2025, 1, 2, 23, 30, 0, 0, tokyo),
+			want:   time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:   "after midnight defers to same morning",
+			window: overnight,
+			now:    time.Date(2025, 1, 3, 3, 0, 0, 0, tokyo),
+			want:   time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:   "end of window is allowed",
+			window: overnight,
+			now:    time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+			want:   time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:   "UTC instant is evaluated in recipient time zone",
+			window: overnight,
+			now:    time.Date(2025, 1, 2, 18, 0, 0, 0, time.UTC), // 03:00 JST
+			want:   time.Date(2025, 1, 3, 8, 0, 0, 0, tokyo),
+		},
+		{
+			name:   "same-day window defers to its end",
+			window: daytime,
+			now:    time.Date(2025, 1, 2, 12, 10, 0, 0, tokyo),
+			want:   time.Date(2025, 1, 2, 13, 0, 0, 0, tokyo),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Defer(tt.now, tokyo); !got.Equal(tt.want) {
+				t.Errorf("Defer(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
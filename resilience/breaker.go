@@ -0,0 +1,210 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// State はサーキットブレーカーの状態です。
+type State int
+
+const (
+	Closed   State = iota // 送信する
+	Open                  // 送信せずに失敗させる
+	HalfOpen              // 1件だけ試しに送信し、結果で Closed か Open に戻る (FCMに届かなかった場合は HalfOpen のまま)
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// Breaker は1つのテナントのFCMへの送信で一時的な失敗が続いた場合に、一定時間そのテナントへの送信を止めます。
+// UNREGISTERED など送信先ごとの失敗は数えず、FCMの一時的なエラーとタイムアウトだけを数えます。
+type Breaker struct {
+	tenant    string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker は一時的な失敗が threshold 回続いたら tenant への送信を cooldown の間止める Breaker を作成します。
+// cooldown の経過後は1件だけ試しに送信し、成功すれば送信を再開します。
+func NewBreaker(tenant string, threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		tenant:    tenant,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Middleware は Breaker が開いている間は送信せずに fcm.ErrThrottled をラップしたエラーを返す fcm.Middleware を返します。
+func (b *Breaker) Middleware() fcm.Middleware {
+	return func(next fcm.Sender) fcm.Sender {
+		return &breakerSender{next: next, breaker: b}
+	}
+}
+
+// State は現在の状態を返します。
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && time.Since(b.openedAt) >= b.cooldown {
+		return HalfOpen
+	}
+
+	return b.state
+}
+
+// Check は Breaker が開いていればエラーを返します。readinessチェックに使います。
+func (b *Breaker) Check(ctx context.Context) error {
+	if state := b.State(); state == Open {
+		return fmt.Errorf("circuit breaker for tenant %s is %s", b.tenant, state)
+	}
+
+	return nil
+}
+
+// outcome は1回の送信の結果のうち、ブレーカーが数える分類です。
+type outcome int
+
+const (
+	succeeded outcome = iota // FCMに届いた (送信先ごとのエラーを含む)
+	failed                   // FCMの一時的なエラーまたはタイムアウト
+	neutral                  // FCMに届かなかった (RateLimiter による制限、呼び出し元のキャンセル)
+)
+
+// allow は送信してよいかを判定します。nil を返した場合、送信後に結果を done で記録します。
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Closed:
+		return nil
+	case Open:
+		if time.Since(b.openedAt) < b.cooldown {
+			break
+		}
+		b.setState(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if !b.probing {
+			b.probing = true
+			return nil
+		}
+	}
+
+	return fmt.Errorf("tenant %s: circuit breaker is open: %w", b.tenant, fcm.ErrThrottled)
+}
+
+// done は送信の結果を記録します。neutral の結果は状態を変えず、HalfOpen なら次の送信で試し直します。
+func (b *Breaker) done(result outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Closed:
+		switch result {
+		case succeeded:
+			b.failures = 0
+		case failed:
+			b.failures++
+			if b.failures >= b.threshold {
+				b.setState(Open)
+			}
+		}
+	case HalfOpen:
+		b.probing = false
+		switch result {
+		case succeeded:
+			b.failures = 0
+			b.setState(Closed)
+		case failed:
+			b.setState(Open)
+		}
+	}
+	// Open の間に届いたのは開く前に始めた送信の結果なので数えない
+}
+
+// setState は状態を変え、変化をログに記録します。b.mu を保持して呼び出します。
+func (b *Breaker) setState(state State) {
+	slog.Warn("FCM circuit breaker state changed", "component", "resilience", "tenant", b.tenant,
+		"from", b.state.String(), "to", state.String(), "failures", b.failures)
+
+	b.state = state
+	if state == Open {
+		b.openedAt = time.Now()
+	}
+}
+
+type breakerSender struct {
+	next    fcm.Sender
+	breaker *Breaker
+}
+
+func (s *breakerSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := s.breaker.allow(); err != nil {
+		return "", err
+	}
+
+	id, err := s.next.Send(ctx, message)
+	s.breaker.done(classify(err))
+
+	return id, err
+}
+
+// SendEach は呼び出し全体が一時的なエラーで失敗した場合と、成功がなく一時的な失敗を含む場合を失敗として数えます。
+func (s *breakerSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	if err := s.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.next.SendEach(ctx, messages)
+	result := classify(err)
+	if err == nil && resp.SuccessCount == 0 {
+		for _, r := range resp.Responses {
+			if classify(r.Error) == failed {
+				result = failed
+			}
+		}
+	}
+	s.breaker.done(result)
+
+	return resp, err
+}
+
+// classify は送信のエラーをブレーカーが数える分類にします。
+// 内側の RateLimiter が送信しなかった場合と、呼び出し元がキャンセルした場合はFCMの状態が分からないため数えません。
+func classify(err error) outcome {
+	switch {
+	case errors.Is(err, fcm.ErrThrottled), errors.Is(err, context.Canceled):
+		return neutral
+	case fcm.IsRetryableError(err):
+		return failed
+	}
+
+	return succeeded
+}
@@ -0,0 +1,179 @@
+package resilience_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/resilience"
+)
+
+// fakeSender は errs の先頭のエラーを順に返します。errs が尽きたら成功します。
+type fakeSender struct {
+	errs  []error
+	calls int
+}
+
+func (s *fakeSender) next() error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *fakeSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := s.next(); err != nil {
+		return "", err
+	}
+	return "projects/p/messages/1", nil
+}
+
+func (s *fakeSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	err := s.next()
+	resp := &messaging.BatchResponse{}
+	for range messages {
+		if err != nil {
+			resp.Responses = append(resp.Responses, &messaging.SendResponse{Error: err})
+			resp.FailureCount++
+		} else {
+			resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: true, MessageID: "projects/p/messages/1"})
+			resp.SuccessCount++
+		}
+	}
+	return resp, nil
+}
+
+var (
+	errTemporary = context.DeadlineExceeded
+	errPermanent = errors.New("registration token is not registered")
+)
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+
+	type step struct {
+		wait          bool // cooldown だけ待ってから送信する
+		batch         bool
+		expectedSent  bool // 内側の Sender が呼ばれる
+		expectedState resilience.State
+	}
+
+	tests := []struct {
+		name  string
+		errs  []error
+		steps []step
+	}{
+		{
+			name: "opens after consecutive temporary failures",
+			errs: []error{errTemporary, errTemporary},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Open},
+				{expectedSent: false, expectedState: resilience.Open},
+			},
+		},
+		{
+			name: "permanent failures and successes do not open",
+			errs: []error{errTemporary, errPermanent, errTemporary, nil, errTemporary},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+			},
+		},
+		{
+			name: "successful probe after cooldown closes",
+			errs: []error{errTemporary, errTemporary},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Open},
+				{wait: true, expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+			},
+		},
+		{
+			name: "failed probe opens again",
+			errs: []error{errTemporary, errTemporary, errTemporary},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Open},
+				{wait: true, expectedSent: true, expectedState: resilience.Open},
+				{expectedSent: false, expectedState: resilience.Open},
+			},
+		},
+		{
+			name: "throttled or cancelled probe stays half-open",
+			errs: []error{errTemporary, errTemporary, fcm.ErrThrottled, context.Canceled, nil},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Open},
+				{wait: true, expectedSent: true, expectedState: resilience.HalfOpen},
+				{expectedSent: true, expectedState: resilience.HalfOpen},
+				{expectedSent: true, expectedState: resilience.Closed},
+			},
+		},
+		{
+			name: "throttled or cancelled sends do not reset failures",
+			errs: []error{errTemporary, fcm.ErrThrottled, context.Canceled, errTemporary},
+			steps: []step{
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Closed},
+				{expectedSent: true, expectedState: resilience.Open},
+			},
+		},
+		{
+			name: "batch with only temporary failures counts as a failure",
+			errs: []error{errTemporary, errTemporary},
+			steps: []step{
+				{batch: true, expectedSent: true, expectedState: resilience.Closed},
+				{batch: true, expectedSent: true, expectedState: resilience.Open},
+				{batch: true, expectedSent: false, expectedState: resilience.Open},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := resilience.NewBreaker("app-a", 2, cooldown)
+			sender := &fakeSender{errs: tt.errs}
+			client := fcm.NewClientWithSender(sender, breaker.Middleware())
+
+			for i, s := range tt.steps {
+				if s.wait {
+					time.Sleep(cooldown)
+				}
+
+				calls := sender.calls
+				var err error
+				if s.batch {
+					err = client.SendMessages(context.Background(), []*messaging.Message{{Token: "token-1"}})[0].Err
+				} else {
+					_, err = client.SendToToken(context.Background(), "token-1", "T", "B", nil)
+				}
+
+				if sent := sender.calls > calls; sent != s.expectedSent {
+					t.Errorf("step %d: sent = %v, want %v", i, sent, s.expectedSent)
+				}
+				if !s.expectedSent && (!errors.Is(err, fcm.ErrThrottled) || !fcm.IsRetryableError(err)) {
+					t.Errorf("step %d: error = %v, want a retryable throttled error", i, err)
+				}
+				if state := breaker.State(); state != s.expectedState {
+					t.Errorf("step %d: state = %s, want %s", i, state, s.expectedState)
+				}
+				if err := breaker.Check(context.Background()); (err != nil) != (s.expectedState == resilience.Open) {
+					t.Errorf("step %d: Check() = %v", i, err)
+				}
+			}
+		})
+	}
+}
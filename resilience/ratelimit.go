@@ -0,0 +1,74 @@
+// Package resilience はテナントごとにFCMへの送信を守る fcm.Middleware (送信レートの上限とサーキットブレーカー) を提供します。
+// 1つのテナントの大量送信やFCMの障害が、ほかのテナントの送信に影響しないようにするために使います。
+//
+// 送信しなかった場合のエラーは fcm.ErrThrottled をラップするため、fcm.IsRetryableError は再送対象と判定します。
+package resilience
+
+import (
+	"context"
+	"fmt"
+
+	"firebase.google.com/go/v4/messaging"
+	"golang.org/x/time/rate"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+// RateLimiter は1つのテナントのFCMへの送信数をトークンバケットで制限します。
+type RateLimiter struct {
+	tenant  string
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter は tenant の送信を1秒あたり perSecond 件、瞬間的には burst 件までに制限する RateLimiter を作成します。
+// burst が 0 以下なら perSecond と同じにします。
+func NewRateLimiter(tenant string, perSecond, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = perSecond
+	}
+
+	return &RateLimiter{
+		tenant:  tenant,
+		limiter: rate.NewLimiter(rate.Limit(perSecond), burst),
+	}
+}
+
+// Middleware は送信できるようになるまで待つ fcm.Middleware を返します。
+// ctx の期限までに送信できない場合は待たずに fcm.ErrThrottled をラップしたエラーを返します。
+func (l *RateLimiter) Middleware() fcm.Middleware {
+	return func(next fcm.Sender) fcm.Sender {
+		return &rateLimitedSender{next: next, limiter: l}
+	}
+}
+
+// wait は n 件の送信枠を1件ずつ待ちます。
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	for range n {
+		if err := l.limiter.Wait(ctx); err != nil {
+			return fmt.Errorf("tenant %s: waiting for send rate limit (%v): %w", l.tenant, err, fcm.ErrThrottled)
+		}
+	}
+
+	return nil
+}
+
+type rateLimitedSender struct {
+	next    fcm.Sender
+	limiter *RateLimiter
+}
+
+func (s *rateLimitedSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if err := s.limiter.wait(ctx, 1); err != nil {
+		return "", err
+	}
+
+	return s.next.Send(ctx, message)
+}
+
+func (s *rateLimitedSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	if err := s.limiter.wait(ctx, len(messages)); err != nil {
+		return nil, err
+	}
+
+	return s.next.SendEach(ctx, messages)
+}
@@ -0,0 +1,72 @@
+package resilience_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/resilience"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name          string
+		perSecond     int
+		burst         int
+		messages      int
+		timeout       time.Duration
+		expectedSent  int
+		expectedError bool
+	}{
+		{name: "within burst", perSecond: 1, burst: 3, messages: 3, timeout: time.Second, expectedSent: 3},
+		{name: "waits for the next token", perSecond: 100, burst: 1, messages: 3, timeout: time.Second, expectedSent: 3},
+		{name: "throttled when the deadline comes first", perSecond: 1, burst: 1, messages: 2, timeout: 100 * time.Millisecond, expectedSent: 1, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			client := fcm.NewClientWithSender(sender, resilience.NewRateLimiter("app-a", tt.perSecond, tt.burst).Middleware())
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			var err error
+			for range tt.messages {
+				if _, err = client.SendToToken(ctx, "token-1", "T", "B", nil); err != nil {
+					break
+				}
+			}
+
+			if sender.calls != tt.expectedSent {
+				t.Errorf("sent %d messages, want %d", sender.calls, tt.expectedSent)
+			}
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("error = %v, want error: %v", err, tt.expectedError)
+			}
+			if err != nil && (!errors.Is(err, fcm.ErrThrottled) || !fcm.IsRetryableError(err)) {
+				t.Errorf("error = %v, want a retryable throttled error", err)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Batch(t *testing.T) {
+	sender := &fakeSender{}
+	client := fcm.NewClientWithSender(sender, resilience.NewRateLimiter("app-a", 1000, 10).Middleware())
+
+	messages := make([]*messaging.Message, 20)
+	for i := range messages {
+		messages[i] = &messaging.Message{Token: "token-1"}
+	}
+
+	for i, r := range client.SendMessages(context.Background(), messages) {
+		if r.Err != nil {
+			t.Errorf("message %d: %v", i, r.Err)
+		}
+	}
+}
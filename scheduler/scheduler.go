@@ -0,0 +1,289 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/logging"
+)
+
+const (
+	defaultInterval       = time.Second
+	defaultRetryBaseDelay = 10 * time.Second
+	defaultRetryMaxDelay  = 10 * time.Minute
+	defaultMaxAttempts    = 10
+
+	// stallThreshold を超えて送信ループが回っていなければ Check は失敗します。
+	stallThreshold = time.Minute
+)
+
+// DispatchFunc は予約時刻を迎えたジョブのペイロードを実際に送信します。
+// 最後の試行かどうかは LastAttempt(ctx) で分かります。
+type DispatchFunc func(ctx context.Context, payload []byte) error
+
+// ErrAttemptsExhausted は最後の試行でも送信できなかったことを表します。
+// DispatchFunc がこのエラーをラップして (Exhausted を参照) 返すと、再送対象のエラーでなくてもジョブを失敗として残します。
+var ErrAttemptsExhausted = errors.New("scheduled job exhausted its attempts")
+
+// Exhausted は最後の試行の送信エラー err を、ErrAttemptsExhausted として判定されるエラーにします。
+// errors.Unwrap で err を取り出せます。
+func Exhausted(err error) error {
+	return exhaustedError{err}
+}
+
+type exhaustedError struct {
+	err error
+}
+
+func (e exhaustedError) Error() string { return "giving up after the last attempt: " + e.err.Error() }
+
+func (e exhaustedError) Unwrap() error { return e.err }
+
+func (e exhaustedError) Is(target error) bool { return target == ErrAttemptsExhausted }
+
+type lastAttemptKey struct{}
+
+// LastAttempt は ctx が DispatchFunc に渡された最後の試行のものかどうかを返します。
+// 最後の試行で失敗したジョブは再送せずに失敗として残るため、DispatchFunc はそれを配信結果として記録できます。
+func LastAttempt(ctx context.Context) bool {
+	last, _ := ctx.Value(lastAttemptKey{}).(bool)
+	return last
+}
+
+// Scheduler は予約済みの通知を保持し、予約時刻になったものをバックグラウンドで送信します。
+type Scheduler struct {
+	store     Store
+	retryable func(error) bool
+	interval  time.Duration
+
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	maxAttempts    int
+
+	mu          sync.RWMutex
+	dispatchers map[string]DispatchFunc
+
+	running  atomic.Bool
+	lastTick atomic.Int64 // 送信ループが最後に回った時刻 (UnixNano)
+}
+
+// New は新しい Scheduler を作成します。
+// retryable が true を返した送信エラーはバックオフ後に再送され、それ以外はジョブを破棄します。
+// 試行回数の上限 (WithMaxAttempts) に達したジョブは、送信せずに JobFailed の状態で残します。
+func New(store Store, retryable func(error) bool) *Scheduler {
+	return &Scheduler{
+		store:       store,
+		retryable:   retryable,
+		interval:    defaultInterval,
+		dispatchers: make(map[string]DispatchFunc),
+
+		retryBaseDelay: defaultRetryBaseDelay,
+		retryMaxDelay:  defaultRetryMaxDelay,
+		maxAttempts:    defaultMaxAttempts,
+	}
+}
+
+// WithRetryDelay は再送までの待ち時間を設定します。待ち時間は base から試行ごとに倍になり、max で頭打ちになります。
+func (s *Scheduler) WithRetryDelay(base, max time.Duration) *Scheduler {
+	s.retryBaseDelay = base
+	s.retryMaxDelay = max
+
+	return s
+}
+
+// WithMaxAttempts は1件のジョブを送信する回数の上限を設定します。
+func (s *Scheduler) WithMaxAttempts(n int) *Scheduler {
+	s.maxAttempts = n
+
+	return s
+}
+
+// Register は kind のジョブを送信する関数を登録します。
+func (s *Scheduler) Register(kind string, fn DispatchFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dispatchers[kind] = fn
+}
+
+// Schedule は payload を at に送信するジョブとして保存します。
+func (s *Scheduler) Schedule(kind string, payload []byte, at time.Time) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := Job{
+		ID:        id,
+		Kind:      kind,
+		Payload:   append([]byte(nil), payload...),
+		SendAt:    at.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := s.store.Put(job); err != nil {
+		return Job{}, fmt.Errorf("storing scheduled job: %w", err)
+	}
+
+	slog.Debug("scheduled job", "component", "scheduler", "jobId", job.ID, "kind", job.Kind, "sendAt", job.SendAt)
+
+	return job, nil
+}
+
+// Cancel は未送信のジョブを取り消します。該当するジョブがなければ false を返します。
+func (s *Scheduler) Cancel(id string) (bool, error) {
+	return s.store.Delete(id)
+}
+
+// Pending は未送信のジョブを送信予定時刻順に返します。試行回数の上限に達して失敗したジョブ (JobFailed) も含みます。
+func (s *Scheduler) Pending() ([]Job, error) {
+	return s.store.List()
+}
+
+// Run は ctx がキャンセルされるまで定期的に DispatchDue を実行します。
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	slog.InfoContext(ctx, "scheduler started", "component", "scheduler")
+
+	s.running.Store(true)
+	defer s.running.Store(false)
+
+	for {
+		now := time.Now()
+		s.lastTick.Store(now.UnixNano())
+		s.DispatchDue(ctx, now)
+
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "scheduler stopped", "component", "scheduler")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check は Run が実行中で、送信ループが止まっていないことを確認します。readinessチェックに使います。
+func (s *Scheduler) Check(context.Context) error {
+	if !s.running.Load() {
+		return fmt.Errorf("scheduler is not running")
+	}
+
+	if last := time.Unix(0, s.lastTick.Load()); time.Since(last) > stallThreshold {
+		return fmt.Errorf("scheduler loop has not run since %s", last.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// DispatchDue は now までに送信時刻を迎えたジョブをすべて送信します。
+func (s *Scheduler) DispatchDue(ctx context.Context, now time.Time) {
+	jobs, err := s.store.List()
+	if err != nil {
+		slog.ErrorContext(ctx, "listing scheduled jobs", "component", "scheduler", "error", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if job.SendAt.After(now) {
+			break // List は送信予定時刻順
+		}
+		if job.Status == JobFailed {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.dispatch(ctx, job, now)
+	}
+}
+
+func (s *Scheduler) dispatch(ctx context.Context, job Job, now time.Time) {
+	s.mu.RLock()
+	fn, ok := s.dispatchers[job.Kind]
+	s.mu.RUnlock()
+
+	logger := logging.FromContext(ctx).With("component", "scheduler", "jobId", job.ID, "kind", job.Kind)
+	ctx = logging.WithLogger(ctx, logger)
+
+	if !ok {
+		logger.ErrorContext(ctx, "no dispatcher for job kind, dropping job")
+		s.remove(ctx, job)
+		return
+	}
+
+	last := job.Attempts+1 >= s.maxAttempts
+	err := fn(context.WithValue(ctx, lastAttemptKey{}, last), job.Payload)
+	if err == nil {
+		logger.InfoContext(ctx, "dispatched job")
+		s.remove(ctx, job)
+		return
+	}
+
+	if ctx.Err() != nil {
+		// シャットダウンで中断された送信は、試行回数を増やさずに次回の起動時に再送する
+		logger.WarnContext(ctx, "job interrupted, keeping it for the next run", "error", err)
+		return
+	}
+
+	retryable := s.retryable != nil && s.retryable(err)
+	job.Attempts++
+
+	switch {
+	case errors.Is(err, ErrAttemptsExhausted) || (retryable && last):
+		// 取り消すか調査できるよう、送信せずに残す
+		job.Status = JobFailed
+		job.LastError = err.Error()
+		logger.ErrorContext(ctx, "job exhausted its attempts, marking it failed", "attempts", job.Attempts, "error", err)
+		if err := s.store.Put(job); err != nil {
+			logger.ErrorContext(ctx, "marking job failed", "error", err)
+		}
+		return
+	case !retryable:
+		logger.ErrorContext(ctx, "job failed permanently, dropping", "error", err)
+		s.remove(ctx, job)
+		return
+	}
+
+	job.SendAt = now.Add(s.retryDelay(job.Attempts)).UTC()
+
+	logger.WarnContext(ctx, "job failed, retrying", "attempt", job.Attempts, "retryAt", job.SendAt, "error", err)
+
+	if err := s.store.Put(job); err != nil {
+		logger.ErrorContext(ctx, "rescheduling job", "error", err)
+	}
+}
+
+func (s *Scheduler) remove(ctx context.Context, job Job) {
+	if _, err := s.store.Delete(job.ID); err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "deleting job", "error", err)
+	}
+}
+
+func (s *Scheduler) retryDelay(attempts int) time.Duration {
+	d := s.retryBaseDelay
+	for i := 1; i < attempts && d < s.retryMaxDelay; i++ {
+		d *= 2
+	}
+
+	return min(d, s.retryMaxDelay)
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating job id: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,271 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/scheduler"
+)
+
+func isRetryable(err error) bool {
+	return err != nil && err.Error() == "retryable"
+}
+
+func TestScheduler_DispatchDue(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name            string
+		dispatchErr     error
+		at              time.Time
+		expectedCalls   int
+		expectedPending int
+	}{
+		{
+			name:            "due job is dispatched and removed",
+			at:              now.Add(-time.Second),
+			expectedCalls:   1,
+			expectedPending: 0,
+		},
+		{
+			name:            "future job is kept",
+			at:              now.Add(time.Hour),
+			expectedCalls:   0,
+			expectedPending: 1,
+		},
+		{
+			name:            "retryable error keeps job for retry",
+			dispatchErr:     errors.New("retryable"),
+			at:              now,
+			expectedCalls:   1,
+			expectedPending: 1,
+		},
+		{
+			name:            "permanent error drops job",
+			dispatchErr:     errors.New("invalid token"),
+			at:              now,
+			expectedCalls:   1,
+			expectedPending: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := scheduler.New(scheduler.NewMemoryStore(), isRetryable)
+
+			calls := 0
+			s.Register("token", func(ctx context.Context, payload []byte) error {
+				calls++
+				if string(payload) != `{"title":"t"}` {
+					t.Errorf("unexpected payload: %s", payload)
+				}
+				return tt.dispatchErr
+			})
+
+			if _, err := s.Schedule("token", []byte(`{"title":"t"}`), tt.at); err != nil {
+				t.Fatalf("Schedule: %v", err)
+			}
+
+			s.DispatchDue(context.Background(), now)
+
+			pending, err := s.Pending()
+			if err != nil {
+				t.Fatalf("Pending: %v", err)
+			}
+
+			if calls != tt.expectedCalls {
+				t.Errorf("dispatch calls: got %d want %d", calls, tt.expectedCalls)
+			}
+
+			if len(pending) != tt.expectedPending {
+				t.Errorf("pending jobs: got %d want %d", len(pending), tt.expectedPending)
+			}
+
+			if tt.dispatchErr != nil && len(pending) == 1 {
+				if pending[0].Attempts != 1 || !pending[0].SendAt.After(now) {
+					t.Errorf("retried job not rescheduled: %+v", pending[0])
+				}
+			}
+		})
+	}
+}
+
+func TestScheduler_MaxAttempts(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		dispatchErr error
+	}{
+		{name: "retryable error on the last attempt", dispatchErr: errors.New("retryable")},
+		{name: "dispatcher reports exhausted attempts", dispatchErr: scheduler.Exhausted(errors.New("invalid token"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := scheduler.New(scheduler.NewMemoryStore(), isRetryable).WithRetryDelay(time.Second, time.Second).WithMaxAttempts(2)
+
+			var lastAttempts []bool
+			s.Register("token", func(ctx context.Context, payload []byte) error {
+				lastAttempts = append(lastAttempts, scheduler.LastAttempt(ctx))
+				if scheduler.LastAttempt(ctx) {
+					return tt.dispatchErr
+				}
+				return errors.New("retryable")
+			})
+
+			if _, err := s.Schedule("token", []byte(`{}`), now); err != nil {
+				t.Fatalf("Schedule: %v", err)
+			}
+
+			// 3回目は失敗したジョブなので送信しない
+			for i := range 3 {
+				s.DispatchDue(context.Background(), now.Add(time.Duration(i)*time.Minute))
+			}
+
+			if want := []bool{false, true}; !slices.Equal(lastAttempts, want) {
+				t.Errorf("LastAttempt per call: got %v want %v", lastAttempts, want)
+			}
+
+			pending, _ := s.Pending()
+			if len(pending) != 1 {
+				t.Fatalf("pending jobs: got %d want 1", len(pending))
+			}
+			if job := pending[0]; job.Status != scheduler.JobFailed || job.Attempts != 2 || job.LastError != tt.dispatchErr.Error() {
+				t.Errorf("failed job: got %+v", job)
+			}
+		})
+	}
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	s := scheduler.New(scheduler.NewMemoryStore(), isRetryable)
+
+	job, err := s.Schedule("topic", []byte(`{}`), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	if ok, err := s.Cancel(job.ID); err != nil || !ok {
+		t.Fatalf("Cancel(%s) = %v, %v; want true, nil", job.ID, ok, err)
+	}
+
+	if ok, err := s.Cancel(job.ID); err != nil || ok {
+		t.Fatalf("second Cancel(%s) = %v, %v; want false, nil", job.ID, ok, err)
+	}
+}
+
+func TestScheduler_Check(t *testing.T) {
+	s := scheduler.New(scheduler.NewMemoryStore(), isRetryable)
+
+	if err := s.Check(context.Background()); err == nil {
+		t.Error("Check before Run: expected error, got nil")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for s.Check(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Check while running: %v", s.Check(context.Background()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if err := s.Check(context.Background()); err == nil {
+		t.Error("Check after Run returned: expected error, got nil")
+	}
+}
+
+func TestFileStore_Check(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := scheduler.NewFileStore(filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	if err := store.Check(context.Background()); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("removing store directory: %v", err)
+	}
+
+	if err := store.Check(context.Background()); err == nil {
+		t.Error("Check after removing the directory: expected error, got nil")
+	}
+}
+
+func TestFileStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+
+	store, err := scheduler.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	at := time.Now().Add(time.Hour)
+	job, err := scheduler.New(store, isRetryable).Schedule("token", []byte(`{"token":"abc"}`), at)
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	reopened, err := scheduler.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopening store: %v", err)
+	}
+
+	jobs, err := reopened.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	if len(jobs) != 1 || jobs[0].ID != job.ID || string(jobs[0].Payload) != `{"token":"abc"}` || !jobs[0].SendAt.Equal(at.UTC()) {
+		t.Fatalf("reopened store has %+v, want job %+v", jobs, job)
+	}
+}
+
+func TestScheduler_DispatchDue_Interrupted(t *testing.T) {
+	s := scheduler.New(scheduler.NewMemoryStore(), isRetryable)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Register("token", func(context.Context, []byte) error {
+		cancel() // 送信中にシャットダウンされた
+		return errors.New("context canceled")
+	})
+
+	at := time.Now().Add(-time.Second)
+	if _, err := s.Schedule("token", []byte(`{}`), at); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	s.DispatchDue(ctx, time.Now())
+
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+
+	if len(pending) != 1 {
+		t.Fatalf("pending jobs: got %d want 1", len(pending))
+	}
+
+	if pending[0].Attempts != 0 || !pending[0].SendAt.Equal(at.UTC()) {
+		t.Errorf("interrupted job was rescheduled: %+v", pending[0])
+	}
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/teamzidi/example-go-fcm/internal/jsonfile"
+)
+
+// Job は送信予約された1件の通知です。
+type Job struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`    // 送信種別 ("token", "topic" など)
+	Payload   json.RawMessage `json:"payload"` // 業務ペイロード (Pub/Sub data のデコード結果)
+	SendAt    time.Time       `json:"send_at"`
+	CreatedAt time.Time       `json:"created_at"`
+	Attempts  int             `json:"attempts"`
+	Status    JobStatus       `json:"status,omitempty"`     // 空なら送信待ち
+	LastError string          `json:"last_error,omitempty"` // JobFailed になった最後の送信のエラー
+}
+
+// JobStatus はジョブの状態です。
+type JobStatus string
+
+// JobFailed は試行回数の上限に達して送信を諦めたジョブです。取り消すまで残ります。
+const JobFailed JobStatus = "failed"
+
+// Store は予約済みジョブの保存先です。
+type Store interface {
+	Put(job Job) error
+	Delete(id string) (bool, error)
+	List() ([]Job, error)
+}
+
+// MemoryStore はプロセス内メモリにジョブを保持する Store です。再起動で内容は失われます。
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: make(map[string]Job)}
+}
+
+func (s *MemoryStore) Put(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return false, nil
+	}
+
+	delete(s.jobs, id)
+	return true, nil
+}
+
+func (s *MemoryStore) List() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedJobs(s.jobs), nil
+}
+
+// FileStore はジョブをJSONファイルに永続化する Store です。更新のたびにファイル全体を書き直して同期するため、
+// 予約・送信・再送の1回ごとにジョブの件数に比例するコストがかかります。数千件程度までの予約を想定しています。
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	jobs map[string]Job
+}
+
+// NewFileStore は path のファイルから既存のジョブを読み込んだ FileStore を返します。
+// ファイルが存在しない場合は空の状態から開始します。
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, jobs: make(map[string]Job)}
+
+	var jobs []Job
+	if _, err := jsonfile.Read(path, &jobs); err != nil {
+		return nil, fmt.Errorf("opening schedule store: %w", err)
+	}
+
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Put(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.jobs[job.ID]
+	s.jobs[job.ID] = job
+
+	if err := s.flush(); err != nil {
+		if existed {
+			s.jobs[job.ID] = prev
+		} else {
+			delete(s.jobs, job.ID)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.jobs[id]
+	if !ok {
+		return false, nil
+	}
+
+	delete(s.jobs, id)
+
+	if err := s.flush(); err != nil {
+		s.jobs[id] = prev
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *FileStore) List() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sortedJobs(s.jobs), nil
+}
+
+// Check は保存先のファイルに書き込めることを確認します。readinessチェックに使います。
+func (s *FileStore) Check(context.Context) error {
+	return jsonfile.CheckWritable(s.path)
+}
+
+func (s *FileStore) flush() error {
+	return jsonfile.Write(s.path, sortedJobs(s.jobs))
+}
+
+func sortedJobs(m map[string]Job) []Job {
+	jobs := make([]Job, 0, len(m))
+	for _, job := range m {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].SendAt.Equal(jobs[j].SendAt) {
+			return jobs[i].ID < jobs[j].ID
+		}
+		return jobs[i].SendAt.Before(jobs[j].SendAt)
+	})
+
+	return jobs
+}
@@ -0,0 +1,165 @@
+// Package tracing はOpenTelemetryによるトレースの設定と、Pub/Sub・FCM向けの計測を提供します。
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+)
+
+const instrumentationName = "github.com/teamzidi/example-go-fcm"
+
+// Pub/Subのメッセージ属性でトレースコンテキストを運ぶキー。
+// Pub/Subのクライアントライブラリは googclient_ プレフィックス付きで、それ以外のプロデューサーは素のW3Cヘッダー名で設定します。
+var traceContextAttributes = map[string]string{
+	"googclient_OpenTelemetryTraceContext": "traceparent",
+	"googclient_traceparent":               "traceparent",
+	"googclient_tracestate":                "tracestate",
+	"traceparent":                          "traceparent",
+	"tracestate":                           "tracestate",
+}
+
+// Setup は標準のOpenTelemetry環境変数に従ってトレースのエクスポートを構成し、終了処理を返します。
+//
+//   - OTEL_TRACES_EXPORTER: "otlp" でOTLP/HTTPにエクスポートします。未設定または "none" の場合は何もしません (no-op)。
+//   - OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS など: エクスポート先の設定。
+//   - OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES: リソース属性。OTEL_SERVICE_NAME が未設定なら serviceName を使います。
+//   - OTEL_TRACES_SAMPLER, OTEL_TRACES_SAMPLER_ARG: サンプリング設定。
+//
+// プロパゲータは exporter の設定にかかわらず W3C Trace Context と Baggage を使います。
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")))
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q (supported: otlp, none)", exporter)
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	res := resource.Default() // OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES を反映済み
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		res, err = resource.Merge(res, resource.NewSchemaless(semconv.ServiceName(serviceName)))
+		if err != nil {
+			return nil, fmt.Errorf("creating trace resource: %w", err)
+		}
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+
+	slog.Info("exporting traces via OTLP", "component", "tracing")
+
+	return tp.Shutdown, nil
+}
+
+// Tracer はこのサービスのトレーサーを返します。
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// ExtractAttributes はPub/Subのメッセージ属性に含まれるトレースコンテキストを取り出し、ctx に設定して返します。
+// 属性にトレースコンテキストがなければ ctx をそのまま返します。
+func ExtractAttributes(ctx context.Context, attributes map[string]string) context.Context {
+	carrier := propagation.MapCarrier{}
+	for attr, header := range traceContextAttributes {
+		if v, ok := attributes[attr]; ok && v != "" {
+			if _, set := carrier[header]; !set || attr == header {
+				carrier[header] = v // 素のW3Cヘッダー名を優先する
+			}
+		}
+	}
+
+	if len(carrier) == 0 {
+		return ctx
+	}
+
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// HTTPMiddleware は受信したHTTPヘッダーからトレースコンテキストを取り出し、サーバースパンを開始するよう h をラップします。
+func HTTPMiddleware(name string, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, name)
+}
+
+// FCMMiddleware はFCMの送信呼び出しごとにスパンを記録する fcm.Middleware を返します。
+func FCMMiddleware() fcm.Middleware {
+	return func(next fcm.Sender) fcm.Sender {
+		return &tracedSender{next: next}
+	}
+}
+
+type tracedSender struct {
+	next fcm.Sender
+}
+
+func (s *tracedSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	ctx, span := Tracer().Start(ctx, "fcm.Send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "fcm"),
+			attribute.String("fcm.target_type", fcm.TargetType(message)),
+		))
+	defer span.End()
+
+	id, err := s.next.Send(ctx, message)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("fcm.error_code", fcm.ErrorCode(err)))
+		return id, err
+	}
+
+	span.SetAttributes(attribute.String("messaging.message.id", id))
+
+	return id, nil
+}
+
+func (s *tracedSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	ctx, span := Tracer().Start(ctx, "fcm.SendEach",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "fcm"),
+			attribute.Int("messaging.batch.message_count", len(messages)),
+		))
+	defer span.End()
+
+	resp, err := s.next.SendEach(ctx, messages)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("fcm.error_code", fcm.ErrorCode(err)))
+		return resp, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("fcm.success_count", resp.SuccessCount),
+		attribute.Int("fcm.failure_count", resp.FailureCount),
+	)
+
+	return resp, nil
+}
@@ -0,0 +1,174 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/teamzidi/example-go-fcm/fcm"
+	"github.com/teamzidi/example-go-fcm/tracing"
+	"github.com/teamzidi/example-go-fcm/tracing/tracingtest"
+)
+
+type stubSender struct {
+	id  string
+	err error
+	ctx context.Context
+}
+
+func (s *stubSender) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	s.ctx = ctx
+	return s.id, s.err
+}
+
+func (s *stubSender) SendEach(ctx context.Context, messages []*messaging.Message) (*messaging.BatchResponse, error) {
+	s.ctx = ctx
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	resp := &messaging.BatchResponse{SuccessCount: len(messages)}
+	for range messages {
+		resp.Responses = append(resp.Responses, &messaging.SendResponse{Success: true, MessageID: s.id})
+	}
+	return resp, nil
+}
+
+func TestExtractAttributes(t *testing.T) {
+	_, restore := tracingtest.NewInMemoryProvider()
+	defer restore()
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		otherTraceID = "0af7651916cd43dd8448eb211c80319c"
+	)
+
+	tests := []struct {
+		name            string
+		attributes      map[string]string
+		expectedTraceID string // 空ならトレースコンテキストなし
+	}{
+		{
+			name:            "traceparent",
+			attributes:      map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			expectedTraceID: traceID,
+		},
+		{
+			name:            "googclient_OpenTelemetryTraceContext",
+			attributes:      map[string]string{"googclient_OpenTelemetryTraceContext": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			expectedTraceID: traceID,
+		},
+		{
+			name:            "googclient_traceparent",
+			attributes:      map[string]string{"googclient_traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"},
+			expectedTraceID: traceID,
+		},
+		{
+			name: "plain traceparent wins",
+			attributes: map[string]string{
+				"googclient_OpenTelemetryTraceContext": "00-" + otherTraceID + "-00f067aa0ba902b7-01",
+				"traceparent":                          "00-" + traceID + "-00f067aa0ba902b7-01",
+			},
+			expectedTraceID: traceID,
+		},
+		{
+			name:       "malformed traceparent",
+			attributes: map[string]string{"traceparent": "not-a-traceparent"},
+		},
+		{
+			name:       "no attributes",
+			attributes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := trace.SpanContextFromContext(tracing.ExtractAttributes(context.Background(), tt.attributes))
+
+			if tt.expectedTraceID == "" {
+				if sc.IsValid() {
+					t.Errorf("expected no span context, got trace ID %s", sc.TraceID())
+				}
+				return
+			}
+
+			if !sc.IsRemote() || sc.TraceID().String() != tt.expectedTraceID {
+				t.Errorf("trace ID: got %s (remote=%v) want %s", sc.TraceID(), sc.IsRemote(), tt.expectedTraceID)
+			}
+		})
+	}
+}
+
+func TestFCMMiddleware(t *testing.T) {
+	tests := []struct {
+		name              string
+		sendErr           error
+		expectedStatus    codes.Code
+		expectedAttribute attribute.KeyValue
+	}{
+		{
+			name:              "success",
+			expectedStatus:    codes.Unset,
+			expectedAttribute: attribute.String("messaging.message.id", "fcm-id"),
+		},
+		{
+			name:              "failure",
+			sendErr:           errors.New("boom"),
+			expectedStatus:    codes.Error,
+			expectedAttribute: attribute.String("fcm.error_code", "UNKNOWN"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter, restore := tracingtest.NewInMemoryProvider()
+			defer restore()
+
+			stub := &stubSender{id: "fcm-id", err: tt.sendErr}
+			client := fcm.NewClientWithSender(stub, tracing.FCMMiddleware())
+
+			ctx, parent := tracing.Tracer().Start(context.Background(), "parent")
+			client.SendToToken(ctx, "token", "title", "body", nil)
+			parent.End()
+
+			if got := trace.SpanContextFromContext(stub.ctx); got.TraceID() != parent.SpanContext().TraceID() {
+				t.Errorf("context passed to sender is not in the parent trace")
+			}
+
+			var found bool
+			for _, s := range exporter.GetSpans() {
+				if s.Name != "fcm.Send" {
+					continue
+				}
+				found = true
+
+				if s.Parent.SpanID() != parent.SpanContext().SpanID() {
+					t.Errorf("fcm.Send parent: got %s want %s", s.Parent.SpanID(), parent.SpanContext().SpanID())
+				}
+				if s.Status.Code != tt.expectedStatus {
+					t.Errorf("status: got %v want %v", s.Status.Code, tt.expectedStatus)
+				}
+
+				attrs := map[attribute.Key]attribute.Value{}
+				for _, kv := range s.Attributes {
+					attrs[kv.Key] = kv.Value
+				}
+				if attrs["fcm.target_type"].AsString() != "token" {
+					t.Errorf("fcm.target_type: got %q want %q", attrs["fcm.target_type"].AsString(), "token")
+				}
+				if v := attrs[tt.expectedAttribute.Key]; v != tt.expectedAttribute.Value {
+					t.Errorf("%s: got %q want %q", tt.expectedAttribute.Key, v.Emit(), tt.expectedAttribute.Value.Emit())
+				}
+			}
+
+			if !found {
+				t.Fatal("fcm.Send span was not recorded")
+			}
+		})
+	}
+}